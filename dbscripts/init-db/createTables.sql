@@ -14,7 +14,8 @@ CREATE TABLE data_source_types (
 
 CREATE TABLE file_objects (
 	file_object_id BIGINT NOT NULL AUTO_INCREMENT,
-	sha1_checksum BINARY(20),
+	checksum VARBINARY(64),
+	checksum_algorithm VARCHAR(16),
 	checksum_date DATETIME,
 	creation_date DATETIME,
 	PRIMARY KEY (file_object_id)
@@ -67,6 +68,7 @@ CREATE TABLE ini_files_denorm (
 	when_acquired DATETIME NOT NULL,
 	when_inserted DATETIME NOT NULL,
 	when_completed DATETIME,
+	acq_state VARCHAR(16) NOT NULL DEFAULT 'created',
 	uid BIGINT NOT NULL,
 	number_of_cameras INTEGER NOT NULL,
 	x_sm_step_pix INTEGER,
@@ -98,6 +100,7 @@ CREATE TABLE ini_files_denorm (
 CREATE INDEX ix_ini_files_denorm_sample_name ON ini_files_denorm (sample_name);
 CREATE UNIQUE INDEX ix_ini_files_denorm_uid ON ini_files_denorm (uid);
 CREATE INDEX ix_ini_files_denorm_when_acquired ON ini_files_denorm (when_acquired);
+CREATE INDEX ix_ini_files_denorm_acq_state ON ini_files_denorm (acq_state);
 
 CREATE TABLE tem_scintillator_manufacturers (
 	tem_scintillator_manufacturer_id INTEGER NOT NULL AUTO_INCREMENT,
@@ -307,6 +310,9 @@ CREATE TABLE file_object_fs_replicas (
 	file_exists_yn BOOL NOT NULL,
 	last_verified DATETIME,
 	replica_created_date DATETIME NOT NULL,
+	storage_name VARCHAR(64),
+	verification_status VARCHAR(16),
+	mipmap_level INTEGER,
 	PRIMARY KEY (file_object_fs_replica_id),
 	FOREIGN KEY(path_prefix_id) REFERENCES path_prefixes (path_prefix_id),
 	CHECK (relative_path IN (0,1)),
@@ -316,6 +322,9 @@ CREATE TABLE file_object_fs_replicas (
 );
 CREATE INDEX ix_file_object_fs_replicas_path ON file_object_fs_replicas (path);
 CREATE INDEX ix_file_object_fs_replicas_jfs_key ON file_object_fs_replicas (jfs_key);
+CREATE INDEX ix_file_object_fs_replicas_file_object_storage ON file_object_fs_replicas (file_object_id, storage_name);
+CREATE INDEX ix_file_object_fs_replicas_jfs_path ON file_object_fs_replicas (jfs_path(255));
+CREATE INDEX ix_file_object_fs_replicas_derived_mipmap ON file_object_fs_replicas (derived_from_file_object_fs_replica_id, mipmap_level);
 
 CREATE TABLE tem_cameras (
 	tem_camera_id INTEGER NOT NULL AUTO_INCREMENT,
@@ -637,6 +646,67 @@ CREATE TABLE acq_time_rois (
 );
 CREATE INDEX roi_section_idx ON acq_time_rois (nominal_section_number);
 
+CREATE TABLE stored_image_discrepancies (
+	stored_image_discrepancy_id BIGINT NOT NULL AUTO_INCREMENT,
+	tem_camera_image_mosaic_id INTEGER NOT NULL,
+	tem_camera_image_id BIGINT,
+	mosaic_col INTEGER NOT NULL,
+	mosaic_row INTEGER NOT NULL,
+	camera INTEGER NOT NULL,
+	frame_number INTEGER NOT NULL,
+	image_name VARCHAR(255),
+	discrepancy VARCHAR(32) NOT NULL,
+	details VARCHAR(1024),
+	found_date DATETIME NOT NULL,
+	PRIMARY KEY (stored_image_discrepancy_id),
+	FOREIGN KEY(tem_camera_image_mosaic_id) REFERENCES tem_camera_image_mosaics (tem_camera_image_mosaic_id),
+	FOREIGN KEY(tem_camera_image_id) REFERENCES tem_camera_images (tem_camera_image_id)
+);
+CREATE INDEX ix_stored_image_discrepancies_mosaic ON stored_image_discrepancies (tem_camera_image_mosaic_id);
+
+CREATE TABLE acq_timing_steps (
+	acq_timing_step_id BIGINT NOT NULL AUTO_INCREMENT,
+	tem_camera_image_mosaic_id INTEGER NOT NULL,
+	step INTEGER NOT NULL,
+	camera INTEGER NOT NULL,
+	mosaic_col INTEGER NOT NULL,
+	mosaic_row INTEGER NOT NULL,
+	frame_number INTEGER NOT NULL,
+	PRIMARY KEY (acq_timing_step_id),
+	FOREIGN KEY(tem_camera_image_mosaic_id) REFERENCES tem_camera_image_mosaics (tem_camera_image_mosaic_id)
+);
+CREATE INDEX ix_acq_timing_steps_mosaic_step ON acq_timing_steps (tem_camera_image_mosaic_id, step);
+CREATE INDEX ix_acq_timing_steps_mosaic_tile ON acq_timing_steps (tem_camera_image_mosaic_id, mosaic_col, mosaic_row);
+
+CREATE TABLE acq_timing_values (
+	acq_timing_value_id BIGINT NOT NULL AUTO_INCREMENT,
+	tem_camera_image_mosaic_id INTEGER NOT NULL,
+	source VARCHAR(64) NOT NULL,
+	step INTEGER NOT NULL,
+	camera INTEGER NOT NULL,
+	measure VARCHAR(64) NOT NULL,
+	value DOUBLE,
+	text_value VARCHAR(255),
+	PRIMARY KEY (acq_timing_value_id),
+	FOREIGN KEY(tem_camera_image_mosaic_id) REFERENCES tem_camera_image_mosaics (tem_camera_image_mosaic_id)
+);
+CREATE INDEX ix_acq_timing_values_mosaic_step ON acq_timing_values (tem_camera_image_mosaic_id, step);
+CREATE INDEX ix_acq_timing_values_mosaic_source ON acq_timing_values (tem_camera_image_mosaic_id, source);
+
+CREATE TABLE tile_metrics (
+	tile_metric_id BIGINT NOT NULL AUTO_INCREMENT,
+	tem_camera_image_mosaic_id INTEGER NOT NULL,
+	mosaic_col INTEGER NOT NULL,
+	mosaic_row INTEGER NOT NULL,
+	frame_number INTEGER NOT NULL,
+	camera INTEGER NOT NULL,
+	metric VARCHAR(64) NOT NULL,
+	value DOUBLE NOT NULL,
+	PRIMARY KEY (tile_metric_id),
+	FOREIGN KEY(tem_camera_image_mosaic_id) REFERENCES tem_camera_image_mosaics (tem_camera_image_mosaic_id)
+);
+CREATE INDEX ix_tile_metrics_mosaic_tile ON tile_metrics (tem_camera_image_mosaic_id, mosaic_col, mosaic_row, frame_number);
+
 CREATE TABLE gomigrate (
        id INTEGER NOT NULL AUTO_INCREMENT,
        migration_id BIGINT NOT NULL,
@@ -0,0 +1,2 @@
+ALTER TABLE file_objects DROP checksum_algorithm;
+ALTER TABLE file_objects CHANGE checksum sha1_checksum BINARY(20);
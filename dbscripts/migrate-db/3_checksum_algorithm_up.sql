@@ -0,0 +1,4 @@
+ALTER TABLE file_objects CHANGE sha1_checksum checksum VARBINARY(64);
+ALTER TABLE file_objects ADD checksum_algorithm VARCHAR(16) NULL;
+
+UPDATE file_objects SET checksum = SUBSTRING(checksum, 1, 16), checksum_algorithm = 'MD5' WHERE LENGTH(checksum) = 20 AND SUBSTRING(checksum, 17, 4) = X'00000000';
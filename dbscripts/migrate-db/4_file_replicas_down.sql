@@ -0,0 +1,6 @@
+DROP INDEX ix_file_object_fs_replicas_jfs_path ON file_object_fs_replicas;
+DROP INDEX ix_file_object_fs_replicas_file_object_storage ON file_object_fs_replicas;
+
+DELETE FROM file_object_fs_replicas WHERE storage_name IS NOT NULL;
+ALTER TABLE file_object_fs_replicas DROP verification_status;
+ALTER TABLE file_object_fs_replicas DROP storage_name;
@@ -0,0 +1,5 @@
+ALTER TABLE file_object_fs_replicas ADD storage_name VARCHAR(64) NULL;
+ALTER TABLE file_object_fs_replicas ADD verification_status VARCHAR(16) NULL;
+
+CREATE INDEX ix_file_object_fs_replicas_file_object_storage ON file_object_fs_replicas (file_object_id, storage_name);
+CREATE INDEX ix_file_object_fs_replicas_jfs_path ON file_object_fs_replicas (jfs_path(255));
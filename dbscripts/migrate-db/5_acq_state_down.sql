@@ -0,0 +1,3 @@
+DROP INDEX ix_ini_files_denorm_acq_state ON ini_files_denorm;
+
+ALTER TABLE ini_files_denorm DROP acq_state;
@@ -0,0 +1,6 @@
+ALTER TABLE ini_files_denorm ADD acq_state VARCHAR(16) NOT NULL DEFAULT 'created';
+
+UPDATE ini_files_denorm SET acq_state = 'completed' WHERE when_completed IS NOT NULL;
+UPDATE ini_files_denorm SET acq_state = 'acquiring' WHERE when_completed IS NULL;
+
+CREATE INDEX ix_ini_files_denorm_acq_state ON ini_files_denorm (acq_state);
@@ -0,0 +1 @@
+DROP TABLE stored_image_discrepancies;
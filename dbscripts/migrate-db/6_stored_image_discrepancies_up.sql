@@ -0,0 +1,17 @@
+CREATE TABLE stored_image_discrepancies (
+	stored_image_discrepancy_id BIGINT NOT NULL AUTO_INCREMENT,
+	tem_camera_image_mosaic_id INTEGER NOT NULL,
+	tem_camera_image_id BIGINT,
+	mosaic_col INTEGER NOT NULL,
+	mosaic_row INTEGER NOT NULL,
+	camera INTEGER NOT NULL,
+	frame_number INTEGER NOT NULL,
+	image_name VARCHAR(255),
+	discrepancy VARCHAR(32) NOT NULL,
+	details VARCHAR(1024),
+	found_date DATETIME NOT NULL,
+	PRIMARY KEY (stored_image_discrepancy_id),
+	FOREIGN KEY(tem_camera_image_mosaic_id) REFERENCES tem_camera_image_mosaics (tem_camera_image_mosaic_id),
+	FOREIGN KEY(tem_camera_image_id) REFERENCES tem_camera_images (tem_camera_image_id)
+);
+CREATE INDEX ix_stored_image_discrepancies_mosaic ON stored_image_discrepancies (tem_camera_image_mosaic_id);
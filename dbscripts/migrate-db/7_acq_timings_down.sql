@@ -0,0 +1,2 @@
+DROP TABLE acq_timing_values;
+DROP TABLE acq_timing_steps;
@@ -0,0 +1,28 @@
+CREATE TABLE acq_timing_steps (
+	acq_timing_step_id BIGINT NOT NULL AUTO_INCREMENT,
+	tem_camera_image_mosaic_id INTEGER NOT NULL,
+	step INTEGER NOT NULL,
+	camera INTEGER NOT NULL,
+	mosaic_col INTEGER NOT NULL,
+	mosaic_row INTEGER NOT NULL,
+	frame_number INTEGER NOT NULL,
+	PRIMARY KEY (acq_timing_step_id),
+	FOREIGN KEY(tem_camera_image_mosaic_id) REFERENCES tem_camera_image_mosaics (tem_camera_image_mosaic_id)
+);
+CREATE INDEX ix_acq_timing_steps_mosaic_step ON acq_timing_steps (tem_camera_image_mosaic_id, step);
+CREATE INDEX ix_acq_timing_steps_mosaic_tile ON acq_timing_steps (tem_camera_image_mosaic_id, mosaic_col, mosaic_row);
+
+CREATE TABLE acq_timing_values (
+	acq_timing_value_id BIGINT NOT NULL AUTO_INCREMENT,
+	tem_camera_image_mosaic_id INTEGER NOT NULL,
+	source VARCHAR(64) NOT NULL,
+	step INTEGER NOT NULL,
+	camera INTEGER NOT NULL,
+	measure VARCHAR(64) NOT NULL,
+	value DOUBLE,
+	text_value VARCHAR(255),
+	PRIMARY KEY (acq_timing_value_id),
+	FOREIGN KEY(tem_camera_image_mosaic_id) REFERENCES tem_camera_image_mosaics (tem_camera_image_mosaic_id)
+);
+CREATE INDEX ix_acq_timing_values_mosaic_step ON acq_timing_values (tem_camera_image_mosaic_id, step);
+CREATE INDEX ix_acq_timing_values_mosaic_source ON acq_timing_values (tem_camera_image_mosaic_id, source);
@@ -0,0 +1 @@
+DROP TABLE tile_metrics;
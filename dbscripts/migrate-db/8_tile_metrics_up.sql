@@ -0,0 +1,13 @@
+CREATE TABLE tile_metrics (
+	tile_metric_id BIGINT NOT NULL AUTO_INCREMENT,
+	tem_camera_image_mosaic_id INTEGER NOT NULL,
+	mosaic_col INTEGER NOT NULL,
+	mosaic_row INTEGER NOT NULL,
+	frame_number INTEGER NOT NULL,
+	camera INTEGER NOT NULL,
+	metric VARCHAR(64) NOT NULL,
+	value DOUBLE NOT NULL,
+	PRIMARY KEY (tile_metric_id),
+	FOREIGN KEY(tem_camera_image_mosaic_id) REFERENCES tem_camera_image_mosaics (tem_camera_image_mosaic_id)
+);
+CREATE INDEX ix_tile_metrics_mosaic_tile ON tile_metrics (tem_camera_image_mosaic_id, mosaic_col, mosaic_row, frame_number);
@@ -0,0 +1,4 @@
+DROP INDEX ix_file_object_fs_replicas_derived_mipmap ON file_object_fs_replicas;
+
+DELETE FROM file_object_fs_replicas WHERE mipmap_level IS NOT NULL;
+ALTER TABLE file_object_fs_replicas DROP mipmap_level;
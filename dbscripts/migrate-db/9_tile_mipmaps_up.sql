@@ -0,0 +1,3 @@
+ALTER TABLE file_object_fs_replicas ADD mipmap_level INTEGER NULL;
+
+CREATE INDEX ix_file_object_fs_replicas_derived_mipmap ON file_object_fs_replicas (derived_from_file_object_fs_replica_id, mipmap_level);
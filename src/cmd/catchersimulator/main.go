@@ -2,7 +2,6 @@ package main
 
 import (
 	"bytes"
-	"crypto/md5"
 	"encoding/json"
 	"flag"
 	"fmt"
@@ -22,6 +21,7 @@ import (
 	"sync"
 	"time"
 
+	"imagecatcher/checksum"
 	"imagecatcher/protocol"
 )
 
@@ -44,9 +44,11 @@ func main() {
 		imageSizeDesc          = flag.String("image-size", "5.3m", "Image size")
 		acqDirURL              = flag.String("acq-dir-url", "", "Acquisition directory url")
 		action                 = flag.String("action", "send-tile", "Action: send-tile|send-acq-log|send-rois")
-		sendMethod             = flag.String("send-method", "TCP-PUT", "Request method used for sending the tiles {HTTP-PUT|HTTP-POST|TCP-PUT}")
+		sendMethod             = flag.String("send-method", "TCP-PUT", "Request method used for sending the tiles {HTTP-PUT|HTTP-POST|TCP-PUT|TCP-PIPELINE}")
 		logfile                = flag.String("logfile", "", "Name of the logfile")
 		concurrently           = flag.Bool("concurrently", false, "Flag whether to send the tiles concurrently")
+		maxInFlight            = flag.Int("max-inflight", 8, "Maximum number of in-flight requests when using TCP-PIPELINE")
+		checksumAlgName        = flag.String("checksum-algorithm", "MD5", "Tile checksum algorithm {MD5|SHA1|SHA256|CRC32C|XXH64}")
 	)
 	flag.Parse()
 	var imageSize int
@@ -54,6 +56,10 @@ func main() {
 	if imageSize, err = parseImageSizeDesc(*imageSizeDesc); err != nil {
 		log.Panicf("Invalid image size %s\n", err)
 	}
+	var checksumAlg checksum.Algorithm
+	if checksumAlg, err = checksum.Lookup(*checksumAlgName); err != nil {
+		log.Panicf("Invalid checksum algorithm %s\n", err)
+	}
 	initializeLog(*logfile)
 	if *acqDirURL == "" {
 		fmt.Print("Acquisition dir is required")
@@ -67,7 +73,7 @@ func main() {
 	case "send-rois":
 		sendRois(*serviceURL, *acqDirURL, acqID)
 	case "send-tile":
-		sendTiles(*serviceURL, acqID, *camera, imageSize, *iterations, *rateInMillis, int(*totalRunningTimeInMins*60), int(*runningPeriodInMins*60), int(*breakPeriodInMins*60), *sendMethod, *concurrently)
+		sendTiles(*serviceURL, acqID, *camera, imageSize, *iterations, *rateInMillis, int(*totalRunningTimeInMins*60), int(*runningPeriodInMins*60), int(*breakPeriodInMins*60), *sendMethod, *concurrently, *maxInFlight, checksumAlg)
 	}
 }
 
@@ -242,7 +248,7 @@ type sendTileRequest struct {
 	timeLimit    time.Duration
 }
 
-func sendTiles(serviceURL string, acqID uint64, camera, size, iterations, rateInMillis, totalRunningTimeInSecs, runningPeriodInSecs, breakPeriodInSecs int, method string, concurrently bool) {
+func sendTiles(serviceURL string, acqID uint64, camera, size, iterations, rateInMillis, totalRunningTimeInSecs, runningPeriodInSecs, breakPeriodInSecs int, method string, concurrently bool, maxInFlight int, checksumAlg checksum.Algorithm) {
 	var col, row int
 	var rate, totalRunningTime, runningPeriod, breakPeriod time.Duration
 	var err error
@@ -265,7 +271,7 @@ func sendTiles(serviceURL string, acqID uint64, camera, size, iterations, rateIn
 		log.Panicf("Invalid break period")
 	}
 	iteration := 0
-	imageBuffer, checksum := createTestImage(size)
+	imageBuffer, imageChecksum := createTestImage(size, checksumAlg)
 	var sendTileFunc func(*sendTileRequest)
 	switch method {
 	case "HTTP-PUT":
@@ -301,8 +307,29 @@ func sendTiles(serviceURL string, acqID uint64, camera, size, iterations, rateIn
 			}
 			ts.tcpPutTile(r, conn)
 		}
+	case "TCP-PIPELINE":
+		tcpconn, err := net.Dial("tcp", serviceURL)
+		if err != nil {
+			log.Panicf("Error opening the tcp connection to %s: %v", serviceURL, err)
+		}
+		hs, err := protocol.ClientHandshake(tcpconn, &protocol.Handshake{
+			Version:             protocol.CurrentProtocolVersion,
+			MaxInFlightRequests: uint16(maxInFlight),
+			Capabilities:        protocol.SupportedCapabilities,
+		})
+		if err != nil {
+			log.Panicf("Error negotiating the protocol with %s: %v", serviceURL, err)
+		}
+		log.Printf("Negotiated protocol version %d with %s - capabilities %x, %d in-flight requests",
+			hs.Version, serviceURL, hs.Capabilities, hs.MaxInFlightRequests)
+		sender := protocol.NewPipelinedTileSender(tcpconn, hs)
+		// wait for all the responses before returning
+		defer sender.Wait()
+		sendTileFunc = func(r *sendTileRequest) {
+			ts.tcpPipelineTile(r, sender)
+		}
 	default:
-		log.Panicf("Invalid send tile method - supported methods are : HTTP-PUT | HTTP-POST | TCP-PUT")
+		log.Panicf("Invalid send tile method - supported methods are : HTTP-PUT | HTTP-POST | TCP-PUT | TCP-PIPELINE")
 	}
 
 	time.AfterFunc(totalRunningTime, func() {
@@ -324,13 +351,14 @@ func sendTiles(serviceURL string, acqID uint64, camera, size, iterations, rateIn
 			}
 			tileRequest := &sendTileRequest{
 				base: protocol.CaptureImageRequest{
-					AcqID:    acqID,
-					Camera:   int32(camera),
-					Frame:    -1,
-					Col:      int32(col),
-					Row:      int32(row),
-					Image:    imageBuffer,
-					Checksum: checksum,
+					AcqID:             acqID,
+					Camera:            int32(camera),
+					Frame:             -1,
+					Col:               int32(col),
+					Row:               int32(row),
+					Image:             imageBuffer,
+					Checksum:          imageChecksum,
+					ChecksumAlgorithm: checksumAlg,
 				},
 				serviceURL: serviceURL,
 				timeLimit:  rate,
@@ -493,13 +521,44 @@ func (ts tileSender) tcpPutTile(req *sendTileRequest, tcpconn net.Conn) {
 		(req.timeLimit.Nanoseconds()-actualExecTime.Nanoseconds())/1000000)
 }
 
-func createTestImage(size int) (content, md5checksum []byte) {
+func (ts tileSender) tcpPipelineTile(req *sendTileRequest, sender *protocol.PipelinedTileSender) {
+	startTime := time.Now()
+	req.tileFileName = fmt.Sprintf("col%04d_row%04d_cam%d.tif", req.base.Col, req.base.Row, req.base.Camera)
+	log.Printf("Sending %d:%s (%d bytes) to %s", req.base.AcqID, req.tileFileName, len(req.base.Image), req.serviceURL)
+
+	// the request is copied because the sender sets the request ID on it
+	tileRequest := req.base
+	err := sender.Send(&tileRequest, func(r *protocol.CaptureImageRequest, imageTileResponse *protocol.CaptureImageResponse, err error) {
+		actualExecTime := time.Since(startTime)
+		if err != nil {
+			log.Printf("Error sending request %d for %d:%s (%d bytes) to %s: %v",
+				r.RequestID, r.AcqID, req.tileFileName, len(r.Image), req.serviceURL, err)
+			return
+		}
+		log.Printf("Sent request %d for %d:%s (%d) in %v, request status - %d, tileId - %d, content queue status - %s, tile queue status - %s, system status - %s, time left %d ms",
+			imageTileResponse.RequestID, imageTileResponse.AcqID, req.tileFileName,
+			len(r.Image), actualExecTime,
+			imageTileResponse.Status,
+			imageTileResponse.TileID,
+			queueStatusToString(imageTileResponse.ContentQueueStatus),
+			queueStatusToString(imageTileResponse.TileQueueStatus),
+			queueStatusToString(imageTileResponse.SystemStatus),
+			(req.timeLimit.Nanoseconds()-actualExecTime.Nanoseconds())/1000000)
+	})
+	if err != nil {
+		log.Printf("Error pipelining %d:%s (%d bytes) to %s: %v", req.base.AcqID, req.tileFileName, len(req.base.Image), req.serviceURL, err)
+	}
+}
+
+func createTestImage(size int, checksumAlg checksum.Algorithm) (content, imageChecksum []byte) {
 	content = make([]byte, size)
 	for i := range content {
 		content[i] = byte(rand.Intn(256))
 	}
-	checksum := md5.Sum(content)
-	md5checksum = checksum[0:]
+	imageChecksum, err := checksum.Sum(checksumAlg, content)
+	if err != nil {
+		log.Panic(err)
+	}
 	return
 }
 
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"net"
@@ -11,6 +12,7 @@ import (
 	"strings"
 	"sync"
 	"syscall"
+	"time"
 
 	"imagecatcher/config"
 	"imagecatcher/dao"
@@ -66,12 +68,7 @@ func startService(configs ...string) {
 
 	startProfiler()
 
-	stopChan := make(chan os.Signal)
-	go func() {
-		<-stopChan
-		stopProfiler()
-		os.Exit(0)
-	}()
+	stopChan := make(chan os.Signal, 1)
 	signal.Notify(stopChan, os.Interrupt, os.Kill, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGINT, syscall.SIGKILL)
 
 	var dbHandler dao.DbHandler
@@ -97,20 +94,95 @@ func startService(configs ...string) {
 
 	notifier := service.NewEmailNotifier(serviceInstanceName, *config)
 	tileRequestHandler := service.NewTileRequestHandler(imageCatcherService, notifier, *config)
+	go tileRequestHandler.RecoverSpooledContent()
+	replicaScrubber := service.NewReplicaScrubber(imageCatcherService, notifier, *config)
+	go replicaScrubber.Run()
+
+	shutdownTimeoutValue := config.GetStringProperty("SHUTDOWN_TIMEOUT", "30s")
+	shutdownTimeout, err := time.ParseDuration(shutdownTimeoutValue)
+	if err != nil {
+		logger.Errorf("Invalid shutdown timeout value %s - will default to 30s: %v", shutdownTimeoutValue, err)
+		shutdownTimeout = 30 * time.Second
+	}
+	var servers serverGroup
+	shutdownDeadline := make(chan time.Time, 1)
+	serversStopped := make(chan struct{})
+	go func() {
+		defer close(serversStopped)
+		sig := <-stopChan
+		logger.Printf("Received %v - stop accepting new requests", sig)
+		go func() {
+			sig := <-stopChan
+			logger.Printf("Received %v again - stop without draining the processing queues", sig)
+			stopProfiler()
+			os.Exit(1)
+		}()
+		deadline := time.Now().Add(shutdownTimeout)
+		shutdownDeadline <- deadline
+		ctx, cancel := context.WithDeadline(context.Background(), deadline)
+		defer cancel()
+		servers.shutdown(ctx)
+	}()
 
 	wg.Add(2)
-	go startTCPServer(tileRequestHandler, *config, &wg)
-	go startHTTPServer(imageCatcherService, tileRequestHandler, dbHandler, notifier, *config, &wg)
+	go startTCPServer(tileRequestHandler, *config, &servers, &wg)
+	go startHTTPServer(imageCatcherService, tileRequestHandler, dbHandler, notifier, *config, &servers, &wg)
 	wg.Wait()
 
+	// the servers no longer accept requests but Serve returns as soon as the shutdown starts, so wait
+	// for the requests that are still in flight to complete before processing whatever is still queued
+	deadline := time.Now().Add(shutdownTimeout)
+	select {
+	case deadline = <-shutdownDeadline:
+		<-serversStopped
+	default:
+	}
+	replicaScrubber.Stop()
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	if err = tileRequestHandler.Shutdown(ctx); err != nil {
+		logger.Errorf("Error draining the processing queues: %v", err)
+	}
+	cancel()
+	stopProfiler()
+
 	logger.Printf("ImageCatcher stopped")
 }
 
+// serverGroup keeps track of the running servers so that they can be stopped together
+type serverGroup struct {
+	sync.Mutex
+	servers []service.ServerHandler
+}
+
+func (g *serverGroup) add(s service.ServerHandler) {
+	g.Lock()
+	defer g.Unlock()
+	g.servers = append(g.servers, s)
+}
+
+// shutdown stops all servers and waits for their active requests to complete
+func (g *serverGroup) shutdown(ctx context.Context) {
+	g.Lock()
+	servers := g.servers
+	g.Unlock()
+	var wg sync.WaitGroup
+	for _, s := range servers {
+		wg.Add(1)
+		go func(s service.ServerHandler) {
+			defer wg.Done()
+			if err := s.Shutdown(ctx); err != nil {
+				logger.Errorf("Error stopping the server: %v", err)
+			}
+		}(s)
+	}
+	wg.Wait()
+}
+
 func startHTTPServer(imageCatcherService service.ImageCatcherService,
 	tileRequestHandler *service.TileRequestHandler,
 	dbHandler dao.DbHandler,
 	notifier service.MessageNotifier,
-	config config.Config, wg *sync.WaitGroup) (err error) {
+	config config.Config, servers *serverGroup, wg *sync.WaitGroup) (err error) {
 	defer wg.Done()
 	if *httpbind == "" {
 		return nil
@@ -125,8 +197,11 @@ func startHTTPServer(imageCatcherService service.ImageCatcherService,
 
 	tileDistributor := service.NewTileDistributor(dbHandler, config)
 	configurator := service.NewConfigurator(dbHandler)
+	storedImageReconciler := service.NewStoredImageReconciler(imageCatcherService, notifier, config)
 	keepAlives := !config.GetBoolProperty("DISABLE_SO_KEEP_ALIVE", false)
-	httpServer := service.NewHTTPServerHandler(httpListener, imageCatcherService, tileRequestHandler, tileDistributor, configurator, notifier, keepAlives)
+	httpServer := service.NewHTTPServerHandler(httpListener, imageCatcherService, tileRequestHandler, tileDistributor, configurator,
+		storedImageReconciler, notifier, keepAlives)
+	servers.add(httpServer)
 
 	logger.Printf("Starting HTTP ImageCatcher Service %s", *httpbind)
 	if err = httpServer.Serve(); err != nil {
@@ -135,7 +210,7 @@ func startHTTPServer(imageCatcherService service.ImageCatcherService,
 	return err
 }
 
-func startTCPServer(tileRequestHandler *service.TileRequestHandler, config config.Config, wg *sync.WaitGroup) (err error) {
+func startTCPServer(tileRequestHandler *service.TileRequestHandler, config config.Config, servers *serverGroup, wg *sync.WaitGroup) (err error) {
 	defer wg.Done()
 	if *tcpbind == "" {
 		return nil
@@ -149,6 +224,7 @@ func startTCPServer(tileRequestHandler *service.TileRequestHandler, config confi
 	defer tcpListener.Close()
 
 	tcpServer := service.NewTCPServerHandler(tcpListener, tileRequestHandler)
+	servers.add(tcpServer)
 
 	logger.Printf("Starting TCP ImageCatcher Service %s", *tcpbind)
 	if err = tcpServer.Serve(); err != nil {
@@ -2,8 +2,8 @@ package main
 
 import (
 	"bytes"
-	"crypto/md5"
 	"encoding/csv"
+	"encoding/hex"
 	"encoding/json"
 	"flag"
 	"fmt"
@@ -20,9 +20,11 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
+	"imagecatcher/checksum"
 	"imagecatcher/protocol"
 )
 
@@ -38,6 +40,15 @@ type tileInfo struct {
 	camera, col, row int
 }
 
+// sendOptions holds the tile protocol settings
+type sendOptions struct {
+	handshake         bool
+	maxInFlight       int
+	checksumAlgorithm checksum.Algorithm
+	// throttle adapts the send rate to the hints received from the service; nil if the rate is not adapted
+	throttle *sendThrottle
+}
+
 // String representation of a tileInfo
 func (ti tileInfo) String() string {
 	return fmt.Sprintf("Cam: %d, tile: (%d, %d)", ti.camera, ti.col, ti.row)
@@ -49,16 +60,49 @@ func main() {
 		acqServiceURL  = flag.String("acq-service-url", "", "Service url")
 		tileServiceURL = flag.String("tile-service-url", "", "Service url")
 		acqDirURL      = flag.String("acq-dir-url", "", "Acquisition directory url")
+		acqIDFlag      = flag.Uint64("acq-id", 0, "Acquisition id - if not set it is extracted from the acquisition directory")
 		camera         = flag.Int("camera", 0, "Camera index")
 		col            = flag.Int("col", 0, "Tile col")
 		row            = flag.Int("row", 0, "Tile row")
 		rateInMillis   = flag.Int("rate", 0, "Rate in milliseconds")
-		action         = flag.String("action", "send-tile", "Action: send-acq|send-tile|send-acq-log|send-rois")
-		sendMethod     = flag.String("send-method", "TCP-PUT", "Request method used for sending the tiles {HTTP-PUT|HTTP-POST|TCP-PUT}")
+		action         = flag.String("action", "send-tile", "Action: send-acq|send-tile|send-acq-log|send-rois|completeness")
+		sendMethod     = flag.String("send-method", "TCP-PUT", "Request method used for sending the tiles {HTTP-PUT|HTTP-POST|TCP-PUT|TCP-PIPELINE}")
 		logfile        = flag.String("logfile", "", "Name of the logfile")
+		tcpHandshake   = flag.Bool("tcp-handshake", false, "Start the TCP connections with a protocol handshake - requires a server that supports it")
+		maxInFlight    = flag.Int("max-inflight", 8, "Maximum number of in-flight requests per connection when using TCP-PIPELINE")
+		checksumAlg    = flag.String("checksum-algorithm", "MD5", "Tile checksum algorithm {MD5|SHA1|SHA256|CRC32C|XXH64}")
+		adaptRate      = flag.Bool("adapt-rate", true, "Adapt the tile send rate to the hints received from the service")
 	)
 	flag.Parse()
+	sendOpts := sendOptions{
+		handshake:   *tcpHandshake,
+		maxInFlight: *maxInFlight,
+	}
+	if *adaptRate {
+		sendOpts.throttle = &sendThrottle{}
+	}
 	initializeLog(*logfile)
+	var err error
+	if sendOpts.checksumAlgorithm, err = checksum.Lookup(*checksumAlg); err != nil {
+		fmt.Print(err)
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+	if *action == "completeness" {
+		acqID := *acqIDFlag
+		if acqID == 0 && *acqDirURL != "" {
+			acqID = extractAcqID(*acqDirURL)
+		}
+		if acqID == 0 {
+			fmt.Print("Acquisition id or acquisition dir is required")
+			flag.PrintDefaults()
+			os.Exit(1)
+		}
+		if !printAcqCompleteness(*serviceURL, acqID) {
+			os.Exit(2)
+		}
+		return
+	}
 	if *acqDirURL == "" {
 		fmt.Print("Acquisition dir is required")
 		flag.PrintDefaults()
@@ -72,13 +116,13 @@ func main() {
 	}
 	switch *action {
 	case "send-acq":
-		sendAcq(*acqServiceURL, *tileServiceURL, *acqDirURL, *camera, *rateInMillis, *sendMethod)
+		sendAcq(*acqServiceURL, *tileServiceURL, *acqDirURL, *camera, *rateInMillis, *sendMethod, sendOpts)
 	case "send-acq-log":
 		sendAcqLog(*acqServiceURL, *acqDirURL)
 	case "send-rois":
 		sendRois(*acqServiceURL, *acqDirURL)
 	case "send-tile":
-		sendImageTile(*tileServiceURL, *acqDirURL, *camera, *col, *row, *sendMethod)
+		sendImageTile(*tileServiceURL, *acqDirURL, *camera, *col, *row, *sendMethod, sendOpts)
 	}
 }
 
@@ -112,7 +156,7 @@ func extractAcqID(acqDirURL string) (acqID uint64) {
 	return
 }
 
-func sendAcq(acqServiceURL, tileServiceURL, acqDirURL string, camera int, rateInMillis int, tileSendMethod string) {
+func sendAcq(acqServiceURL, tileServiceURL, acqDirURL string, camera int, rateInMillis int, tileSendMethod string, sendOpts sendOptions) {
 	sendAcqLog(acqServiceURL, acqDirURL)
 	sendRois(acqServiceURL, acqDirURL)
 
@@ -147,6 +191,7 @@ func sendAcq(acqServiceURL, tileServiceURL, acqDirURL string, camera int, rateIn
 		tileServiceURL: tileServiceURL,
 		acqDirURL:      acqDirURL,
 		tileSendMethod: tileSendMethod,
+		sendOpts:       sendOpts,
 		workersTileCh:  tileSendersCh,
 	}
 	wp.startWorkers(nWorkers)
@@ -167,6 +212,7 @@ type imageSendWorkerPool struct {
 	tileServiceURL string
 	acqDirURL      string
 	tileSendMethod string
+	sendOpts       sendOptions
 	workersTileCh  chan tileInfo
 }
 
@@ -176,6 +222,7 @@ func (iswp imageSendWorkerPool) startWorkers(nWorkers int) {
 			tileServiceURL: iswp.tileServiceURL,
 			acqDirURL:      iswp.acqDirURL,
 			tileSendMethod: iswp.tileSendMethod,
+			sendOpts:       iswp.sendOpts,
 		}
 		go w.run(iswp.workersTileCh)
 	}
@@ -185,14 +232,37 @@ type imageSendWorker struct {
 	tileServiceURL string
 	acqDirURL      string
 	tileSendMethod string
+	sendOpts       sendOptions
 }
 
 func (isw imageSendWorker) run(tilesCh chan tileInfo) {
+	if isw.tileSendMethod == "TCP-PIPELINE" {
+		isw.runPipelined(tilesCh)
+		return
+	}
 	for ti := range tilesCh {
-		sendImageTile(isw.tileServiceURL, isw.acqDirURL, ti.camera, ti.col, ti.row, isw.tileSendMethod)
+		sendImageTile(isw.tileServiceURL, isw.acqDirURL, ti.camera, ti.col, ti.row, isw.tileSendMethod, isw.sendOpts)
 	}
 }
 
+// runPipelined sends all the tiles over a single connection without waiting for the responses
+func (isw imageSendWorker) runPipelined(tilesCh chan tileInfo) {
+	sender, conn, err := openPipelinedTCPSender(isw.tileServiceURL, isw.sendOpts.maxInFlight)
+	if err != nil {
+		log.Print(err)
+		for ti := range tilesCh {
+			log.Printf("Skip %v", ti)
+		}
+		return
+	}
+	defer conn.Close()
+	for ti := range tilesCh {
+		isw.sendOpts.throttle.wait()
+		tcpPipelineTile(isw.tileServiceURL, createTileRequest(isw.acqDirURL, ti.camera, ti.col, ti.row, isw.sendOpts.checksumAlgorithm), sender, isw.sendOpts.throttle.update)
+	}
+	sender.Wait()
+}
+
 func getAcqTiles(acqDirURL, timingFileName string, camera int, rate time.Duration, quit <-chan bool) (<-chan chan tileInfo, error) {
 
 	tf, err := os.Open(timingFileName)
@@ -451,60 +521,168 @@ func endAcq(serviceURL, acqDirURL string) {
 	log.Printf("Sent %s to %s - status %d", acqDirURL, endpoint, res.StatusCode)
 }
 
-func sendImageTile(serviceURL, acqDirURL string, camera, col, row int, method string) {
-	var err error
+// acqCompleteness is the completeness report returned by the service
+type acqCompleteness struct {
+	AcqUID    uint64 `json:"acq_id"`
+	FromROIs  bool   `json:"from_rois"`
+	Expected  int    `json:"n_expected"`
+	Received  int    `json:"n_received"`
+	NoContent int    `json:"n_no_content"`
+	Missing   int    `json:"n_missing"`
+	Groups    []struct {
+		Section   int64 `json:"section"`
+		Camera    int   `json:"camera"`
+		Expected  int   `json:"n_expected"`
+		Received  int   `json:"n_received"`
+		NoContent []struct {
+			Col int `json:"col"`
+			Row int `json:"row"`
+		} `json:"no_content"`
+		Missing []struct {
+			Col int `json:"col"`
+			Row int `json:"row"`
+		} `json:"missing"`
+	} `json:"groups"`
+}
+
+// printAcqCompleteness prints the expected tiles that were not received and returns true if the acquisition is complete
+func printAcqCompleteness(serviceURL string, acqID uint64) bool {
+	endpoint := fmt.Sprintf("%s/service/v1/acquisition/%d/completeness", serviceURL, acqID)
+	res, err := http.Get(endpoint)
+	if err != nil {
+		log.Printf("Error sending request %s: %s", endpoint, err)
+		return false
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		errBody, _ := ioutil.ReadAll(res.Body)
+		log.Printf("Request %s failed - status %d: %s", endpoint, res.StatusCode, errBody)
+		return false
+	}
+	var report acqCompleteness
+	if err = json.NewDecoder(res.Body).Decode(&report); err != nil {
+		log.Printf("Error decoding the completeness report for %d: %s", acqID, err)
+		return false
+	}
+	expectedFrom := "target grid"
+	if report.FromROIs {
+		expectedFrom = "ROI tiles"
+	}
+	fmt.Printf("Acquisition %d: %d tiles expected from the %s, %d received, %d without content, %d missing\n",
+		report.AcqUID, report.Expected, expectedFrom, report.Received, report.NoContent, report.Missing)
+	for _, g := range report.Groups {
+		fmt.Printf("Section %d, camera %d: %d expected, %d received\n", g.Section, g.Camera, g.Expected, g.Received)
+		for _, t := range g.NoContent {
+			fmt.Printf("\tno content: col %d row %d\n", t.Col, t.Row)
+		}
+		for _, t := range g.Missing {
+			fmt.Printf("\tmissing: col %d row %d\n", t.Col, t.Row)
+		}
+	}
+	return report.NoContent == 0 && report.Missing == 0
+}
 
+func createTileRequest(acqDirURL string, camera, col, row int, checksumAlg checksum.Algorithm) *protocol.CaptureImageRequest {
 	acqID := extractAcqID(acqDirURL)
 	acqTileName := getAcqFile(acqDirURL, fmt.Sprintf("col%04d/col%04d_row%04d_cam%d.tif", col, col, row, camera))
 	imageBuffer, err := ioutil.ReadFile(acqTileName)
 	if err != nil {
 		log.Fatal(err)
 	}
-	checksum := md5.Sum(imageBuffer)
-	var sendTileFunc func(*protocol.CaptureImageRequest)
+	imageChecksum, err := checksum.Sum(checksumAlg, imageBuffer)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return &protocol.CaptureImageRequest{
+		AcqID:             acqID,
+		Camera:            int32(camera),
+		Frame:             -1,
+		Col:               int32(col),
+		Row:               int32(row),
+		Image:             imageBuffer,
+		Checksum:          imageChecksum,
+		ChecksumAlgorithm: checksumAlg,
+	}
+}
+
+func sendImageTile(serviceURL, acqDirURL string, camera, col, row int, method string, sendOpts sendOptions) {
+	var err error
+
+	var sendTileFunc func(*protocol.CaptureImageRequest) sendHints
 	switch method {
 	case "HTTP-PUT":
-		sendTileFunc = func(r *protocol.CaptureImageRequest) {
+		sendTileFunc = func(r *protocol.CaptureImageRequest) sendHints {
 			tr := &http.Transport{
 				ResponseHeaderTimeout: 120 * time.Second,
 				DisableCompression:    true,
 				MaxIdleConnsPerHost:   0,
 				DisableKeepAlives:     true,
 			}
-			httpPutTile(serviceURL, r, tr)
+			return httpPutTile(serviceURL, r, tr)
 		}
 	case "HTTP-POST":
-		sendTileFunc = func(r *protocol.CaptureImageRequest) {
-			httpPostTile(serviceURL, r, http.Client{})
+		sendTileFunc = func(r *protocol.CaptureImageRequest) sendHints {
+			return httpPostTile(serviceURL, r, http.Client{})
 		}
 	case "TCP-PUT":
-		sendTileFunc = func(r *protocol.CaptureImageRequest) {
+		sendTileFunc = func(r *protocol.CaptureImageRequest) sendHints {
 			var conn net.Conn
 			conn, err = net.Dial("tcp", serviceURL)
 			if err != nil {
 				log.Printf("Error opening the tcp connection to %s: %v", serviceURL, err)
-				return
+				return sendHints{failed: true}
 			}
 			defer conn.Close()
-			tcpPutTile(serviceURL, r, conn)
+			if sendOpts.handshake {
+				var hs *protocol.Handshake
+				if hs, err = protocol.ClientHandshake(conn, &protocol.Handshake{
+					Version:      protocol.CurrentProtocolVersion,
+					Capabilities: protocol.CapVersionedMessages,
+				}); err != nil {
+					log.Printf("Error negotiating the protocol with %s: %v", serviceURL, err)
+					return sendHints{failed: true}
+				}
+				r.Version = hs.Version
+			}
+			return tcpPutTile(serviceURL, r, conn)
+		}
+	case "TCP-PIPELINE":
+		sendTileFunc = func(r *protocol.CaptureImageRequest) sendHints {
+			sender, conn, err := openPipelinedTCPSender(serviceURL, sendOpts.maxInFlight)
+			if err != nil {
+				log.Print(err)
+				return sendHints{failed: true}
+			}
+			defer conn.Close()
+			var hints sendHints
+			tcpPipelineTile(serviceURL, r, sender, func(h sendHints) {
+				hints = h
+			})
+			sender.Wait()
+			return hints
 		}
 	default:
-		log.Panicf("Invalid send tile method - supported methods are : HTTP-PUT | HTTP-POST | TCP-PUT")
+		log.Panicf("Invalid send tile method - supported methods are : HTTP-PUT | HTTP-POST | TCP-PUT | TCP-PIPELINE")
 	}
 
-	tileRequest := &protocol.CaptureImageRequest{
-		AcqID:    acqID,
-		Camera:   int32(camera),
-		Frame:    -1,
-		Col:      int32(col),
-		Row:      int32(row),
-		Image:    imageBuffer,
-		Checksum: checksum[0:],
+	req := createTileRequest(acqDirURL, camera, col, row, sendOpts.checksumAlgorithm)
+	for attempt := 0; ; attempt++ {
+		sendOpts.throttle.wait()
+		hints := sendTileFunc(req)
+		sendOpts.throttle.update(hints)
+		// the service sets the retry after hint for the failures that may succeed later
+		if !hints.failed || hints.retryAfter == 0 || attempt >= maxSendRetries {
+			break
+		}
+		log.Printf("Resend %d:%d:%d:%d after %v", req.AcqID, req.Camera, req.Col, req.Row, hints.retryAfter)
+		if sendOpts.throttle == nil {
+			time.Sleep(hints.retryAfter)
+		}
 	}
-	sendTileFunc(tileRequest)
 }
 
-func httpPostTile(serviceURL string, req *protocol.CaptureImageRequest, httpConn http.Client) {
+func httpPostTile(serviceURL string, req *protocol.CaptureImageRequest, httpConn http.Client) (hints sendHints) {
+	hints.failed = true
 	startTime := time.Now()
 	storeTileEndpoint := fmt.Sprintf("%s/service/v1/capture-image-content/%d", serviceURL, req.AcqID)
 	tileFileName := fmt.Sprintf("col%04d/col%04d_row%04d_cam%d.tif", req.Col, req.Col, req.Row, req.Camera)
@@ -524,6 +702,14 @@ func httpPostTile(serviceURL string, req *protocol.CaptureImageRequest, httpConn
 		log.Printf("Error writing the tile file name %s: %s", tileFileName, err)
 		return
 	}
+	if err = writer.WriteField("checksum-str", hex.EncodeToString(req.Checksum)); err != nil {
+		log.Printf("Error writing the checksum for %s: %s", tileFileName, err)
+		return
+	}
+	if err = writer.WriteField("checksum-algorithm", req.ChecksumAlgorithm.String()); err != nil {
+		log.Printf("Error writing the checksum algorithm for %s: %s", tileFileName, err)
+		return
+	}
 	if err = writer.Close(); err != nil {
 		log.Printf("Error closing the multipart writer for %s: %s", tileFileName, err)
 		return
@@ -554,13 +740,15 @@ func httpPostTile(serviceURL string, req *protocol.CaptureImageRequest, httpConn
 	}
 	log.Printf("Sent %d:%s (%d) in %v - status %d, resp %v", req.AcqID, tileFileName,
 		len(req.Image), actualExecTime, res.StatusCode, tileInfo)
+	return hintsFromHTTPResponse(res)
 }
 
-func httpPutTile(serviceURL string, req *protocol.CaptureImageRequest, tr *http.Transport) {
+func httpPutTile(serviceURL string, req *protocol.CaptureImageRequest, tr *http.Transport) (hints sendHints) {
+	hints.failed = true
 	startTime := time.Now()
 	tileFileName := fmt.Sprintf("col%04d/col%04d_row%04d_cam%d.tif", req.Col, req.Col, req.Row, req.Camera)
-	storeTileEndpoint := fmt.Sprintf("%s/service/v1/capture-image-content/%d?tile-filename=%s",
-		serviceURL, req.AcqID, tileFileName)
+	storeTileEndpoint := fmt.Sprintf("%s/service/v1/capture-image-content/%d?tile-filename=%s&checksum=%x&checksum-algorithm=%s",
+		serviceURL, req.AcqID, tileFileName, req.Checksum, req.ChecksumAlgorithm)
 	log.Printf("Sending %d:%s (%d bytes) to %s", req.AcqID, tileFileName, len(req.Image), storeTileEndpoint)
 
 	request, err := http.NewRequest("PUT", storeTileEndpoint, bytes.NewReader(req.Image))
@@ -587,9 +775,10 @@ func httpPutTile(serviceURL string, req *protocol.CaptureImageRequest, tr *http.
 	}
 	log.Printf("Sent %d:%s (%d) in %v - status %d, resp %v, headers: %v", req.AcqID, tileFileName,
 		len(req.Image), actualExecTime, res.StatusCode, tileInfo, res.Header)
+	return hintsFromHTTPResponse(res)
 }
 
-func tcpPutTile(serviceURL string, req *protocol.CaptureImageRequest, tcpconn net.Conn) {
+func tcpPutTile(serviceURL string, req *protocol.CaptureImageRequest, tcpconn net.Conn) sendHints {
 	startTime := time.Now()
 	tileFileName := fmt.Sprintf("col%04d_row%04d_cam%d.tif", req.Col, req.Row, req.Camera)
 	log.Printf("Sending %d:%s (%d bytes) to %s", req.AcqID, tileFileName, len(req.Image), serviceURL)
@@ -630,6 +819,67 @@ func tcpPutTile(serviceURL string, req *protocol.CaptureImageRequest, tcpconn ne
 		queueStatusToString(imageTileResponse.TileQueueStatus),
 		queueStatusToString(imageTileResponse.SystemStatus),
 	)
+	if imageTileResponse.Status != 0 {
+		log.Printf("Error %d sending %d:%s: %s", imageTileResponse.ErrorCode, req.AcqID, tileFileName, imageTileResponse.ErrorMessage)
+	}
+	return hintsFromTileResponse(imageTileResponse)
+}
+
+func openPipelinedTCPSender(serviceURL string, maxInFlight int) (*protocol.PipelinedTileSender, net.Conn, error) {
+	conn, err := net.Dial("tcp", serviceURL)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Error opening the tcp connection to %s: %v", serviceURL, err)
+	}
+	hs, err := protocol.ClientHandshake(conn, &protocol.Handshake{
+		Version:             protocol.CurrentProtocolVersion,
+		MaxInFlightRequests: uint16(maxInFlight),
+		Capabilities:        protocol.SupportedCapabilities,
+	})
+	if err != nil {
+		conn.Close()
+		return nil, nil, fmt.Errorf("Error negotiating the protocol with %s: %v", serviceURL, err)
+	}
+	if !hs.Capabilities.Has(protocol.CapPipelining) {
+		log.Printf("%s does not support pipelining - the tiles will be sent one at a time", serviceURL)
+	}
+	log.Printf("Negotiated protocol version %d with %s - %d in-flight requests", hs.Version, serviceURL, hs.MaxInFlightRequests)
+	return protocol.NewPipelinedTileSender(conn, hs), conn, nil
+}
+
+// tcpPipelineTile sends the tile without waiting for the response. handleHints is called once, with the hints of
+// the response or with a failure if no response was received.
+func tcpPipelineTile(serviceURL string, req *protocol.CaptureImageRequest, sender *protocol.PipelinedTileSender, handleHints func(sendHints)) {
+	var handled sync.Once
+	reportHints := func(hints sendHints) {
+		handled.Do(func() { handleHints(hints) })
+	}
+	startTime := time.Now()
+	tileFileName := fmt.Sprintf("col%04d_row%04d_cam%d.tif", req.Col, req.Row, req.Camera)
+	log.Printf("Sending %d:%s (%d bytes) to %s", req.AcqID, tileFileName, len(req.Image), serviceURL)
+
+	err := sender.Send(req, func(req *protocol.CaptureImageRequest, imageTileResponse *protocol.CaptureImageResponse, err error) {
+		actualExecTime := time.Since(startTime)
+		if err != nil {
+			log.Printf("Error sending request %d for %d:%s (%d bytes) to %s: %v",
+				req.RequestID, req.AcqID, tileFileName, len(req.Image), serviceURL, err)
+			reportHints(sendHints{failed: true})
+			return
+		}
+		log.Printf("Sent request %d for %d:%s (%d) in %v, request status - %d, tileId - %d, content queue status - %s, tile queue status - %s, system status - %s",
+			imageTileResponse.RequestID, imageTileResponse.AcqID, tileFileName,
+			len(req.Image), actualExecTime,
+			imageTileResponse.Status,
+			imageTileResponse.TileID,
+			queueStatusToString(imageTileResponse.ContentQueueStatus),
+			queueStatusToString(imageTileResponse.TileQueueStatus),
+			queueStatusToString(imageTileResponse.SystemStatus),
+		)
+		reportHints(hintsFromTileResponse(imageTileResponse))
+	})
+	if err != nil {
+		log.Printf("Error pipelining %d:%s (%d bytes) to %s: %v", req.AcqID, tileFileName, len(req.Image), serviceURL, err)
+		reportHints(sendHints{failed: true})
+	}
 }
 
 func queueStatusToString(qs int16) string {
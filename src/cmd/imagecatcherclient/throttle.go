@@ -0,0 +1,86 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"imagecatcher/protocol"
+)
+
+// maxSendRetries is the number of times a tile is resent when the service asks the client to retry later
+const maxSendRetries = 3
+
+// sendHints are the backpressure hints received with a tile response
+type sendHints struct {
+	failed          bool
+	retryAfter      time.Duration
+	recommendedRate time.Duration
+}
+
+func hintsFromTileResponse(resp *protocol.CaptureImageResponse) sendHints {
+	return sendHints{
+		failed:          resp.Status != 0,
+		retryAfter:      time.Duration(resp.RetryAfterMs) * time.Millisecond,
+		recommendedRate: time.Duration(resp.RecommendedRateMs) * time.Millisecond,
+	}
+}
+
+func hintsFromHTTPResponse(res *http.Response) sendHints {
+	hints := sendHints{failed: res.StatusCode != http.StatusOK}
+	if retryAfterMs, err := strconv.ParseUint(res.Header.Get("Retry-After-Ms"), 10, 32); err == nil {
+		hints.retryAfter = time.Duration(retryAfterMs) * time.Millisecond
+	} else if retryAfter, err := strconv.ParseUint(res.Header.Get("Retry-After"), 10, 32); err == nil {
+		hints.retryAfter = time.Duration(retryAfter) * time.Second
+	}
+	if recommendedRateMs, err := strconv.ParseUint(res.Header.Get("Recommended-Rate-Ms"), 10, 32); err == nil {
+		hints.recommendedRate = time.Duration(recommendedRateMs) * time.Millisecond
+	}
+	return hints
+}
+
+// sendThrottle spaces the tiles sent by all workers according to the hints received from the service.
+// A nil throttle does not limit the send rate.
+type sendThrottle struct {
+	lock         sync.Mutex
+	interval     time.Duration
+	nextSendTime time.Time
+}
+
+// wait blocks until the next tile may be sent
+func (t *sendThrottle) wait() {
+	if t == nil {
+		return
+	}
+	t.lock.Lock()
+	now := time.Now()
+	sendTime := t.nextSendTime
+	if sendTime.Before(now) {
+		sendTime = now
+	}
+	t.nextSendTime = sendTime.Add(t.interval)
+	t.lock.Unlock()
+	time.Sleep(sendTime.Sub(now))
+}
+
+// update adjusts the send interval to the recommended rate and postpones the next send if the service asked for it
+func (t *sendThrottle) update(hints sendHints) {
+	if t == nil {
+		return
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if !hints.failed || hints.recommendedRate > 0 {
+		// a failure without a recommendation most likely means that no response was received
+		t.interval = hints.recommendedRate
+	}
+	if hints.retryAfter > 0 {
+		retryTime := time.Now().Add(hints.retryAfter)
+		if retryTime.After(t.nextSendTime) {
+			log.Printf("Pause sending for %v", hints.retryAfter)
+			t.nextSendTime = retryTime
+		}
+	}
+}
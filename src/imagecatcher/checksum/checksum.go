@@ -0,0 +1,114 @@
+package checksum
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"strings"
+	"sync"
+)
+
+// Algorithm identifies a checksum algorithm. The value is sent on the wire with the tile requests
+// so the values of the existing algorithms must never change.
+type Algorithm uint8
+
+const (
+	// MD5 is the default algorithm - this is what the clients that don't specify the algorithm use
+	MD5 Algorithm = iota
+	// SHA1 algorithm
+	SHA1
+	// SHA256 algorithm
+	SHA256
+	// CRC32C - CRC32 with the Castagnoli polynomial
+	CRC32C
+	// XXHash64 - 64 bit xxHash with seed 0
+	XXHash64
+)
+
+// DefaultAlgorithm is the algorithm assumed when none is specified
+const DefaultAlgorithm = MD5
+
+type registration struct {
+	name    string
+	newHash func() hash.Hash
+}
+
+var (
+	registryLock sync.RWMutex
+	registry     = map[Algorithm]registration{}
+)
+
+func init() {
+	castagnoliTable := crc32.MakeTable(crc32.Castagnoli)
+	Register(MD5, "MD5", md5.New)
+	Register(SHA1, "SHA1", sha1.New)
+	Register(SHA256, "SHA256", sha256.New)
+	Register(CRC32C, "CRC32C", func() hash.Hash { return crc32.New(castagnoliTable) })
+	Register(XXHash64, "XXH64", func() hash.Hash { return NewXXHash64(0) })
+}
+
+// Register adds an algorithm to the registry or replaces an existing registration
+func Register(alg Algorithm, name string, newHash func() hash.Hash) {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+	registry[alg] = registration{strings.ToUpper(name), newHash}
+}
+
+// String returns the registered name of the algorithm
+func (alg Algorithm) String() string {
+	registryLock.RLock()
+	defer registryLock.RUnlock()
+	if r, found := registry[alg]; found {
+		return r.name
+	}
+	return fmt.Sprintf("UNKNOWN(%d)", uint8(alg))
+}
+
+// Supported checks if the algorithm is registered
+func (alg Algorithm) Supported() bool {
+	registryLock.RLock()
+	defer registryLock.RUnlock()
+	_, found := registry[alg]
+	return found
+}
+
+// Lookup returns the algorithm registered with the given name. The name is case insensitive
+// and the dashes are ignored so "sha-256" and "SHA256" identify the same algorithm. An empty name returns the default algorithm.
+func Lookup(name string) (Algorithm, error) {
+	if name == "" {
+		return DefaultAlgorithm, nil
+	}
+	normalizedName := strings.Replace(strings.ToUpper(name), "-", "", -1)
+	registryLock.RLock()
+	defer registryLock.RUnlock()
+	for alg, r := range registry {
+		if r.name == normalizedName {
+			return alg, nil
+		}
+	}
+	return DefaultAlgorithm, fmt.Errorf("Unsupported checksum algorithm %s", name)
+}
+
+// New creates a new hash for the given algorithm
+func New(alg Algorithm) (hash.Hash, error) {
+	registryLock.RLock()
+	r, found := registry[alg]
+	registryLock.RUnlock()
+	if !found {
+		return nil, fmt.Errorf("Unsupported checksum algorithm %d", uint8(alg))
+	}
+	return r.newHash(), nil
+}
+
+// Sum computes the checksum of the given content
+func Sum(alg Algorithm, content []byte) ([]byte, error) {
+	h, err := New(alg)
+	if err != nil {
+		return nil, err
+	}
+	h.Write(content)
+	return h.Sum(nil), nil
+}
@@ -0,0 +1,81 @@
+package checksum
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+func TestSum(t *testing.T) {
+	testData := []struct {
+		alg      Algorithm
+		content  string
+		expected string
+	}{
+		{MD5, "abc", "900150983cd24fb0d6963f7d28e17f72"},
+		{SHA1, "abc", "a9993e364706816aba3e25717850c26c9cd0d89d"},
+		{SHA256, "abc", "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad"},
+		{CRC32C, "123456789", "e3069283"},
+		{XXHash64, "", "ef46db3751d8e999"},
+		{XXHash64, "abc", "44bc2cf5ad770999"},
+		{XXHash64, "The quick brown fox jumps over the lazy dog", "0b242d361fda71bc"},
+	}
+	for _, td := range testData {
+		s, err := Sum(td.alg, []byte(td.content))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hex.EncodeToString(s) != td.expected {
+			t.Errorf("Expected %s(%q) to be %s but got %x", td.alg, td.content, td.expected, s)
+		}
+	}
+}
+
+func TestXXHash64StreamingWrites(t *testing.T) {
+	content := make([]byte, 1000)
+	for i := range content {
+		content[i] = byte(i * 7)
+	}
+	expected, _ := Sum(XXHash64, content)
+	for _, chunkSize := range []int{1, 3, 31, 32, 33, 100} {
+		h := NewXXHash64(0)
+		for i := 0; i < len(content); i += chunkSize {
+			end := i + chunkSize
+			if end > len(content) {
+				end = len(content)
+			}
+			h.Write(content[i:end])
+		}
+		if s := h.Sum(nil); hex.EncodeToString(s) != hex.EncodeToString(expected) {
+			t.Errorf("Expected chunked writes of %d bytes to produce %x but got %x", chunkSize, expected, s)
+		}
+	}
+}
+
+func TestLookup(t *testing.T) {
+	testData := []struct {
+		name     string
+		expected Algorithm
+	}{
+		{"", MD5},
+		{"md5", MD5},
+		{"SHA-1", SHA1},
+		{"sha256", SHA256},
+		{"crc32c", CRC32C},
+		{"XXH64", XXHash64},
+	}
+	for _, td := range testData {
+		alg, err := Lookup(td.name)
+		if err != nil {
+			t.Error(err)
+		}
+		if alg != td.expected {
+			t.Errorf("Expected %q to be %s but got %s", td.name, td.expected, alg)
+		}
+	}
+	if _, err := Lookup("whirlpool"); err == nil {
+		t.Error("Expected an unsupported algorithm error")
+	}
+	if _, err := Sum(Algorithm(200), nil); err == nil {
+		t.Error("Expected an unsupported algorithm error")
+	}
+}
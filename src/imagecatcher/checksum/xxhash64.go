@@ -0,0 +1,128 @@
+package checksum
+
+import (
+	"encoding/binary"
+	"hash"
+	"math/bits"
+)
+
+const (
+	xxPrime64v1 uint64 = 11400714785074694791
+	xxPrime64v2 uint64 = 14029467366897019727
+	xxPrime64v3 uint64 = 1609587929392839161
+	xxPrime64v4 uint64 = 9650029242287828579
+	xxPrime64v5 uint64 = 2870177450012600261
+)
+
+// xxHash64 is a streaming implementation of the 64 bit xxHash
+type xxHash64 struct {
+	seed           uint64
+	v1, v2, v3, v4 uint64
+	total          uint64
+	mem            [32]byte
+	memSize        int
+}
+
+// NewXXHash64 creates a 64 bit xxHash with the given seed. Sum appends the hash in big endian order,
+// which is the canonical xxHash representation.
+func NewXXHash64(seed uint64) hash.Hash64 {
+	h := &xxHash64{seed: seed}
+	h.Reset()
+	return h
+}
+
+func (h *xxHash64) Reset() {
+	h.v1 = h.seed + xxPrime64v1 + xxPrime64v2
+	h.v2 = h.seed + xxPrime64v2
+	h.v3 = h.seed
+	h.v4 = h.seed - xxPrime64v1
+	h.total = 0
+	h.memSize = 0
+}
+
+func (h *xxHash64) Size() int {
+	return 8
+}
+
+func (h *xxHash64) BlockSize() int {
+	return 32
+}
+
+func (h *xxHash64) Write(b []byte) (int, error) {
+	n := len(b)
+	h.total += uint64(n)
+	if h.memSize+n < 32 {
+		h.memSize += copy(h.mem[h.memSize:], b)
+		return n, nil
+	}
+	if h.memSize > 0 {
+		c := copy(h.mem[h.memSize:], b)
+		b = b[c:]
+		h.v1 = xxRound(h.v1, binary.LittleEndian.Uint64(h.mem[0:]))
+		h.v2 = xxRound(h.v2, binary.LittleEndian.Uint64(h.mem[8:]))
+		h.v3 = xxRound(h.v3, binary.LittleEndian.Uint64(h.mem[16:]))
+		h.v4 = xxRound(h.v4, binary.LittleEndian.Uint64(h.mem[24:]))
+		h.memSize = 0
+	}
+	for ; len(b) >= 32; b = b[32:] {
+		h.v1 = xxRound(h.v1, binary.LittleEndian.Uint64(b[0:]))
+		h.v2 = xxRound(h.v2, binary.LittleEndian.Uint64(b[8:]))
+		h.v3 = xxRound(h.v3, binary.LittleEndian.Uint64(b[16:]))
+		h.v4 = xxRound(h.v4, binary.LittleEndian.Uint64(b[24:]))
+	}
+	h.memSize = copy(h.mem[:], b)
+	return n, nil
+}
+
+func (h *xxHash64) Sum64() uint64 {
+	var h64 uint64
+	if h.total >= 32 {
+		h64 = bits.RotateLeft64(h.v1, 1) + bits.RotateLeft64(h.v2, 7) + bits.RotateLeft64(h.v3, 12) + bits.RotateLeft64(h.v4, 18)
+		h64 = xxMergeRound(h64, h.v1)
+		h64 = xxMergeRound(h64, h.v2)
+		h64 = xxMergeRound(h64, h.v3)
+		h64 = xxMergeRound(h64, h.v4)
+	} else {
+		h64 = h.seed + xxPrime64v5
+	}
+	h64 += h.total
+
+	b := h.mem[:h.memSize]
+	for ; len(b) >= 8; b = b[8:] {
+		h64 ^= xxRound(0, binary.LittleEndian.Uint64(b))
+		h64 = bits.RotateLeft64(h64, 27)*xxPrime64v1 + xxPrime64v4
+	}
+	if len(b) >= 4 {
+		h64 ^= uint64(binary.LittleEndian.Uint32(b)) * xxPrime64v1
+		h64 = bits.RotateLeft64(h64, 23)*xxPrime64v2 + xxPrime64v3
+		b = b[4:]
+	}
+	for _, c := range b {
+		h64 ^= uint64(c) * xxPrime64v5
+		h64 = bits.RotateLeft64(h64, 11) * xxPrime64v1
+	}
+
+	h64 ^= h64 >> 33
+	h64 *= xxPrime64v2
+	h64 ^= h64 >> 29
+	h64 *= xxPrime64v3
+	h64 ^= h64 >> 32
+	return h64
+}
+
+func (h *xxHash64) Sum(b []byte) []byte {
+	var s [8]byte
+	binary.BigEndian.PutUint64(s[:], h.Sum64())
+	return append(b, s[:]...)
+}
+
+func xxRound(acc, input uint64) uint64 {
+	acc += input * xxPrime64v2
+	acc = bits.RotateLeft64(acc, 31)
+	return acc * xxPrime64v1
+}
+
+func xxMergeRound(acc, val uint64) uint64 {
+	acc ^= xxRound(0, val)
+	return acc*xxPrime64v1 + xxPrime64v4
+}
@@ -154,3 +154,19 @@ func (cfg Config) GetStringMapProperty(name string) (res map[string]string) {
 	}
 	return res
 }
+
+// GetConfigMapProperty - read a map from string to a nested configuration property
+func (cfg Config) GetConfigMapProperty(name string) (res map[string]Config) {
+	res = map[string]Config{}
+	defer func() {
+		if r := recover(); r != nil {
+			logger.Errorf("Error encountered while reading config map property: %s - %v", name, r)
+		}
+	}()
+	if cfg[name] != nil {
+		for k, v := range cfg[name].(map[string]interface{}) {
+			res[k] = Config(v.(map[string]interface{}))
+		}
+	}
+	return res
+}
@@ -13,11 +13,21 @@ import (
 
 // CreateAcqLog creates the acquisition log if it doesn't exist, otherwise simply return the existing record.
 func CreateAcqLog(acq *models.Acquisition, session DbSession) error {
-	acqfID, err := getAcqLog(acq, session)
+	acqfID, currentState, err := getAcqLog(acq, session)
 	if err != nil {
 		return fmt.Errorf("Error reading the INI acquisition log for '%d': %v", acq.AcqUID, err)
 	}
 	if acqfID != 0 {
+		// resending the acquisition log reopens a finished acquisition
+		switch currentState {
+		case models.AcqCreatedState, models.AcqAcquiringState:
+			acq.AcqState = currentState
+		default:
+			if !(models.Acquisition{AcqState: currentState}).CanChangeStateTo(models.AcqAcquiringState) {
+				return fmt.Errorf("Acquisition '%d' cannot be restarted because it is %s", acq.AcqUID, currentState)
+			}
+			acq.AcqState = models.AcqAcquiringState
+		}
 		logger.Infof("Update INI Log for '%d'", acq.AcqUID)
 		nUpdates, err := updateAcquisition(acq, session)
 		if err != nil {
@@ -27,32 +37,35 @@ func CreateAcqLog(acq *models.Acquisition, session DbSession) error {
 		return nil
 	}
 	logger.Infof("Create INI Log for '%d'", acq.AcqUID)
+	acq.AcqState = models.AcqCreatedState
 	if acq.IniFileID, err = insertAcquisition(acq, session); err != nil {
 		return fmt.Errorf("Error creating a new acquisition for '%d': %v", acq.AcqUID, err)
 	}
 	return nil
 }
 
-func getAcqLog(acq *models.Acquisition, session DbSession) (int64, error) {
+func getAcqLog(acq *models.Acquisition, session DbSession) (int64, string, error) {
 	sqlQuery := `
 		select
 			ini_file_denorm_id,
-			ini_file
+			ini_file,
+			acq_state
 		from ini_files_denorm where uid = ?
 	`
 	rows, err := session.selectQuery(sqlQuery, acq.AcqUID)
 	defer closeRS(rows)
 	if err != nil {
-		return 0, err
+		return 0, "", err
 	}
 	if rows.Next() {
-		err = rows.Scan(&acq.IniFileID, &acq.IniContent)
+		var acqState string
+		err = rows.Scan(&acq.IniFileID, &acq.IniContent, &acqState)
 		if err != nil {
-			return 0, fmt.Errorf("Error extracting data from INI file result set: %v", err)
+			return 0, "", fmt.Errorf("Error extracting data from INI file result set: %v", err)
 		}
-		return acq.IniFileID, nil
+		return acq.IniFileID, acqState, nil
 	}
-	return 0, nil
+	return 0, "", nil
 }
 
 func insertAcquisition(acq *models.Acquisition, session DbSession) (int64, error) {
@@ -64,6 +77,7 @@ func insertAcquisition(acq *models.Acquisition, session DbSession) (int64, error
 		when_acquired,
 		when_inserted,
 		when_completed,
+		acq_state,
 		number_of_cameras,
 		x_sm_step_pix,
 		y_sm_step_pix,
@@ -87,7 +101,7 @@ func insertAcquisition(acq *models.Acquisition, session DbSession) (int64, error
 		notes
 		)
 		values
-		(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
 	`
 	return insert(session, insertQuery,
 		acq.AcqUID,
@@ -95,6 +109,7 @@ func insertAcquisition(acq *models.Acquisition, session DbSession) (int64, error
 		acq.Acquired,
 		acq.Inserted,
 		acq.Completed,
+		acq.AcqState,
 		acq.NumberOfCameras,
 		acq.XSmallStepPix,
 		acq.YSmallStepPix,
@@ -125,6 +140,7 @@ func updateAcquisition(acq *models.Acquisition, session DbSession) (int64, error
 		when_acquired = ?,
 		when_inserted = ?,
 		when_completed = ?,
+		acq_state = ?,
 		number_of_cameras = ?,
 		x_sm_step_pix = ?,
 		y_sm_step_pix = ?,
@@ -153,6 +169,7 @@ func updateAcquisition(acq *models.Acquisition, session DbSession) (int64, error
 		acq.Acquired,
 		acq.Inserted,
 		acq.Completed,
+		acq.AcqState,
 		acq.NumberOfCameras,
 		acq.XSmallStepPix,
 		acq.YSmallStepPix,
@@ -178,15 +195,26 @@ func updateAcquisition(acq *models.Acquisition, session DbSession) (int64, error
 	)
 }
 
-// EndAcquisition marks the acquisition as completed
-func EndAcquisition(acqID uint64, session DbSession) error {
-	updateAcqQuery := `
+// UpdateAcquisitionState changes the acquisition state only if the acquisition is still in the expected current state
+// and it returns the number of updated records. The completed timestamp is set when the acquisition completes
+// and it is cleared when the acquisition is reopened.
+func UpdateAcquisitionState(acqID uint64, currentState, newState string, session DbSession) (int64, error) {
+	var sqlQueryBuffer bytes.Buffer
+	queryArgs := []interface{}{newState}
+	sqlQueryBuffer.WriteString(`
 		update ini_files_denorm
-		set when_completed = ?
-		where uid = ?
-	`
-	_, err := update(session, updateAcqQuery, time.Now(), acqID)
-	return err
+		set acq_state = ?
+	`)
+	switch newState {
+	case models.AcqCompletedState:
+		sqlQueryBuffer.WriteString(", when_completed = ? ")
+		queryArgs = append(queryArgs, time.Now())
+	case models.AcqAcquiringState:
+		sqlQueryBuffer.WriteString(", when_completed = null ")
+	}
+	sqlQueryBuffer.WriteString("where uid = ? and acq_state = ?")
+	queryArgs = append(queryArgs, acqID, currentState)
+	return update(session, sqlQueryBuffer.String(), queryArgs...)
 }
 
 // CreateImageMosaic creates the image mosaic entity for the given acquisition
@@ -258,6 +286,7 @@ const selectAcqQuery = `
 		acqf.when_acquired,
 		acqf.when_inserted,
 		acqf.when_completed,
+		acqf.acq_state,
 		acqf.uid as acqf_uid,
 		acqf.number_of_cameras,
 		acqf.x_sm_step_pix, acqf.y_sm_step_pix,
@@ -304,6 +333,7 @@ func RetrieveAcquisition(acqID uint64, session DbSession) (*models.Acquisition,
 			&acquired,
 			&inserted,
 			&completedTime,
+			&acq.AcqState,
 			&acq.AcqUID,
 			&acq.NumberOfCameras,
 			&acq.XSmallStepPix, &acq.YSmallStepPix,
@@ -417,6 +447,12 @@ func RetrieveAcquisitions(acqFilter *models.AcquisitionFilter, session DbSession
 		"acqf.mosaic_type=?",
 		queryArgs,
 		nextClause)
+	queryArgs, nextClause = addFlagQueryCond(&sqlQueryBuffer,
+		acqFilter.AcqState != "",
+		acqFilter.AcqState,
+		"acqf.acq_state=?",
+		queryArgs,
+		nextClause)
 	if acqFilter.RequiredStateForAllTiles != "" {
 		// for checking whether it has all in the specified state
 		// it checks if there's any tile in any other state and if
@@ -498,6 +534,7 @@ func RetrieveAcquisitions(acqFilter *models.AcquisitionFilter, session DbSession
 			&acquired,
 			&inserted,
 			&completedTime,
+			&acq.AcqState,
 			&acq.AcqUID,
 			&acq.NumberOfCameras,
 			&acq.XSmallStepPix, &acq.YSmallStepPix,
@@ -553,6 +590,8 @@ func RetrieveImageMosaicByAcqUID(acqID uint64, session DbSession) (*models.TemIm
 			tcm.target_num_rows,
 			acqf.ini_file_denorm_id,
 			acqf.uid, 
+			acqf.acq_state,
+			acqf.number_of_cameras,
 			acqf.sample_name,
 			acqf.project_name,
 			acqf.project_owner,
@@ -582,6 +621,8 @@ func RetrieveImageMosaicByAcqUID(acqID uint64, session DbSession) (*models.TemIm
 			&imageMosaic.NumRows,
 			&imageMosaic.IniFileID,
 			&imageMosaic.AcqUID,
+			&imageMosaic.AcqState,
+			&imageMosaic.NumberOfCameras,
 			&sampleName,
 			&projectName,
 			&projectOwner,
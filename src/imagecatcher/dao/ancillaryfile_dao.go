@@ -1,6 +1,8 @@
 package dao
 
 import (
+	"database/sql"
+
 	"imagecatcher/logger"
 	"imagecatcher/models"
 )
@@ -37,7 +39,7 @@ func CreateAncillaryFile(imageMosaic *models.TemImageMosaic, fname string, fileT
 	sqlQuery := `
 		select fo.file_object_fs_replica_id, fo.file_object_id
 		from ancillary_files af
-		join file_object_fs_replicas fo on fo.file_object_id = af.file_object_id
+		join file_object_fs_replicas fo on fo.file_object_id = af.file_object_id and fo.storage_name is null
 		where af.tem_camera_image_mosaic_id = ?
 		and fo.path = ?
 		and af.ancillary_file_type_id = ?
@@ -74,3 +76,47 @@ func CreateAncillaryFile(imageMosaic *models.TemImageMosaic, fname string, fileT
 	}
 	return &f, nil
 }
+
+// RetrieveAncillaryFiles retrieves the ancillary files of the acquisition together with their primary replica
+func RetrieveAncillaryFiles(acqID uint64, session DbSession) ([]*models.FileObject, error) {
+	sqlQuery := `
+		select
+			fo.file_object_id,
+			fr.file_object_fs_replica_id,
+			fr.path,
+			fr.jfs_path,
+			fr.jfs_key,
+			fr.location_url,
+			fo.checksum,
+			fo.checksum_algorithm
+		from ini_files_denorm acqf
+		join tem_camera_image_mosaics tm on tm.ini_file_denorm_id = acqf.ini_file_denorm_id
+		join ancillary_files af on af.tem_camera_image_mosaic_id = tm.tem_camera_image_mosaic_id
+		join file_objects fo on fo.file_object_id = af.file_object_id
+		join file_object_fs_replicas fr on fr.file_object_id = af.file_object_id and fr.storage_name is null
+		where acqf.uid = ?
+		order by fo.file_object_id
+	`
+	rows, err := session.selectQuery(sqlQuery, acqID)
+	defer closeRS(rows)
+	if err != nil {
+		return nil, err
+	}
+	var files []*models.FileObject
+	for rows.Next() {
+		var f models.FileObject
+		var path, jfsPath, jfsKey, locationURL, checksumAlgorithm sql.NullString
+		err = rows.Scan(&f.FileObjectID, &f.FileFSID, &path, &jfsPath, &jfsKey, &locationURL, &f.Checksum, &checksumAlgorithm)
+		if err != nil {
+			logger.Errorf("Error extracting data from ancillary_files result set: %s", err)
+			return nil, err
+		}
+		f.Path = path.String
+		f.JfsPath = jfsPath.String
+		f.JfsKey = jfsKey.String
+		f.LocationURL = locationURL.String
+		f.ChecksumAlgorithm = checksumAlgorithm.String
+		files = append(files, &f)
+	}
+	return files, nil
+}
@@ -15,6 +15,23 @@ import (
 
 const maxRows = 1000
 
+// nullableFloat64 returns nil for a NULL value
+func nullableFloat64(v sql.NullFloat64) *float64 {
+	if !v.Valid {
+		return nil
+	}
+	f := v.Float64
+	return &f
+}
+
+// nullFloat64 returns the SQL value of an optional float
+func nullFloat64(f *float64) sql.NullFloat64 {
+	if f == nil {
+		return sql.NullFloat64{}
+	}
+	return sql.NullFloat64{Float64: *f, Valid: true}
+}
+
 // NullableTime nullable SQL timestamp data type
 type NullableTime struct {
 	Time  time.Time
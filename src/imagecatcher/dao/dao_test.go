@@ -1,7 +1,11 @@
 package dao
 
 import (
+	"reflect"
+	"strings"
 	"testing"
+
+	"imagecatcher/models"
 )
 
 func TestScanningNullAndValidTimeValues(t *testing.T) {
@@ -27,3 +31,25 @@ func TestScanningNullAndValidTimeValues(t *testing.T) {
 		}
 	}
 }
+
+func TestMetricRangesCond(t *testing.T) {
+	min, max := 1.0, 2.0
+	cond, condArgs := metricRangesCond([]models.MetricRange{
+		{Metric: "Mean", Min: &min, Max: &max},
+		{Metric: "Unbounded"},
+		{Metric: "Std", Max: &max},
+	})
+	if !strings.Contains(cond, "(m.metric = ? and (m.value < ? or m.value > ?)) or (m.metric = ? and (m.value > ?))") {
+		t.Errorf("Unexpected metric ranges condition %s", cond)
+	}
+	if !strings.Contains(cond, "m.camera = mtc.tem_camera_number") {
+		t.Errorf("Expected the metric ranges condition to match the tile camera: %s", cond)
+	}
+	expectedArgs := []interface{}{"Mean", 1.0, 2.0, "Std", 2.0}
+	if !reflect.DeepEqual(condArgs, expectedArgs) {
+		t.Errorf("Expected condition arguments %v but got %v", expectedArgs, condArgs)
+	}
+	if cond, _ = metricRangesCond(nil); cond != "" {
+		t.Errorf("Expected no condition without metric ranges but got %s", cond)
+	}
+}
@@ -16,17 +16,19 @@ func UpdateFileObj(fileObj *models.FileObject, session DbSession) error {
 		location_url = ?,
 		file_exists_yn = ?
 		where file_object_id = ?
+		and storage_name is null
 	`
 	if _, err := update(session, updateFSQuery, fileObj.Path, fileObj.JfsPath, fileObj.JfsKey, fileObj.LocationURL, fileObj.JfsKey != "", fileObj.FileObjectID); err != nil {
 		return err
 	}
 	updateFOQuery := `
 		update file_objects set
-		sha1_checksum = ?,
+		checksum = ?,
+		checksum_algorithm = ?,
 		checksum_date = ?
 		where file_object_id = ?
 	`
-	_, err := update(session, updateFOQuery, fileObj.Checksum, time.Now(), fileObj.FileObjectID)
+	_, err := update(session, updateFOQuery, fileObj.Checksum, fileObj.ChecksumAlgorithm, time.Now(), fileObj.FileObjectID)
 	return err
 }
 
@@ -35,9 +37,9 @@ func insertFileObj(fileObj *models.FileObject, session DbSession) error {
 		fileObj.SetChecksumTimestamp(time.Now())
 	}
 	insertQuery := `
-		insert into file_objects (sha1_checksum, checksum_date, creation_date) values (?, ?, ?)
+		insert into file_objects (checksum, checksum_algorithm, checksum_date, creation_date) values (?, ?, ?, ?)
 	`
-	id, err := insert(session, insertQuery, fileObj.Checksum, fileObj.ChecksumTimestamp, time.Now())
+	id, err := insert(session, insertQuery, fileObj.Checksum, fileObj.ChecksumAlgorithm, fileObj.ChecksumTimestamp, time.Now())
 	fileObj.FileObjectID = id
 	return err
 }
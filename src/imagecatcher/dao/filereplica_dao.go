@@ -0,0 +1,307 @@
+package dao
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"imagecatcher/logger"
+	"imagecatcher/models"
+)
+
+// SaveFileReplica creates or updates the replica of a file object in the replica's store.
+// The primary replica of a file object is the one without a storage name and every other replica is derived from it.
+func SaveFileReplica(r *models.FileReplica, session DbSession) error {
+	if r.StorageName == "" {
+		return fmt.Errorf("The storage name of a file object replica must be set")
+	}
+	if r.DerivedFromReplicaID == 0 || r.ReplicaID == 0 {
+		replicaIDs, err := retrieveFileReplicaIDs(r.FileObjectID, r.StorageName, session)
+		if err != nil {
+			return err
+		}
+		if r.DerivedFromReplicaID == 0 {
+			r.DerivedFromReplicaID = replicaIDs[""]
+		}
+		if r.ReplicaID == 0 {
+			r.ReplicaID = replicaIDs[r.StorageName]
+		}
+	}
+	if r.DerivedFromReplicaID == 0 {
+		return fmt.Errorf("No primary replica found for file object %d", r.FileObjectID)
+	}
+	if r.VerificationStatus == models.ReplicaVerifiedStatus {
+		r.LastVerified = new(time.Time)
+		*r.LastVerified = time.Now()
+	}
+	if r.ReplicaID > 0 {
+		updateQuery := `
+			update file_object_fs_replicas set
+			jfs_path = ?,
+			jfs_key = ?,
+			location_url = ?,
+			derived_from_file_object_fs_replica_id = ?,
+			file_exists_yn = ?,
+			verification_status = ?,
+			last_verified = coalesce(?, last_verified)
+			where file_object_fs_replica_id = ?
+		`
+		_, err := update(session, updateQuery, r.JfsPath, r.JfsKey, r.LocationURL, r.DerivedFromReplicaID,
+			r.FileExists, r.VerificationStatus, r.LastVerified, r.ReplicaID)
+		return err
+	}
+	insertQuery := `
+		insert into file_object_fs_replicas
+		(jfs_path, jfs_key, location_url, file_object_id, derived_from_file_object_fs_replica_id,
+		 file_exists_yn, verification_status, last_verified, storage_name, replica_created_date)
+		values
+		(?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`
+	id, err := insert(session, insertQuery, r.JfsPath, r.JfsKey, r.LocationURL, r.FileObjectID, r.DerivedFromReplicaID,
+		r.FileExists, r.VerificationStatus, r.LastVerified, r.StorageName, time.Now())
+	r.ReplicaID = id
+	return err
+}
+
+// retrieveFileReplicaIDs returns the ids of the primary replica, mapped to the empty storage name,
+// and of the replica in the given store
+func retrieveFileReplicaIDs(fileObjectID int64, storageName string, session DbSession) (map[string]int64, error) {
+	sqlQuery := `
+		select file_object_fs_replica_id, coalesce(storage_name, '')
+		from file_object_fs_replicas
+		where file_object_id = ?
+		and (storage_name is null or storage_name = ?)
+	`
+	rows, err := session.selectQuery(sqlQuery, fileObjectID, storageName)
+	defer closeRS(rows)
+	if err != nil {
+		return nil, err
+	}
+	replicaIDs := map[string]int64{}
+	for rows.Next() {
+		var replicaID int64
+		var name string
+		if err = rows.Scan(&replicaID, &name); err != nil {
+			logger.Errorf("Error extracting data from file_object_fs_replicas result set: %s", err)
+			return nil, err
+		}
+		replicaIDs[name] = replicaID
+	}
+	return replicaIDs, nil
+}
+
+// RetrieveFileReplicasByPath returns the replicas, other than the primary replica, of the file stored at the given path
+func RetrieveFileReplicasByPath(path string, session DbSession) ([]*models.FileReplica, error) {
+	sqlQuery := `
+		select
+			file_object_fs_replica_id,
+			file_object_id,
+			derived_from_file_object_fs_replica_id,
+			storage_name,
+			jfs_path,
+			jfs_key,
+			location_url,
+			file_exists_yn,
+			verification_status,
+			last_verified
+		from file_object_fs_replicas
+		where jfs_path = ?
+		and storage_name is not null
+		order by file_object_fs_replica_id
+	`
+	rows, err := session.selectQuery(sqlQuery, path)
+	defer closeRS(rows)
+	if err != nil {
+		return nil, err
+	}
+	var replicas []*models.FileReplica
+	for rows.Next() {
+		var r models.FileReplica
+		var derivedFrom sql.NullInt64
+		var jfsKey, locationURL, status sql.NullString
+		var lastVerified NullableTime
+		err = rows.Scan(&r.ReplicaID, &r.FileObjectID, &derivedFrom, &r.StorageName, &r.JfsPath, &jfsKey, &locationURL,
+			&r.FileExists, &status, &lastVerified)
+		if err != nil {
+			logger.Errorf("Error extracting data from file_object_fs_replicas result set: %s", err)
+			return nil, err
+		}
+		r.DerivedFromReplicaID = derivedFrom.Int64
+		r.JfsKey = jfsKey.String
+		r.LocationURL = locationURL.String
+		r.VerificationStatus = status.String
+		if lastVerified.Valid {
+			r.LastVerified = &lastVerified.Time
+		}
+		replicas = append(replicas, &r)
+	}
+	return replicas, nil
+}
+
+// RetrieveReplicasToScrub returns up to limit stored tile and ancillary file replicas, ordered by their id,
+// that come after the given replica. The primary replicas have an empty storage name.
+func RetrieveReplicasToScrub(afterReplicaID int64, limit int, session DbSession) ([]*models.StoredReplica, error) {
+	sqlQuery := `
+		select
+			fr.file_object_fs_replica_id,
+			fr.file_object_id,
+			coalesce(fr.storage_name, ''),
+			coalesce(fr.jfs_path, ''),
+			fr.jfs_key,
+			fr.file_exists_yn,
+			fr.verification_status,
+			fr.last_verified,
+			fo.checksum,
+			fo.checksum_algorithm,
+			acqf.uid,
+			acqf.sample_name,
+			acqf.project_name,
+			acqf.project_owner,
+			acqf.stack_name
+		from file_object_fs_replicas fr
+		join file_objects fo on fo.file_object_id = fr.file_object_id
+		left outer join tem_camera_images ti on ti.file_object_id = fr.file_object_id
+		left outer join ancillary_files af on af.file_object_id = fr.file_object_id
+		join tem_camera_image_mosaics tm on tm.tem_camera_image_mosaic_id = coalesce(ti.tem_camera_image_mosaic_id, af.tem_camera_image_mosaic_id)
+		join ini_files_denorm acqf on tm.ini_file_denorm_id = acqf.ini_file_denorm_id
+		where fr.file_object_fs_replica_id > ?
+		and fr.jfs_key is not null and fr.jfs_key != ''
+		order by fr.file_object_fs_replica_id
+		limit ?
+	`
+	rows, err := session.selectQuery(sqlQuery, afterReplicaID, limit)
+	defer closeRS(rows)
+	if err != nil {
+		return nil, err
+	}
+	var replicas []*models.StoredReplica
+	for rows.Next() {
+		var r models.StoredReplica
+		var status, checksumAlgorithm sql.NullString
+		var sampleName, projectName, projectOwner, stackName sql.NullString
+		var lastVerified NullableTime
+		err = rows.Scan(&r.ReplicaID, &r.FileObjectID, &r.StorageName, &r.JfsPath, &r.JfsKey, &r.FileExists, &status, &lastVerified,
+			&r.Checksum, &checksumAlgorithm,
+			&r.Acquisition.AcqUID, &sampleName, &projectName, &projectOwner, &stackName)
+		if err != nil {
+			logger.Errorf("Error extracting data from file_object_fs_replicas result set: %s", err)
+			return nil, err
+		}
+		r.VerificationStatus = status.String
+		if lastVerified.Valid {
+			r.LastVerified = &lastVerified.Time
+		}
+		r.ChecksumAlgorithm = checksumAlgorithm.String
+		r.Acquisition.SampleName = sampleName.String
+		r.Acquisition.ProjectName = projectName.String
+		r.Acquisition.ProjectOwner = projectOwner.String
+		r.Acquisition.StackName = stackName.String
+		replicas = append(replicas, &r)
+	}
+	return replicas, nil
+}
+
+// UpdateReplicaVerification records the result of verifying a replica
+func UpdateReplicaVerification(replicaID int64, fileExists bool, status string, session DbSession) error {
+	updateQuery := `
+		update file_object_fs_replicas set
+		file_exists_yn = ?,
+		verification_status = ?,
+		last_verified = ?
+		where file_object_fs_replica_id = ?
+	`
+	_, err := update(session, updateQuery, fileExists, status, time.Now(), replicaID)
+	return err
+}
+
+// acqReplicasQuery selects the replicas of an acquisition's tiles and ancillary files
+const acqReplicasQuery = `
+	select fr.file_object_fs_replica_id, fr.file_object_id, coalesce(fr.storage_name, '') storage_name, fr.jfs_path,
+		fr.file_exists_yn, coalesce(fr.verification_status, '') verification_status, fr.last_verified
+	from ini_files_denorm acqf
+	join tem_camera_image_mosaics tm on tm.ini_file_denorm_id = acqf.ini_file_denorm_id
+	join tem_camera_images ti on ti.tem_camera_image_mosaic_id = tm.tem_camera_image_mosaic_id
+	join file_object_fs_replicas fr on fr.file_object_id = ti.file_object_id
+	where acqf.uid = ?
+	union all
+	select fr.file_object_fs_replica_id, fr.file_object_id, coalesce(fr.storage_name, '') storage_name, fr.jfs_path,
+		fr.file_exists_yn, coalesce(fr.verification_status, '') verification_status, fr.last_verified
+	from ini_files_denorm acqf
+	join tem_camera_image_mosaics tm on tm.ini_file_denorm_id = acqf.ini_file_denorm_id
+	join ancillary_files af on af.tem_camera_image_mosaic_id = tm.tem_camera_image_mosaic_id
+	join file_object_fs_replicas fr on fr.file_object_id = af.file_object_id
+	where acqf.uid = ?
+`
+
+// RetrieveReplicaStatusSummary counts the replicas of the acquisition's files by store and verification status
+func RetrieveReplicaStatusSummary(acqID uint64, session DbSession) ([]*models.ReplicaStatusSummary, error) {
+	sqlQuery := `
+		select acqr.storage_name, acqr.verification_status, count(1), min(acqr.last_verified), max(acqr.last_verified)
+		from (` + acqReplicasQuery + `) acqr
+		group by acqr.storage_name, acqr.verification_status
+		order by acqr.storage_name, acqr.verification_status
+	`
+	rows, err := session.selectQuery(sqlQuery, acqID, acqID)
+	defer closeRS(rows)
+	if err != nil {
+		return nil, err
+	}
+	var summary []*models.ReplicaStatusSummary
+	for rows.Next() {
+		var s models.ReplicaStatusSummary
+		var oldest, latest NullableTime
+		if err = rows.Scan(&s.StorageName, &s.VerificationStatus, &s.Files, &oldest, &latest); err != nil {
+			logger.Errorf("Error extracting data from the replica status result set: %s", err)
+			return nil, err
+		}
+		if oldest.Valid {
+			s.OldestVerification = &oldest.Time
+		}
+		if latest.Valid {
+			s.LatestVerification = &latest.Time
+		}
+		summary = append(summary, &s)
+	}
+	return summary, nil
+}
+
+// RetrieveAcqReplicasByStatus returns the replicas of the acquisition's files that have one of the given verification statuses
+func RetrieveAcqReplicasByStatus(acqID uint64, statuses []string, session DbSession) ([]*models.FileReplica, error) {
+	if len(statuses) == 0 {
+		return nil, nil
+	}
+	sqlQuery := `
+		select acqr.file_object_fs_replica_id, acqr.file_object_id, acqr.storage_name, acqr.jfs_path,
+			acqr.file_exists_yn, acqr.verification_status, acqr.last_verified
+		from (` + acqReplicasQuery + `) acqr
+		where acqr.verification_status in (?` + strings.Repeat(", ?", len(statuses)-1) + `)
+		order by acqr.file_object_fs_replica_id
+	`
+	args := []interface{}{acqID, acqID}
+	for _, status := range statuses {
+		args = append(args, status)
+	}
+	rows, err := session.selectQuery(sqlQuery, args...)
+	defer closeRS(rows)
+	if err != nil {
+		return nil, err
+	}
+	var replicas []*models.FileReplica
+	for rows.Next() {
+		var r models.FileReplica
+		var jfsPath sql.NullString
+		var lastVerified NullableTime
+		err = rows.Scan(&r.ReplicaID, &r.FileObjectID, &r.StorageName, &jfsPath, &r.FileExists, &r.VerificationStatus, &lastVerified)
+		if err != nil {
+			logger.Errorf("Error extracting data from the acquisition replicas result set: %s", err)
+			return nil, err
+		}
+		r.JfsPath = jfsPath.String
+		if lastVerified.Valid {
+			r.LastVerified = &lastVerified.Time
+		}
+		replicas = append(replicas, &r)
+	}
+	return replicas, nil
+}
@@ -0,0 +1,104 @@
+package dao
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"imagecatcher/logger"
+	"imagecatcher/models"
+)
+
+// SaveTileMipmap records a mipmap level of the tile stored in the given file object. The mipmap is a file object of its own
+// whose primary replica is derived from the primary replica of the tile; if the level already exists its file object is updated.
+func SaveTileMipmap(tileFileObjectID int64, level int, mipmap *models.FileObject, session DbSession) error {
+	replicaIDs, err := retrieveFileReplicaIDs(tileFileObjectID, "", session)
+	if err != nil {
+		return err
+	}
+	tileReplicaID := replicaIDs[""]
+	if tileReplicaID == 0 {
+		return fmt.Errorf("No primary replica found for tile file object %d", tileFileObjectID)
+	}
+	sqlQuery := `
+		select file_object_id, file_object_fs_replica_id
+		from file_object_fs_replicas
+		where derived_from_file_object_fs_replica_id = ?
+		and mipmap_level = ?
+		and storage_name is null
+	`
+	rows, err := session.selectQuery(sqlQuery, tileReplicaID, level)
+	defer closeRS(rows)
+	if err != nil {
+		return err
+	}
+	if rows.Next() {
+		if err = rows.Scan(&mipmap.FileObjectID, &mipmap.FileFSID); err != nil {
+			logger.Errorf("Error extracting data from file_object_fs_replicas result set: %s", err)
+			return err
+		}
+	}
+	closeRS(rows)
+	if mipmap.FileObjectID == 0 {
+		if err = insertFileObj(mipmap, session); err != nil {
+			return err
+		}
+		if err = insertFileFS(mipmap, session); err != nil {
+			return err
+		}
+		updateQuery := `
+			update file_object_fs_replicas set
+			derived_from_file_object_fs_replica_id = ?,
+			mipmap_level = ?
+			where file_object_fs_replica_id = ?
+		`
+		if _, err = update(session, updateQuery, tileReplicaID, level, mipmap.FileFSID); err != nil {
+			return err
+		}
+	}
+	return UpdateFileObj(mipmap, session)
+}
+
+// RetrieveTileMipmaps sets the stored mipmap levels of the given tile specs
+func RetrieveTileMipmaps(tileSpecs []*models.TileSpec, session DbSession) error {
+	if len(tileSpecs) == 0 {
+		return nil
+	}
+	tileSpecsByImageID := make(map[int64]*models.TileSpec, len(tileSpecs))
+	args := make([]interface{}, 0, len(tileSpecs))
+	for _, ts := range tileSpecs {
+		tileSpecsByImageID[ts.TileImageID] = ts
+		args = append(args, ts.TileImageID)
+	}
+	sqlQuery := `
+		select ti.tem_camera_image_id, mf.mipmap_level, mf.jfs_path, mf.location_url
+		from tem_camera_images ti
+		join file_object_fs_replicas tf on tf.file_object_id = ti.file_object_id and tf.storage_name is null
+		join file_object_fs_replicas mf on mf.derived_from_file_object_fs_replica_id = tf.file_object_fs_replica_id
+		where ti.tem_camera_image_id in (?` + strings.Repeat(", ?", len(args)-1) + `)
+		and mf.mipmap_level is not null
+		and mf.storage_name is null
+		and mf.file_exists_yn = 1
+		order by ti.tem_camera_image_id, mf.mipmap_level
+	`
+	rows, err := session.selectQuery(sqlQuery, args...)
+	defer closeRS(rows)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var tileImageID int64
+		var mipmap models.TileMipmap
+		var jfsPath, locationURL sql.NullString
+		if err = rows.Scan(&tileImageID, &mipmap.Level, &jfsPath, &locationURL); err != nil {
+			logger.Errorf("Error extracting data from the tile mipmaps result set: %s", err)
+			return err
+		}
+		mipmap.JFSPath = jfsPath.String
+		mipmap.ImageURL = locationURL.String
+		if ts := tileSpecsByImageID[tileImageID]; ts != nil {
+			ts.Mipmaps = append(ts.Mipmaps, mipmap)
+		}
+	}
+	return nil
+}
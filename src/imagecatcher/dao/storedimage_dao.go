@@ -0,0 +1,139 @@
+package dao
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"imagecatcher/models"
+)
+
+// RetrieveAcqTileFiles retrieves all tiles and frames of the acquisition, each only once, with the primary replica of their content.
+// The tiles that only have been created from the ROI tiles file are not included.
+func RetrieveAcqTileFiles(acqID uint64, session DbSession) ([]*models.TemImage, error) {
+	sqlQuery := `
+		select
+			ti.tem_camera_image_id,
+			ti.mosaic_col,
+			ti.mosaic_row,
+			ti.frame_number,
+			tc.tem_camera_number,
+			fr.path,
+			fr.jfs_path,
+			fr.jfs_key,
+			fo.checksum,
+			fo.checksum_algorithm
+		from tem_camera_images ti
+		join tem_camera_image_mosaics tm on tm.tem_camera_image_mosaic_id = ti.tem_camera_image_mosaic_id
+		join ini_files_denorm acqf on tm.ini_file_denorm_id = acqf.ini_file_denorm_id
+		left outer join file_objects fo on fo.file_object_id = ti.file_object_id
+		left outer join file_object_fs_replicas fr on fr.file_object_id = ti.file_object_id and fr.storage_name is null
+		left outer join tem_camera_configurations tc on tc.tem_camera_configuration_id = ti.tem_camera_configuration_id
+		where acqf.uid = ?
+		and (ti.tem_camera_configuration_id is not null or ti.acquired_timestamp is not null)
+		order by ti.tem_camera_image_id
+	`
+	rows, err := session.selectQuery(sqlQuery, acqID)
+	defer closeRS(rows)
+	if err != nil {
+		return nil, err
+	}
+	var tiles []*models.TemImage
+	for rows.Next() {
+		var (
+			camera                                   sql.NullInt64
+			path, jfsPath, jfsKey, checksumAlgorithm sql.NullString
+		)
+		tile := &models.TemImage{}
+		if err = rows.Scan(&tile.ImageID, &tile.Col, &tile.Row, &tile.Frame, &camera,
+			&path, &jfsPath, &jfsKey, &tile.TileFile.Checksum, &checksumAlgorithm); err != nil {
+			return tiles, fmt.Errorf("Error extracting data from tile files result set for %d: %v", acqID, err)
+		}
+		if camera.Valid {
+			tile.Configuration = &models.TemCameraConfiguration{Camera: int(camera.Int64)}
+		}
+		tile.TileFile.Path = path.String
+		tile.TileFile.JfsPath = jfsPath.String
+		tile.TileFile.JfsKey = jfsKey.String
+		tile.TileFile.ChecksumAlgorithm = checksumAlgorithm.String
+		tiles = append(tiles, tile)
+	}
+	return tiles, nil
+}
+
+// ReplaceStoredImageDiscrepancies replaces the discrepancies recorded for the mosaic with the given ones
+func ReplaceStoredImageDiscrepancies(imageMosaic *models.TemImageMosaic, discrepancies []*models.StoredImageDiscrepancy, session DbSession) error {
+	deleteQuery := `
+		delete from stored_image_discrepancies where tem_camera_image_mosaic_id = ?
+	`
+	if _, err := update(session, deleteQuery, imageMosaic.ImageMosaicID); err != nil {
+		return fmt.Errorf("Error deleting the stored image discrepancies of %v: %v", imageMosaic, err)
+	}
+	insertQuery := `
+		insert into stored_image_discrepancies
+		(tem_camera_image_mosaic_id, tem_camera_image_id, mosaic_col, mosaic_row, camera, frame_number, image_name, discrepancy, details, found_date)
+		values
+		(?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`
+	for _, d := range discrepancies {
+		imageID := sql.NullInt64{Int64: d.ImageID, Valid: d.ImageID > 0}
+		imageName := sql.NullString{String: d.Name, Valid: d.Name != ""}
+		details := sql.NullString{String: d.Details, Valid: d.Details != ""}
+		if d.Found.IsZero() {
+			d.Found = time.Now()
+		}
+		discrepancyID, err := insert(session, insertQuery, imageMosaic.ImageMosaicID, imageID, d.Col, d.Row, d.Camera, d.Frame,
+			imageName, d.Discrepancy, details, d.Found)
+		if err != nil {
+			return fmt.Errorf("Error inserting the stored image discrepancy %v of %v: %v", d, imageMosaic, err)
+		}
+		d.DiscrepancyID = discrepancyID
+	}
+	return nil
+}
+
+// RetrieveStoredImageDiscrepancies retrieves the discrepancies recorded for the acquisition
+func RetrieveStoredImageDiscrepancies(acqID uint64, session DbSession) ([]*models.StoredImageDiscrepancy, error) {
+	sqlQuery := `
+		select
+			d.stored_image_discrepancy_id,
+			d.tem_camera_image_id,
+			d.mosaic_col,
+			d.mosaic_row,
+			d.camera,
+			d.frame_number,
+			d.image_name,
+			d.discrepancy,
+			d.details,
+			d.found_date
+		from stored_image_discrepancies d
+		join tem_camera_image_mosaics tm on tm.tem_camera_image_mosaic_id = d.tem_camera_image_mosaic_id
+		join ini_files_denorm acqf on tm.ini_file_denorm_id = acqf.ini_file_denorm_id
+		where acqf.uid = ?
+		order by d.stored_image_discrepancy_id
+	`
+	rows, err := session.selectQuery(sqlQuery, acqID)
+	defer closeRS(rows)
+	if err != nil {
+		return nil, err
+	}
+	var discrepancies []*models.StoredImageDiscrepancy
+	for rows.Next() {
+		var (
+			imageID            sql.NullInt64
+			imageName, details sql.NullString
+			found              NullableTime
+		)
+		d := &models.StoredImageDiscrepancy{}
+		if err = rows.Scan(&d.DiscrepancyID, &imageID, &d.Col, &d.Row, &d.Camera, &d.Frame,
+			&imageName, &d.Discrepancy, &details, &found); err != nil {
+			return discrepancies, fmt.Errorf("Error extracting data from stored image discrepancies result set for %d: %v", acqID, err)
+		}
+		d.ImageID = imageID.Int64
+		d.Name = imageName.String
+		d.Details = details.String
+		d.Found = found.Time
+		discrepancies = append(discrepancies, d)
+	}
+	return discrepancies, nil
+}
@@ -25,8 +25,11 @@ func RetrieveTemImage(tileID int64, session DbSession) (*models.TemImageROI, err
 			ti.mosaic_col,
 			ti.mosaic_row,
 			ti.acquired_timestamp,
+			ti.u8HistOffset,
+			ti.u8HistScale,
 			tc.tem_camera_number,
-			fo.sha1_checksum,
+			fo.checksum,
+			fo.checksum_algorithm,
 			fr.jfs_path,
 			fr.jfs_key,
 			fr.location_url,
@@ -46,7 +49,7 @@ func RetrieveTemImage(tileID int64, session DbSession) (*models.TemImageROI, err
 		join tem_camera_image_mosaics tm on tm.tem_camera_image_mosaic_id = ti.tem_camera_image_mosaic_id
 		join ini_files_denorm acqf on tm.ini_file_denorm_id = acqf.ini_file_denorm_id
 		join file_objects fo on fo.file_object_id = ti.file_object_id
-		join file_object_fs_replicas fr on fr.file_object_id = ti.file_object_id
+		join file_object_fs_replicas fr on fr.file_object_id = ti.file_object_id and fr.storage_name is null
 		left outer join roi_images troi on troi.tem_camera_image_id = ti.tem_camera_image_id
 		left outer join image_mosaic_rois mroi on mroi.image_mosaic_roi_id = troi.image_mosaic_roi_id and mroi.tem_camera_image_mosaic_id = tm.tem_camera_image_mosaic_id
 		left outer join acq_time_rois roi on roi.image_mosaic_roi_id = mroi.image_mosaic_roi_id
@@ -62,7 +65,9 @@ func RetrieveTemImage(tileID int64, session DbSession) (*models.TemImageROI, err
 		temImage := &models.TemImageROI{}
 		var cameraConfigurationID, cameraNumber sql.NullInt64
 		var mosaicAcquiredTimestamp, mosaicCompletedTimestamp, tileAcquiredTimestamp NullableTime
+		var u8HistOffset, u8HistScale sql.NullFloat64
 		var jfsPath, jfsKey, tileFileURL sql.NullString
+		var checksumAlgorithm sql.NullString
 		var sampleName, projectName, projectOwner sql.NullString
 		var stackName, mosaicType sql.NullString
 		var tileState sql.NullString
@@ -75,8 +80,11 @@ func RetrieveTemImage(tileID int64, session DbSession) (*models.TemImageROI, err
 			&temImage.Col,
 			&temImage.Row,
 			&tileAcquiredTimestamp,
+			&u8HistOffset,
+			&u8HistScale,
 			&cameraNumber,
 			&temImage.TileFile.Checksum,
+			&checksumAlgorithm,
 			&jfsPath,
 			&jfsKey,
 			&tileFileURL,
@@ -109,6 +117,9 @@ func RetrieveTemImage(tileID int64, session DbSession) (*models.TemImageROI, err
 		if tileAcquiredTimestamp.Valid {
 			temImage.SetAcquiredTimestamp(tileAcquiredTimestamp.Time)
 		}
+		temImage.U8HistOffset = nullableFloat64(u8HistOffset)
+		temImage.U8HistScale = nullableFloat64(u8HistScale)
+		temImage.TileFile.ChecksumAlgorithm = checksumAlgorithm.String
 		if jfsKey.Valid {
 			temImage.TileFile.JfsKey = jfsKey.String
 			temImage.TileFile.JfsPath = jfsPath.String
@@ -155,8 +166,11 @@ func RetrieveTemImages(tileFilter *models.TileFilter, session DbSession) ([]*mod
 			ti.mosaic_col,
 			ti.mosaic_row,
 			ti.acquired_timestamp,
+			ti.u8HistOffset,
+			ti.u8HistScale,
 			tc.tem_camera_number,
-			fo.sha1_checksum,
+			fo.checksum,
+			fo.checksum_algorithm,
 			fr.jfs_path,
 			fr.jfs_key,
 			fr.location_url,
@@ -176,7 +190,7 @@ func RetrieveTemImages(tileFilter *models.TileFilter, session DbSession) ([]*mod
 		join tem_camera_image_mosaics tm on tm.tem_camera_image_mosaic_id = ti.tem_camera_image_mosaic_id
 		join ini_files_denorm acqf on tm.ini_file_denorm_id = acqf.ini_file_denorm_id
 		join file_objects fo on fo.file_object_id = ti.file_object_id
-		join file_object_fs_replicas fr on fr.file_object_id = ti.file_object_id
+		join file_object_fs_replicas fr on fr.file_object_id = ti.file_object_id and fr.storage_name is null
 		left outer join roi_images troi on troi.tem_camera_image_id = ti.tem_camera_image_id
 		left outer join image_mosaic_rois mroi on mroi.image_mosaic_roi_id = troi.image_mosaic_roi_id and mroi.tem_camera_image_mosaic_id = tm.tem_camera_image_mosaic_id
 		left outer join acq_time_rois roi on roi.image_mosaic_roi_id = mroi.image_mosaic_roi_id
@@ -286,7 +300,9 @@ func RetrieveTemImages(tileFilter *models.TileFilter, session DbSession) ([]*mod
 			queryArgs,
 			nextClause)
 	}
-	sqlQueryBuffer.WriteString("order by ti.acquired_timestamp ")
+	queryArgs, nextClause = addMetricRangesCond(&sqlQueryBuffer, tileFilter.MetricRanges, queryArgs, nextClause)
+	// the tile id breaks the ties between the timestamps so that the pages do not skip or repeat tiles
+	sqlQueryBuffer.WriteString("order by ti.acquired_timestamp, ti.tem_camera_image_id ")
 	if tileFilter.Pagination.StartRecordIndex > 0 || tileFilter.Pagination.NRecords > 0 {
 		var offset int64
 		var length int32 = maxRows
@@ -312,8 +328,10 @@ func RetrieveTemImages(tileFilter *models.TileFilter, session DbSession) ([]*mod
 
 	var rsExtractErr error
 	var mosaicAcquiredTimestamp, mosaicCompletedTimestamp, tileAcquiredTimestamp NullableTime
+	var u8HistOffset, u8HistScale sql.NullFloat64
 	var cameraConfigurationID, cameraNumber sql.NullInt64
 	var jfsPath, jfsKey, tileFileURL sql.NullString
+	var checksumAlgorithm sql.NullString
 	var sampleName, projectName, projectOwner sql.NullString
 	var stackName, mosaicType sql.NullString
 	var tileState sql.NullString
@@ -328,8 +346,11 @@ func RetrieveTemImages(tileFilter *models.TileFilter, session DbSession) ([]*mod
 			&temImage.Col,
 			&temImage.Row,
 			&tileAcquiredTimestamp,
+			&u8HistOffset,
+			&u8HistScale,
 			&cameraNumber,
 			&temImage.TileFile.Checksum,
+			&checksumAlgorithm,
 			&jfsPath,
 			&jfsKey,
 			&tileFileURL,
@@ -364,6 +385,9 @@ func RetrieveTemImages(tileFilter *models.TileFilter, session DbSession) ([]*mod
 		if tileAcquiredTimestamp.Valid {
 			temImage.SetAcquiredTimestamp(tileAcquiredTimestamp.Time)
 		}
+		temImage.U8HistOffset = nullableFloat64(u8HistOffset)
+		temImage.U8HistScale = nullableFloat64(u8HistScale)
+		temImage.TileFile.ChecksumAlgorithm = checksumAlgorithm.String
 		if jfsKey.Valid {
 			temImage.TileFile.JfsKey = jfsKey.String
 			temImage.TileFile.JfsPath = jfsPath.String
@@ -395,6 +419,60 @@ func RetrieveTemImages(tileFilter *models.TileFilter, session DbSession) ([]*mod
 	return temImages, rsExtractErr
 }
 
+// RetrieveTileCoverage retrieves all stable tile records of the acquisition together with their sections and content keys.
+// A tile that belongs to more than one section is returned once for every section.
+func RetrieveTileCoverage(acqID uint64, session DbSession) ([]*models.TileCoverage, error) {
+	sqlQuery := `
+		select
+			ti.mosaic_col,
+			ti.mosaic_row,
+			tc.tem_camera_number,
+			roi.nominal_section_number,
+			ti.tem_camera_configuration_id is not null or ti.acquired_timestamp is not null,
+			fr.jfs_key
+		from tem_camera_images ti
+		join tem_camera_image_mosaics tm on tm.tem_camera_image_mosaic_id = ti.tem_camera_image_mosaic_id
+		join ini_files_denorm acqf on tm.ini_file_denorm_id = acqf.ini_file_denorm_id
+		left outer join file_object_fs_replicas fr on fr.file_object_id = ti.file_object_id and fr.storage_name is null
+		left outer join roi_images troi on troi.tem_camera_image_id = ti.tem_camera_image_id
+		left outer join image_mosaic_rois mroi on mroi.image_mosaic_roi_id = troi.image_mosaic_roi_id and mroi.tem_camera_image_mosaic_id = tm.tem_camera_image_mosaic_id
+		left outer join acq_time_rois roi on roi.image_mosaic_roi_id = mroi.image_mosaic_roi_id
+		left outer join tem_camera_configurations tc on tc.tem_camera_configuration_id = ti.tem_camera_configuration_id
+		where acqf.uid = ?
+		and ti.frame_number = -1
+		order by roi.nominal_section_number, ti.mosaic_col, ti.mosaic_row
+	`
+	rows, err := session.selectQuery(sqlQuery, acqID)
+	defer closeRS(rows)
+	if err != nil {
+		return nil, err
+	}
+	var tiles []*models.TileCoverage
+	for rows.Next() {
+		var (
+			camera, nominalSection sql.NullInt64
+			jfsKey                 sql.NullString
+		)
+		tile := &models.TileCoverage{}
+		if err = rows.Scan(&tile.Col, &tile.Row, &camera, &nominalSection, &tile.Received, &jfsKey); err != nil {
+			return tiles, fmt.Errorf("Error extracting data from tile coverage result set for %d: %v", acqID, err)
+		}
+		tile.Camera = -1
+		if camera.Valid {
+			tile.Camera = int(camera.Int64)
+		}
+		tile.NominalSection = -1
+		if nominalSection.Valid {
+			tile.NominalSection = nominalSection.Int64
+		}
+		if jfsKey.Valid {
+			tile.JfsKey = jfsKey.String
+		}
+		tiles = append(tiles, tile)
+	}
+	return tiles, nil
+}
+
 // CountTilesByStatus retrieves the number of tiles by acquisition/section/state as
 // a map of counts indexed by acquisition id, section number and tile state.
 // If the 'includeDrifts' flag is set to true it includes
@@ -413,7 +491,7 @@ func CountTilesByStatus(filter *models.TileFilter, session DbSession) (map[uint6
 			count(1)
 		from tem_camera_images ti
 		join tem_camera_configurations tc on tc.tem_camera_configuration_id = ti.tem_camera_configuration_id
-		join file_object_fs_replicas tf on tf.file_object_id = ti.file_object_id
+		join file_object_fs_replicas tf on tf.file_object_id = ti.file_object_id and tf.storage_name is null
 		join tem_camera_image_mosaics tm on tm.tem_camera_image_mosaic_id = ti.tem_camera_image_mosaic_id
 		join ini_files_denorm acqf on tm.ini_file_denorm_id = acqf.ini_file_denorm_id
 		join roi_images troi on troi.tem_camera_image_id = ti.tem_camera_image_id
@@ -495,6 +573,7 @@ func CountTilesByStatus(filter *models.TileFilter, session DbSession) (map[uint6
 		"ti.tem_camera_configuration_id is not NULL",
 		queryArgs,
 		nextClause)
+	queryArgs, nextClause = addMetricRangesCond(&sqlQueryBuffer, filter.MetricRanges, queryArgs, nextClause)
 	sqlQueryBuffer.WriteString(`
 		group by
 			acqf.uid,
@@ -641,6 +720,8 @@ func retrieveUpdatedTilesUsingTx(txHash string, session DbSession) ([]*models.Ti
 			ti.mosaic_col,
 			ti.mosaic_row,
 			ti.frame_number,
+			ti.u8HistOffset,
+			ti.u8HistScale,
 			troi.roi_image_id,
 			troi.current_state,
 			tc.tem_camera_number,
@@ -655,7 +736,7 @@ func retrieveUpdatedTilesUsingTx(txHash string, session DbSession) ([]*models.Ti
 			tf.location_url
 		from tem_camera_images ti
 		join tem_camera_configurations tc on tc.tem_camera_configuration_id = ti.tem_camera_configuration_id
-		join file_object_fs_replicas tf on tf.file_object_id = ti.file_object_id
+		join file_object_fs_replicas tf on tf.file_object_id = ti.file_object_id and tf.storage_name is null
 		join tem_camera_image_mosaics tm on tm.tem_camera_image_mosaic_id = ti.tem_camera_image_mosaic_id
 		join ini_files_denorm acqf on tm.ini_file_denorm_id = acqf.ini_file_denorm_id
 		join roi_images troi on troi.tem_camera_image_id = ti.tem_camera_image_id
@@ -685,6 +766,7 @@ func retrieveUpdatedTilesUsingTx(txHash string, session DbSession) ([]*models.Ti
 		sampleName, projectName, projectOwner sql.NullString
 		stackName, mosaicType                 sql.NullString
 		maskURL, transformationRef            sql.NullString
+		u8HistOffset, u8HistScale             sql.NullFloat64
 	)
 	for rows.Next() {
 		tileSpec := &models.TileSpec{}
@@ -711,6 +793,8 @@ func retrieveUpdatedTilesUsingTx(txHash string, session DbSession) ([]*models.Ti
 			&tileSpec.Col,
 			&tileSpec.Row,
 			&tileSpec.Frame,
+			&u8HistOffset,
+			&u8HistScale,
 			&tileSpec.RoiImageID,
 			&tileSpec.State,
 			&tileSpec.CameraConfig.Camera,
@@ -751,6 +835,8 @@ func retrieveUpdatedTilesUsingTx(txHash string, session DbSession) ([]*models.Ti
 			tileSpec.CameraConfig.TransformationRef = transformationRef.String
 		}
 		tileSpec.Acquired = acquired.Time
+		tileSpec.U8HistOffset = nullableFloat64(u8HistOffset)
+		tileSpec.U8HistScale = nullableFloat64(u8HistScale)
 		tileSpecImages = append(tileSpecImages, tileSpec)
 	}
 	return tileSpecImages, rsExtractErr
@@ -775,7 +861,7 @@ func updateTilesStatusUsingTx(filter *models.TileFilter, newState, txHash string
 		join ini_files_denorm acqf on tm.ini_file_denorm_id = acqf.ini_file_denorm_id
 		join tem_camera_images ti on troi.tem_camera_image_id = ti.tem_camera_image_id
 		join tem_camera_configurations tc on tc.tem_camera_configuration_id = ti.tem_camera_configuration_id
-		join file_object_fs_replicas tf on tf.file_object_id = ti.file_object_id
+		join file_object_fs_replicas tf on tf.file_object_id = ti.file_object_id and tf.storage_name is null
 		where troi.current_state = ?
 	`)
 	queryArgs = append(queryArgs, filter.State)
@@ -870,6 +956,7 @@ func updateTilesStatusUsingTx(filter *models.TileFilter, newState, txHash string
 		"tf.jfs_key is not NULL and tf.jfs_key != ''",
 		queryArgs,
 		nextClause)
+	queryArgs, nextClause = addMetricRangesCond(&sqlQueryBuffer, filter.MetricRanges, queryArgs, nextClause)
 	sqlQueryBuffer.WriteString(`
 		order by
 			acqf.when_acquired,
@@ -986,14 +1073,20 @@ func UpdateTemImageCamera(temImage *models.TemImage, session DbSession) error {
 	return err
 }
 
-// UpdateTemImage updates tile image metadata - currently it only updates the acquired timestamp.
+// UpdateTemImage updates tile image metadata - the acquired timestamp and the histogram parameters if they are set.
 func UpdateTemImage(temImage *models.TemImage, session DbSession) error {
 	updateQuery := `
 		update tem_camera_images set
-		acquired_timestamp = ?
+		acquired_timestamp = ?,
+		u8HistOffset = coalesce(?, u8HistOffset),
+		u8HistScale = coalesce(?, u8HistScale)
 		where tem_camera_image_id = ?
 	`
-	_, err := update(session, updateQuery, temImage.AcquiredTimestamp, temImage.ImageID)
+	_, err := update(session, updateQuery,
+		temImage.AcquiredTimestamp,
+		nullFloat64(temImage.U8HistOffset),
+		nullFloat64(temImage.U8HistScale),
+		temImage.ImageID)
 	return err
 }
 
@@ -0,0 +1,115 @@
+package dao
+
+import (
+	"bytes"
+	"fmt"
+
+	"imagecatcher/models"
+)
+
+// ReplaceTileMetrics replaces the metrics of the mosaic tiles acquired by the given camera or by all cameras if the camera is negative,
+// and it sets the u8HistOffset and u8HistScale of the received tiles of the same camera from the metrics with the same name
+func ReplaceTileMetrics(imageMosaic *models.TemImageMosaic, camera int, metrics []models.TileMetric, session DbSession) error {
+	var deleteQueryBuffer bytes.Buffer
+	deleteArgs := make([]interface{}, 0, 2)
+	deleteQueryBuffer.WriteString(`
+		delete from tile_metrics where tem_camera_image_mosaic_id = ?
+	`)
+	deleteArgs = append(deleteArgs, imageMosaic.ImageMosaicID)
+	deleteArgs, _ = addFlagQueryCond(&deleteQueryBuffer,
+		camera >= 0,
+		camera,
+		"camera = ?",
+		deleteArgs,
+		"and ")
+	if _, err := update(session, deleteQueryBuffer.String(), deleteArgs...); err != nil {
+		return fmt.Errorf("Error deleting the tile metrics of %v: %v", imageMosaic, err)
+	}
+	insertQuery := `
+		insert into tile_metrics
+		(tem_camera_image_mosaic_id, mosaic_col, mosaic_row, frame_number, camera, metric, value)
+		values
+	`
+	err := insertRows(session, insertQuery, "(?, ?, ?, ?, ?, ?, ?)", len(metrics), func(i int) []interface{} {
+		m := metrics[i]
+		return []interface{}{imageMosaic.ImageMosaicID, m.Col, m.Row, m.Frame, m.Camera, m.Metric, m.Value}
+	})
+	if err != nil {
+		return fmt.Errorf("Error inserting the tile metrics of %v: %v", imageMosaic, err)
+	}
+	for _, histColumn := range []string{models.U8HistOffsetMetric, models.U8HistScaleMetric} {
+		var updateQueryBuffer bytes.Buffer
+		updateArgs := []interface{}{histColumn, imageMosaic.ImageMosaicID}
+		updateQueryBuffer.WriteString(fmt.Sprintf(`
+			update tem_camera_images ti
+			join tem_camera_configurations tc on tc.tem_camera_configuration_id = ti.tem_camera_configuration_id
+			join tile_metrics m on m.tem_camera_image_mosaic_id = ti.tem_camera_image_mosaic_id
+				and m.mosaic_col = ti.mosaic_col
+				and m.mosaic_row = ti.mosaic_row
+				and m.frame_number = ti.frame_number
+				and m.camera = tc.tem_camera_number
+				and m.metric = ?
+			set ti.%s = m.value
+			where ti.tem_camera_image_mosaic_id = ?
+		`, histColumn))
+		updateArgs, _ = addFlagQueryCond(&updateQueryBuffer,
+			camera >= 0,
+			camera,
+			"tc.tem_camera_number = ?",
+			updateArgs,
+			"and ")
+		if _, err = update(session, updateQueryBuffer.String(), updateArgs...); err != nil {
+			return fmt.Errorf("Error updating the %s of the tiles of %v: %v", histColumn, imageMosaic, err)
+		}
+	}
+	return nil
+}
+
+// metricRangesCond returns the condition that excludes the tiles with a metric outside of its range
+// and the query arguments of the condition; the tiles without metrics are not excluded.
+func metricRangesCond(ranges []models.MetricRange) (string, []interface{}) {
+	var condBuffer bytes.Buffer
+	var condArgs []interface{}
+	condBuffer.WriteString(`not exists (
+		select 1 from tile_metrics m
+		join tem_camera_configurations mtc on mtc.tem_camera_configuration_id = ti.tem_camera_configuration_id
+		where m.tem_camera_image_mosaic_id = ti.tem_camera_image_mosaic_id
+		and m.mosaic_col = ti.mosaic_col
+		and m.mosaic_row = ti.mosaic_row
+		and m.frame_number = ti.frame_number
+		and m.camera = mtc.tem_camera_number
+		and (`)
+	nextClause := ""
+	for _, r := range ranges {
+		if r.Min == nil && r.Max == nil {
+			continue
+		}
+		condBuffer.WriteString(nextClause)
+		condBuffer.WriteString("(m.metric = ? and (")
+		condArgs = append(condArgs, r.Metric)
+		switch {
+		case r.Min != nil && r.Max != nil:
+			condBuffer.WriteString("m.value < ? or m.value > ?")
+			condArgs = append(condArgs, *r.Min, *r.Max)
+		case r.Min != nil:
+			condBuffer.WriteString("m.value < ?")
+			condArgs = append(condArgs, *r.Min)
+		default:
+			condBuffer.WriteString("m.value > ?")
+			condArgs = append(condArgs, *r.Max)
+		}
+		condBuffer.WriteString("))")
+		nextClause = " or "
+	}
+	if len(condArgs) == 0 {
+		return "", nil
+	}
+	condBuffer.WriteString("))")
+	return condBuffer.String(), condArgs
+}
+
+// addMetricRangesCond adds the metric ranges condition to the query
+func addMetricRangesCond(queryBuffer *bytes.Buffer, ranges []models.MetricRange, queryArgs []interface{}, clause string) ([]interface{}, string) {
+	cond, condArgs := metricRangesCond(ranges)
+	return addFlagQueryCond(queryBuffer, cond != "", condArgs, cond, queryArgs, clause)
+}
@@ -0,0 +1,235 @@
+package dao
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"imagecatcher/models"
+)
+
+// insertBatchSize is the maximum number of rows inserted with a single statement
+const insertBatchSize = 500
+
+// insertRows inserts nRows rows using multi-row insert statements; rowArgs returns the values of the i-th row
+func insertRows(session DbSession, insertQuery, rowPlaceholders string, nRows int, rowArgs func(i int) []interface{}) error {
+	for start := 0; start < nRows; start += insertBatchSize {
+		end := start + insertBatchSize
+		if end > nRows {
+			end = nRows
+		}
+		var queryArgs []interface{}
+		for i := start; i < end; i++ {
+			queryArgs = append(queryArgs, rowArgs(i)...)
+		}
+		batchQuery := insertQuery + strings.TrimSuffix(strings.Repeat(rowPlaceholders+",", end-start), ",")
+		if _, err := session.execQuery(batchQuery, queryArgs...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReplaceTimingSteps replaces the tile positions recorded for the acquisition steps of the mosaic
+func ReplaceTimingSteps(imageMosaic *models.TemImageMosaic, steps []models.TimingStep, session DbSession) error {
+	deleteQuery := `
+		delete from acq_timing_steps where tem_camera_image_mosaic_id = ?
+	`
+	if _, err := update(session, deleteQuery, imageMosaic.ImageMosaicID); err != nil {
+		return fmt.Errorf("Error deleting the timing steps of %v: %v", imageMosaic, err)
+	}
+	insertQuery := `
+		insert into acq_timing_steps
+		(tem_camera_image_mosaic_id, step, camera, mosaic_col, mosaic_row, frame_number)
+		values
+	`
+	err := insertRows(session, insertQuery, "(?, ?, ?, ?, ?, ?)", len(steps), func(i int) []interface{} {
+		s := steps[i]
+		return []interface{}{imageMosaic.ImageMosaicID, s.Step, s.Camera, s.Col, s.Row, s.Frame}
+	})
+	if err != nil {
+		return fmt.Errorf("Error inserting the timing steps of %v: %v", imageMosaic, err)
+	}
+	return nil
+}
+
+// ReplaceTimingValues replaces the values recorded for the mosaic from the given timing file type
+func ReplaceTimingValues(imageMosaic *models.TemImageMosaic, source string, values []models.TimingValue, session DbSession) error {
+	deleteQuery := `
+		delete from acq_timing_values where tem_camera_image_mosaic_id = ? and source = ?
+	`
+	if _, err := update(session, deleteQuery, imageMosaic.ImageMosaicID, source); err != nil {
+		return fmt.Errorf("Error deleting the %s values of %v: %v", source, imageMosaic, err)
+	}
+	insertQuery := `
+		insert into acq_timing_values
+		(tem_camera_image_mosaic_id, source, step, camera, measure, value, text_value)
+		values
+	`
+	err := insertRows(session, insertQuery, "(?, ?, ?, ?, ?, ?, ?)", len(values), func(i int) []interface{} {
+		v := values[i]
+		var value sql.NullFloat64
+		if v.Value != nil {
+			value = sql.NullFloat64{Float64: *v.Value, Valid: true}
+		}
+		textValue := sql.NullString{String: v.TextValue, Valid: v.TextValue != ""}
+		return []interface{}{imageMosaic.ImageMosaicID, source, v.Step, v.Camera, v.Measure, value, textValue}
+	})
+	if err != nil {
+		return fmt.Errorf("Error inserting the %s values of %v: %v", source, imageMosaic, err)
+	}
+	return nil
+}
+
+// RetrieveTileTimings retrieves the tiles of the acquisition steps selected by the filter, ordered by step and camera,
+// together with the values recorded for their steps
+func RetrieveTileTimings(filter *models.TimingFilter, session DbSession) ([]*models.TileTiming, error) {
+	var sqlQueryBuffer bytes.Buffer
+	queryArgs := make([]interface{}, 0, 10)
+	sqlQueryBuffer.WriteString(`
+		select
+			s.step,
+			s.camera,
+			s.mosaic_col,
+			s.mosaic_row,
+			s.frame_number,
+			ti.tem_camera_image_id,
+			ti.acquired_timestamp
+		from acq_timing_steps s
+		join tem_camera_image_mosaics tm on tm.tem_camera_image_mosaic_id = s.tem_camera_image_mosaic_id
+		join ini_files_denorm acqf on tm.ini_file_denorm_id = acqf.ini_file_denorm_id
+		left outer join (
+			tem_camera_images ti
+			join tem_camera_configurations tc on tc.tem_camera_configuration_id = ti.tem_camera_configuration_id
+		) on ti.tem_camera_image_mosaic_id = s.tem_camera_image_mosaic_id
+			and ti.mosaic_col = s.mosaic_col
+			and ti.mosaic_row = s.mosaic_row
+			and ti.frame_number = s.frame_number
+			and tc.tem_camera_number = s.camera
+		where acqf.uid = ? `)
+	queryArgs = append(queryArgs, filter.AcqUID)
+	nextClause := "and "
+	queryArgs, nextClause = addFlagQueryCond(&sqlQueryBuffer,
+		filter.Col >= 0,
+		filter.Col,
+		"s.mosaic_col = ?",
+		queryArgs,
+		nextClause)
+	queryArgs, nextClause = addFlagQueryCond(&sqlQueryBuffer,
+		filter.Row >= 0,
+		filter.Row,
+		"s.mosaic_row = ?",
+		queryArgs,
+		nextClause)
+	queryArgs, nextClause = addFlagQueryCond(&sqlQueryBuffer,
+		filter.Camera >= 0,
+		filter.Camera,
+		"s.camera = ?",
+		queryArgs,
+		nextClause)
+	sqlQueryBuffer.WriteString("order by s.step, s.camera ")
+	var offset int64
+	var length int32 = maxRows
+	if filter.Pagination.StartRecordIndex > 0 {
+		offset = filter.Pagination.StartRecordIndex
+	}
+	if filter.Pagination.NRecords > 0 && filter.Pagination.NRecords < maxRows {
+		length = filter.Pagination.NRecords
+	}
+	sqlQueryBuffer.WriteString("limit ? offset ? ")
+	queryArgs = append(queryArgs, length, offset)
+
+	rows, err := session.selectQuery(sqlQueryBuffer.String(), queryArgs...)
+	defer closeRS(rows)
+	if err != nil {
+		return nil, err
+	}
+	var tiles []*models.TileTiming
+	tilesByStep := make(map[int][]*models.TileTiming)
+	for rows.Next() {
+		var imageID sql.NullInt64
+		var acquiredTimestamp NullableTime
+		tile := &models.TileTiming{}
+		if err = rows.Scan(&tile.Step, &tile.Camera, &tile.Col, &tile.Row, &tile.Frame, &imageID, &acquiredTimestamp); err != nil {
+			return nil, fmt.Errorf("Error extracting data from timing steps result set for %d: %v", filter.AcqUID, err)
+		}
+		tile.ImageID = imageID.Int64
+		if acquiredTimestamp.Valid {
+			tile.AcquiredTimestamp = &acquiredTimestamp.Time
+		}
+		tiles = append(tiles, tile)
+		tilesByStep[tile.Step] = append(tilesByStep[tile.Step], tile)
+	}
+	if len(tiles) == 0 {
+		return tiles, nil
+	}
+	closeRS(rows)
+	values, err := retrieveTimingValues(filter, tiles[0].Step, tiles[len(tiles)-1].Step, session)
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range values {
+		for _, tile := range tilesByStep[v.Step] {
+			if v.Camera < 0 || v.Camera == tile.Camera {
+				tile.Values = append(tile.Values, v)
+			}
+		}
+	}
+	return tiles, nil
+}
+
+func retrieveTimingValues(filter *models.TimingFilter, fromStep, toStep int, session DbSession) ([]models.TimingValue, error) {
+	var sqlQueryBuffer bytes.Buffer
+	queryArgs := make([]interface{}, 0, 10)
+	sqlQueryBuffer.WriteString(`
+		select
+			v.source,
+			v.step,
+			v.camera,
+			v.measure,
+			v.value,
+			v.text_value
+		from acq_timing_values v
+		join tem_camera_image_mosaics tm on tm.tem_camera_image_mosaic_id = v.tem_camera_image_mosaic_id
+		join ini_files_denorm acqf on tm.ini_file_denorm_id = acqf.ini_file_denorm_id
+		where acqf.uid = ?
+		and v.step between ? and ? `)
+	queryArgs = append(queryArgs, filter.AcqUID, fromStep, toStep)
+	nextClause := "and "
+	queryArgs, nextClause = addFlagQueryCond(&sqlQueryBuffer,
+		filter.Source != "",
+		filter.Source,
+		"v.source = ?",
+		queryArgs,
+		nextClause)
+	queryArgs, nextClause = addFlagQueryCond(&sqlQueryBuffer,
+		filter.Measure != "",
+		filter.Measure,
+		"v.measure = ?",
+		queryArgs,
+		nextClause)
+	sqlQueryBuffer.WriteString("order by v.acq_timing_value_id")
+
+	rows, err := session.selectQuery(sqlQueryBuffer.String(), queryArgs...)
+	defer closeRS(rows)
+	if err != nil {
+		return nil, err
+	}
+	var values []models.TimingValue
+	for rows.Next() {
+		var value sql.NullFloat64
+		var textValue sql.NullString
+		var v models.TimingValue
+		if err = rows.Scan(&v.Source, &v.Step, &v.Camera, &v.Measure, &value, &textValue); err != nil {
+			return nil, fmt.Errorf("Error extracting data from timing values result set for %d: %v", filter.AcqUID, err)
+		}
+		if value.Valid {
+			v.Value = new(float64)
+			*v.Value = value.Float64
+		}
+		v.TextValue = textValue.String
+		values = append(values, v)
+	}
+	return values, nil
+}
@@ -18,6 +18,19 @@ const (
 	TileInProgressState = "IN_PROGRESS"
 )
 
+const (
+	// ReplicaPendingStatus - the replica was not written yet
+	ReplicaPendingStatus = "pending"
+	// ReplicaVerifiedStatus - the replica was written and its checksum was verified
+	ReplicaVerifiedStatus = "verified"
+	// ReplicaFailedStatus - writing or verifying the replica failed
+	ReplicaFailedStatus = "failed"
+	// ReplicaMissingStatus - the replica was not found in its store
+	ReplicaMissingStatus = "missing"
+	// ReplicaCorruptedStatus - the stored replica does not match the file object checksum
+	ReplicaCorruptedStatus = "corrupted"
+)
+
 // FrameTypeFilter defines whether the frame is stable, drift or any
 type FrameTypeFilter int
 
@@ -54,6 +67,8 @@ type TemImage struct {
 	TileFile          FileObject
 	Configuration     *TemCameraConfiguration
 	AcquiredTimestamp *time.Time
+	// U8HistOffset and U8HistScale map the pixel values to 8 bit as (v - U8HistOffset) * U8HistScale; they are nil if not known
+	U8HistOffset, U8HistScale *float64
 }
 
 // String - string representation of a tile
@@ -87,6 +102,107 @@ func (r AcqROI) String() string {
 		r.MosaicRoiID, r.AcqRoiID, r.RegionName, r.SectionName, r.NominalSection)
 }
 
+// TileCoverage - a stable tile record of an acquisition, together with the section it belongs to and the key of its stored content
+type TileCoverage struct {
+	Col, Row int
+	// Camera is -1 if the camera is not known, e.g. for the tiles created from the ROI tiles file
+	Camera int
+	// NominalSection is -1 if the tile does not belong to any ROI
+	NominalSection int64
+	// Received is set if the tile was sent by the acquisition
+	Received bool
+	JfsKey   string
+}
+
+// StoredImage - an image that the microscope lists as saved
+type StoredImage struct {
+	Col, Row, Camera, Frame int
+	Name                    string
+	Checksum                []byte
+}
+
+// Discrepancies between the images listed as saved by the microscope and the persisted tiles
+const (
+	StoredImageNotPersisted     = "not_persisted"
+	StoredImageNoContent        = "no_content"
+	StoredImageChecksumMismatch = "checksum_mismatch"
+	StoredImageNotListed        = "not_listed"
+)
+
+// StoredImageDiscrepancy - a listed image that does not match the persisted tile or a persisted tile that was not listed
+type StoredImageDiscrepancy struct {
+	DiscrepancyID int64
+	// ImageID is 0 if the listed image was never persisted
+	ImageID                 int64
+	Col, Row, Camera, Frame int
+	Name                    string
+	Discrepancy             string
+	Details                 string
+	Found                   time.Time
+}
+
+// String representation of a stored image discrepancy
+func (d StoredImageDiscrepancy) String() string {
+	s := fmt.Sprintf("col %d, row %d, cam %d, frame %d: %s", d.Col, d.Row, d.Camera, d.Frame, d.Discrepancy)
+	if d.Details != "" {
+		s += " - " + d.Details
+	}
+	return s
+}
+
+// TimingStep - the tile acquired by a camera at a step of the acquisition, as recorded in the timing files
+type TimingStep struct {
+	Step, Camera, Col, Row, Frame int
+}
+
+// TimingValue - a value recorded in a timing file for an acquisition step
+type TimingValue struct {
+	Source, Measure string
+	Step            int
+	// Camera is -1 if the value applies to all cameras
+	Camera int
+	// Value is nil if the recorded value is not a number, in which case the value is in TextValue
+	Value     *float64
+	TextValue string
+}
+
+// TileTiming - the timing values recorded for a tile
+type TileTiming struct {
+	TimingStep
+	// ImageID is 0 if the tile was not received
+	ImageID           int64
+	AcquiredTimestamp *time.Time
+	Values            []TimingValue
+}
+
+// TimingFilter - tile timing filter; negative col, row or camera select all
+type TimingFilter struct {
+	AcqUID           uint64
+	Col, Row, Camera int
+	Source, Measure  string
+	Pagination       Page
+}
+
+// TileMetric - an image statistic of a tile, as recorded in the statistics file
+type TileMetric struct {
+	Col, Row, Camera, Frame int
+	Metric                  string
+	Value                   float64
+}
+
+const (
+	// U8HistOffsetMetric is the tile metric that sets the u8HistOffset of the tile
+	U8HistOffsetMetric = "u8HistOffset"
+	// U8HistScaleMetric is the tile metric that sets the u8HistScale of the tile
+	U8HistScaleMetric = "u8HistScale"
+)
+
+// MetricRange - the accepted range of a tile metric; a nil bound is not checked
+type MetricRange struct {
+	Metric   string
+	Min, Max *float64
+}
+
 // TemImageROI represents a TemImage with a region of interest
 type TemImageROI struct {
 	TemImage
@@ -138,6 +254,7 @@ type FileObject struct {
 	Path, JfsPath, JfsKey  string
 	LocationURL            string
 	Checksum               []byte
+	ChecksumAlgorithm      string
 	ChecksumTimestamp      *time.Time
 }
 
@@ -160,6 +277,9 @@ func (f *FileObject) UpdateJFSAndPathParams(filePath string, jfsParams map[strin
 	if jfsParams["locationUrl"] != nil {
 		f.LocationURL = jfsParams["locationUrl"].(string)
 	}
+	if jfsParams["checksumAlgorithm"] != nil {
+		f.ChecksumAlgorithm = jfsParams["checksumAlgorithm"].(string)
+	}
 	if jfsParams["checksum"] != nil {
 		checksum := jfsParams["checksum"].(string)
 		logger.Debugf("Checksum: %s", checksum)
@@ -173,11 +293,73 @@ func (f *FileObject) UpdateJFSAndPathParams(filePath string, jfsParams map[strin
 	return
 }
 
+// FileReplica - a copy of a file object in one of the replica stores
+type FileReplica struct {
+	ReplicaID, FileObjectID int64
+	DerivedFromReplicaID    int64
+	StorageName             string
+	JfsPath, JfsKey         string
+	LocationURL             string
+	FileExists              bool
+	VerificationStatus      string
+	LastVerified            *time.Time
+}
+
+// StoredReplica - a file replica together with the checksum of its file object and the acquisition that owns it
+type StoredReplica struct {
+	FileReplica
+	Acquisition       Acquisition
+	Checksum          []byte
+	ChecksumAlgorithm string
+}
+
+// ReplicaStatusSummary - number of an acquisition's file replicas in a store with a given verification status
+type ReplicaStatusSummary struct {
+	StorageName        string
+	VerificationStatus string
+	Files              int64
+	OldestVerification *time.Time
+	LatestVerification *time.Time
+}
+
+// Acquisition lifecycle states
+const (
+	// AcqCreatedState - the acquisition log was received but no tile was captured yet
+	AcqCreatedState = "created"
+	// AcqAcquiringState - the acquisition is capturing tiles
+	AcqAcquiringState = "acquiring"
+	// AcqCompletedState - the acquisition ended normally
+	AcqCompletedState = "completed"
+	// AcqAbortedState - the acquisition was stopped by the operator before it completed
+	AcqAbortedState = "aborted"
+	// AcqFailedState - the acquisition was stopped because of an error
+	AcqFailedState = "failed"
+	// AcqArchivedState - the acquisition is final and it can no longer be reopened
+	AcqArchivedState = "archived"
+)
+
+// acqStateTransitions maps an acquisition state to the states it can change to
+var acqStateTransitions = map[string][]string{
+	AcqCreatedState:   {AcqAcquiringState, AcqCompletedState, AcqAbortedState, AcqFailedState},
+	AcqAcquiringState: {AcqCompletedState, AcqAbortedState, AcqFailedState},
+	AcqCompletedState: {AcqAcquiringState, AcqArchivedState},
+	AcqAbortedState:   {AcqAcquiringState, AcqArchivedState},
+	AcqFailedState:    {AcqAcquiringState, AcqArchivedState},
+	AcqArchivedState:  {},
+}
+
+// IsValidAcqState returns true if the argument is a known acquisition state
+func IsValidAcqState(state string) bool {
+	_, found := acqStateTransitions[state]
+	return found
+}
+
 // Acquisition - acquisition entity
 type Acquisition struct {
 	IniFileID, ImageMosaicID     int64
 	Acquired, Inserted           time.Time
 	Completed                    *time.Time
+	AcqState                     string
 	AcqUID                       uint64
 	NumberOfCameras              int
 	XSmallStepPix, YSmallStepPix int
@@ -215,6 +397,27 @@ func (a Acquisition) IsCompleted() bool {
 	return a.Completed != nil
 }
 
+// IsFinished returns true if the acquisition will not receive any more tiles unless it is reopened,
+// i.e. it is completed, aborted, failed or archived
+func (a Acquisition) IsFinished() bool {
+	switch a.AcqState {
+	case AcqCompletedState, AcqAbortedState, AcqFailedState, AcqArchivedState:
+		return true
+	default:
+		return false
+	}
+}
+
+// CanChangeStateTo returns true if the acquisition can move from its current state to the new state
+func (a Acquisition) CanChangeStateTo(newState string) bool {
+	for _, s := range acqStateTransitions[a.AcqState] {
+		if s == newState {
+			return true
+		}
+	}
+	return false
+}
+
 // AcquisitionFilter acquisition filter parameters
 type AcquisitionFilter struct {
 	Acquisition
@@ -252,12 +455,25 @@ type TileSpec struct {
 	ImageURL, MaskURL   string
 	TransformationRefID string
 	CameraConfig        TemCameraConfiguration
+	// U8HistOffset and U8HistScale are nil if the histogram parameters of the tile are not known
+	U8HistOffset, U8HistScale *float64
+	// Mipmaps are the downsampled levels of the tile ordered by level
+	Mipmaps []TileMipmap
+}
+
+// TileMipmap - a downsampled copy of a tile; level n is 2^n times smaller than the tile in each dimension
+type TileMipmap struct {
+	Level             int
+	JFSPath, ImageURL string
 }
 
 // SetTileImageURL set tile image url
 func (ts *TileSpec) SetTileImageURL(host string) {
 	imageURL := ts.ImageURL + "?fName=" + ts.JFSPath
 	ts.ImageURL = imageURL
+	for i := range ts.Mipmaps {
+		ts.Mipmaps[i].ImageURL = ts.Mipmaps[i].ImageURL + "?fName=" + ts.Mipmaps[i].JFSPath
+	}
 }
 
 // SetMaskURL updates tile mask url based on the mask root set in current cameraConfig
@@ -276,7 +492,11 @@ type TileFilter struct {
 	FrameType            FrameTypeFilter
 	IncludeNotPersisted  bool
 	TileAcquiredInterval TimeInterval
-	Pagination           Page
+	// WithinMetricThresholds excludes the tiles with metrics outside the configured thresholds
+	WithinMetricThresholds bool
+	// MetricRanges are the ranges of the tile metrics checked by the tile queries
+	MetricRanges []MetricRange
+	Pagination   Page
 }
 
 // IncludeOnlyPersisted specifies whether to only include persisted tiles
@@ -82,3 +82,32 @@ func TestUpdateJFSAndPathParams(t *testing.T) {
 		}
 	}
 }
+
+func TestAcqStateTransitions(t *testing.T) {
+	type testdata struct {
+		currentState, newState string
+		expectedResult         bool
+	}
+	var tests = []testdata{
+		{AcqCreatedState, AcqAcquiringState, true},
+		{AcqCreatedState, AcqAbortedState, true},
+		{AcqAcquiringState, AcqCompletedState, true},
+		{AcqAcquiringState, AcqFailedState, true},
+		{AcqAcquiringState, AcqArchivedState, false},
+		{AcqAbortedState, AcqAcquiringState, true},
+		{AcqCompletedState, AcqAbortedState, false},
+		{AcqCompletedState, AcqArchivedState, true},
+		{AcqArchivedState, AcqAcquiringState, false},
+		{"unknown", AcqAcquiringState, false},
+	}
+	for ti, testparams := range tests {
+		acq := Acquisition{AcqState: testparams.currentState}
+		if res := acq.CanChangeStateTo(testparams.newState); res != testparams.expectedResult {
+			t.Error("Test", ti, "Expected", testparams.expectedResult, "for changing from",
+				testparams.currentState, "to", testparams.newState, "got", res)
+		}
+	}
+	if (Acquisition{AcqState: AcqAcquiringState}).IsFinished() || !(Acquisition{AcqState: AcqAbortedState}).IsFinished() {
+		t.Error("Only completed, aborted, failed or archived acquisitions are expected to be finished")
+	}
+}
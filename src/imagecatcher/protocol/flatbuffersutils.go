@@ -2,23 +2,29 @@ package protocol
 
 import (
 	"bytes"
-	"crypto/md5"
 	"fmt"
 	"github.com/google/flatbuffers/go"
 	"io"
 
 	"idls/tilerequests"
+	"imagecatcher/checksum"
 )
 
 // CaptureImageRequest defines the request fields
 type CaptureImageRequest struct {
-	AcqID    uint64
-	Camera   int32
-	Frame    int32
-	Col      int32
-	Row      int32
-	Image    []byte
-	Checksum []byte
+	AcqID     uint64
+	Camera    int32
+	Frame     int32
+	Col       int32
+	Row       int32
+	Image     []byte
+	Checksum  []byte
+	Version   uint16
+	RequestID uint64
+	// ChecksumAlgorithm is the algorithm used for the checksum; legacy clients don't set it and use MD5
+	ChecksumAlgorithm checksum.Algorithm
+	// ImageSize is the size of the image that follows a request header; it is only set for streamed requests
+	ImageSize uint64
 }
 
 // CaptureImageResponse defines the response fields
@@ -29,6 +35,24 @@ type CaptureImageResponse struct {
 	SystemStatus       int16
 	TileQueueStatus    int16
 	ContentQueueStatus int16
+	Version            uint16
+	RequestID          uint64
+	ErrorCode          int16
+	ErrorMessage       string
+	RetryAfterMs       uint32
+	RecommendedRateMs  uint32
+}
+
+// ChecksumMismatchError is returned when the checksum sent with the tile does not match the checksum of the tile content
+type ChecksumMismatchError struct {
+	Algorithm checksum.Algorithm
+	Received  []byte
+	Computed  []byte
+}
+
+// Error returns the error message
+func (e *ChecksumMismatchError) Error() string {
+	return fmt.Sprintf("The received %s checksum %x and the calculated checksum %x do not match", e.Algorithm, e.Received, e.Computed)
 }
 
 // ReadUint32 - reads a uint32 value
@@ -74,6 +98,32 @@ func MarshalTileRequest(req *CaptureImageRequest) []byte {
 	tilerequests.ImageTileRequestAddRow(b, req.Row)
 	tilerequests.ImageTileRequestAddImage(b, image)
 	tilerequests.ImageTileRequestAddChecksum(b, checksum)
+	tilerequests.ImageTileRequestAddVersion(b, req.Version)
+	tilerequests.ImageTileRequestAddRequestId(b, req.RequestID)
+	tilerequests.ImageTileRequestAddChecksumAlgorithm(b, byte(req.ChecksumAlgorithm))
+	done := tilerequests.ImageTileRequestEnd(b)
+	b.Finish(done)
+
+	return b.Bytes[b.Head():]
+}
+
+// MarshalTileRequestHeader - serializes the request without the image; the header only carries the image size
+func MarshalTileRequestHeader(req *CaptureImageRequest) []byte {
+	b := flatbuffers.NewBuilder(1024)
+
+	checksum := b.CreateByteVector(req.Checksum)
+
+	tilerequests.ImageTileRequestStart(b)
+	tilerequests.ImageTileRequestAddAcqId(b, req.AcqID)
+	tilerequests.ImageTileRequestAddCamera(b, req.Camera)
+	tilerequests.ImageTileRequestAddFrame(b, req.Frame)
+	tilerequests.ImageTileRequestAddCol(b, req.Col)
+	tilerequests.ImageTileRequestAddRow(b, req.Row)
+	tilerequests.ImageTileRequestAddChecksum(b, checksum)
+	tilerequests.ImageTileRequestAddVersion(b, req.Version)
+	tilerequests.ImageTileRequestAddRequestId(b, req.RequestID)
+	tilerequests.ImageTileRequestAddChecksumAlgorithm(b, byte(req.ChecksumAlgorithm))
+	tilerequests.ImageTileRequestAddImageSize(b, uint64(len(req.Image)))
 	done := tilerequests.ImageTileRequestEnd(b)
 	b.Finish(done)
 
@@ -81,33 +131,108 @@ func MarshalTileRequest(req *CaptureImageRequest) []byte {
 }
 
 // UnmarshalTileRequest - unserialize the request
-func UnmarshalTileRequest(requestBuffer []byte) (acqID uint64, camera, frame, col, row, imageSize int, image, checksum []byte, err error) {
+func UnmarshalTileRequest(requestBuffer []byte) (req *CaptureImageRequest, err error) {
+	if req, err = unmarshalTileRequestFields(requestBuffer); err != nil {
+		return req, err
+	}
+	computedChecksum, err := checksum.Sum(req.ChecksumAlgorithm, req.Image)
+	if err != nil {
+		return req, err
+	}
+	if !bytes.Equal(computedChecksum, req.Checksum) {
+		err = &ChecksumMismatchError{Algorithm: req.ChecksumAlgorithm, Received: req.Checksum, Computed: computedChecksum}
+	}
+	return req, err
+}
+
+// UnmarshalTileRequestHeader - unserialize the header of a streamed request; the image must be read
+// from the connection with ReadTileContent
+func UnmarshalTileRequestHeader(headerBuffer []byte) (req *CaptureImageRequest, err error) {
+	if req, err = unmarshalTileRequestFields(headerBuffer); err != nil {
+		return req, err
+	}
+	if !req.ChecksumAlgorithm.Supported() {
+		return req, fmt.Errorf("Unsupported checksum algorithm %d", req.ChecksumAlgorithm)
+	}
+	return req, nil
+}
+
+// PeekTileRequestID reads the request ID from the beginning of a serialized request. The request table is written
+// after the image so it is at the beginning of the buffer and the ID can be read without the rest of the request.
+func PeekTileRequestID(requestPrefix []byte) (requestID uint64, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("Error reading the request ID: %v", r)
+		}
+	}()
+	return tilerequests.GetRootAsImageTileRequest(requestPrefix, 0).RequestId(), nil
+}
+
+func unmarshalTileRequestFields(requestBuffer []byte) (req *CaptureImageRequest, err error) {
 	defer func() {
 		if r := recover(); r != nil {
 			err = fmt.Errorf("%v", r)
 		}
 	}()
 	imageTileRequest := tilerequests.GetRootAsImageTileRequest(requestBuffer, 0)
-	acqID = imageTileRequest.AcqId()
-	camera = int(imageTileRequest.Camera())
-	frame = int(imageTileRequest.Frame())
-	col = int(imageTileRequest.Col())
-	row = int(imageTileRequest.Row())
-	imageSize = imageTileRequest.ImageLength()
-	image = imageTileRequest.ImageBytes()
-	checksum = imageTileRequest.ChecksumBytes()
+	req = &CaptureImageRequest{}
+	req.AcqID = imageTileRequest.AcqId()
+	req.Camera = imageTileRequest.Camera()
+	req.Frame = imageTileRequest.Frame()
+	req.Col = imageTileRequest.Col()
+	req.Row = imageTileRequest.Row()
+	req.Image = imageTileRequest.ImageBytes()
+	req.Checksum = imageTileRequest.ChecksumBytes()
+	req.Version = imageTileRequest.Version()
+	req.RequestID = imageTileRequest.RequestId()
+	req.ChecksumAlgorithm = checksum.Algorithm(imageTileRequest.ChecksumAlgorithm())
+	req.ImageSize = imageTileRequest.ImageSize()
+	return req, nil
+}
 
-	computedChecksum := md5.Sum(image)
-	if !bytes.Equal(computedChecksum[0:], checksum) {
-		err = fmt.Errorf("The received checksum %x and the calculated checksum %x do not match", checksum, computedChecksum)
+// discardOnErrorWriter keeps consuming the content after the underlying writer failed
+type discardOnErrorWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (dw *discardOnErrorWriter) Write(p []byte) (int, error) {
+	if dw.err == nil {
+		_, dw.err = dw.w.Write(p)
+	}
+	return len(p), nil
+}
+
+// ReadTileContent reads the image of a streamed request into dst and verifies its checksum while reading it.
+// The image is read completely even if writing it to dst fails so that the next request can be read from the connection.
+// It returns the number of bytes read - if it is less than the image length the connection cannot be used anymore.
+func ReadTileContent(reader io.Reader, req *CaptureImageRequest, dst io.Writer) (int64, error) {
+	h, err := checksum.New(req.ChecksumAlgorithm)
+	if err != nil {
+		return 0, err
 	}
-	return acqID, camera, frame, col, row, imageSize, image, checksum, err
+	dw := &discardOnErrorWriter{w: dst}
+	n, err := io.CopyN(io.MultiWriter(h, dw), reader, int64(req.ImageSize))
+	if err != nil {
+		return n, err
+	}
+	if dw.err != nil {
+		return n, dw.err
+	}
+	if computedChecksum := h.Sum(nil); !bytes.Equal(computedChecksum, req.Checksum) {
+		return n, &ChecksumMismatchError{Algorithm: req.ChecksumAlgorithm, Received: req.Checksum, Computed: computedChecksum}
+	}
+	return n, nil
 }
 
 // MarshalTileResponse - serialize the response
 func MarshalTileResponse(resp *CaptureImageResponse) []byte {
 	b := flatbuffers.NewBuilder(1024)
 
+	var errorMessage flatbuffers.UOffsetT
+	if resp.ErrorMessage != "" {
+		errorMessage = b.CreateString(resp.ErrorMessage)
+	}
 	tilerequests.ImageTileResponseStart(b)
 	tilerequests.ImageTileResponseAddAcqId(b, resp.AcqID)
 	tilerequests.ImageTileResponseAddTileId(b, resp.TileID)
@@ -115,6 +240,14 @@ func MarshalTileResponse(resp *CaptureImageResponse) []byte {
 	tilerequests.ImageTileResponseAddSystemStatus(b, resp.SystemStatus)
 	tilerequests.ImageTileResponseAddTileQueueStatus(b, resp.TileQueueStatus)
 	tilerequests.ImageTileResponseAddContentQueueStatus(b, resp.ContentQueueStatus)
+	tilerequests.ImageTileResponseAddVersion(b, resp.Version)
+	tilerequests.ImageTileResponseAddRequestId(b, resp.RequestID)
+	tilerequests.ImageTileResponseAddErrorCode(b, resp.ErrorCode)
+	if errorMessage != 0 {
+		tilerequests.ImageTileResponseAddErrorMessage(b, errorMessage)
+	}
+	tilerequests.ImageTileResponseAddRetryAfterMs(b, resp.RetryAfterMs)
+	tilerequests.ImageTileResponseAddRecommendedRateMs(b, resp.RecommendedRateMs)
 	done := tilerequests.ImageTileResponseEnd(b)
 	b.Finish(done)
 
@@ -131,5 +264,11 @@ func UnmarshalTileResponse(responsebuffer []byte) *CaptureImageResponse {
 	tileResponse.SystemStatus = int16(imageTileResponse.SystemStatus())
 	tileResponse.ContentQueueStatus = int16(imageTileResponse.ContentQueueStatus())
 	tileResponse.TileQueueStatus = int16(imageTileResponse.TileQueueStatus())
+	tileResponse.Version = imageTileResponse.Version()
+	tileResponse.RequestID = imageTileResponse.RequestId()
+	tileResponse.ErrorCode = imageTileResponse.ErrorCode()
+	tileResponse.ErrorMessage = string(imageTileResponse.ErrorMessage())
+	tileResponse.RetryAfterMs = imageTileResponse.RetryAfterMs()
+	tileResponse.RecommendedRateMs = imageTileResponse.RecommendedRateMs()
 	return tileResponse
 }
@@ -0,0 +1,91 @@
+package protocol
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"imagecatcher/checksum"
+)
+
+type failingWriter struct{}
+
+func (failingWriter) Write(p []byte) (int, error) {
+	return 0, errors.New("disk full")
+}
+
+func createStreamedTestRequest(image []byte) *CaptureImageRequest {
+	sum, _ := checksum.Sum(checksum.SHA256, image)
+	return &CaptureImageRequest{
+		AcqID:             10,
+		Col:               3,
+		Row:               4,
+		Image:             image,
+		Checksum:          sum,
+		ChecksumAlgorithm: checksum.SHA256,
+		RequestID:         7,
+	}
+}
+
+func TestStreamedTileRequestRoundTrip(t *testing.T) {
+	image := bytes.Repeat([]byte("tile"), 1000)
+	var buf bytes.Buffer
+	if err := WriteStreamedTileRequest(&buf, createStreamedTestRequest(image)); err != nil {
+		t.Fatal(err)
+	}
+	headerLength, err := ReadUint32(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err := UnmarshalTileRequestHeader(buf.Next(int(headerLength)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req.AcqID != 10 || req.Col != 3 || req.Row != 4 || req.RequestID != 7 || len(req.Image) != 0 || req.ImageSize != uint64(len(image)) {
+		t.Errorf("Unexpected request header %+v", req)
+	}
+	var content bytes.Buffer
+	if n, err := ReadTileContent(&buf, req, &content); err != nil || n != int64(len(image)) {
+		t.Fatalf("Unexpected result reading the tile content: %d, %v", n, err)
+	}
+	if !bytes.Equal(content.Bytes(), image) {
+		t.Error("The streamed content does not match the image")
+	}
+}
+
+func TestReadTileContentErrors(t *testing.T) {
+	image := bytes.Repeat([]byte("tile"), 1000)
+	req := createStreamedTestRequest(image)
+	req.ImageSize = uint64(len(image))
+
+	// the content must be consumed even if it cannot be written
+	reader := bytes.NewReader(append(image, 'x'))
+	if _, err := ReadTileContent(reader, req, failingWriter{}); err == nil || err.Error() != "disk full" {
+		t.Errorf("Expected the write error but got %v", err)
+	}
+	if reader.Len() != 1 {
+		t.Errorf("Expected the whole image to be consumed but %d bytes are left", reader.Len()-1)
+	}
+
+	corrupted := append([]byte{}, image...)
+	corrupted[0] = 'x'
+	if _, err := ReadTileContent(bytes.NewReader(corrupted), req, &bytes.Buffer{}); err == nil {
+		t.Error("Expected a checksum mismatch")
+	} else if _, ok := err.(*ChecksumMismatchError); !ok {
+		t.Errorf("Expected a checksum mismatch but got %v", err)
+	}
+
+	if n, err := ReadTileContent(bytes.NewReader(image[0:10]), req, &bytes.Buffer{}); err == nil || n != 10 {
+		t.Errorf("Expected a short read error after 10 bytes but got %d, %v", n, err)
+	}
+}
+
+func TestPeekTileRequestID(t *testing.T) {
+	requestBuffer := MarshalTileRequest(createStreamedTestRequest(bytes.Repeat([]byte("tile"), 1000)))
+	if requestID, err := PeekTileRequestID(requestBuffer[:256]); err != nil || requestID != 7 {
+		t.Errorf("Expected request ID 7 from the beginning of the request but got %d, %v", requestID, err)
+	}
+	if _, err := PeekTileRequestID(requestBuffer[:2]); err == nil {
+		t.Error("Expected an error reading the request ID from a truncated request")
+	}
+}
@@ -0,0 +1,133 @@
+package protocol
+
+import (
+	"fmt"
+	"github.com/google/flatbuffers/go"
+	"io"
+)
+
+// HandshakeMagic marks the beginning of a connection handshake. A legacy client
+// starts the connection with the length of the first tile request so the magic value was chosen
+// to be much larger than any tile request we could possibly receive.
+const HandshakeMagic uint32 = 0x54454d43 // "CMET" on the wire
+
+// handshakeLength - magic (4 bytes), version (2 bytes), max in-flight requests (2 bytes), capabilities (4 bytes)
+const handshakeLength = 12
+
+const (
+	// LegacyProtocolVersion is the version assumed for the clients that do not send a handshake
+	LegacyProtocolVersion uint16 = 0
+	// ProtocolVersion1 is the first version that supports the handshake and the versioned messages
+	ProtocolVersion1 uint16 = 1
+	// CurrentProtocolVersion is the latest protocol version supported by this package
+	CurrentProtocolVersion = ProtocolVersion1
+)
+
+// Capability flags exchanged during the handshake
+type Capability uint32
+
+const (
+	// CapVersionedMessages - tile requests and responses carry the negotiated protocol version
+	CapVersionedMessages Capability = 1 << iota
+	// CapPipelining - the client may send more requests before receiving the responses for the previous ones
+	// and the server may respond out of order; requests and responses are matched using the request ID
+	CapPipelining
+	// CapStreamedContent - every tile request is a small header followed by the raw image bytes
+	// so that the server can write the image to disk as it reads it
+	CapStreamedContent
+)
+
+// SupportedCapabilities - all capabilities supported by this package
+const SupportedCapabilities = CapVersionedMessages | CapPipelining | CapStreamedContent
+
+// Has checks if all the given flags are set
+func (c Capability) Has(flags Capability) bool {
+	return c&flags == flags
+}
+
+// Handshake defines the handshake fields
+type Handshake struct {
+	Version             uint16
+	MaxInFlightRequests uint16
+	Capabilities        Capability
+}
+
+// IsHandshake checks if the first 4 bytes read from a connection are the handshake magic
+func IsHandshake(prefix []byte) bool {
+	return len(prefix) >= 4 && flatbuffers.GetUint32(prefix) == HandshakeMagic
+}
+
+// WriteHandshake - writes the handshake including the magic bytes
+func WriteHandshake(writer io.Writer, hs *Handshake) error {
+	var hsbuffer [handshakeLength]byte
+	flatbuffers.WriteUint32(hsbuffer[0:], HandshakeMagic)
+	flatbuffers.WriteUint16(hsbuffer[4:], hs.Version)
+	flatbuffers.WriteUint16(hsbuffer[6:], hs.MaxInFlightRequests)
+	flatbuffers.WriteUint32(hsbuffer[8:], uint32(hs.Capabilities))
+
+	n, err := writer.Write(hsbuffer[0:])
+	if err != nil {
+		return err
+	}
+	if n < handshakeLength {
+		return fmt.Errorf("Expected to write %d handshake bytes but only wrote %d", handshakeLength, n)
+	}
+	return nil
+}
+
+// ReadHandshake - reads the handshake including the magic bytes
+func ReadHandshake(reader io.Reader) (*Handshake, error) {
+	var hsbuffer [handshakeLength]byte
+	if _, err := io.ReadFull(reader, hsbuffer[0:]); err != nil {
+		return nil, err
+	}
+	if !IsHandshake(hsbuffer[0:]) {
+		return nil, fmt.Errorf("Invalid handshake magic %x", hsbuffer[0:4])
+	}
+	return &Handshake{
+		Version:             flatbuffers.GetUint16(hsbuffer[4:]),
+		MaxInFlightRequests: flatbuffers.GetUint16(hsbuffer[6:]),
+		Capabilities:        Capability(flatbuffers.GetUint32(hsbuffer[8:])),
+	}, nil
+}
+
+// NegotiateHandshake returns the handshake that the server should send back to the client:
+// the lowest of the two versions, only the capabilities supported by both sides and
+// the lowest of the two in-flight request limits; a 0 limit means that side has no preference.
+func NegotiateHandshake(clientHandshake, serverHandshake *Handshake) *Handshake {
+	version := clientHandshake.Version
+	if version > serverHandshake.Version {
+		version = serverHandshake.Version
+	}
+	capabilities := clientHandshake.Capabilities & serverHandshake.Capabilities
+	var maxInFlightRequests uint16 = 1
+	if capabilities.Has(CapPipelining) {
+		maxInFlightRequests = clientHandshake.MaxInFlightRequests
+		if maxInFlightRequests == 0 || serverHandshake.MaxInFlightRequests != 0 && serverHandshake.MaxInFlightRequests < maxInFlightRequests {
+			maxInFlightRequests = serverHandshake.MaxInFlightRequests
+		}
+		if maxInFlightRequests == 0 {
+			maxInFlightRequests = 1
+		}
+	}
+	return &Handshake{
+		Version:             version,
+		MaxInFlightRequests: maxInFlightRequests,
+		Capabilities:        capabilities,
+	}
+}
+
+// ClientHandshake sends the client handshake and waits for the server's reply
+func ClientHandshake(conn io.ReadWriter, clientHandshake *Handshake) (*Handshake, error) {
+	if err := WriteHandshake(conn, clientHandshake); err != nil {
+		return nil, fmt.Errorf("Error sending the handshake: %v", err)
+	}
+	serverHandshake, err := ReadHandshake(conn)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading the server handshake: %v", err)
+	}
+	if serverHandshake.Version == LegacyProtocolVersion || serverHandshake.Version > CurrentProtocolVersion {
+		return nil, fmt.Errorf("Unsupported protocol version %d", serverHandshake.Version)
+	}
+	return serverHandshake, nil
+}
@@ -0,0 +1,69 @@
+package protocol
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestHandshakeRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	if err := WriteHandshake(&buf, &Handshake{Version: ProtocolVersion1, Capabilities: CapVersionedMessages}); err != nil {
+		t.Fatal(err)
+	}
+	if !IsHandshake(buf.Bytes()) {
+		t.Error("Expected the buffer to start with the handshake magic")
+	}
+	hs, err := ReadHandshake(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hs.Version != ProtocolVersion1 {
+		t.Errorf("Expected version %d but got %d", ProtocolVersion1, hs.Version)
+	}
+	if !hs.Capabilities.Has(CapVersionedMessages) {
+		t.Errorf("Expected capabilities %x to contain %x", hs.Capabilities, CapVersionedMessages)
+	}
+}
+
+func TestLegacyLengthPrefixIsNotAHandshake(t *testing.T) {
+	var buf bytes.Buffer
+	if err := WriteUint32(&buf, 20*1024*1024); err != nil {
+		t.Fatal(err)
+	}
+	if IsHandshake(buf.Bytes()) {
+		t.Error("Did not expect a tile request length to be interpreted as a handshake")
+	}
+	if _, err := ReadHandshake(bytes.NewReader(append(buf.Bytes(), make([]byte, 8)...))); err == nil {
+		t.Error("Expected an invalid handshake error")
+	}
+}
+
+func TestNegotiateHandshake(t *testing.T) {
+	server := Handshake{Version: CurrentProtocolVersion, MaxInFlightRequests: 8, Capabilities: SupportedCapabilities}
+	testData := []struct {
+		client               Handshake
+		server               Handshake
+		expectedVersion      uint16
+		expectedCapabilities Capability
+		expectedMaxInFlight  uint16
+	}{
+		{Handshake{Version: ProtocolVersion1, Capabilities: CapVersionedMessages}, server, ProtocolVersion1, CapVersionedMessages, 1},
+		{Handshake{Version: CurrentProtocolVersion + 1, Capabilities: CapVersionedMessages | 1<<30}, server, CurrentProtocolVersion, CapVersionedMessages, 1},
+		{Handshake{Version: ProtocolVersion1, Capabilities: CapVersionedMessages}, Handshake{Version: CurrentProtocolVersion}, ProtocolVersion1, 0, 1},
+		{Handshake{Version: ProtocolVersion1, MaxInFlightRequests: 4, Capabilities: SupportedCapabilities}, server, ProtocolVersion1, SupportedCapabilities, 4},
+		{Handshake{Version: ProtocolVersion1, MaxInFlightRequests: 32, Capabilities: SupportedCapabilities}, server, ProtocolVersion1, SupportedCapabilities, 8},
+		{Handshake{Version: ProtocolVersion1, Capabilities: SupportedCapabilities}, server, ProtocolVersion1, SupportedCapabilities, 8},
+	}
+	for _, td := range testData {
+		hs := NegotiateHandshake(&td.client, &td.server)
+		if hs.Version != td.expectedVersion {
+			t.Errorf("Expected negotiated version %d but got %d", td.expectedVersion, hs.Version)
+		}
+		if hs.Capabilities != td.expectedCapabilities {
+			t.Errorf("Expected negotiated capabilities %x but got %x", td.expectedCapabilities, hs.Capabilities)
+		}
+		if hs.MaxInFlightRequests != td.expectedMaxInFlight {
+			t.Errorf("Expected negotiated in-flight limit %d but got %d", td.expectedMaxInFlight, hs.MaxInFlightRequests)
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package protocol
+
+import (
+	"fmt"
+	"io"
+	"sync"
+)
+
+// WriteTileRequest - writes a length prefixed tile request
+func WriteTileRequest(writer io.Writer, req *CaptureImageRequest) error {
+	tileReqBuf := MarshalTileRequest(req)
+	if err := WriteUint32(writer, uint32(len(tileReqBuf))); err != nil {
+		return fmt.Errorf("Error writing the request buffer length: %v", err)
+	}
+	if _, err := writer.Write(tileReqBuf); err != nil {
+		return fmt.Errorf("Error writing the request buffer: %v", err)
+	}
+	return nil
+}
+
+// WriteStreamedTileRequest - writes a length prefixed tile request header followed by the image
+func WriteStreamedTileRequest(writer io.Writer, req *CaptureImageRequest) error {
+	headerBuf := MarshalTileRequestHeader(req)
+	if err := WriteUint32(writer, uint32(len(headerBuf))); err != nil {
+		return fmt.Errorf("Error writing the request header length: %v", err)
+	}
+	if _, err := writer.Write(headerBuf); err != nil {
+		return fmt.Errorf("Error writing the request header: %v", err)
+	}
+	if _, err := writer.Write(req.Image); err != nil {
+		return fmt.Errorf("Error writing the request image: %v", err)
+	}
+	return nil
+}
+
+// ReadTileResponse - reads a length prefixed tile response
+func ReadTileResponse(reader io.Reader) (*CaptureImageResponse, error) {
+	responseBufferLength, err := ReadUint32(reader)
+	if err != nil {
+		return nil, err
+	}
+	responseBuffer := make([]byte, responseBufferLength)
+	if _, err = io.ReadFull(reader, responseBuffer); err != nil {
+		return nil, fmt.Errorf("Error reading the response buffer (%d bytes): %v", responseBufferLength, err)
+	}
+	return UnmarshalTileResponse(responseBuffer), nil
+}
+
+// TileResponseHandler is invoked once for every pipelined request either with the response or with the error
+// that prevented the response from being received
+type TileResponseHandler func(req *CaptureImageRequest, resp *CaptureImageResponse, err error)
+
+type pendingTileRequest struct {
+	req     *CaptureImageRequest
+	handler TileResponseHandler
+}
+
+// PipelinedTileSender sends tile requests over a single connection without waiting for the responses
+// to the previous requests. The responses may arrive in any order and they are matched with their requests by the request ID.
+type PipelinedTileSender struct {
+	conn          io.ReadWriter
+	version       uint16
+	streamed      bool
+	inFlight      chan struct{}
+	writeLock     sync.Mutex
+	lock          sync.Mutex
+	pending       map[uint64]*pendingTileRequest
+	pendingWG     sync.WaitGroup
+	lastRequestID uint64
+	err           error
+}
+
+// NewPipelinedTileSender creates a sender for a connection on which the handshake has already been completed
+func NewPipelinedTileSender(conn io.ReadWriter, hs *Handshake) *PipelinedTileSender {
+	maxInFlightRequests := int(hs.MaxInFlightRequests)
+	if !hs.Capabilities.Has(CapPipelining) || maxInFlightRequests < 1 {
+		maxInFlightRequests = 1
+	}
+	s := &PipelinedTileSender{
+		conn:     conn,
+		version:  hs.Version,
+		streamed: hs.Capabilities.Has(CapStreamedContent),
+		inFlight: make(chan struct{}, maxInFlightRequests),
+		pending:  make(map[uint64]*pendingTileRequest),
+	}
+	go s.readResponses()
+	return s
+}
+
+// Send assigns a new request ID to the request and writes it to the connection. If the number of in-flight requests
+// already reached the negotiated limit it blocks until one of the pending responses arrives.
+func (s *PipelinedTileSender) Send(req *CaptureImageRequest, handler TileResponseHandler) error {
+	s.inFlight <- struct{}{}
+	s.lock.Lock()
+	if s.err != nil {
+		err := s.err
+		s.lock.Unlock()
+		<-s.inFlight
+		return err
+	}
+	s.lastRequestID++
+	req.RequestID = s.lastRequestID
+	req.Version = s.version
+	s.pending[req.RequestID] = &pendingTileRequest{req: req, handler: handler}
+	s.pendingWG.Add(1)
+	s.lock.Unlock()
+
+	var err error
+	s.writeLock.Lock()
+	if s.streamed {
+		err = WriteStreamedTileRequest(s.conn, req)
+	} else {
+		err = WriteTileRequest(s.conn, req)
+	}
+	s.writeLock.Unlock()
+	if err != nil {
+		s.complete(req.RequestID, nil, err)
+	}
+	return err
+}
+
+// Wait blocks until all pending requests are completed
+func (s *PipelinedTileSender) Wait() {
+	s.pendingWG.Wait()
+}
+
+func (s *PipelinedTileSender) readResponses() {
+	for {
+		resp, err := ReadTileResponse(s.conn)
+		if err != nil {
+			s.fail(err)
+			return
+		}
+		if !s.complete(resp.RequestID, resp, nil) {
+			s.fail(fmt.Errorf("Received a response for an unknown request ID %d", resp.RequestID))
+			return
+		}
+	}
+}
+
+func (s *PipelinedTileSender) complete(requestID uint64, resp *CaptureImageResponse, err error) bool {
+	s.lock.Lock()
+	p := s.pending[requestID]
+	delete(s.pending, requestID)
+	s.lock.Unlock()
+	if p == nil {
+		return false
+	}
+	<-s.inFlight
+	p.handler(p.req, resp, err)
+	s.pendingWG.Done()
+	return true
+}
+
+func (s *PipelinedTileSender) fail(err error) {
+	s.lock.Lock()
+	s.err = err
+	pending := s.pending
+	s.pending = make(map[uint64]*pendingTileRequest)
+	s.lock.Unlock()
+	for _, p := range pending {
+		<-s.inFlight
+		p.handler(p.req, nil, err)
+		s.pendingWG.Done()
+	}
+}
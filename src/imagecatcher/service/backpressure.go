@@ -0,0 +1,128 @@
+package service
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// latencySmoothingFactor is the weight of the latest sample in the latency and error rate moving averages
+const latencySmoothingFactor = 0.2
+
+// unhealthyStorageErrorRate is the content store error rate above which the storage is considered unhealthy
+const unhealthyStorageErrorRate = 0.5
+
+// backpressureHints tell the acquisition clients how fast they should send the tiles
+type backpressureHints struct {
+	// retryAfter is how long the client should wait before sending the next tile or before resending a failed tile; 0 if it doesn't have to wait
+	retryAfter time.Duration
+	// recommendedRate is the recommended minimum interval between two tiles; 0 if there's no recommendation yet
+	recommendedRate time.Duration
+}
+
+// backpressureMonitor keeps track of the recent processing latencies and of the content store health
+type backpressureMonitor struct {
+	lock             sync.Mutex
+	tileLatency      time.Duration
+	contentLatency   time.Duration
+	storageErrorRate float64
+}
+
+func (m *backpressureMonitor) recordTileLatency(d time.Duration) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.tileLatency = movingAverageDuration(m.tileLatency, d)
+}
+
+func (m *backpressureMonitor) recordContentResult(d time.Duration, err error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.contentLatency = movingAverageDuration(m.contentLatency, d)
+	var errSample float64
+	if err != nil {
+		errSample = 1
+	}
+	m.storageErrorRate = m.storageErrorRate*(1-latencySmoothingFactor) + errSample*latencySmoothingFactor
+}
+
+func (m *backpressureMonitor) snapshot() (tileLatency, contentLatency time.Duration, storageErrorRate float64) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.tileLatency, m.contentLatency, m.storageErrorRate
+}
+
+func movingAverageDuration(avg, sample time.Duration) time.Duration {
+	if avg == 0 {
+		return sample
+	}
+	return time.Duration(float64(avg)*(1-latencySmoothingFactor) + float64(sample)*latencySmoothingFactor)
+}
+
+// computeBackpressureHints computes the hints from the queues fill level, the recent processing latencies and the storage health.
+// The recommended rate is the interval at which the workers can process the tiles, increased as the queues fill up
+// or as the storage starts failing. The client is asked to wait if the queues are nearly full, if the request
+// timed out waiting for a queue or if the storage is unhealthy.
+func (th *TileRequestHandler) computeBackpressureHints(perr error) backpressureHints {
+	tileLatency, contentLatency, storageErrorRate := th.backpressure.snapshot()
+	tileInterval := tileLatency / time.Duration(maxInt(th.tileProcessingWorkers, 1))
+	contentInterval := contentLatency / time.Duration(maxInt(th.contentProcessingWorkers, 1))
+	serviceInterval := tileInterval
+	if contentInterval > serviceInterval {
+		serviceInterval = contentInterval
+	}
+	fill := math.Max(queueFillLevel(len(th.tileProcessingJobQueue), cap(th.tileProcessingJobQueue)),
+		queueFillLevel(len(th.contentProcessingJobQueue), cap(th.contentProcessingJobQueue)))
+	// slow down proportionally to the remaining queue capacity and to the storage success rate
+	slowdown := 1 / (1 - math.Min(fill, 0.95)) / (1 - math.Min(storageErrorRate, 0.95))
+
+	var hints backpressureHints
+	hints.recommendedRate = time.Duration(float64(serviceInterval) * slowdown)
+
+	// a 0.9 fill level is the threshold for a RED queue status
+	if fill >= 0.9 || captureErrorCode(perr) == ErrCodeQueueTimeout {
+		// wait until the queued jobs are expected to be processed
+		drainTime := time.Duration(len(th.tileProcessingJobQueue))*tileInterval + time.Duration(len(th.contentProcessingJobQueue))*contentInterval
+		if drainTime < th.waitTimeout {
+			drainTime = th.waitTimeout
+		}
+		hints.retryAfter = drainTime
+	}
+	if storageErrorRate >= unhealthyStorageErrorRate && hints.retryAfter < th.storageRetryAfter {
+		hints.retryAfter = th.storageRetryAfter
+	}
+	return hints
+}
+
+// durationToMillis converts the duration to milliseconds rounding up so that a non zero duration is never reported as 0
+func durationToMillis(d time.Duration) uint32 {
+	ms := (d + time.Millisecond - 1) / time.Millisecond
+	if ms > math.MaxUint32 {
+		return math.MaxUint32
+	}
+	return uint32(ms)
+}
+
+func queueFillLevel(size, capacity int) float64 {
+	if capacity == 0 {
+		return 0
+	}
+	return float64(size) / float64(capacity)
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+func monitoredContentProcessing(m *backpressureMonitor) contentProcessDecorator {
+	return func(p contentProcessor) contentProcessor {
+		return contentProcessorFunc(func(job *contentProcessingJob) contentProcessingResult {
+			localStartTime := time.Now()
+			res := p.process(job)
+			m.recordContentResult(time.Since(localStartTime), res.err)
+			return res
+		})
+	}
+}
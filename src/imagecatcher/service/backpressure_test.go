@@ -0,0 +1,64 @@
+package service
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestComputeBackpressureHints(t *testing.T) {
+	th := &TileRequestHandler{
+		tileProcessingWorkers:    2,
+		tileProcessingJobQueue:   make(chan *tileProcessingJob, 10),
+		contentProcessingWorkers: 1,
+		waitTimeout:              time.Second,
+		storageRetryAfter:        5 * time.Second,
+	}
+	th.backpressure.recordTileLatency(100 * time.Millisecond)
+
+	hints := th.computeBackpressureHints(nil)
+	if hints.recommendedRate != 50*time.Millisecond {
+		t.Errorf("Expected the recommended rate for empty queues to be 50ms but got %v", hints.recommendedRate)
+	}
+	if hints.retryAfter != 0 {
+		t.Errorf("Did not expect a retry after hint for empty queues but got %v", hints.retryAfter)
+	}
+
+	for i := 0; i < 5; i++ {
+		th.tileProcessingJobQueue <- &tileProcessingJob{}
+	}
+	hints = th.computeBackpressureHints(nil)
+	if hints.recommendedRate != 100*time.Millisecond {
+		t.Errorf("Expected the recommended rate for a half full queue to be 100ms but got %v", hints.recommendedRate)
+	}
+
+	hints = th.computeBackpressureHints(&CaptureError{Code: ErrCodeQueueTimeout, Err: fmt.Errorf("timeout")})
+	if hints.retryAfter != th.waitTimeout {
+		t.Errorf("Expected the retry after hint for a queue timeout to be %v but got %v", th.waitTimeout, hints.retryAfter)
+	}
+
+	for i := 0; i < 5; i++ {
+		th.backpressure.recordContentResult(10*time.Millisecond, fmt.Errorf("storage error"))
+	}
+	hints = th.computeBackpressureHints(nil)
+	if hints.retryAfter != th.storageRetryAfter {
+		t.Errorf("Expected the retry after hint for an unhealthy storage to be %v but got %v", th.storageRetryAfter, hints.retryAfter)
+	}
+}
+
+func TestDurationToMillis(t *testing.T) {
+	testData := []struct {
+		d        time.Duration
+		expected uint32
+	}{
+		{0, 0},
+		{time.Microsecond, 1},
+		{1500 * time.Microsecond, 2},
+		{2 * time.Second, 2000},
+	}
+	for _, td := range testData {
+		if ms := durationToMillis(td.d); ms != td.expected {
+			t.Errorf("Expected %v to be %dms but got %dms", td.d, td.expected, ms)
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package service
+
+import (
+	"sort"
+
+	"imagecatcher/models"
+)
+
+// TileCoord tile mosaic coordinates
+type TileCoord struct {
+	Col int `json:"col"`
+	Row int `json:"row"`
+}
+
+// CompletenessGroup counts the expected and received tiles of a section acquired by one camera
+type CompletenessGroup struct {
+	NominalSection int64       `json:"section"`
+	Camera         int         `json:"camera"`
+	Expected       int         `json:"n_expected"`
+	Received       int         `json:"n_received"`
+	NoContent      []TileCoord `json:"no_content"`
+	Missing        []TileCoord `json:"missing"`
+}
+
+// CompletenessReport compares the tiles expected for an acquisition with the tiles that were received with their content.
+// The expected tiles are the ROI tiles or, if the acquisition has no ROIs, the entire target grid.
+type CompletenessReport struct {
+	AcqUID      uint64               `json:"acq_id"`
+	NTargetCols int                  `json:"target_cols"`
+	NTargetRows int                  `json:"target_rows"`
+	FromROIs    bool                 `json:"from_rois"`
+	Expected    int                  `json:"n_expected"`
+	Received    int                  `json:"n_received"`
+	NoContent   int                  `json:"n_no_content"`
+	Missing     int                  `json:"n_missing"`
+	Groups      []*CompletenessGroup `json:"groups"`
+}
+
+type sectionTile struct {
+	section  int64
+	col, row int
+}
+
+type cameraTile struct {
+	col, row, camera int
+}
+
+type completenessKey struct {
+	section int64
+	camera  int
+}
+
+// tileProgress ranks a tile record by how far it got, so that of several records of the same tile the most advanced one is used
+func tileProgress(t *models.TileCoverage) int {
+	switch {
+	case t.JfsKey != "":
+		return 2
+	case t.Received:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// buildCompletenessReport groups the expected tiles by section and camera. Every camera of the acquisition is expected
+// to acquire every tile; the cameras are taken from the acquisition's number of cameras or, if that is not set,
+// from the received tiles. Tiles whose camera is not known are only attributed to the camera of a single camera acquisition.
+func buildCompletenessReport(acqMosaic *models.TemImageMosaic, tiles []*models.TileCoverage) *CompletenessReport {
+	report := &CompletenessReport{
+		AcqUID:      acqMosaic.AcqUID,
+		NTargetCols: acqMosaic.NumCols,
+		NTargetRows: acqMosaic.NumRows,
+		Groups:      []*CompletenessGroup{},
+	}
+	receivedTiles := map[cameraTile]*models.TileCoverage{}
+	cameraSet := map[int]bool{}
+	var expectedTiles []sectionTile
+	expectedROITiles := map[sectionTile]bool{}
+	for _, t := range tiles {
+		ct := cameraTile{t.Col, t.Row, t.Camera}
+		if prev, found := receivedTiles[ct]; !found || tileProgress(t) > tileProgress(prev) {
+			receivedTiles[ct] = t
+		}
+		if t.Camera >= 0 {
+			cameraSet[t.Camera] = true
+		}
+		if t.NominalSection < 0 {
+			continue
+		}
+		st := sectionTile{t.NominalSection, t.Col, t.Row}
+		if !expectedROITiles[st] {
+			expectedROITiles[st] = true
+			expectedTiles = append(expectedTiles, st)
+		}
+	}
+	if len(expectedTiles) > 0 {
+		report.FromROIs = true
+	} else {
+		for col := 0; col < acqMosaic.NumCols; col++ {
+			for row := 0; row < acqMosaic.NumRows; row++ {
+				expectedTiles = append(expectedTiles, sectionTile{-1, col, row})
+			}
+		}
+	}
+	var cameras []int
+	if acqMosaic.NumberOfCameras > 0 {
+		for c := 0; c < acqMosaic.NumberOfCameras; c++ {
+			cameras = append(cameras, c)
+		}
+	} else {
+		for c := range cameraSet {
+			cameras = append(cameras, c)
+		}
+		sort.Ints(cameras)
+	}
+	if len(cameras) == 0 {
+		cameras = []int{-1}
+	}
+	lookupTile := func(col, row, camera int) *models.TileCoverage {
+		if tile := receivedTiles[cameraTile{col, row, camera}]; tile != nil || len(cameras) > 1 {
+			return tile
+		}
+		return receivedTiles[cameraTile{col, row, -1}]
+	}
+
+	groups := map[completenessKey]*CompletenessGroup{}
+	for _, st := range expectedTiles {
+		for _, camera := range cameras {
+			coord := TileCoord{st.col, st.row}
+			tile := lookupTile(st.col, st.row, camera)
+			key := completenessKey{st.section, camera}
+			group := groups[key]
+			if group == nil {
+				group = &CompletenessGroup{
+					NominalSection: key.section,
+					Camera:         key.camera,
+					NoContent:      []TileCoord{},
+					Missing:        []TileCoord{},
+				}
+				groups[key] = group
+				report.Groups = append(report.Groups, group)
+			}
+			group.Expected++
+			report.Expected++
+			switch {
+			case tile != nil && tile.JfsKey != "":
+				group.Received++
+				report.Received++
+			case tile != nil && tile.Received:
+				group.NoContent = append(group.NoContent, coord)
+				report.NoContent++
+			default:
+				group.Missing = append(group.Missing, coord)
+				report.Missing++
+			}
+		}
+	}
+	sort.Slice(report.Groups, func(i, j int) bool {
+		gi, gj := report.Groups[i], report.Groups[j]
+		if gi.NominalSection != gj.NominalSection {
+			return gi.NominalSection < gj.NominalSection
+		}
+		return gi.Camera < gj.Camera
+	})
+	return report
+}
@@ -0,0 +1,92 @@
+package service
+
+import (
+	"reflect"
+	"testing"
+
+	"imagecatcher/models"
+)
+
+func TestCompletenessReportFromROIs(t *testing.T) {
+	acqMosaic := &models.TemImageMosaic{NumCols: 10, NumRows: 10}
+	acqMosaic.AcqUID = 50
+	acqMosaic.NumberOfCameras = 2
+	tiles := []*models.TileCoverage{
+		{Col: 1, Row: 1, Camera: 0, NominalSection: 7, Received: true, JfsKey: "k11"},
+		{Col: 1, Row: 2, Camera: 1, NominalSection: 7, Received: true},
+		{Col: 2, Row: 1, Camera: -1, NominalSection: 7},
+		{Col: 2, Row: 2, Camera: 1, NominalSection: 7, Received: true, JfsKey: "k22"},
+		// the same tile in two sections
+		{Col: 2, Row: 2, Camera: 1, NominalSection: 8, Received: true, JfsKey: "k22"},
+		// a tile outside the ROIs is not expected
+		{Col: 5, Row: 5, Camera: 0, NominalSection: -1, Received: true, JfsKey: "k55"},
+	}
+	report := buildCompletenessReport(acqMosaic, tiles)
+	if !report.FromROIs || report.AcqUID != 50 || report.Expected != 10 || report.Received != 3 ||
+		report.NoContent != 1 || report.Missing != 6 {
+		t.Errorf("Unexpected completeness report %+v", report)
+	}
+	expectedGroups := []*CompletenessGroup{
+		{NominalSection: 7, Camera: 0, Expected: 4, Received: 1, NoContent: []TileCoord{}, Missing: []TileCoord{{1, 2}, {2, 1}, {2, 2}}},
+		{NominalSection: 7, Camera: 1, Expected: 4, Received: 1, NoContent: []TileCoord{{1, 2}}, Missing: []TileCoord{{1, 1}, {2, 1}}},
+		{NominalSection: 8, Camera: 0, Expected: 1, NoContent: []TileCoord{}, Missing: []TileCoord{{2, 2}}},
+		{NominalSection: 8, Camera: 1, Expected: 1, Received: 1, NoContent: []TileCoord{}, Missing: []TileCoord{}},
+	}
+	if len(report.Groups) != len(expectedGroups) {
+		t.Fatalf("Expected %d groups but got %d", len(expectedGroups), len(report.Groups))
+	}
+	for i, g := range expectedGroups {
+		if !reflect.DeepEqual(report.Groups[i], g) {
+			t.Errorf("Expected group %d to be %+v but got %+v", i, g, report.Groups[i])
+		}
+	}
+}
+
+func TestCompletenessReportFromGrid(t *testing.T) {
+	acqMosaic := &models.TemImageMosaic{NumCols: 2, NumRows: 2}
+	tiles := []*models.TileCoverage{
+		{Col: 0, Row: 0, Camera: 2, NominalSection: -1, Received: true, JfsKey: "k00"},
+		{Col: 1, Row: 1, Camera: 2, NominalSection: -1, Received: true, JfsKey: "k11"},
+	}
+	report := buildCompletenessReport(acqMosaic, tiles)
+	if report.FromROIs || report.Expected != 4 || report.Received != 2 || report.Missing != 2 || len(report.Groups) != 1 {
+		t.Fatalf("Unexpected completeness report %+v", report)
+	}
+	// all received tiles come from the same camera so the missing tiles are attributed to it
+	expectedGroup := &CompletenessGroup{
+		NominalSection: -1,
+		Camera:         2,
+		Expected:       4,
+		Received:       2,
+		NoContent:      []TileCoord{},
+		Missing:        []TileCoord{{0, 1}, {1, 0}},
+	}
+	if !reflect.DeepEqual(report.Groups[0], expectedGroup) {
+		t.Errorf("Expected %+v but got %+v", expectedGroup, report.Groups[0])
+	}
+}
+
+func TestCompletenessReportByCamera(t *testing.T) {
+	acqMosaic := &models.TemImageMosaic{NumCols: 1, NumRows: 2}
+	tiles := []*models.TileCoverage{
+		{Col: 0, Row: 0, Camera: 0, NominalSection: -1, Received: true, JfsKey: "k00-0"},
+		{Col: 0, Row: 0, Camera: 1, NominalSection: -1, Received: true, JfsKey: "k00-1"},
+		{Col: 0, Row: 1, Camera: 0, NominalSection: -1, Received: true, JfsKey: "k01-0"},
+	}
+	report := buildCompletenessReport(acqMosaic, tiles)
+	if report.Expected != 4 || report.Received != 3 || report.Missing != 1 || len(report.Groups) != 2 {
+		t.Fatalf("Unexpected completeness report %+v", report)
+	}
+	// the tile received from camera 0 does not hide the same tile missing from camera 1
+	expectedGroup := &CompletenessGroup{
+		NominalSection: -1,
+		Camera:         1,
+		Expected:       2,
+		Received:       1,
+		NoContent:      []TileCoord{},
+		Missing:        []TileCoord{{0, 1}},
+	}
+	if !reflect.DeepEqual(report.Groups[1], expectedGroup) {
+		t.Errorf("Expected %+v but got %+v", expectedGroup, report.Groups[1])
+	}
+}
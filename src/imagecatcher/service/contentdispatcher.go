@@ -1,9 +1,12 @@
 package service
 
 import (
+	"fmt"
+	"io"
+	"math/rand"
 	"os"
+	"runtime/debug"
 	"time"
-	"unsafe"
 
 	"imagecatcher/logger"
 	"imagecatcher/models"
@@ -20,8 +23,12 @@ type contentProcessingJob struct {
 	tileImage   *models.TemImage
 	processor   contentProcessor
 	execCtx     ExecutionContext
-	memPtr      unsafe.Pointer
+	buffer      *utils.Buffer
 	tmpTileFile string
+	// attempts counts how many times the content store was tried
+	attempts int
+	// resubmitted is set for the jobs recovered from the spool or retried from the dead letters
+	resubmitted bool
 }
 
 func (j contentProcessingJob) getTileMosaic() *models.TemImageMosaic {
@@ -32,11 +39,48 @@ func (j contentProcessingJob) getTileFile() *models.FileObject {
 	return &j.tileImage.TileFile
 }
 
+// loadSpooledContent reads the temporary tile file into a buffer that the job keeps until it is cleared, so the
+// upload and the decorators that need the content share one copy that counts as in-flight tile bytes.
+// Without acquireBuffer the buffer is allocated outside of the pool.
+func (j *contentProcessingJob) loadSpooledContent(acquireBuffer func(size int) (*utils.Buffer, error)) error {
+	if !j.fileParams.isEmpty() || j.tmpTileFile == "" {
+		return nil
+	}
+	tmpFile, err := os.Open(j.tmpTileFile)
+	if err != nil {
+		return fmt.Errorf("Error opening the temporary tile file %s: %v", j.tmpTileFile, err)
+	}
+	defer tmpFile.Close()
+	fi, err := tmpFile.Stat()
+	if err != nil {
+		return fmt.Errorf("Error reading the size of the temporary tile file %s: %v", j.tmpTileFile, err)
+	}
+	var buffer *utils.Buffer
+	var content []byte
+	if acquireBuffer != nil {
+		if buffer, err = acquireBuffer(int(fi.Size())); err != nil {
+			return err
+		}
+		content = buffer.Bytes()
+	} else {
+		content = make([]byte, fi.Size())
+	}
+	if _, err = io.ReadFull(tmpFile, content); err != nil {
+		buffer.Release()
+		return fmt.Errorf("Error reading the temporary tile file %s: %v", j.tmpTileFile, err)
+	}
+	j.buffer.Release()
+	j.buffer = buffer
+	j.fileParams.Content = content
+	j.fileParams.ContentLen = len(content)
+	return nil
+}
+
 func (j *contentProcessingJob) clear() {
-	utils.Free(j.memPtr)
+	j.buffer.Release()
 	j.tileImage = nil
 	j.fileParams = nil
-	j.memPtr = nil
+	j.buffer = nil
 }
 
 type contentProcessingResult struct {
@@ -52,6 +96,7 @@ type contentDispatcher struct {
 	maxWorkers int
 	jobQueue   chan *contentProcessingJob
 	quit       chan struct{}
+	stopped    chan struct{}
 }
 
 // contentWorker subscribes to a pool of workers by putting its own
@@ -70,6 +115,7 @@ func newContentDispatcher(jobQueue chan *contentProcessingJob, maxWorkers int) *
 		maxWorkers: maxWorkers,
 		workerPool: workerPool,
 		quit:       make(chan struct{}),
+		stopped:    make(chan struct{}),
 	}
 }
 
@@ -82,25 +128,44 @@ func (d *contentDispatcher) run() {
 	go d.dispatch()
 }
 
+// stop the dispatcher - the returned channel is closed once all workers finished their current jobs.
+// The jobs that were not dispatched yet are left in the job queue.
+func (d *contentDispatcher) stop() <-chan struct{} {
+	close(d.quit)
+	return d.stopped
+}
+
 // dispatch is the method that looks up an available worker and
 // then it transfers the job to that workers queue
 func (d *contentDispatcher) dispatch() {
+	defer close(d.stopped)
 	for {
 		select {
 		case workerJobQueue := <-d.workerPool:
-			job := <-d.jobQueue
-			logger.Debugf("Dispatching content %d %s (%d): %v",
-				job.acqID, job.fileParams.Name, len(job.fileParams.Content), time.Since(job.execCtx.StartTime))
-			workerJobQueue <- job
-		case <-d.quit:
-			for workerJobQueue := range d.workerPool {
-				close(workerJobQueue)
+			select {
+			case job := <-d.jobQueue:
+				logger.Debugf("Dispatching content %d %s (%d): %v",
+					job.acqID, job.fileParams.Name, job.fileParams.ContentLen, time.Since(job.execCtx.StartTime))
+				workerJobQueue <- job
+			case <-d.quit:
+				d.workerPool <- workerJobQueue
+				d.stopWorkers()
+				return
 			}
+		case <-d.quit:
+			d.stopWorkers()
 			return
 		}
 	}
 }
 
+// stopWorkers waits for every worker to become available and then closes its queue
+func (d *contentDispatcher) stopWorkers() {
+	for i := 0; i < d.maxWorkers; i++ {
+		close(<-d.workerPool)
+	}
+}
+
 // dispatch is the method that looks up an available worker and
 // then it transfers the job to that workers queue
 func newContentWorker(workerPool chan chan *contentProcessingJob) *contentWorker {
@@ -120,7 +185,7 @@ func (w contentWorker) start() {
 			job, ok := <-w.jobQueue
 			if ok {
 				// Dispatcher has added a job to the queue so do the work
-				job.processor.process(job)
+				w.process(job)
 			} else {
 				// the channel was closed
 				return
@@ -129,6 +194,17 @@ func (w contentWorker) start() {
 	}()
 }
 
+// process runs the job and recovers from a panic so that a malformed tile cannot stop the worker
+func (w contentWorker) process(job *contentProcessingJob) {
+	acqID, name := job.acqID, job.fileParams.Name
+	defer func() {
+		if r := recover(); r != nil {
+			logger.Errorf("Unexpected error while processing content %d:%s: %v\n%s", acqID, name, r, debug.Stack())
+		}
+	}()
+	job.processor.process(job)
+}
+
 type contentProcessorFunc func(job *contentProcessingJob) contentProcessingResult
 
 func (f contentProcessorFunc) process(job *contentProcessingJob) contentProcessingResult {
@@ -213,21 +289,35 @@ func removeTemporaryTileFile() contentProcessDecorator {
 	}
 }
 
-func retryContentProcessing(maxRetries int) contentProcessDecorator {
+// retryBackoff computes the exponentially increasing delays between the content processing retries
+type retryBackoff struct {
+	initial, max time.Duration
+}
+
+// delay returns the delay before the given retry - a random value between half and the full exponential delay
+func (b retryBackoff) delay(retry int) time.Duration {
+	d := b.initial << uint(retry-1)
+	if d > b.max || d < b.initial {
+		d = b.max
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+func retryContentProcessing(maxRetries int, backoff retryBackoff) contentProcessDecorator {
 	return func(p contentProcessor) contentProcessor {
 		return contentProcessorFunc(func(job *contentProcessingJob) contentProcessingResult {
+			job.attempts++
 			res := p.process(job)
-			if res.err == nil {
-				return res
+			for r := 1; res.err != nil && r < maxRetries; r++ {
+				delay := backoff.delay(r)
+				logger.Infof("Retry (%d) content processing for %d:%s in %v: %v", r, job.acqID, job.fileParams.Name, delay, res.err)
+				time.Sleep(delay)
+				job.attempts++
+				res = p.process(job)
 			}
-			for r := 1; r < maxRetries; r++ {
-				logger.Infof("Retry (%d) content processing  for %d:%s", r, job.acqID, job.fileParams.Name)
-				res := p.process(job)
-				if res.err == nil {
-					return res
-				}
+			if res.err != nil {
+				logger.Errorf("Processing of %d:%s aborted after %d retries", job.acqID, job.fileParams.Name, maxRetries)
 			}
-			logger.Errorf("Processing of %d:%s aborted after %d retries", job.acqID, job.fileParams.Name, maxRetries)
 			return res
 		})
 	}
@@ -262,6 +352,44 @@ func updateTileMetadata(updateTileFunc func(*models.TemImage) error) contentProc
 	}
 }
 
+// histogramPercentiles are the percentiles of the tile histogram that are mapped to the 0-255 range
+type histogramPercentiles struct {
+	low, high float64
+}
+
+// computeTileHistogram decodes the stored tile and sets its histogram parameters; if the tile cannot be decoded
+// it is stored without them. The decorator does nothing if the percentiles are not set. It uses the content
+// loaded for the upload; a spooled tile that was not loaded yet is loaded in a buffer from acquireBuffer.
+func computeTileHistogram(percentiles *histogramPercentiles, acquireBuffer func(size int) (*utils.Buffer, error)) contentProcessDecorator {
+	return func(p contentProcessor) contentProcessor {
+		if percentiles == nil {
+			return p
+		}
+		return contentProcessorFunc(func(job *contentProcessingJob) contentProcessingResult {
+			res := p.process(job)
+			if res.err != nil {
+				return res
+			}
+			localStartTime := time.Now()
+			if err := job.loadSpooledContent(acquireBuffer); err != nil {
+				logger.Errorf("Error reading the content of %d:%s for computing its histogram: %v", job.acqID, job.fileParams.Name, err)
+				return res
+			}
+			img, err := utils.DecodeTIFF(job.fileParams.Content)
+			if err != nil {
+				logger.Errorf("Error decoding %d:%s for computing its histogram: %v", job.acqID, job.fileParams.Name, err)
+				return res
+			}
+			offset, scale := utils.HistogramScaling(img, percentiles.low, percentiles.high)
+			job.tileImage.U8HistOffset = &offset
+			job.tileImage.U8HistScale = &scale
+			logger.Debugf("Computed the histogram of %d:%s - offset %f, scale %f: %v / %v",
+				job.acqID, job.fileParams.Name, offset, scale, time.Since(localStartTime), time.Since(job.execCtx.StartTime))
+			return res
+		})
+	}
+}
+
 func decorateContentProcessor(p contentProcessor, decorators ...contentProcessDecorator) contentProcessor {
 	decorated := p
 	for _, decorate := range decorators {
@@ -0,0 +1,146 @@
+package service
+
+import (
+	"image"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"imagecatcher/models"
+	"imagecatcher/utils"
+)
+
+func TestComputeTileHistogram(t *testing.T) {
+	img := image.NewGray(image.Rect(0, 0, 16, 16))
+	for i := range img.Pix {
+		img.Pix[i] = uint8(i)
+	}
+	var updatedTile models.TemImage
+	pool := utils.NewBufferPool(0)
+	acquireBuffer := func(size int) (*utils.Buffer, error) {
+		return pool.Acquire(size, 0)
+	}
+	storeContent := contentProcessorFunc(func(job *contentProcessingJob) contentProcessingResult {
+		if err := job.loadSpooledContent(acquireBuffer); err != nil {
+			return contentProcessingResult{job.getTileFile(), err}
+		}
+		return contentProcessingResult{fObj: job.getTileFile()}
+	})
+	p := decorateContentProcessor(storeContent,
+		computeTileHistogram(&histogramPercentiles{low: 0, high: 100}, acquireBuffer),
+		updateTileMetadata(func(ti *models.TemImage) error {
+			updatedTile = *ti
+			return nil
+		}),
+	)
+
+	job := &contentProcessingJob{
+		acqID:      1,
+		fileParams: &FileParams{Name: "col0001_row0001_cam0.tif", Content: utils.EncodeTIFF(img)},
+		tileImage:  &models.TemImage{ImageID: 1},
+	}
+	if res := p.process(job); res.err != nil {
+		t.Fatal(res.err)
+	}
+	if updatedTile.U8HistOffset == nil || *updatedTile.U8HistOffset != 0 || updatedTile.U8HistScale == nil || *updatedTile.U8HistScale != 1 {
+		t.Errorf("Expected the tile to be updated with offset 0 and scale 1 but got %v and %v", updatedTile.U8HistOffset, updatedTile.U8HistScale)
+	}
+
+	job = &contentProcessingJob{
+		acqID:      1,
+		fileParams: &FileParams{Name: "col0001_row0002_cam0.tif", Content: []byte("not a tiff")},
+		tileImage:  &models.TemImage{ImageID: 2},
+	}
+	if res := p.process(job); res.err != nil {
+		t.Fatalf("Expected a tile that cannot be decoded to be stored but got %v", res.err)
+	}
+	if updatedTile.ImageID != 2 || updatedTile.U8HistOffset != nil || updatedTile.U8HistScale != nil {
+		t.Errorf("Expected the tile to be updated without histogram parameters but got %v", updatedTile)
+	}
+
+	// the histogram of a spooled tile uses the content loaded for the upload
+	tmpFile, err := ioutil.TempFile("", "histogram")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(tmpFile.Name())
+	tmpFile.Write(utils.EncodeTIFF(img))
+	tmpFile.Close()
+	job = &contentProcessingJob{
+		acqID:       1,
+		fileParams:  &FileParams{Name: "col0001_row0003_cam0.tif"},
+		tileImage:   &models.TemImage{ImageID: 3},
+		tmpTileFile: tmpFile.Name(),
+	}
+	if res := p.process(job); res.err != nil {
+		t.Fatal(res.err)
+	}
+	if updatedTile.ImageID != 3 || updatedTile.U8HistScale == nil || *updatedTile.U8HistScale != 1 {
+		t.Errorf("Expected the spooled tile to be updated with scale 1 but got %v", updatedTile)
+	}
+	if stats := pool.Stats(); stats.Acquired != 1 {
+		t.Errorf("Expected the spooled content to be loaded once but it was loaded %d times", stats.Acquired)
+	}
+	job.clear()
+}
+
+func TestContentWorkerRecoversFromPanic(t *testing.T) {
+	jobQueue := make(chan *contentProcessingJob, 2)
+	d := newContentDispatcher(jobQueue, 1)
+	d.run()
+	defer d.stop()
+
+	processed := make(chan string, 1)
+	p := contentProcessorFunc(func(job *contentProcessingJob) contentProcessingResult {
+		if job.fileParams.Name == "malformed.tif" {
+			panic("malformed tile")
+		}
+		processed <- job.fileParams.Name
+		return contentProcessingResult{}
+	})
+	jobQueue <- &contentProcessingJob{acqID: 1, fileParams: &FileParams{Name: "malformed.tif"}, processor: p}
+	jobQueue <- &contentProcessingJob{acqID: 1, fileParams: &FileParams{Name: "col0001_row0001_cam0.tif"}, processor: p}
+	select {
+	case name := <-processed:
+		if name != "col0001_row0001_cam0.tif" {
+			t.Errorf("Unexpected job %s", name)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("The worker stopped after a panic")
+	}
+}
+
+func TestLoadSpooledContentUsesPooledBuffer(t *testing.T) {
+	tmpFile, err := ioutil.TempFile("", "spooled")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(tmpFile.Name())
+	content := []byte("spooled tile content")
+	tmpFile.Write(content)
+	tmpFile.Close()
+
+	pool := utils.NewBufferPool(int64(len(content)))
+	acquireBuffer := func(size int) (*utils.Buffer, error) {
+		return pool.Acquire(size, 0)
+	}
+	job := &contentProcessingJob{fileParams: &FileParams{}, tmpTileFile: tmpFile.Name()}
+	if err = job.loadSpooledContent(acquireBuffer); err != nil {
+		t.Fatal(err)
+	}
+	if string(job.fileParams.Content) != string(content) || job.fileParams.ContentLen != len(content) {
+		t.Errorf("Unexpected spooled content %q", job.fileParams.Content)
+	}
+	if inUse := pool.Stats().InUseBytes; inUse != int64(len(content)) {
+		t.Errorf("Expected the spooled content to use %d pooled bytes but got %d", len(content), inUse)
+	}
+	other := &contentProcessingJob{fileParams: &FileParams{}, tmpTileFile: tmpFile.Name()}
+	if err = other.loadSpooledContent(acquireBuffer); err == nil {
+		t.Error("Expected the content not to be loaded while the pool is full")
+	}
+	job.clear()
+	if inUse := pool.Stats().InUseBytes; inUse != 0 {
+		t.Errorf("Expected the buffer to be released with the job but %d bytes are in use", inUse)
+	}
+}
@@ -0,0 +1,63 @@
+package service
+
+import (
+	"fmt"
+
+	"imagecatcher/config"
+	"imagecatcher/models"
+)
+
+// Storage backends that can be selected with STORAGE_BACKEND
+const (
+	jfsStorageBackend   = "jfs"
+	localStorageBackend = "local"
+	s3StorageBackend    = "s3"
+)
+
+// ContentStore persists the content of the acquisition files. The path of a file is always
+// /acquisitions/<acqID>/<file name> and the storage parameters are the ones created by createAcqStorageContext.
+type ContentStore interface {
+	// Put stores the content and returns the parameters of the stored object: "scalityKey" and optionally
+	// "checksum", "checksumAlgorithm" and "locationUrl"
+	Put(acq *models.Acquisition, path string, content []byte, params map[string]string) (map[string]interface{}, error)
+	// Get retrieves the stored content; it returns a contentNotFoundError if the content does not exist
+	Get(acq *models.Acquisition, path string) ([]byte, error)
+	// Verify checks that the stored content matches the checksum from the parameters; it returns
+	// a contentNotFoundError if the content does not exist
+	Verify(acq *models.Acquisition, path string, params map[string]string) error
+	// Delete removes the stored content
+	Delete(acq *models.Acquisition, path string) error
+	// Ping checks that content can be written to and read from the store
+	Ping() error
+}
+
+// contentNotFoundError is returned by the content stores when the stored content does not exist,
+// so that a missing file can be told apart from a store that could not be reached
+type contentNotFoundError struct {
+	path string
+	err  error
+}
+
+func (e *contentNotFoundError) Error() string {
+	return fmt.Sprintf("%s not found: %v", e.path, e.err)
+}
+
+// isContentNotFound returns true if the error reports that the stored content does not exist
+func isContentNotFound(err error) bool {
+	_, notFound := err.(*contentNotFoundError)
+	return notFound
+}
+
+// newContentStore creates the content store selected by STORAGE_BACKEND
+func newContentStore(config config.Config) (ContentStore, error) {
+	switch backend := config.GetStringProperty("STORAGE_BACKEND", jfsStorageBackend); backend {
+	case jfsStorageBackend:
+		return newJFSContentStoreFromConfig(config)
+	case localStorageBackend:
+		return newLocalContentStore(config.GetStringProperty("LOCAL_STORAGE_DIR", ""))
+	case s3StorageBackend:
+		return newS3ContentStore(config)
+	default:
+		return nil, fmt.Errorf("Unknown storage backend %s", backend)
+	}
+}
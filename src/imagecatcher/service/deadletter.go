@@ -0,0 +1,268 @@
+package service
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"imagecatcher/logger"
+)
+
+// deadLettersDirName is the directory in TMP_DATA_DIR that holds the dead letters
+const deadLettersDirName = "dead-letters"
+
+// deadLetter is a tile whose content could not be stored after all retries.
+// The tile content is kept in the temporary tile file until the dead letter is retried or discarded.
+type deadLetter struct {
+	TileID            int64     `json:"tileId"`
+	AcqID             uint64    `json:"acqId"`
+	Name              string    `json:"name"`
+	TmpTileFile       string    `json:"tmpTileFile"`
+	Checksum          string    `json:"checksum,omitempty"`
+	ChecksumAlgorithm string    `json:"checksumAlgorithm"`
+	Reason            string    `json:"reason"`
+	Attempts          int       `json:"attempts"`
+	FirstFailed       time.Time `json:"firstFailed"`
+	LastFailed        time.Time `json:"lastFailed"`
+}
+
+func (dl *deadLetter) spoolEntry() spoolEntry {
+	return spoolEntry{
+		TileID:            dl.TileID,
+		AcqID:             dl.AcqID,
+		Name:              dl.Name,
+		TmpTileFile:       dl.TmpTileFile,
+		Checksum:          dl.Checksum,
+		ChecksumAlgorithm: dl.ChecksumAlgorithm,
+	}
+}
+
+// deadLetterStore persists the dead letters as one JSON file per tile grouped by acquisition
+type deadLetterStore struct {
+	lock sync.Mutex
+	dir  string
+}
+
+func newDeadLetterStore(dataDir string) *deadLetterStore {
+	return &deadLetterStore{dir: filepath.Join(dataDir, deadLettersDirName)}
+}
+
+func (s *deadLetterStore) fileName(acqID uint64, tileID int64) string {
+	return filepath.Join(s.dir, strconv.FormatUint(acqID, 10), strconv.FormatInt(tileID, 10)+".json")
+}
+
+// add records a new failure; if the tile was already dead lettered the attempts are added to the previous ones
+func (s *deadLetterStore) add(dl *deadLetter) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	prev, err := s.read(s.fileName(dl.AcqID, dl.TileID))
+	if err != nil {
+		return err
+	}
+	if prev != nil {
+		dl.Attempts += prev.Attempts
+		dl.FirstFailed = prev.FirstFailed
+	}
+	content, err := json.Marshal(dl)
+	if err != nil {
+		return fmt.Errorf("Error encoding the dead letter for tile %d: %v", dl.TileID, err)
+	}
+	name := s.fileName(dl.AcqID, dl.TileID)
+	if err = os.MkdirAll(filepath.Dir(name), os.ModePerm); err != nil {
+		return fmt.Errorf("Error creating the dead letters directory %s: %v", filepath.Dir(name), err)
+	}
+	// write a new file and rename it so that a crash never leaves a partially written dead letter
+	if err = ioutil.WriteFile(name+".tmp", content, 0644); err != nil {
+		return fmt.Errorf("Error writing the dead letter for tile %d: %v", dl.TileID, err)
+	}
+	if err = os.Rename(name+".tmp", name); err != nil {
+		return fmt.Errorf("Error writing the dead letter for tile %d: %v", dl.TileID, err)
+	}
+	return nil
+}
+
+// get returns the tile's dead letter or nil if the tile is not dead lettered
+func (s *deadLetterStore) get(acqID uint64, tileID int64) (*deadLetter, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.read(s.fileName(acqID, tileID))
+}
+
+// list returns the acquisition's dead letters ordered by tile ID
+func (s *deadLetterStore) list(acqID uint64) ([]*deadLetter, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	names, err := filepath.Glob(filepath.Join(s.dir, strconv.FormatUint(acqID, 10), "*.json"))
+	if err != nil {
+		return nil, fmt.Errorf("Error listing the dead letters of acquisition %d: %v", acqID, err)
+	}
+	deadLetters := make([]*deadLetter, 0, len(names))
+	for _, name := range names {
+		dl, err := s.read(name)
+		if err != nil {
+			return nil, err
+		}
+		if dl != nil {
+			deadLetters = append(deadLetters, dl)
+		}
+	}
+	sort.Slice(deadLetters, func(i, j int) bool { return deadLetters[i].TileID < deadLetters[j].TileID })
+	return deadLetters, nil
+}
+
+func (s *deadLetterStore) remove(acqID uint64, tileID int64) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if err := os.Remove(s.fileName(acqID, tileID)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("Error removing the dead letter for tile %d: %v", tileID, err)
+	}
+	return nil
+}
+
+func (s *deadLetterStore) read(name string) (*deadLetter, error) {
+	content, err := ioutil.ReadFile(name)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("Error reading the dead letter %s: %v", name, err)
+	}
+	dl := &deadLetter{}
+	if err = json.Unmarshal(content, dl); err != nil {
+		return nil, fmt.Errorf("Error decoding the dead letter %s: %v", name, err)
+	}
+	return dl, nil
+}
+
+// deadLetterContentProcessing moves the tiles that still fail after all retries to the dead letter store
+// and it removes the dead letters of the resubmitted tiles that were stored successfully
+func deadLetterContentProcessing(store *deadLetterStore) contentProcessDecorator {
+	return func(p contentProcessor) contentProcessor {
+		return contentProcessorFunc(func(job *contentProcessingJob) contentProcessingResult {
+			res := p.process(job)
+			if store == nil || job.tileImage == nil {
+				return res
+			}
+			if res.err == nil {
+				if job.resubmitted {
+					if err := store.remove(job.acqID, job.tileImage.ImageID); err != nil {
+						logger.Error(err)
+					}
+				}
+				return res
+			}
+			if job.tmpTileFile == "" {
+				// there's no content left to retry
+				return res
+			}
+			now := time.Now()
+			dl := &deadLetter{
+				TileID:            job.tileImage.ImageID,
+				AcqID:             job.acqID,
+				Name:              job.fileParams.Name,
+				TmpTileFile:       job.tmpTileFile,
+				Checksum:          hex.EncodeToString(job.fileParams.Checksum),
+				ChecksumAlgorithm: job.fileParams.ChecksumAlgorithm.String(),
+				Reason:            res.err.Error(),
+				Attempts:          job.attempts,
+				FirstFailed:       now,
+				LastFailed:        now,
+			}
+			if err := store.add(dl); err != nil {
+				logger.Errorf("Error dead lettering tile %d:%s: %v", job.acqID, job.fileParams.Name, err)
+			} else {
+				logger.Infof("Dead lettered tile %d:%s after %d attempts", job.acqID, job.fileParams.Name, dl.Attempts)
+			}
+			return res
+		})
+	}
+}
+
+// selectDeadLetters returns the acquisition's dead letters for the given tiles or all of them if no tile is given
+func (th *TileRequestHandler) selectDeadLetters(acqID uint64, tileIDs []int64) ([]*deadLetter, error) {
+	deadLetters, err := th.deadLetters.list(acqID)
+	if err != nil || len(tileIDs) == 0 {
+		return deadLetters, err
+	}
+	selected := make(map[int64]bool)
+	for _, tileID := range tileIDs {
+		selected[tileID] = true
+	}
+	var res []*deadLetter
+	for _, dl := range deadLetters {
+		if selected[dl.TileID] {
+			res = append(res, dl)
+			delete(selected, dl.TileID)
+		}
+	}
+	if len(selected) > 0 {
+		var notFound []string
+		for tileID := range selected {
+			notFound = append(notFound, strconv.FormatInt(tileID, 10))
+		}
+		sort.Strings(notFound)
+		return nil, fmt.Errorf("No dead letter found for tiles %s of acquisition %d", strings.Join(notFound, ","), acqID)
+	}
+	return res, nil
+}
+
+// retryDeadLetters resubmits the content storage of the selected dead lettered tiles. A dead letter is removed
+// once its tile is stored or, right away, if there's nothing left to retry.
+func (th *TileRequestHandler) retryDeadLetters(acqID uint64, tileIDs []int64) ([]*deadLetter, error) {
+	deadLetters, err := th.selectDeadLetters(acqID, tileIDs)
+	if err != nil {
+		return nil, err
+	}
+	var jobs []*contentProcessingJob
+	for _, dl := range deadLetters {
+		job, err := th.prepareSpooledContentJob(dl.spoolEntry())
+		if err != nil {
+			return nil, fmt.Errorf("Error retrying the dead lettered tile %d:%s (%d): %v", dl.AcqID, dl.Name, dl.TileID, err)
+		}
+		if job == nil {
+			th.removeDeadLetter(dl, false)
+			continue
+		}
+		jobs = append(jobs, job)
+	}
+	go func() {
+		for _, job := range jobs {
+			th.resubmitContentJob(job)
+		}
+	}()
+	return deadLetters, nil
+}
+
+// discardDeadLetters removes the selected dead letters together with their spooled content
+func (th *TileRequestHandler) discardDeadLetters(acqID uint64, tileIDs []int64) ([]*deadLetter, error) {
+	deadLetters, err := th.selectDeadLetters(acqID, tileIDs)
+	if err != nil {
+		return nil, err
+	}
+	for _, dl := range deadLetters {
+		logger.Infof("Discard dead lettered tile %d:%s (%d) - %s", dl.AcqID, dl.Name, dl.TileID, dl.Reason)
+		th.removeDeadLetter(dl, true)
+	}
+	return deadLetters, nil
+}
+
+func (th *TileRequestHandler) removeDeadLetter(dl *deadLetter, removeContent bool) {
+	if removeContent {
+		removeSpooledFile(dl.TmpTileFile)
+	}
+	if th.spool != nil {
+		if err := th.spool.complete(dl.TileID); err != nil {
+			logger.Errorf("Error removing spooled tile %d:%s (%d): %v", dl.AcqID, dl.Name, dl.TileID, err)
+		}
+	}
+	if err := th.deadLetters.remove(dl.AcqID, dl.TileID); err != nil {
+		logger.Error(err)
+	}
+}
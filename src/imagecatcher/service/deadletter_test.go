@@ -0,0 +1,122 @@
+package service
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"imagecatcher/checksum"
+	"imagecatcher/models"
+)
+
+func TestRetryBackoffDelay(t *testing.T) {
+	backoff := retryBackoff{initial: 100 * time.Millisecond, max: time.Second}
+	testData := []struct {
+		retry    int
+		min, max time.Duration
+	}{
+		{1, 50 * time.Millisecond, 100 * time.Millisecond},
+		{2, 100 * time.Millisecond, 200 * time.Millisecond},
+		{4, 400 * time.Millisecond, 800 * time.Millisecond},
+		{5, 500 * time.Millisecond, time.Second},
+		{100, 500 * time.Millisecond, time.Second},
+	}
+	for _, td := range testData {
+		for i := 0; i < 10; i++ {
+			if d := backoff.delay(td.retry); d < td.min || d > td.max {
+				t.Errorf("Expected the delay before retry %d to be between %v and %v but got %v", td.retry, td.min, td.max, d)
+			}
+		}
+	}
+}
+
+func TestDeadLetterRetryAndDiscard(t *testing.T) {
+	dataDir := createSpoolTestDir(t)
+	defer os.RemoveAll(dataDir)
+
+	testService := &spoolTestService{
+		fakeImageCatcherService: fakeImageCatcherService{
+			tileData:    createLocalStorage(),
+			tileContent: createLocalStorage(),
+		},
+	}
+	var storeFailures int32 = 1
+	var storeCalls int32
+	th := &TileRequestHandler{
+		imageCatcher:             testService,
+		messageNotifier:          createFakeErrorNotifier(),
+		tmpDataDir:               dataDir,
+		contentProcessingWorkers: 1,
+		contentRetries:           3,
+		deadLetters:              newDeadLetterStore(dataDir),
+		contentProcessor: contentProcessorFunc(func(job *contentProcessingJob) contentProcessingResult {
+			atomic.AddInt32(&storeCalls, 1)
+			if atomic.LoadInt32(&storeFailures) > 0 {
+				return contentProcessingResult{err: fmt.Errorf("storage unavailable")}
+			}
+			return contentProcessingResult{fObj: job.getTileFile()}
+		}),
+	}
+
+	testContent := []byte("dead letter content")
+	testChecksum, _ := checksum.Sum(checksum.MD5, testContent)
+	for tileID := int64(1); tileID <= 2; tileID++ {
+		f := &FileParams{Name: fmt.Sprintf("tile%d.tif", tileID), Content: testContent, Checksum: testChecksum}
+		tmpTileFile, err := createTmpDataFile(dataDir, 1, f, ExecutionContext{})
+		if err != nil {
+			t.Fatalf("Error creating the temporary file for tile %d: %v", tileID, err)
+		}
+		err = th.startStoreFileContent(&contentProcessingJob{
+			acqID:       1,
+			fileParams:  f,
+			tileImage:   &models.TemImage{ImageID: tileID},
+			tmpTileFile: tmpTileFile,
+		})
+		if err == nil {
+			t.Fatalf("Expected the content store of tile %d to fail", tileID)
+		}
+	}
+	if storeCalls != 6 {
+		t.Errorf("Expected 3 attempts for each tile but got %d", storeCalls)
+	}
+	deadLetters, err := th.deadLetters.list(1)
+	if err != nil {
+		t.Fatalf("Error listing the dead letters: %v", err)
+	}
+	if len(deadLetters) != 2 || deadLetters[0].TileID != 1 || deadLetters[0].Attempts != 3 || deadLetters[0].Reason != "storage unavailable" {
+		t.Fatalf("Unexpected dead letters %v", deadLetters)
+	}
+
+	atomic.StoreInt32(&storeFailures, 0)
+	if _, err = th.retryDeadLetters(1, []int64{1}); err != nil {
+		t.Fatalf("Error retrying tile 1: %v", err)
+	}
+	for i := 0; i < 100; i++ {
+		if deadLetters, _ = th.deadLetters.list(1); len(deadLetters) == 1 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(deadLetters) != 1 || deadLetters[0].TileID != 2 {
+		t.Fatalf("Expected only tile 2 to be left in the dead letters but got %v", deadLetters)
+	}
+	if _, err = os.Stat(deadLetters[0].TmpTileFile); err != nil {
+		t.Errorf("Expected the content of tile 2 to be kept until it's discarded: %v", err)
+	}
+
+	if _, err = th.discardDeadLetters(1, []int64{3}); err == nil {
+		t.Error("Expected an error when discarding a tile that is not dead lettered")
+	}
+	if _, err = th.discardDeadLetters(1, nil); err != nil {
+		t.Fatalf("Error discarding the dead letters: %v", err)
+	}
+	if deadLetters, _ = th.deadLetters.list(1); len(deadLetters) != 0 {
+		t.Errorf("Expected no dead letters after discarding them but got %v", deadLetters)
+	}
+	if _, err = os.Stat(filepath.Join(dataDir, "1", "tile2.tif")); !os.IsNotExist(err) {
+		t.Errorf("Expected the content of the discarded tile to be removed: %v", err)
+	}
+}
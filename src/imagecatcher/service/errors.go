@@ -0,0 +1,131 @@
+package service
+
+import (
+	"fmt"
+	"net/http"
+
+	"imagecatcher/protocol"
+)
+
+// ErrorCode identifies the category of a tile capture error. The codes are sent to the
+// acquisition clients so the values of the existing codes must never change.
+type ErrorCode int16
+
+const (
+	// ErrCodeNone - the request was successful
+	ErrCodeNone ErrorCode = iota
+	// ErrCodeInternal - unclassified error
+	ErrCodeInternal
+	// ErrCodeInvalidRequest - the request could not be decoded or it has invalid parameters; resending the same request will fail again
+	ErrCodeInvalidRequest
+	// ErrCodeUnsupportedVersion - the request version does not match the negotiated protocol version
+	ErrCodeUnsupportedVersion
+	// ErrCodeChecksumMismatch - the content checksum does not match the checksum sent with the request; the tile should be resent
+	ErrCodeChecksumMismatch
+	// ErrCodeUnknownAcquisition - the acquisition has not been started
+	ErrCodeUnknownAcquisition
+	// ErrCodeQueueTimeout - the processing queues are full; the client should slow down and resend the tile
+	ErrCodeQueueTimeout
+	// ErrCodeMetadataStore - the tile metadata could not be persisted
+	ErrCodeMetadataStore
+	// ErrCodeContentStore - the tile content could not be stored or verified
+	ErrCodeContentStore
+	// ErrCodeInvalidTileImage - the tile content is not an image that matches the camera configuration; resending the same tile will fail again
+	ErrCodeInvalidTileImage
+	// ErrCodeAcquisitionStopped - the acquisition was aborted or it failed; it must be reopened before it can receive tiles
+	ErrCodeAcquisitionStopped
+)
+
+// String ErrorCode string representation
+func (c ErrorCode) String() string {
+	switch c {
+	case ErrCodeNone:
+		return "NONE"
+	case ErrCodeInternal:
+		return "INTERNAL_ERROR"
+	case ErrCodeInvalidRequest:
+		return "INVALID_REQUEST"
+	case ErrCodeUnsupportedVersion:
+		return "UNSUPPORTED_VERSION"
+	case ErrCodeChecksumMismatch:
+		return "CHECKSUM_MISMATCH"
+	case ErrCodeUnknownAcquisition:
+		return "UNKNOWN_ACQUISITION"
+	case ErrCodeQueueTimeout:
+		return "QUEUE_TIMEOUT"
+	case ErrCodeMetadataStore:
+		return "METADATA_STORE_ERROR"
+	case ErrCodeContentStore:
+		return "CONTENT_STORE_ERROR"
+	case ErrCodeInvalidTileImage:
+		return "INVALID_TILE_IMAGE"
+	case ErrCodeAcquisitionStopped:
+		return "ACQUISITION_STOPPED"
+	default:
+		return "INVALID"
+	}
+}
+
+// httpStatus returns the HTTP status corresponding to the error code
+func (c ErrorCode) httpStatus() int {
+	switch c {
+	case ErrCodeNone:
+		return http.StatusOK
+	case ErrCodeInvalidRequest, ErrCodeUnsupportedVersion, ErrCodeChecksumMismatch, ErrCodeInvalidTileImage:
+		return http.StatusBadRequest
+	case ErrCodeUnknownAcquisition:
+		return http.StatusNotFound
+	case ErrCodeQueueTimeout:
+		return http.StatusServiceUnavailable
+	case ErrCodeAcquisitionStopped:
+		return http.StatusConflict
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// CaptureError is a tile capture error classified by an error code
+type CaptureError struct {
+	Code ErrorCode
+	Err  error
+}
+
+// Error returns the message of the underlying error
+func (e *CaptureError) Error() string {
+	return e.Err.Error()
+}
+
+// AcqStateError is returned when an acquisition cannot change from its current state to the requested state
+type AcqStateError struct {
+	AcqUID                 uint64
+	CurrentState, NewState string
+}
+
+// Error returns the error message
+func (e *AcqStateError) Error() string {
+	return fmt.Sprintf("Acquisition %d cannot change from %s to %s", e.AcqUID, e.CurrentState, e.NewState)
+}
+
+// newCaptureError classifies the error with the given code unless the error is nil or it is already classified
+func newCaptureError(code ErrorCode, err error) error {
+	if err == nil || captureErrorCode(err) != ErrCodeInternal {
+		return err
+	}
+	return &CaptureError{Code: code, Err: err}
+}
+
+// captureErrorCode returns the code of the given error; errors that were not classified are internal errors
+func captureErrorCode(err error) ErrorCode {
+	switch e := err.(type) {
+	case nil:
+		return ErrCodeNone
+	case *CaptureError:
+		return e.Code
+	case *protocol.ChecksumMismatchError:
+		return ErrCodeChecksumMismatch
+	}
+	if err == ErrInvalidTileFileName {
+		return ErrCodeInvalidRequest
+	}
+	return ErrCodeInternal
+}
@@ -0,0 +1,61 @@
+package service
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+
+	"imagecatcher/models"
+	"imagecatcher/protocol"
+)
+
+func TestCaptureErrorCode(t *testing.T) {
+	testData := []struct {
+		err            error
+		expectedCode   ErrorCode
+		expectedStatus int
+	}{
+		{nil, ErrCodeNone, http.StatusOK},
+		{fmt.Errorf("unclassified"), ErrCodeInternal, http.StatusInternalServerError},
+		{ErrInvalidTileFileName, ErrCodeInvalidRequest, http.StatusBadRequest},
+		{&protocol.ChecksumMismatchError{}, ErrCodeChecksumMismatch, http.StatusBadRequest},
+		{&CaptureError{Code: ErrCodeQueueTimeout, Err: fmt.Errorf("timeout")}, ErrCodeQueueTimeout, http.StatusServiceUnavailable},
+		{&CaptureError{Code: ErrCodeUnknownAcquisition, Err: fmt.Errorf("not found")}, ErrCodeUnknownAcquisition, http.StatusNotFound},
+		{newCaptureError(ErrCodeMetadataStore, fmt.Errorf("db error")), ErrCodeMetadataStore, http.StatusInternalServerError},
+		{&CaptureError{Code: ErrCodeInvalidTileImage, Err: fmt.Errorf("invalid image")}, ErrCodeInvalidTileImage, http.StatusBadRequest},
+		{&CaptureError{Code: ErrCodeAcquisitionStopped, Err: fmt.Errorf("aborted")}, ErrCodeAcquisitionStopped, http.StatusConflict},
+		// an error that is already classified keeps its code
+		{newCaptureError(ErrCodeInvalidRequest, &protocol.ChecksumMismatchError{}), ErrCodeChecksumMismatch, http.StatusBadRequest},
+	}
+	for i, td := range testData {
+		code := captureErrorCode(td.err)
+		if code != td.expectedCode {
+			t.Errorf("Test %d: expected error code %s but got %s", i, td.expectedCode, code)
+		}
+		if code.httpStatus() != td.expectedStatus {
+			t.Errorf("Test %d: expected HTTP status %d but got %d", i, td.expectedStatus, code.httpStatus())
+		}
+	}
+	if newCaptureError(ErrCodeInternal, nil) != nil {
+		t.Error("Expected a nil error to remain nil")
+	}
+}
+
+func TestStoreTileRejectsStoppedAcquisitions(t *testing.T) {
+	s := &imageCatcherServiceImpl{}
+	testData := []struct {
+		state        string
+		expectedCode ErrorCode
+	}{
+		{models.AcqAbortedState, ErrCodeAcquisitionStopped},
+		{models.AcqFailedState, ErrCodeAcquisitionStopped},
+		{models.AcqArchivedState, ErrCodeInvalidRequest},
+	}
+	for _, td := range testData {
+		acqMosaic := &models.TemImageMosaic{Acquisition: models.Acquisition{AcqUID: 1, AcqState: td.state}}
+		_, err := s.StoreTile(acqMosaic, &TileParams{})
+		if code := captureErrorCode(err); code != td.expectedCode {
+			t.Errorf("Expected a tile of a %s acquisition to be rejected with %s but got %s: %v", td.state, td.expectedCode, code, err)
+		}
+	}
+}
@@ -87,6 +87,10 @@ func (s fakeImageCatcherService) EndAcquisition(acqID uint64) error {
 	return nil
 }
 
+func (s fakeImageCatcherService) ReconcileStoredImages(acqID uint64) (*StoredImageReconciliation, error) {
+	return &StoredImageReconciliation{AcqUID: acqID}, nil
+}
+
 func (s fakeImageCatcherService) StoreAcquisitionFile(acqMosaic *models.TemImageMosaic, f *FileParams, fObj *models.FileObject) (err error) {
 	err = nil
 	defer func() {
@@ -108,6 +112,10 @@ func (s fakeImageCatcherService) GetMosaic(acqID uint64) (*models.TemImageMosaic
 	}, nil
 }
 
+func (s fakeImageCatcherService) GetCameraConfiguration(acqMosaic *models.TemImageMosaic, camera int) (*models.TemCameraConfiguration, error) {
+	return &models.TemCameraConfiguration{Camera: camera}, nil
+}
+
 func (s fakeImageCatcherService) GetAcquisitions(acqFilter *models.AcquisitionFilter) ([]*models.Acquisition, error) {
 	return []*models.Acquisition{}, nil
 }
@@ -0,0 +1,69 @@
+package service
+
+import (
+	"bytes"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"time"
+
+	"imagecatcher/checksum"
+	"imagecatcher/models"
+)
+
+// storedContentETag returns a strong ETag derived from the stored checksum of the file object; the representation
+// distinguishes the converted representations of the same content. The ETag is empty if the checksum is not known.
+func storedContentETag(fObj *models.FileObject, representation string) string {
+	if len(fObj.Checksum) == 0 {
+		return ""
+	}
+	algorithm := fObj.ChecksumAlgorithm
+	if algorithm == "" {
+		algorithm = checksum.DefaultAlgorithm.String()
+	}
+	tag := strings.ToLower(algorithm) + "-" + hex.EncodeToString(fObj.Checksum)
+	if representation != "" {
+		tag += "-" + representation
+	}
+	return `"` + tag + `"`
+}
+
+// checkNotModified sets the ETag of the response and if the If-None-Match header of the request matches it,
+// it writes 304 (Not Modified) and returns true so that the content does not have to be retrieved at all
+func checkNotModified(w http.ResponseWriter, r *http.Request, etag string) bool {
+	if etag == "" {
+		return false
+	}
+	w.Header().Set("ETag", etag)
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+	if !etagMatches(r.Header.Get("If-None-Match"), etag) {
+		return false
+	}
+	w.Header().Del("Content-Type")
+	w.WriteHeader(http.StatusNotModified)
+	return true
+}
+
+// etagMatches checks the ETag against an If-None-Match header value using the weak comparison
+func etagMatches(ifNoneMatch, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
+// serveStoredContent writes the content with its length and last modified time; the conditional and the range headers
+// of the request are honoured so the response may be 304 (Not Modified), 206 (Partial Content) or 416 (Range Not Satisfiable).
+func serveStoredContent(w http.ResponseWriter, r *http.Request, contentType string, lastModified *time.Time, content []byte) {
+	var modtime time.Time
+	if lastModified != nil {
+		modtime = *lastModified
+	}
+	w.Header().Set("Content-Type", contentType)
+	http.ServeContent(w, r, "", modtime, bytes.NewReader(content))
+}
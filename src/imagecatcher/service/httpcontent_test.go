@@ -0,0 +1,80 @@
+package service
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"imagecatcher/models"
+)
+
+func TestStoredContentETag(t *testing.T) {
+	fObj := &models.FileObject{Checksum: []byte{0xab, 0xcd}, ChecksumAlgorithm: "SHA256"}
+	if etag := storedContentETag(fObj, ""); etag != `"sha256-abcd"` {
+		t.Errorf("Unexpected ETag %s", etag)
+	}
+	if etag := storedContentETag(fObj, "png.d2"); etag != `"sha256-abcd-png.d2"` {
+		t.Errorf("Unexpected ETag %s for a converted representation", etag)
+	}
+	if etag := storedContentETag(&models.FileObject{}, ""); etag != "" {
+		t.Errorf("Expected no ETag without a checksum but got %s", etag)
+	}
+	for _, ifNoneMatch := range []string{`"sha256-abcd"`, `"other", W/"sha256-abcd"`, "*"} {
+		if !etagMatches(ifNoneMatch, `"sha256-abcd"`) {
+			t.Errorf("Expected %s to match", ifNoneMatch)
+		}
+	}
+	if etagMatches(`"sha256-abcd-png"`, `"sha256-abcd"`) {
+		t.Error("Expected the ETags of different representations not to match")
+	}
+}
+
+func TestServeTileContent(t *testing.T) {
+	content := []byte("0123456789")
+	lastModified := time.Date(2026, 3, 4, 9, 25, 22, 0, time.UTC)
+	tileImage := &models.TemImage{
+		TileFile:          models.FileObject{Checksum: []byte{0x01, 0x02}, ChecksumAlgorithm: "MD5"},
+		AcquiredTimestamp: &lastModified,
+	}
+	options := &tileImageOptions{format: tiffImageFormat, downsample: 1}
+	serve := func(headers map[string]string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/service/v1/tile/1/content", nil)
+		for name, value := range headers {
+			r.Header.Set(name, value)
+		}
+		w := httptest.NewRecorder()
+		if !checkTileContentNotModified(w, r, tileImage, options) {
+			writeTileContent(w, r, tileImage, content, options)
+		}
+		return w
+	}
+
+	w := serve(nil)
+	if w.Code != http.StatusOK || w.Body.String() != string(content) {
+		t.Fatalf("Expected the entire content but got %d: %s", w.Code, w.Body.String())
+	}
+	if w.Header().Get("ETag") != `"md5-0102"` || w.Header().Get("Content-Length") != "10" ||
+		w.Header().Get("Last-Modified") != "Wed, 04 Mar 2026 09:25:22 GMT" || w.Header().Get("Accept-Ranges") != "bytes" {
+		t.Errorf("Unexpected headers %v", w.Header())
+	}
+
+	if w = serve(map[string]string{"If-None-Match": `"md5-0102"`}); w.Code != http.StatusNotModified || w.Body.Len() != 0 {
+		t.Errorf("Expected %d for a matching ETag but got %d", http.StatusNotModified, w.Code)
+	}
+	if w = serve(map[string]string{"If-Modified-Since": "Wed, 04 Mar 2026 09:25:22 GMT"}); w.Code != http.StatusNotModified {
+		t.Errorf("Expected %d for an unmodified tile but got %d", http.StatusNotModified, w.Code)
+	}
+
+	w = serve(map[string]string{"Range": "bytes=2-5"})
+	if w.Code != http.StatusPartialContent || w.Body.String() != "2345" || w.Header().Get("Content-Range") != "bytes 2-5/10" {
+		t.Errorf("Expected bytes 2-5 but got %d %s: %s", w.Code, w.Header().Get("Content-Range"), w.Body.String())
+	}
+	if w = serve(map[string]string{"Range": "bytes=20-"}); w.Code != http.StatusRequestedRangeNotSatisfiable {
+		t.Errorf("Expected %d for a range past the content but got %d", http.StatusRequestedRangeNotSatisfiable, w.Code)
+	}
+	// a range is ignored if the content changed
+	if w = serve(map[string]string{"Range": "bytes=2-5", "If-Range": `"md5-ffff"`}); w.Code != http.StatusOK || w.Body.Len() != 10 {
+		t.Errorf("Expected the entire content for a stale If-Range but got %d", w.Code)
+	}
+}
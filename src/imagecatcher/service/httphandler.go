@@ -2,8 +2,7 @@ package service
 
 import (
 	"bytes"
-	"crypto/md5"
-	"crypto/sha1"
+	"context"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
@@ -19,9 +18,9 @@ import (
 	"strings"
 	"time"
 
+	"imagecatcher/checksum"
 	"imagecatcher/logger"
 	"imagecatcher/models"
-	"imagecatcher/utils"
 )
 
 // httpServerHandler handler for HTTP requests
@@ -32,6 +31,7 @@ type httpServerHandler struct {
 	trh             *TileRequestHandler
 	tileDistributor TileDistributor
 	configurator    Configurator
+	sir             *StoredImageReconciler
 	messageNotifier MessageNotifier
 }
 
@@ -50,10 +50,22 @@ func init() {
 
 // Serve implementation of a ServerHandler method
 func (h *httpServerHandler) Serve() error {
+	var err error
 	if h.Listener == nil {
-		return h.httpImpl.ListenAndServe()
+		err = h.httpImpl.ListenAndServe()
+	} else {
+		err = h.httpImpl.Serve(h.Listener)
+	}
+	if err == http.ErrServerClosed {
+		return nil
 	}
-	return h.httpImpl.Serve(h.Listener)
+	return err
+}
+
+// Shutdown implementation of a ServerHandler method. It stops accepting new connections
+// and it waits until the active requests complete or until the context is done.
+func (h *httpServerHandler) Shutdown(ctx context.Context) error {
+	return h.httpImpl.Shutdown(ctx)
 }
 
 // NewHTTPServerHandler creates an instance of an HTTPHandler
@@ -62,6 +74,7 @@ func NewHTTPServerHandler(l net.Listener,
 	trh *TileRequestHandler,
 	td TileDistributor,
 	configurator Configurator,
+	sir *StoredImageReconciler,
 	messageNotifier MessageNotifier,
 	keepAlives bool) ServerHandler {
 	router := httprouter.New()
@@ -76,13 +89,18 @@ func NewHTTPServerHandler(l net.Listener,
 		trh:             trh,
 		tileDistributor: td,
 		configurator:    configurator,
+		sir:             sir,
 		messageNotifier: messageNotifier,
 	}
 
 	router.GET("/service/v1/ping", h.ping)
+	router.GET("/service/v1/tile-buffers", h.getTileBufferStats)
 	// Acquisition Capture Endpoints
 	router.POST("/service/v1/start-acquisition", h.startAcquisition)
 	router.POST("/service/v1/end-acquisition/:acqid", h.endAcquisition)
+	router.POST("/service/v1/acquisition/:acqid/abort", h.abortAcquisition)
+	router.POST("/service/v1/acquisition/:acqid/reopen", h.reopenAcquisition)
+	router.PUT("/service/v1/acquisition/:acqid/state", h.updateAcquisitionState)
 	router.POST("/service/v1/create-rois/:acqid", h.createROIs)
 	router.POST("/service/v1/capture-image-content/:acqid", h.captureImage)
 	router.POST("/service/v1/store-ancillary-files/:acqid", h.storeAncillaryFiles)
@@ -93,11 +111,26 @@ func NewHTTPServerHandler(l net.Listener,
 	router.GET("/service/v1/acquisition/:acqid/tiles", h.getAcqTiles)
 	router.GET("/service/v1/acquisition/:acqid/tile/:col/:row", h.getTileByTileCoord)
 	router.GET("/service/v1/acquisition/:acqid/tile/:col/:row/content", h.getTileContentByTileCoord)
+	router.HEAD("/service/v1/acquisition/:acqid/tile/:col/:row/content", h.getTileContentByTileCoord)
 	router.GET("/service/v1/verify-tile/:acqid/tile/:tileid", h.verifyTile)
+	router.GET("/service/v1/acquisition/:acqid/scrub-status", h.getReplicaScrubStatus)
+	router.GET("/service/v1/acquisition/:acqid/completeness", h.getAcquisitionCompleteness)
+	router.GET("/service/v1/acquisition/:acqid/timings", h.getTileTimings)
+	router.POST("/service/v1/acquisition/:acqid/reconcile-stored-images", h.reconcileStoredImages)
+	router.GET("/service/v1/acquisition/:acqid/stored-image-discrepancies", h.getStoredImageDiscrepancies)
+	router.POST("/service/v1/acquisition/:acqid/verify", h.verifyAcquisition)
+	router.POST("/service/v1/verify-acquisitions", h.verifyAcquisitions)
+	router.GET("/service/v1/verification/:jobid", h.getVerification)
+	router.GET("/service/v1/verification/:jobid/report", h.getVerificationReport)
+	// Dead Letters Endpoints
+	router.GET("/service/v1/acquisition/:acqid/dead-letters", h.getDeadLetters)
+	router.POST("/service/v1/acquisition/:acqid/dead-letters/retry", h.retryDeadLetters)
+	router.DELETE("/service/v1/acquisition/:acqid/dead-letters", h.discardDeadLetters)
 	// Tile Data Endpoints
 	router.GET("/service/v1/tiles", h.getAllTiles)
 	router.GET("/service/v1/tile/:tileid", h.getTileByTileID)
 	router.GET("/service/v1/tile/:tileid/content", h.getTileContentByTileID)
+	router.HEAD("/service/v1/tile/:tileid/content", h.getTileContentByTileID)
 	// Calibration Endpoints
 	router.POST("/service/v1/calibrations", h.createCalibrations)
 	router.GET("/service/v1/calibrations", h.getCalibrations)
@@ -120,6 +153,12 @@ func (h *httpServerHandler) ping(w http.ResponseWriter, r *http.Request, params
 	w.WriteHeader(http.StatusOK)
 }
 
+// getTileBufferStats returns the usage of the memory reserved for the tile requests
+func (h *httpServerHandler) getTileBufferStats(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(h.trh.tileBuffers.Stats())
+}
+
 func (h *httpServerHandler) writeQueueStatus(w http.ResponseWriter) {
 	systemStatus, tileQueueStatus, contentQueueStatus := h.trh.getProcessingQueuesStatus()
 	w.Header().Set("System Status", systemStatus.String())
@@ -127,6 +166,18 @@ func (h *httpServerHandler) writeQueueStatus(w http.ResponseWriter) {
 	w.Header().Set("Content Queue Status", contentQueueStatus.String())
 }
 
+// writeBackpressureHints sets the hints for the acquisition clients in the response headers
+func (h *httpServerHandler) writeBackpressureHints(w http.ResponseWriter, perr error) backpressureHints {
+	hints := h.trh.computeBackpressureHints(perr)
+	if hints.retryAfter > 0 {
+		// Retry-After is expressed in seconds
+		w.Header().Set("Retry-After", strconv.FormatInt(int64((hints.retryAfter+time.Second-1)/time.Second), 10))
+	}
+	w.Header().Set("Retry-After-Ms", strconv.FormatUint(uint64(durationToMillis(hints.retryAfter)), 10))
+	w.Header().Set("Recommended-Rate-Ms", strconv.FormatUint(uint64(durationToMillis(hints.recommendedRate)), 10))
+	return hints
+}
+
 func (h *httpServerHandler) startAcquisition(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
 	w.Header().Set("Content-Type", "application/json")
 
@@ -192,6 +243,21 @@ func writeError(w http.ResponseWriter, errmsgs interface{}, status int) {
 	w.Write(errresp)
 }
 
+// writeCaptureError writes the error together with its code; errors that are not classified yet are classified with the default code
+func writeCaptureError(w http.ResponseWriter, err error, defaultCode ErrorCode) {
+	code := captureErrorCode(newCaptureError(defaultCode, err))
+	w.WriteHeader(code.httpStatus())
+	errresp, merr := json.Marshal(map[string]interface{}{
+		"errormessage": err.Error(),
+		"errorcode":    code,
+		"errorname":    code.String(),
+	})
+	if merr != nil {
+		logger.Errorf("Error marshalling the error response: %v", merr)
+	}
+	w.Write(errresp)
+}
+
 func formatAcquisitionResponse(acq models.Acquisition) map[string]interface{} {
 	r := make(map[string]interface{})
 	r["uid"] = acq.AcqUID
@@ -219,6 +285,8 @@ func (h *httpServerHandler) endAcquisition(w http.ResponseWriter, r *http.Reques
 	if err = h.imageCatcher.EndAcquisition(acqID); err != nil {
 		logger.Error("Error finishing the acquisition: ", acqID, err)
 		writeError(w, err, http.StatusInternalServerError)
+	} else {
+		h.sir.Schedule(acqID)
 	}
 	// perform a quick verification to see if the current acquisition still has tiles in the create state
 	var acqFilter models.AcquisitionFilter
@@ -232,6 +300,57 @@ func (h *httpServerHandler) endAcquisition(w http.ResponseWriter, r *http.Reques
 	}
 }
 
+func (h *httpServerHandler) abortAcquisition(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	h.changeAcquisitionState(w, params, models.AcqAbortedState)
+}
+
+func (h *httpServerHandler) reopenAcquisition(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	h.changeAcquisitionState(w, params, models.AcqAcquiringState)
+}
+
+func (h *httpServerHandler) updateAcquisitionState(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	newState := getQueryParamAsString(r, "state", "")
+	if newState == "" {
+		w.Header().Set("Content-Type", "application/json")
+		err := fmt.Errorf("State parameter is required")
+		logger.Error(err)
+		writeError(w, err, http.StatusBadRequest)
+		return
+	}
+	h.changeAcquisitionState(w, params, newState)
+}
+
+func (h *httpServerHandler) changeAcquisitionState(w http.ResponseWriter, params httprouter.Params, newState string) {
+	w.Header().Set("Content-Type", "application/json")
+	acqID, err := parseRequiredParamValueAsUint64("acqid", params.ByName("acqid"))
+	if err != nil {
+		logger.Error(err)
+		writeError(w, err, http.StatusBadRequest)
+		return
+	}
+	acq, err := h.imageCatcher.ChangeAcquisitionState(acqID, newState)
+	if err != nil {
+		logger.Error(err)
+		switch err.(type) {
+		case *AcqStateError:
+			writeError(w, err, http.StatusConflict)
+		case *CaptureError:
+			writeError(w, err, captureErrorCode(err).httpStatus())
+		default:
+			writeError(w, err, http.StatusInternalServerError)
+		}
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{
+		"acq_id":        acq.AcqUID,
+		"state":         acq.AcqState,
+		"acq_completed": acq.Completed,
+	}); err != nil {
+		logger.Error("Error encoding the acquisition state as JSON", err)
+	}
+}
+
 func (h *httpServerHandler) storeAncillaryFiles(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
 	var acqID uint64
 	var err error
@@ -249,10 +368,16 @@ func (h *httpServerHandler) storeAncillaryFiles(w http.ResponseWriter, r *http.R
 		writeError(w, err, http.StatusBadRequest)
 		return
 	}
-	h.processAncillaryFiles(w, r, acqMosaic)
+	// stored image lists of an acquisition that already ended are reconciled right away;
+	// otherwise they are reconciled when the acquisition ends
+	if h.processAncillaryFiles(w, r, acqMosaic) && acqMosaic.IsFinished() {
+		h.sir.Schedule(acqID)
+	}
 }
 
-func (h *httpServerHandler) processAncillaryFiles(w http.ResponseWriter, r *http.Request, acqMosaic *models.TemImageMosaic) {
+// processAncillaryFiles stores the ancillary files from the request and returns true if a stored image list was stored
+func (h *httpServerHandler) processAncillaryFiles(w http.ResponseWriter, r *http.Request, acqMosaic *models.TemImageMosaic) bool {
+	var storedImageList bool
 	err := r.ParseMultipartForm(1 << 20)
 	if err != nil {
 		if err == http.ErrNotMultipart && len(r.PostForm) == 0 && r.MultipartForm == nil {
@@ -260,12 +385,12 @@ func (h *httpServerHandler) processAncillaryFiles(w http.ResponseWriter, r *http
 			logger.Infof("Not a multipart/form encoded request")
 			w.WriteHeader(http.StatusOK)
 			w.Write([]byte("{}"))
-			return
+			return false
 		}
 		parseReqErr := fmt.Errorf("Error parsing the request: %v", err)
 		logger.Error(parseReqErr)
 		writeError(w, parseReqErr, http.StatusBadRequest)
-		return
+		return false
 	}
 	fhs := r.MultipartForm.File["ancillary-file"]
 	var afResults []map[string]interface{}
@@ -316,6 +441,7 @@ func (h *httpServerHandler) processAncillaryFiles(w http.ResponseWriter, r *http
 			afResult["path"] = fObj.Path
 			afResult["jfs_path"] = fObj.JfsPath
 			afResult["jfs_key"] = fObj.JfsKey
+			storedImageList = storedImageList || extractAncillaryFileType(fh.Filename) == storedImageListFileType
 		}
 	}
 	if status == 0 {
@@ -329,10 +455,11 @@ func (h *httpServerHandler) processAncillaryFiles(w http.ResponseWriter, r *http
 		internalErr := fmt.Errorf("Error marshalling the result %v: %v", result, merr)
 		logger.Error(internalErr)
 		writeError(w, internalErr, http.StatusInternalServerError)
-		return
+		return storedImageList
 	}
 	w.WriteHeader(status)
 	w.Write(respBytes)
+	return storedImageList
 }
 
 // extractFileField - extracts the file field from the multipart if the multipart form fieldname matches the provided one
@@ -434,7 +561,7 @@ func (h *httpServerHandler) captureImage(w http.ResponseWriter, r *http.Request,
 	if err != nil {
 		acqIDParseErr := fmt.Errorf("Error while parsing the acqId parameter %v", err)
 		logger.Error(acqIDParseErr)
-		writeError(w, acqIDParseErr, http.StatusBadRequest)
+		writeCaptureError(w, acqIDParseErr, ErrCodeInvalidRequest)
 		return
 	}
 
@@ -444,10 +571,19 @@ func (h *httpServerHandler) captureImage(w http.ResponseWriter, r *http.Request,
 	tileProcessingJob.execCtx.StartTime = startTime
 	defer tileProcessingJob.clear()
 
+	if r.ContentLength > 0 {
+		// reserve a little bit more than the request length to avoid reallocations while reading the content
+		if tileProcessingJob.buffer, err = h.trh.acquireTileBuffer(int(r.ContentLength) + bytes.MinRead + 1); err != nil {
+			logger.Errorf("Error acquiring the buffer for %s (%d bytes): %v", r.URL, r.ContentLength, err)
+			h.writeBackpressureHints(w, err)
+			writeCaptureError(w, err, ErrCodeQueueTimeout)
+			return
+		}
+	}
 	err = extractTileJobParams(r, tileProcessingJob)
 	if err != nil {
 		logger.Errorf("Error extracting the tile parameters (%v): %v", time.Since(startTime), err)
-		writeError(w, err, http.StatusBadRequest)
+		writeCaptureError(w, err, ErrCodeInvalidRequest)
 		return
 	}
 	logger.Infof("End request parsing for %d:%s (%d)  %v",
@@ -458,11 +594,16 @@ func (h *httpServerHandler) captureImage(w http.ResponseWriter, r *http.Request,
 		logger.Errorf("Error processing the tile parameters for %d:%s (%d)  %v: %v",
 			tileProcessingJob.acqID, tileProcessingJob.tileParams.Name,
 			tileProcessingJob.tileParams.ContentLen, time.Since(startTime), err)
-		writeError(w, err, http.StatusInternalServerError)
+		h.writeBackpressureHints(w, err)
+		writeCaptureError(w, err, ErrCodeInternal)
 		return
 	}
 	h.writeQueueStatus(w)
-	json.NewEncoder(w).Encode(formatCapturedImageResponse(tileInfo))
+	hints := h.writeBackpressureHints(w, nil)
+	capturedImageResponse := formatCapturedImageResponse(tileInfo)
+	capturedImageResponse["retry_after_ms"] = durationToMillis(hints.retryAfter)
+	capturedImageResponse["recommended_rate_ms"] = durationToMillis(hints.recommendedRate)
+	json.NewEncoder(w).Encode(capturedImageResponse)
 	logger.Infof("End captureImage for %d:%s (%d)  %v",
 		tileProcessingJob.acqID, tileProcessingJob.tileParams.Name, tileProcessingJob.tileParams.ContentLen, time.Since(startTime))
 }
@@ -543,17 +684,22 @@ func extractTileParam(p *multipart.Part, tileJobParams *tileProcessingJob) error
 			logger.Errorf("Error decoding the checksum %s: %v\n", checksum, err)
 		}
 		return nil
+	case "checksum-algorithm":
+		var formFieldBuf bytes.Buffer
+		if _, err = io.Copy(&formFieldBuf, p); err != nil {
+			return fmt.Errorf("Error extracting the checksum algorithm: %v", err)
+		}
+		tileJobParams.tileParams.ChecksumAlgorithm, err = checksum.Lookup(formFieldBuf.String())
+		return err
 	case "tile-file":
-		formFieldBuf := new(bytes.Buffer)
 		if tileJobParams.tileParams.Name == "" {
 			fName := p.FileName()
 			logger.Debugf("Extract tile params from %s", fName)
 			tileJobParams.tileParams.ExtractTileParamsFromURL(fName)
 		}
-		if _, err = io.Copy(formFieldBuf, p); err != nil {
+		if tileJobParams.tileParams.Content, err = readTileContent(p, tileJobParams); err != nil {
 			return fmt.Errorf("Error reading the multipart file buffer: %v\n", err)
 		}
-		tileJobParams.tileParams.Content = formFieldBuf.Bytes()
 		tileJobParams.tileParams.ContentLen = len(tileJobParams.tileParams.Content)
 		logger.Debugf("Extracted tile content %s (%d bytes) %v", tileJobParams.tileParams.Name, tileJobParams.tileParams.ContentLen, time.Since(startTime))
 		return nil
@@ -562,6 +708,19 @@ func extractTileParam(p *multipart.Part, tileJobParams *tileProcessingJob) error
 	}
 }
 
+// readTileContent reads the tile content into the job's request buffer. Requests without a content length
+// don't have a pooled buffer so their content is read into a buffer that grows as needed.
+func readTileContent(r io.Reader, tileJob *tileProcessingJob) ([]byte, error) {
+	var contentBuffer *bytes.Buffer
+	if tileJob.buffer != nil {
+		contentBuffer = bytes.NewBuffer(tileJob.buffer.Bytes()[0:0])
+	} else {
+		contentBuffer = bytes.NewBuffer(make([]byte, 0, 1024*1024))
+	}
+	_, err := io.Copy(contentBuffer, r)
+	return contentBuffer.Bytes(), err
+}
+
 func extractTileJobParamsFromRequestBody(r *http.Request, tileJobParams *tileProcessingJob) (err error) {
 	startTime := time.Now()
 	tileFileName := r.URL.Query().Get("tile-filename")
@@ -575,6 +734,10 @@ func extractTileJobParamsFromRequestBody(r *http.Request, tileJobParams *tilePro
 	}
 	tileJobParams.tileParams.Name = tileFileName
 
+	if tileJobParams.tileParams.ChecksumAlgorithm, err = checksum.Lookup(r.URL.Query().Get("checksum-algorithm")); err != nil {
+		logger.Errorf("%s", err)
+		return err
+	}
 	checksum := r.URL.Query().Get("checksum")
 	if checksum != "" {
 		tileJobParams.tileParams.Checksum, err = hex.DecodeString(checksum)
@@ -582,19 +745,9 @@ func extractTileJobParamsFromRequestBody(r *http.Request, tileJobParams *tilePro
 			logger.Errorf("Error decoding the checksum %s: %v\n", checksum, err)
 		}
 	}
-	var requestBuffer *bytes.Buffer
-	bodyLen := r.ContentLength
-	if bodyLen > 0 {
-		requestBufferPtr, requestBufferBytes := utils.Alloc(uint32(bodyLen) + bytes.MinRead + 1)
-		requestBuffer = bytes.NewBuffer(requestBufferBytes[0:0])
-		tileJobParams.memPtr = requestBufferPtr
-	} else {
-		requestBuffer = bytes.NewBuffer(make([]byte, 0, 1024*1024))
-	}
-	if _, err = io.Copy(requestBuffer, r.Body); err != nil {
+	if tileJobParams.tileParams.Content, err = readTileContent(r.Body, tileJobParams); err != nil {
 		return fmt.Errorf("Error reading the request body: %v", err)
 	}
-	tileJobParams.tileParams.Content = requestBuffer.Bytes()
 	tileJobParams.tileParams.ContentLen = len(tileJobParams.tileParams.Content)
 	logger.Debugf("Extracted tile content %s (%d) %v", tileJobParams.tileParams.Name, tileJobParams.tileParams.ContentLen, time.Since(startTime))
 	return nil
@@ -628,6 +781,7 @@ func formatTileImageResponse(ti *models.TemImageROI) map[string]interface{} {
 	r["tile_jfs_path"] = ti.TileFile.JfsPath
 	r["tile_jfs_key"] = ti.TileFile.JfsKey
 	r["tile_file_checksum"] = hex.EncodeToString(ti.TileFile.Checksum)
+	r["tile_file_checksum_algorithm"] = ti.TileFile.ChecksumAlgorithm
 	r["image_url"] = ti.TileFile.LocationURL
 	if ti.AcquiredTimestamp != nil {
 		// the time comes in UTC but for display we convert it to local time
@@ -636,6 +790,8 @@ func formatTileImageResponse(ti *models.TemImageROI) map[string]interface{} {
 	} else {
 		r["tile_acquired"] = nil
 	}
+	r["tile_u8_hist_offset"] = ti.U8HistOffset
+	r["tile_u8_hist_scale"] = ti.U8HistScale
 	r["state"] = ti.State
 	r["section"] = ti.Roi.NominalSection
 	return r
@@ -714,6 +870,7 @@ func (h *httpServerHandler) getAcquisitions(w http.ResponseWriter, r *http.Reque
 	acqFilter.SampleName = getQueryParamAsString(r, "sample", "")
 	acqFilter.StackName = getQueryParamAsString(r, "stack", "")
 	acqFilter.MosaicType = getQueryParamAsString(r, "mosaic-type", "")
+	acqFilter.AcqState = getQueryParamAsString(r, "state", "")
 	acqFilter.RequiredStateForAtLeastOneTile = getQueryParamAsString(r, "exists-tile-in-state", "")
 	acqFilter.RequiredStateForAllTiles = getQueryParamAsString(r, "all-tiles-in-state", "")
 	if acqFilter.AcquiredInterval.From, err = getQueryParamAsTime(r, "acq-from", "", "20060102150405", "200601021504", "2006010215", "20060102"); err != nil {
@@ -801,6 +958,11 @@ func (h *httpServerHandler) getAllTiles(w http.ResponseWriter, r *http.Request,
 		writeError(w, err, http.StatusBadRequest)
 		return
 	}
+	if tileFilter.WithinMetricThresholds, err = getQueryParamAsBool(r, "within-metric-thresholds", false); err != nil {
+		logger.Error(err)
+		writeError(w, err, http.StatusBadRequest)
+		return
+	}
 
 	tiles, err := h.imageCatcher.GetTiles(&tileFilter)
 	if err != nil {
@@ -938,6 +1100,11 @@ func (h *httpServerHandler) getAcqTiles(w http.ResponseWriter, r *http.Request,
 		writeError(w, err, http.StatusBadRequest)
 		return
 	}
+	if tileFilter.WithinMetricThresholds, err = getQueryParamAsBool(r, "within-metric-thresholds", false); err != nil {
+		logger.Error(err)
+		writeError(w, err, http.StatusBadRequest)
+		return
+	}
 
 	tiles, err := h.imageCatcher.GetTiles(&tileFilter)
 	if err != nil {
@@ -1107,13 +1274,17 @@ func (h *httpServerHandler) getTileContentByTileID(w http.ResponseWriter, r *htt
 		tileID int64
 		err    error
 	)
-	w.Header().Set("Content-Type", "image/tiff")
-
 	if tileID, err = parseRequiredParamValueAsInt64("tileid", params.ByName("tileid")); err != nil {
 		logger.Error(err)
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	imageOptions, err := parseTileImageOptions(r)
+	if err != nil {
+		logger.Error(err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
 	tileInfo, err := h.imageCatcher.GetTile(tileID)
 	if err != nil {
@@ -1125,12 +1296,15 @@ func (h *httpServerHandler) getTileContentByTileID(w http.ResponseWriter, r *htt
 		http.Error(w, err.Error(), http.StatusNotFound)
 		return
 	}
+	if checkTileContentNotModified(w, r, &tileInfo.TemImage, imageOptions) {
+		return
+	}
 	tileContent, err := h.imageCatcher.RetrieveAcquisitionFile(&tileInfo.ImageMosaic, tileInfo.TileFile.JfsPath)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	w.Write(tileContent)
+	writeTileContent(w, r, &tileInfo.TemImage, tileContent, imageOptions)
 }
 
 func (h *httpServerHandler) getTileByTileCoord(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
@@ -1191,8 +1365,6 @@ func (h *httpServerHandler) getTileContentByTileCoord(w http.ResponseWriter, r *
 		tileFilter models.TileFilter
 		err        error
 	)
-	w.Header().Set("Content-Type", "image/tiff")
-
 	if tileFilter.AcqUID, err = parseRequiredParamValueAsUint64("acqid", params.ByName("acqid")); err != nil {
 		logger.Error(err)
 		http.Error(w, err.Error(), http.StatusBadRequest)
@@ -1208,6 +1380,12 @@ func (h *httpServerHandler) getTileContentByTileCoord(w http.ResponseWriter, r *
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	imageOptions, err := parseTileImageOptions(r)
+	if err != nil {
+		logger.Error(err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
 	tileFilter.CameraConfig.Camera = -1
 	tileFilter.Pagination.StartRecordIndex = 0
@@ -1243,12 +1421,15 @@ func (h *httpServerHandler) getTileContentByTileCoord(w http.ResponseWriter, r *
 		http.Error(w, err.Error(), http.StatusNotFound)
 		return
 	}
+	if checkTileContentNotModified(w, r, &tileInfo.TemImage, imageOptions) {
+		return
+	}
 	tileContent, err := h.imageCatcher.RetrieveAcquisitionFile(&tileInfo.ImageMosaic, tileInfo.TileFile.JfsPath)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	w.Write(tileContent)
+	writeTileContent(w, r, &tileInfo.TemImage, tileContent, imageOptions)
 }
 
 func (h *httpServerHandler) verifyTile(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
@@ -1264,7 +1445,7 @@ func (h *httpServerHandler) verifyTile(w http.ResponseWriter, r *http.Request, p
 		writeError(w, tileIDParseErr, http.StatusBadRequest)
 		return
 	}
-	checksumAlg := r.URL.Query().Get("checksum-algorithm")
+	checksumAlgName := r.URL.Query().Get("checksum-algorithm")
 
 	tileInfo, err := h.imageCatcher.GetTile(tileID)
 	if err != nil {
@@ -1295,20 +1476,27 @@ func (h *httpServerHandler) verifyTile(w http.ResponseWriter, r *http.Request, p
 		json.NewEncoder(w).Encode(tileResponse)
 		return
 	}
-	var checksum []byte
-	switch checksumAlg {
-	case "SHA1":
-		sha1Checksum := sha1.Sum(tileContent)
-		checksum = sha1Checksum[0:]
-	default:
-		checksumAlg = "MD5"
-		md5Checksum := md5.Sum(tileContent)
-		checksum = md5Checksum[0:]
+	if checksumAlgName == "" {
+		// by default use the algorithm of the stored checksum
+		checksumAlgName = tileInfo.TileFile.ChecksumAlgorithm
+	}
+	checksumAlg, err := checksum.Lookup(checksumAlgName)
+	if err != nil {
+		logger.Error(err)
+		writeError(w, err, http.StatusBadRequest)
+		return
+	}
+	calculatedChecksum, err := checksum.Sum(checksumAlg, tileContent)
+	if err != nil {
+		logger.Error(err)
+		writeError(w, err, http.StatusBadRequest)
+		return
 	}
-	tileResponse["calculatedChecksum"] = checksum
-	if bytes.Compare(checksum, tileInfo.TileFile.Checksum) != 0 {
+	tileResponse["calculatedChecksum"] = calculatedChecksum
+	tileResponse["checksumAlgorithm"] = checksumAlg.String()
+	if !bytes.Equal(calculatedChecksum, tileInfo.TileFile.Checksum) {
 		err := fmt.Errorf("%s checksum stored does not match the calculated checksum - expected %x but got %x",
-			checksumAlg, checksum, tileInfo.TileFile.Checksum)
+			checksumAlg, calculatedChecksum, tileInfo.TileFile.Checksum)
 		logger.Error(err)
 		w.WriteHeader(http.StatusExpectationFailed)
 		tileResponse["errormessage"] = err.Error()
@@ -1318,6 +1506,421 @@ func (h *httpServerHandler) verifyTile(w http.ResponseWriter, r *http.Request, p
 	json.NewEncoder(w).Encode(formatTileImageResponse(tileInfo))
 }
 
+func (h *httpServerHandler) getDeadLetters(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	w.Header().Set("Content-Type", "application/json")
+	acqID, err := parseRequiredParamValueAsUint64("acqid", params.ByName("acqid"))
+	if err != nil {
+		logger.Error(err)
+		writeError(w, err, http.StatusBadRequest)
+		return
+	}
+	deadLetters, err := h.trh.deadLetters.list(acqID)
+	if err != nil {
+		logger.Error(err)
+		writeError(w, err, http.StatusInternalServerError)
+		return
+	}
+	encodeDeadLettersResponse(w, acqID, deadLetters)
+}
+
+func (h *httpServerHandler) retryDeadLetters(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	h.processDeadLetters(w, r, params, h.trh.retryDeadLetters)
+}
+
+func (h *httpServerHandler) discardDeadLetters(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	h.processDeadLetters(w, r, params, h.trh.discardDeadLetters)
+}
+
+// processDeadLetters applies the action to the dead letters of the tiles given by the tile-id query parameters
+// or to all dead letters of the acquisition if no tile is given
+func (h *httpServerHandler) processDeadLetters(w http.ResponseWriter, r *http.Request, params httprouter.Params,
+	action func(acqID uint64, tileIDs []int64) ([]*deadLetter, error)) {
+	w.Header().Set("Content-Type", "application/json")
+	acqID, err := parseRequiredParamValueAsUint64("acqid", params.ByName("acqid"))
+	if err != nil {
+		logger.Error(err)
+		writeError(w, err, http.StatusBadRequest)
+		return
+	}
+	var tileIDs []int64
+	for _, tileIDParam := range r.URL.Query()["tile-id"] {
+		tileID, err := parseRequiredParamValueAsInt64("tile-id", tileIDParam)
+		if err != nil {
+			logger.Error(err)
+			writeError(w, err, http.StatusBadRequest)
+			return
+		}
+		tileIDs = append(tileIDs, tileID)
+	}
+	deadLetters, err := action(acqID, tileIDs)
+	if err != nil {
+		logger.Error(err)
+		writeError(w, err, http.StatusBadRequest)
+		return
+	}
+	encodeDeadLettersResponse(w, acqID, deadLetters)
+}
+
+func encodeDeadLettersResponse(w http.ResponseWriter, acqID uint64, deadLetters []*deadLetter) {
+	if deadLetters == nil {
+		deadLetters = []*deadLetter{}
+	}
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{
+		"acq_id":       acqID,
+		"n_tiles":      len(deadLetters),
+		"dead_letters": deadLetters,
+	}); err != nil {
+		logger.Error("Error encoding dead letters as JSON", err)
+	}
+}
+
+// getReplicaScrubStatus returns the verification status of the acquisition's stored files
+func (h *httpServerHandler) getReplicaScrubStatus(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	w.Header().Set("Content-Type", "application/json")
+	acqID, err := parseRequiredParamValueAsUint64("acqid", params.ByName("acqid"))
+	if err != nil {
+		logger.Error(err)
+		writeError(w, err, http.StatusBadRequest)
+		return
+	}
+	status, err := h.imageCatcher.GetReplicaScrubStatus(acqID)
+	if err != nil {
+		logger.Error(err)
+		writeError(w, err, http.StatusInternalServerError)
+		return
+	}
+	summary := make([]map[string]interface{}, 0, len(status.Summary))
+	for _, s := range status.Summary {
+		storageName := s.StorageName
+		if storageName == "" {
+			storageName = "primary"
+		}
+		verificationStatus := s.VerificationStatus
+		if verificationStatus == "" {
+			verificationStatus = "not_verified"
+		}
+		summary = append(summary, map[string]interface{}{
+			"store":               storageName,
+			"status":              verificationStatus,
+			"n_files":             s.Files,
+			"oldest_verification": s.OldestVerification,
+			"latest_verification": s.LatestVerification,
+		})
+	}
+	problems := make([]map[string]interface{}, 0, len(status.Problems))
+	for _, p := range status.Problems {
+		storageName := p.StorageName
+		if storageName == "" {
+			storageName = "primary"
+		}
+		problems = append(problems, map[string]interface{}{
+			"replica_id":     p.ReplicaID,
+			"file_object_id": p.FileObjectID,
+			"store":          storageName,
+			"path":           p.JfsPath,
+			"status":         p.VerificationStatus,
+			"last_verified":  p.LastVerified,
+		})
+	}
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{
+		"acq_id":   status.AcqUID,
+		"replicas": summary,
+		"problems": problems,
+	}); err != nil {
+		logger.Error("Error encoding the replica scrub status as JSON", err)
+	}
+}
+
+func (h *httpServerHandler) getAcquisitionCompleteness(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	w.Header().Set("Content-Type", "application/json")
+	acqID, err := parseRequiredParamValueAsUint64("acqid", params.ByName("acqid"))
+	if err != nil {
+		logger.Error(err)
+		writeError(w, err, http.StatusBadRequest)
+		return
+	}
+	report, err := h.imageCatcher.GetAcquisitionCompleteness(acqID)
+	if err != nil {
+		logger.Error(err)
+		writeError(w, err, captureErrorCode(err).httpStatus())
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(report); err != nil {
+		logger.Error("Error encoding the completeness report as JSON", err)
+	}
+}
+
+// getTileTimings returns the timings recorded by the microscope for the acquisition tiles, grouped by source and measure
+func (h *httpServerHandler) getTileTimings(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	var timingFilter models.TimingFilter
+	var err error
+	w.Header().Set("Content-Type", "application/json")
+	if timingFilter.AcqUID, err = parseRequiredParamValueAsUint64("acqid", params.ByName("acqid")); err != nil {
+		logger.Error(err)
+		writeError(w, err, http.StatusBadRequest)
+		return
+	}
+	if timingFilter.Col, err = getQueryParamAsInt(r, "col", -1); err != nil {
+		logger.Error(err)
+		writeError(w, err, http.StatusBadRequest)
+		return
+	}
+	if timingFilter.Row, err = getQueryParamAsInt(r, "row", -1); err != nil {
+		logger.Error(err)
+		writeError(w, err, http.StatusBadRequest)
+		return
+	}
+	if timingFilter.Camera, err = getQueryParamAsInt(r, "camera", -1); err != nil {
+		logger.Error(err)
+		writeError(w, err, http.StatusBadRequest)
+		return
+	}
+	timingFilter.Source = getQueryParamAsString(r, "source", "")
+	timingFilter.Measure = getQueryParamAsString(r, "measure", "")
+	if timingFilter.Pagination.StartRecordIndex, err = getQueryParamAsInt64(r, "offset", 0); err != nil {
+		logger.Error(err)
+		writeError(w, err, http.StatusBadRequest)
+		return
+	}
+	if timingFilter.Pagination.NRecords, err = getQueryParamAsInt32(r, "length", -1); err != nil {
+		logger.Error(err)
+		writeError(w, err, http.StatusBadRequest)
+		return
+	}
+	tileTimings, err := h.imageCatcher.GetTileTimings(&timingFilter)
+	if err != nil {
+		logger.Error(err)
+		writeError(w, err, http.StatusInternalServerError)
+		return
+	}
+	tiles := make([]map[string]interface{}, 0, len(tileTimings))
+	for _, t := range tileTimings {
+		timings := make(map[string]map[string]interface{})
+		for _, v := range t.Values {
+			sourceTimings := timings[v.Source]
+			if sourceTimings == nil {
+				sourceTimings = make(map[string]interface{})
+				timings[v.Source] = sourceTimings
+			}
+			if v.Value != nil {
+				sourceTimings[v.Measure] = *v.Value
+			} else {
+				sourceTimings[v.Measure] = v.TextValue
+			}
+		}
+		tile := map[string]interface{}{
+			"step":               t.Step,
+			"camera":             t.Camera,
+			"col":                t.Col,
+			"row":                t.Row,
+			"frame":              t.Frame,
+			"acquired_timestamp": t.AcquiredTimestamp,
+			"timings":            timings,
+		}
+		if t.ImageID > 0 {
+			tile["tile_id"] = t.ImageID
+		}
+		tiles = append(tiles, tile)
+	}
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{
+		"acq_id": timingFilter.AcqUID,
+		"tiles":  tiles,
+	}); err != nil {
+		logger.Error("Error encoding the tile timings as JSON", err)
+	}
+}
+
+// reconcileStoredImages reconciles the stored image lists of the acquisition right away and notifies about the discrepancies found
+func (h *httpServerHandler) reconcileStoredImages(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	w.Header().Set("Content-Type", "application/json")
+	acqID, err := parseRequiredParamValueAsUint64("acqid", params.ByName("acqid"))
+	if err != nil {
+		logger.Error(err)
+		writeError(w, err, http.StatusBadRequest)
+		return
+	}
+	res, err := h.sir.Reconcile(acqID)
+	if err != nil {
+		writeError(w, err, captureErrorCode(err).httpStatus())
+		return
+	}
+	discrepancies := make([]map[string]interface{}, 0, len(res.Discrepancies))
+	for _, d := range res.Discrepancies {
+		discrepancies = append(discrepancies, formatStoredImageDiscrepancy(d))
+	}
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{
+		"acq_id":        res.AcqUID,
+		"n_lists":       res.Lists,
+		"n_listed":      res.Listed,
+		"n_persisted":   res.Persisted,
+		"discrepancies": discrepancies,
+	}); err != nil {
+		logger.Error("Error encoding the stored image reconciliation as JSON", err)
+	}
+}
+
+// getStoredImageDiscrepancies returns the discrepancies found by the last reconciliation of the acquisition's stored image lists
+func (h *httpServerHandler) getStoredImageDiscrepancies(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	w.Header().Set("Content-Type", "application/json")
+	acqID, err := parseRequiredParamValueAsUint64("acqid", params.ByName("acqid"))
+	if err != nil {
+		logger.Error(err)
+		writeError(w, err, http.StatusBadRequest)
+		return
+	}
+	res, err := h.imageCatcher.GetStoredImageDiscrepancies(acqID)
+	if err != nil {
+		logger.Error(err)
+		writeError(w, err, http.StatusInternalServerError)
+		return
+	}
+	discrepancies := make([]map[string]interface{}, 0, len(res))
+	for _, d := range res {
+		discrepancies = append(discrepancies, formatStoredImageDiscrepancy(d))
+	}
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{
+		"acq_id":        acqID,
+		"discrepancies": discrepancies,
+	}); err != nil {
+		logger.Error("Error encoding the stored image discrepancies as JSON", err)
+	}
+}
+
+func formatStoredImageDiscrepancy(d *models.StoredImageDiscrepancy) map[string]interface{} {
+	r := map[string]interface{}{
+		"col":         d.Col,
+		"row":         d.Row,
+		"camera":      d.Camera,
+		"frame":       d.Frame,
+		"name":        d.Name,
+		"discrepancy": d.Discrepancy,
+		"details":     d.Details,
+		"found":       d.Found,
+	}
+	if d.ImageID > 0 {
+		r["tile_id"] = d.ImageID
+	}
+	return r
+}
+
+func (h *httpServerHandler) verifyAcquisition(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	var acqFilter models.AcquisitionFilter
+	var err error
+	w.Header().Set("Content-Type", "application/json")
+	if acqFilter.AcqUID, err = parseRequiredParamValueAsUint64("acqid", params.ByName("acqid")); err != nil {
+		logger.Error(err)
+		writeError(w, err, http.StatusBadRequest)
+		return
+	}
+	if _, err = h.imageCatcher.GetMosaic(acqFilter.AcqUID); err != nil {
+		logger.Error(err)
+		writeError(w, err, http.StatusNotFound)
+		return
+	}
+	h.startVerification(w, &acqFilter)
+}
+
+func (h *httpServerHandler) verifyAcquisitions(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	var acqFilter models.AcquisitionFilter
+	var err error
+	w.Header().Set("Content-Type", "application/json")
+	acqFilter.ProjectName = getQueryParamAsString(r, "project", "")
+	acqFilter.ProjectOwner = getQueryParamAsString(r, "owner", "")
+	acqFilter.SampleName = getQueryParamAsString(r, "sample", "")
+	if acqFilter.AcquiredInterval.From, err = getQueryParamAsTime(r, "acq-from", "", "20060102150405", "200601021504", "2006010215", "20060102"); err != nil {
+		logger.Error(err)
+		writeError(w, err, http.StatusBadRequest)
+		return
+	}
+	if acqFilter.AcquiredInterval.To, err = getQueryParamAsTime(r, "acq-to", "", "20060102150405", "200601021504", "2006010215", "20060102"); err != nil {
+		logger.Error(err)
+		writeError(w, err, http.StatusBadRequest)
+		return
+	}
+	if acqFilter.ProjectName == "" && acqFilter.ProjectOwner == "" && acqFilter.SampleName == "" &&
+		acqFilter.AcquiredInterval.From == nil && acqFilter.AcquiredInterval.To == nil {
+		err = fmt.Errorf("At least one of project, owner, sample, acq-from or acq-to must be specified")
+		logger.Error(err)
+		writeError(w, err, http.StatusBadRequest)
+		return
+	}
+	h.startVerification(w, &acqFilter)
+}
+
+func (h *httpServerHandler) startVerification(w http.ResponseWriter, acqFilter *models.AcquisitionFilter) {
+	job, err := h.imageCatcher.StartVerification(acqFilter)
+	if err == ErrTooManyVerifications {
+		logger.Error(err)
+		writeError(w, err, http.StatusServiceUnavailable)
+		return
+	} else if err != nil {
+		logger.Error(err)
+		writeError(w, err, http.StatusInternalServerError)
+		return
+	}
+	progress := job.Progress()
+	w.Header().Set("Location", "/service/v1/verification/"+progress.JobID)
+	w.WriteHeader(http.StatusAccepted)
+	if err := json.NewEncoder(w).Encode(progress); err != nil {
+		logger.Error("Error encoding the verification job as JSON", err)
+	}
+}
+
+func (h *httpServerHandler) getVerification(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	w.Header().Set("Content-Type", "application/json")
+	job := h.imageCatcher.GetVerification(params.ByName("jobid"))
+	if job == nil {
+		err := fmt.Errorf("No verification job found for %s", params.ByName("jobid"))
+		logger.Error(err)
+		writeError(w, err, http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(job.Progress()); err != nil {
+		logger.Error("Error encoding the verification progress as JSON", err)
+	}
+}
+
+func (h *httpServerHandler) getVerificationReport(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	job := h.imageCatcher.GetVerification(params.ByName("jobid"))
+	if job == nil {
+		w.Header().Set("Content-Type", "application/json")
+		err := fmt.Errorf("No verification job found for %s", params.ByName("jobid"))
+		logger.Error(err)
+		writeError(w, err, http.StatusNotFound)
+		return
+	}
+	switch format := getQueryParamAsString(r, "format", "json"); format {
+	case "csv":
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=verification-%s.csv", params.ByName("jobid")))
+		w.WriteHeader(http.StatusOK)
+		if err := job.WriteCSVReport(w); err != nil {
+			logger.Error("Error writing the verification report as CSV", err)
+		}
+	case "json":
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		if err := json.NewEncoder(w).Encode(map[string]interface{}{
+			"progress": job.Progress(),
+			"problems": job.Problems(),
+		}); err != nil {
+			logger.Error("Error encoding the verification report as JSON", err)
+		}
+	default:
+		w.Header().Set("Content-Type", "application/json")
+		err := fmt.Errorf("Invalid report format %s - valid formats are json and csv", format)
+		logger.Error(err)
+		writeError(w, err, http.StatusBadRequest)
+	}
+}
+
 func (h *httpServerHandler) createCalibrations(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
 	w.Header().Set("Content-Type", "application/json")
 
@@ -1464,6 +2067,11 @@ func (h *httpServerHandler) serveNextTiles(w http.ResponseWriter, r *http.Reques
 		return
 	}
 	filter.FrameType.Set(getQueryParamAsString(r, "frame-type", ""))
+	if filter.WithinMetricThresholds, err = getQueryParamAsBool(r, "within-metric-thresholds", false); err != nil {
+		logger.Error(err)
+		writeError(w, err, http.StatusBadRequest)
+		return
+	}
 
 	nextTileState := getQueryParamAsString(r, "newState", models.TileInProgressState)
 
@@ -1551,17 +2159,24 @@ func prepareTileSpec(tileResult *models.TileSpec) map[string]interface{} {
 		// if this happens simply set z to the nominal section
 		z = float64(tileResult.NominalSection)
 	}
-	tilespec := map[string]interface{}{
-		"tileId": fmt.Sprintf("%d.%03d.%03d.%s", tileResult.AcqUID, tileResult.Col, tileResult.Row, sectionID),
-		"width":  tileResult.Width,
-		"height": tileResult.Height,
-		"z":      z,
-		"mipmapLevels": map[string]interface{}{
-			"0": map[string]interface{}{
-				"imageUrl": tileResult.ImageURL,
-				"maskUrl":  tileResult.MaskURL,
-			},
+	mipmapLevels := map[string]interface{}{
+		"0": map[string]interface{}{
+			"imageUrl": tileResult.ImageURL,
+			"maskUrl":  tileResult.MaskURL,
 		},
+	}
+	for _, mipmap := range tileResult.Mipmaps {
+		// the mask is only available at full resolution
+		mipmapLevels[strconv.Itoa(mipmap.Level)] = map[string]interface{}{
+			"imageUrl": mipmap.ImageURL,
+		}
+	}
+	tilespec := map[string]interface{}{
+		"tileId":       fmt.Sprintf("%d.%03d.%03d.%s", tileResult.AcqUID, tileResult.Col, tileResult.Row, sectionID),
+		"width":        tileResult.Width,
+		"height":       tileResult.Height,
+		"z":            z,
+		"mipmapLevels": mipmapLevels,
 		"layout": map[string]interface{}{
 			"camera":    tileResult.CameraConfig.Camera,
 			"imageCol":  tileResult.Col,
@@ -1587,6 +2202,13 @@ func prepareTileSpec(tileResult *models.TileSpec) map[string]interface{} {
 			},
 		},
 	}
+	if tileResult.U8HistOffset != nil && tileResult.U8HistScale != nil && *tileResult.U8HistScale > 0 {
+		// the intensity range mapped to 8 bit
+		tilespec["u8HistOffset"] = *tileResult.U8HistOffset
+		tilespec["u8HistScale"] = *tileResult.U8HistScale
+		tilespec["minIntensity"] = *tileResult.U8HistOffset
+		tilespec["maxIntensity"] = *tileResult.U8HistOffset + 255 / *tileResult.U8HistScale
+	}
 	r["acqid"] = tileResult.AcqUID
 	r["section"] = tileResult.NominalSection
 	r["tilespec"] = tilespec
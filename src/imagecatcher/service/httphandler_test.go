@@ -44,7 +44,7 @@ func setupHTTP(messageNotifier MessageNotifier, td TileDistributor, testConfig c
 		tileContent: createLocalStorage(),
 	}
 	configurator := NewConfigurator(daotest.TestDBHandler)
-	testHandler := NewHTTPServerHandler(nil, serviceImpl, NewTileRequestHandler(serviceImpl, messageNotifier, testConfig), td, configurator, messageNotifier, true)
+	testHandler := NewHTTPServerHandler(nil, serviceImpl, NewTileRequestHandler(serviceImpl, messageNotifier, testConfig), td, configurator, NewStoredImageReconciler(serviceImpl, messageNotifier, testConfig), messageNotifier, true)
 	httpServer := httptest.NewServer(testHandler.(*httpServerHandler).httpImpl.Handler)
 	return serviceImpl, httpServer
 }
@@ -62,7 +62,7 @@ func setupWithContentChannelResult(messageNotifier MessageNotifier) (*fakeImageC
 		tileContent: createLocalStorage(),
 	}
 	tileRequestHandler := NewTileRequestHandler(serviceImpl, messageNotifier, testConfig)
-	testHandler := NewHTTPServerHandler(nil, serviceImpl, tileRequestHandler, nil, nil, messageNotifier, true)
+	testHandler := NewHTTPServerHandler(nil, serviceImpl, tileRequestHandler, nil, nil, NewStoredImageReconciler(serviceImpl, messageNotifier, testConfig), messageNotifier, true)
 	httpServer := httptest.NewServer(testHandler.(*httpServerHandler).httpImpl.Handler)
 	return serviceImpl, tileRequestHandler, httpServer
 }
@@ -34,7 +34,7 @@ func init() {
 	importAcquisition(s)
 	errNotifier := NewEmailNotifier("http test", testConfig)
 	trh := NewTileRequestHandler(s, errNotifier, testConfig)
-	testHandler := NewHTTPServerHandler(nil, s, trh, nil, nil, errNotifier, true)
+	testHandler := NewHTTPServerHandler(nil, s, trh, nil, nil, NewStoredImageReconciler(s, errNotifier, testConfig), errNotifier, true)
 	serverWithRealService = httptest.NewServer(testHandler.(*httpServerHandler).httpImpl.Handler)
 }
 
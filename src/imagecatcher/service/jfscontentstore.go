@@ -0,0 +1,159 @@
+package service
+
+import (
+	"fmt"
+	"github.com/JaneliaSciComp/janelia-file-services/JFSGolang/jfs"
+	"github.com/hashicorp/golang-lru"
+	"strings"
+
+	"imagecatcher/config"
+	"imagecatcher/logger"
+	"imagecatcher/models"
+)
+
+// jfsContentStore stores the content in the JFS collection mapped to the acquisition's sample, project or owner
+type jfsContentStore struct {
+	jfsFactory      jfs.Factory
+	jfsServiceCache *lru.Cache
+	jfsMapping      map[string]string
+	scalityHost     string
+}
+
+func newJFSContentStoreFromConfig(config config.Config) (*jfsContentStore, error) {
+	jfsUser := config.GetStringProperty("JFS_MONGO_USER", "")
+	jfsPassword := config.GetStringProperty("JFS_MONGO_PASSWORD", "")
+	scalityRingsMapping := config.GetStringMapProperty("SCALITY_RINGS_MAPPING")
+	jfsDbUrls := config.GetStringArrayProperty("JFS_MONGO_URL")
+	logger.Debugf("Connect to JFS database(s) %v", jfsDbUrls)
+	jfsFactory, err := jfs.GetFactoryInstance(
+		jfsUser,
+		jfsPassword,
+		jfsDbUrls,
+		scalityRingsMapping)
+	if err != nil {
+		return nil, fmt.Errorf("Error initializing JFS Factory: %v", err)
+	}
+	return newJFSContentStore(jfsFactory, config)
+}
+
+func newJFSContentStore(f jfs.Factory, config config.Config) (*jfsContentStore, error) {
+	var err error
+	store := &jfsContentStore{
+		jfsFactory:  f,
+		jfsMapping:  config.GetStringMapProperty("JFS_MAPPING"),
+		scalityHost: config.GetStringProperty("SCALITY_HOST", "localhost"),
+	}
+	if store.jfsServiceCache, err = lru.New(config.GetIntProperty("JFS_SERVICE_CACHE_LEN", 20)); err != nil {
+		return nil, fmt.Errorf("Error initializing JFS service cache")
+	}
+	return store, nil
+}
+
+func (s *jfsContentStore) getAcqFileService(acq *models.Acquisition) (jfs.FileService, error) {
+	jfsCollectionName := s.jfsMapping[acq.SampleName]
+	if jfsCollectionName == "" {
+		jfsCollectionName = s.jfsMapping[acq.ProjectName]
+	}
+	if jfsCollectionName == "" {
+		jfsCollectionName = s.jfsMapping[acq.ProjectOwner]
+	}
+	if jfsCollectionName == "" {
+		jfsCollectionName = acq.ProjectOwner
+	}
+	return s.getFileService(jfsCollectionName)
+}
+
+func (s *jfsContentStore) getFileService(jfsCollectionName string) (fileService jfs.FileService, err error) {
+	cachedFileService, found := s.jfsServiceCache.Get(jfsCollectionName)
+	if found {
+		return cachedFileService.(jfs.FileService), nil
+	}
+	logger.Debugf("Open fileservice %s", jfsCollectionName)
+	fileService = s.jfsFactory.GetFileService(jfsCollectionName)
+	if fileService == nil {
+		return nil, fmt.Errorf("No JFS service found for %s ", jfsCollectionName)
+	}
+	if err = fileService.Open(); err != nil {
+		return fileService, fmt.Errorf("Error opening JFS service for %s: %v", jfsCollectionName, err)
+	}
+	s.jfsServiceCache.Add(jfsCollectionName, fileService)
+	return fileService, nil
+}
+
+func (s *jfsContentStore) Put(acq *models.Acquisition, path string, content []byte, params map[string]string) (map[string]interface{}, error) {
+	fileService, err := s.getAcqFileService(acq)
+	if err != nil {
+		return nil, err
+	}
+	res, err := fileService.Put(path, content, params)
+	if err != nil {
+		return res, err
+	}
+	if res["locationUrl"] != nil {
+		res["locationUrl"] = strings.Replace(res["locationUrl"].(string), "localhost", s.scalityHost, 1)
+	}
+	return res, nil
+}
+
+func (s *jfsContentStore) Get(acq *models.Acquisition, path string) ([]byte, error) {
+	fileService, err := s.getAcqFileService(acq)
+	if err != nil {
+		return nil, err
+	}
+	content, err := fileService.Get(path)
+	if err != nil && isJFSNotFound(err) {
+		return content, &contentNotFoundError{path: path, err: err}
+	} else if err != nil {
+		return content, fmt.Errorf("Error retrieving content from JFS for %s: %v", path, err)
+	}
+	return content, nil
+}
+
+func (s *jfsContentStore) Verify(acq *models.Acquisition, path string, params map[string]string) error {
+	fileService, err := s.getAcqFileService(acq)
+	if err != nil {
+		return err
+	}
+	if err = fileService.Verify(path, params); err != nil && isJFSNotFound(err) {
+		return &contentNotFoundError{path: path, err: err}
+	}
+	return err
+}
+
+// isJFSNotFound checks whether a JFS error reports a missing file; the JFS client does not
+// have typed errors so the error message is the only way to tell
+func isJFSNotFound(err error) bool {
+	message := strings.ToLower(err.Error())
+	return strings.Contains(message, "not found") || strings.Contains(message, "no such file")
+}
+
+func (s *jfsContentStore) Delete(acq *models.Acquisition, path string) error {
+	fileService, err := s.getAcqFileService(acq)
+	if err != nil {
+		return err
+	}
+	return fileService.Delete(path)
+}
+
+// Ping writes and verifies a small object in the collection mapped to PING
+func (s *jfsContentStore) Ping() error {
+	data := map[string]string{}
+	jfsPingContent := []byte("JFS Ping")
+	fileService, err := s.getFileService(s.jfsMapping["PING"])
+	if err != nil {
+		logger.Errorf("Error opening a file service for ping: %v", err)
+		return err
+	}
+	pingPath := fmt.Sprintf("/acquisitions/%d/%s", 0, jfsPingFileType)
+	_, werr := fileService.Put(pingPath, jfsPingContent, data)
+	// if there was a write error the collection may be an immutable collection so we still want
+	// to attempt a read to see if this succeeds
+	if werr != nil {
+		logger.Errorf("Error sending the ping message: %v", werr)
+	}
+	if rerr := fileService.Verify(pingPath, data); rerr != nil {
+		logger.Errorf("Error verifying the ping message: %v", rerr)
+		return rerr
+	}
+	return nil
+}
@@ -0,0 +1,147 @@
+package service
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"imagecatcher/checksum"
+	"imagecatcher/logger"
+	"imagecatcher/models"
+)
+
+// localContentStore stores the content in a local directory using the same layout as JFS.
+// Next to every file that has a checksum it writes a <file>.<algorithm> sidecar in the md5sum format.
+type localContentStore struct {
+	rootDir string
+}
+
+func newLocalContentStore(rootDir string) (*localContentStore, error) {
+	if rootDir == "" {
+		return nil, fmt.Errorf("LOCAL_STORAGE_DIR must be set for the local storage backend")
+	}
+	if err := os.MkdirAll(rootDir, os.ModePerm); err != nil {
+		return nil, fmt.Errorf("Error creating the local storage directory %s: %v", rootDir, err)
+	}
+	return &localContentStore{rootDir: rootDir}, nil
+}
+
+// fullPath maps the store path to a file under the root directory; the path cannot point outside of the root directory
+func (s *localContentStore) fullPath(path string) string {
+	return filepath.Join(s.rootDir, filepath.FromSlash(filepath.Clean("/"+path)))
+}
+
+func sidecarName(name string, alg checksum.Algorithm) string {
+	return name + "." + strings.ToLower(alg.String())
+}
+
+func (s *localContentStore) Put(acq *models.Acquisition, path string, content []byte, params map[string]string) (map[string]interface{}, error) {
+	name := s.fullPath(path)
+	if err := os.MkdirAll(filepath.Dir(name), os.ModePerm); err != nil {
+		return nil, fmt.Errorf("Error creating directory %s: %v", filepath.Dir(name), err)
+	}
+	// write a new file and rename it so that a partially written file is never visible
+	if err := ioutil.WriteFile(name+".tmp", content, 0644); err != nil {
+		return nil, fmt.Errorf("Error writing %s: %v", name, err)
+	}
+	if err := os.Rename(name+".tmp", name); err != nil {
+		return nil, fmt.Errorf("Error writing %s: %v", name, err)
+	}
+	res := map[string]interface{}{
+		"scalityKey":  path,
+		"locationUrl": "file://" + filepath.ToSlash(name),
+	}
+	if params["checksum"] != "" {
+		alg, err := checksum.Lookup(params["checksumAlgorithm"])
+		if err != nil {
+			return res, err
+		}
+		sidecar := fmt.Sprintf("%s  %s\n", params["checksum"], filepath.Base(name))
+		if err = ioutil.WriteFile(sidecarName(name, alg), []byte(sidecar), 0644); err != nil {
+			return res, fmt.Errorf("Error writing the checksum of %s: %v", name, err)
+		}
+		res["checksum"] = params["checksum"]
+		res["checksumAlgorithm"] = alg.String()
+	}
+	logger.Debugf("Stored %s (%d bytes) in %s", path, len(content), name)
+	return res, nil
+}
+
+func (s *localContentStore) Get(acq *models.Acquisition, path string) ([]byte, error) {
+	content, err := ioutil.ReadFile(s.fullPath(path))
+	if os.IsNotExist(err) {
+		return nil, &contentNotFoundError{path: path, err: err}
+	} else if err != nil {
+		return nil, fmt.Errorf("Error retrieving content for %s: %v", path, err)
+	}
+	return content, nil
+}
+
+// Verify recomputes the checksum of the stored file and compares it with the checksum from the parameters
+// and with the checksum from the sidecar. Without a checksum parameter it only checks that the file exists.
+func (s *localContentStore) Verify(acq *models.Acquisition, path string, params map[string]string) error {
+	name := s.fullPath(path)
+	if _, err := os.Stat(name); os.IsNotExist(err) {
+		return &contentNotFoundError{path: path, err: err}
+	} else if err != nil {
+		return fmt.Errorf("Error verifying %s: %v", path, err)
+	}
+	if params["checksum"] == "" {
+		return nil
+	}
+	alg, err := checksum.Lookup(params["checksumAlgorithm"])
+	if err != nil {
+		return err
+	}
+	expected, err := hex.DecodeString(params["checksum"])
+	if err != nil {
+		return fmt.Errorf("Error decoding the checksum %s of %s: %v", params["checksum"], path, err)
+	}
+	sidecar, err := ioutil.ReadFile(sidecarName(name, alg))
+	if err != nil {
+		return fmt.Errorf("Error reading the %s checksum of %s: %v", alg, path, err)
+	}
+	if fields := strings.Fields(string(sidecar)); len(fields) == 0 || fields[0] != params["checksum"] {
+		return fmt.Errorf("The %s checksum recorded for %s does not match the checksum %s", alg, path, params["checksum"])
+	}
+	computed, err := fileChecksum(alg, name)
+	if err != nil {
+		return fmt.Errorf("Error computing the %s checksum of %s: %v", alg, path, err)
+	}
+	if !bytes.Equal(computed, expected) {
+		return fmt.Errorf("The %s checksum %x of the stored file %s does not match the checksum %x", alg, computed, path, expected)
+	}
+	return nil
+}
+
+func (s *localContentStore) Delete(acq *models.Acquisition, path string) error {
+	name := s.fullPath(path)
+	sidecars, _ := filepath.Glob(name + ".*")
+	for _, f := range append([]string{name}, sidecars...) {
+		if err := os.Remove(f); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("Error deleting %s: %v", f, err)
+		}
+	}
+	return nil
+}
+
+// Ping writes and reads back a small file in the root directory
+func (s *localContentStore) Ping() error {
+	pingPath := acqFilePath(0, jfsPingFileType)
+	pingContent := []byte("Local storage ping")
+	if _, err := s.Put(nil, pingPath, pingContent, nil); err != nil {
+		return err
+	}
+	content, err := s.Get(nil, pingPath)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(content, pingContent) {
+		return fmt.Errorf("The content read from %s does not match the ping content", s.fullPath(pingPath))
+	}
+	return nil
+}
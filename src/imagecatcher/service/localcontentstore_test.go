@@ -0,0 +1,109 @@
+package service
+
+import (
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"imagecatcher/checksum"
+	"imagecatcher/config"
+	"imagecatcher/models"
+)
+
+func TestLocalContentStore(t *testing.T) {
+	rootDir, err := ioutil.TempDir("", "localstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(rootDir)
+	store, err := newContentStore(config.Config{"STORAGE_BACKEND": "local", "LOCAL_STORAGE_DIR": rootDir})
+	if err != nil {
+		t.Fatalf("Error creating the local content store: %v", err)
+	}
+	if err = store.Ping(); err != nil {
+		t.Errorf("Unexpected ping error: %v", err)
+	}
+
+	content := []byte("local tile content")
+	sum, _ := checksum.Sum(checksum.XXHash64, content)
+	params := map[string]string{"checksum": hex.EncodeToString(sum), "checksumAlgorithm": checksum.XXHash64.String()}
+	path := acqFilePath(10, "col0001/col0001_row0002_cam0.tif")
+	res, err := store.Put(nil, path, content, params)
+	if err != nil {
+		t.Fatalf("Error storing the content: %v", err)
+	}
+	if res["scalityKey"] != path || res["checksum"] != params["checksum"] {
+		t.Errorf("Unexpected store result %v", res)
+	}
+	storedFile := filepath.Join(rootDir, "acquisitions", "10", "col0001", "col0001_row0002_cam0.tif")
+	if sidecar, err := ioutil.ReadFile(storedFile + ".xxh64"); err != nil || string(sidecar) != params["checksum"]+"  col0001_row0002_cam0.tif\n" {
+		t.Errorf("Unexpected checksum sidecar %q: %v", sidecar, err)
+	}
+	if storedContent, err := store.Get(nil, path); err != nil || string(storedContent) != string(content) {
+		t.Errorf("Unexpected stored content %q: %v", storedContent, err)
+	}
+	if err = store.Verify(nil, path, params); err != nil {
+		t.Errorf("Unexpected verify error: %v", err)
+	}
+
+	if err = ioutil.WriteFile(storedFile, []byte("corrupted content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err = store.Verify(nil, path, params); err == nil {
+		t.Error("Expected the verification of the corrupted file to fail")
+	}
+
+	if err = store.Delete(nil, path); err != nil {
+		t.Fatalf("Error deleting the content: %v", err)
+	}
+	if remaining, _ := filepath.Glob(storedFile + "*"); len(remaining) != 0 {
+		t.Errorf("Expected the file and its sidecar to be deleted but found %v", remaining)
+	}
+	if _, err = store.Get(nil, path); !isContentNotFound(err) {
+		t.Errorf("Expected a deleted file to be reported as not found but got %v", err)
+	}
+	if _, err = store.Get(nil, "/../../etc/passwd"); err == nil {
+		t.Error("Expected the path to be resolved inside the storage directory")
+	}
+}
+
+// checksummingContentStore simulates a store that computes its own MD5 checksum, like JFS
+type checksummingContentStore struct {
+	ContentStore
+}
+
+func (s *checksummingContentStore) Put(acq *models.Acquisition, path string, content []byte, params map[string]string) (map[string]interface{}, error) {
+	return map[string]interface{}{"scalityKey": path, "checksum": "00112233445566778899aabbccddeeff"}, nil
+}
+
+func TestStoreContentChecksumAlgorithm(t *testing.T) {
+	rootDir, err := ioutil.TempDir("", "localstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(rootDir)
+	store, err := newLocalContentStore(rootDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &imageCatcherServiceImpl{contentStore: store}
+	acqMosaic := &models.TemImageMosaic{}
+	acqMosaic.AcqUID = 40
+	res, err := s.storeContent(acqMosaic, &FileParams{Name: "tile.tif", Content: []byte("content"), ChecksumAlgorithm: checksum.SHA256})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res["checksumAlgorithm"] != checksum.SHA256.String() {
+		t.Errorf("Expected the requested checksum algorithm but got %v", res["checksumAlgorithm"])
+	}
+	s.contentStore = &checksummingContentStore{}
+	res, err = s.storeContent(acqMosaic, &FileParams{Name: "tile.tif", Content: []byte("content"), ChecksumAlgorithm: checksum.SHA256})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res["checksum"] != "00112233445566778899aabbccddeeff" || res["checksumAlgorithm"] != checksum.MD5.String() {
+		t.Errorf("Expected the store checksum to keep its MD5 algorithm but got %v %v", res["checksum"], res["checksumAlgorithm"])
+	}
+}
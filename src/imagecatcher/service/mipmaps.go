@@ -0,0 +1,126 @@
+package service
+
+import (
+	"fmt"
+	"path"
+	"runtime/debug"
+	"time"
+
+	"imagecatcher/checksum"
+	"imagecatcher/config"
+	"imagecatcher/logger"
+	"imagecatcher/models"
+	"imagecatcher/utils"
+)
+
+// tileMipmapStore reads the stored tiles and stores their mipmaps
+type tileMipmapStore interface {
+	RetrieveAcquisitionFile(acqMosaic *models.TemImageMosaic, path string) ([]byte, error)
+	StoreTileMipmap(tileImage *models.TemImage, level int, f *FileParams) (*models.FileObject, error)
+}
+
+// tileMipmapper generates the mipmap levels of the stored tiles in the background. Level n is downsampled
+// 2^n times and every level is computed from the previous one.
+type tileMipmapper struct {
+	store  tileMipmapStore
+	levels int
+	jobs   chan models.TemImage
+}
+
+// newTileMipmapper creates the mipmap workers; it returns nil if TILE_MIPMAP_LEVELS is not set
+func newTileMipmapper(store tileMipmapStore, config config.Config) *tileMipmapper {
+	levels := config.GetIntProperty("TILE_MIPMAP_LEVELS", 0)
+	if levels <= 0 {
+		return nil
+	}
+	m := &tileMipmapper{
+		store:  store,
+		levels: levels,
+		jobs:   make(chan models.TemImage, config.GetIntProperty("TILE_MIPMAP_QUEUE_SIZE", 1000)),
+	}
+	for w := config.GetIntProperty("TILE_MIPMAP_WORKERS", 2); w > 0; w-- {
+		go m.run()
+	}
+	return m
+}
+
+// enqueue queues the stored tile for generating its mipmaps; the tile is skipped if the queue is full
+func (m *tileMipmapper) enqueue(tileImage *models.TemImage) {
+	select {
+	case m.jobs <- *tileImage:
+	default:
+		logger.Errorf("Mipmap queue is full - no mipmaps will be generated for %v", tileImage)
+	}
+}
+
+func (m *tileMipmapper) run() {
+	for tileImage := range m.jobs {
+		if err := m.safeGenerateMipmaps(&tileImage); err != nil {
+			logger.Errorf("Mipmap generation failed: %v", err)
+		}
+	}
+}
+
+// safeGenerateMipmaps recovers from a panic while generating the mipmaps so that a malformed tile cannot stop the worker
+func (m *tileMipmapper) safeGenerateMipmaps(tileImage *models.TemImage) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("Unexpected error while generating the mipmaps of %s: %v\n%s", tileImage.TileFile.JfsPath, r, debug.Stack())
+		}
+	}()
+	return m.generateMipmaps(tileImage)
+}
+
+// generateMipmaps reads the tile from the content store and stores its mipmap levels
+func (m *tileMipmapper) generateMipmaps(tileImage *models.TemImage) error {
+	startTime := time.Now()
+	content, err := m.store.RetrieveAcquisitionFile(&tileImage.ImageMosaic, tileImage.TileFile.JfsPath)
+	if err != nil {
+		return fmt.Errorf("Error reading %s for generating its mipmaps: %v", tileImage.TileFile.JfsPath, err)
+	}
+	img, err := utils.DecodeTIFF(content)
+	if err != nil {
+		return fmt.Errorf("Error decoding %s for generating its mipmaps: %v", tileImage.TileFile.JfsPath, err)
+	}
+	level := 1
+	for ; level <= m.levels; level++ {
+		if img.Bounds().Dx() <= 1 && img.Bounds().Dy() <= 1 {
+			break
+		}
+		img = utils.Downsample(img)
+		mipmapContent := utils.EncodeTIFF(img)
+		f := &FileParams{
+			Name:              mipmapFileName(tileImage.TileFile.Path, level),
+			Content:           mipmapContent,
+			ChecksumAlgorithm: checksum.DefaultAlgorithm,
+			ContentLen:        len(mipmapContent),
+		}
+		if _, err = m.store.StoreTileMipmap(tileImage, level, f); err != nil {
+			return fmt.Errorf("Error storing the mipmap level %d of %s: %v", level, tileImage.TileFile.JfsPath, err)
+		}
+	}
+	logger.Debugf("Generated %d mipmap levels of %s: %v", level-1, tileImage.TileFile.JfsPath, time.Since(startTime))
+	return nil
+}
+
+// mipmapFileName returns the name of the mipmap level of the tile file, e.g. mipmaps/1/col0001_row0002_cam0.tif
+func mipmapFileName(tileName string, level int) string {
+	return path.Join("mipmaps", fmt.Sprintf("%d", level), tileName)
+}
+
+// generateTileMipmaps queues the successfully stored tiles for generating their mipmaps.
+// The decorator does nothing if the mipmaps are not generated.
+func generateTileMipmaps(m *tileMipmapper) contentProcessDecorator {
+	return func(p contentProcessor) contentProcessor {
+		if m == nil {
+			return p
+		}
+		return contentProcessorFunc(func(job *contentProcessingJob) contentProcessingResult {
+			res := p.process(job)
+			if res.err == nil && job.tileImage != nil {
+				m.enqueue(job.tileImage)
+			}
+			return res
+		})
+	}
+}
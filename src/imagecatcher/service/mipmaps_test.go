@@ -0,0 +1,83 @@
+package service
+
+import (
+	"image"
+	"sync"
+	"testing"
+
+	"imagecatcher/models"
+	"imagecatcher/utils"
+)
+
+type fakeMipmapStore struct {
+	tileContent []byte
+	lock        sync.Mutex
+	mipmaps     map[int]*FileParams
+}
+
+func (s *fakeMipmapStore) RetrieveAcquisitionFile(acqMosaic *models.TemImageMosaic, path string) ([]byte, error) {
+	return s.tileContent, nil
+}
+
+func (s *fakeMipmapStore) StoreTileMipmap(tileImage *models.TemImage, level int, f *FileParams) (*models.FileObject, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.mipmaps[level] = f
+	return &models.FileObject{}, nil
+}
+
+func TestGenerateMipmaps(t *testing.T) {
+	store := &fakeMipmapStore{
+		tileContent: utils.EncodeTIFF(image.NewGray16(image.Rect(0, 0, 8, 4))),
+		mipmaps:     map[int]*FileParams{},
+	}
+	m := &tileMipmapper{store: store, levels: 5}
+	tileImage := &models.TemImage{
+		TileFile: models.FileObject{Path: "col0001_row0002_cam0.tif", JfsPath: "/acquisitions/1/col0001_row0002_cam0.tif"},
+	}
+	if err := m.generateMipmaps(tileImage); err != nil {
+		t.Fatal(err)
+	}
+	// the levels stop once the image has a single pixel
+	expectedSizes := map[int]image.Rectangle{
+		1: image.Rect(0, 0, 4, 2),
+		2: image.Rect(0, 0, 2, 1),
+		3: image.Rect(0, 0, 1, 1),
+	}
+	if len(store.mipmaps) != len(expectedSizes) {
+		t.Fatalf("Expected %d mipmap levels but got %d", len(expectedSizes), len(store.mipmaps))
+	}
+	for level, size := range expectedSizes {
+		f := store.mipmaps[level]
+		if expectedName := mipmapFileName(tileImage.TileFile.Path, level); f.Name != expectedName {
+			t.Errorf("Expected mipmap name %s but got %s", expectedName, f.Name)
+		}
+		img, err := utils.DecodeTIFF(f.Content)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := img.(*image.Gray16); !ok || img.Bounds() != size {
+			t.Errorf("Expected a %v 16 bit image for level %d but got %T %v", size, level, img, img.Bounds())
+		}
+	}
+}
+
+func TestTileSpecMipmapLevels(t *testing.T) {
+	tileSpec := &models.TileSpec{
+		ImageURL: "http://store/tiles",
+		JFSPath:  "/acquisitions/1/col0001_row0002_cam0.tif",
+		MaskURL:  "http://masks/temca1_cam0.png",
+		Mipmaps: []models.TileMipmap{
+			{Level: 1, ImageURL: "http://store/tiles", JFSPath: "/acquisitions/1/mipmaps/1/col0001_row0002_cam0.tif"},
+		},
+	}
+	tileSpec.SetTileImageURL("")
+	mipmapLevels := prepareTileSpec(tileSpec)["tilespec"].(map[string]interface{})["mipmapLevels"].(map[string]interface{})
+	if len(mipmapLevels) != 2 {
+		t.Fatalf("Expected 2 mipmap levels but got %v", mipmapLevels)
+	}
+	level1 := mipmapLevels["1"].(map[string]interface{})
+	if level1["imageUrl"] != "http://store/tiles?fName=/acquisitions/1/mipmaps/1/col0001_row0002_cam0.tif" {
+		t.Errorf("Unexpected level 1 image URL %v", level1["imageUrl"])
+	}
+}
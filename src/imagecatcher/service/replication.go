@@ -0,0 +1,257 @@
+package service
+
+import (
+	"fmt"
+	"strings"
+
+	"imagecatcher/config"
+	"imagecatcher/dao"
+	"imagecatcher/logger"
+	"imagecatcher/models"
+)
+
+// Replication modes of a replica target
+const (
+	syncReplication  = "sync"
+	asyncReplication = "async"
+	// defaultReplicationPolicy is the key of the policy used when no policy is mapped to the acquisition
+	defaultReplicationPolicy = "DEFAULT"
+)
+
+// replicaTarget is a store that receives a copy of the content
+type replicaTarget struct {
+	storageName string
+	mode        string
+	store       ContentStore
+}
+
+// replicaJob copies the content of a file to a replica store
+type replicaJob struct {
+	acq     *models.Acquisition
+	path    string
+	params  map[string]string
+	target  replicaTarget
+	replica *models.FileReplica
+}
+
+// replicaCatalog keeps track of the replicas of the file objects
+type replicaCatalog interface {
+	saveReplica(r *models.FileReplica) error
+	retrieveReplicas(path string) ([]*models.FileReplica, error)
+}
+
+type dbReplicaCatalog struct {
+	dbHandler dao.DbHandler
+}
+
+func (c dbReplicaCatalog) saveReplica(r *models.FileReplica) error {
+	session, err := c.dbHandler.OpenSession(false)
+	if err != nil {
+		return err
+	}
+	err = dao.SaveFileReplica(r, session)
+	session.Close(err)
+	return err
+}
+
+func (c dbReplicaCatalog) retrieveReplicas(path string) ([]*models.FileReplica, error) {
+	session, err := c.dbHandler.OpenSession(true)
+	if err != nil {
+		return nil, err
+	}
+	replicas, err := dao.RetrieveFileReplicasByPath(path, session)
+	session.Close(err)
+	return replicas, err
+}
+
+// replicator writes the copies of the stored content to the replica stores selected by the acquisition's
+// replication policy. Synchronous replicas are written together with the primary copy and a failure fails the store
+// operation; asynchronous replicas are copied from the primary store by background workers.
+type replicator struct {
+	primary   ContentStore
+	catalog   replicaCatalog
+	stores    map[string]ContentStore
+	policies  map[string][]replicaTarget
+	asyncJobs chan *replicaJob
+}
+
+// newReplicator creates the replica stores from REPLICA_STORES and the policies from REPLICATION_POLICIES.
+// A policy maps a sample, project or project owner to a comma separated list of <store>[:sync|async] replica targets.
+func newReplicator(config config.Config, catalog replicaCatalog, primary ContentStore) (*replicator, error) {
+	r := &replicator{
+		primary:  primary,
+		catalog:  catalog,
+		stores:   map[string]ContentStore{},
+		policies: map[string][]replicaTarget{},
+	}
+	for name, storeConfig := range config.GetConfigMapProperty("REPLICA_STORES") {
+		store, err := newContentStore(storeConfig)
+		if err != nil {
+			return nil, fmt.Errorf("Error creating replica store %s: %v", name, err)
+		}
+		r.stores[name] = store
+	}
+	for key, policy := range config.GetStringMapProperty("REPLICATION_POLICIES") {
+		targets, err := r.parsePolicy(policy)
+		if err != nil {
+			return nil, fmt.Errorf("Error parsing the replication policy for %s: %v", key, err)
+		}
+		r.policies[key] = targets
+	}
+	r.asyncJobs = make(chan *replicaJob, config.GetIntProperty("REPLICATION_QUEUE_SIZE", 1000))
+	for w := config.GetIntProperty("REPLICATION_WORKERS", 2); w > 0; w-- {
+		go r.runAsyncReplication()
+	}
+	return r, nil
+}
+
+func (r *replicator) parsePolicy(policy string) ([]replicaTarget, error) {
+	var targets []replicaTarget
+	for _, t := range strings.Split(policy, ",") {
+		if t = strings.TrimSpace(t); t == "" {
+			continue
+		}
+		target := replicaTarget{storageName: t, mode: syncReplication}
+		if i := strings.Index(t, ":"); i >= 0 {
+			target.storageName, target.mode = t[:i], t[i+1:]
+		}
+		if target.mode != syncReplication && target.mode != asyncReplication {
+			return nil, fmt.Errorf("Invalid replication mode %s for %s", target.mode, target.storageName)
+		}
+		if target.store = r.stores[target.storageName]; target.store == nil {
+			return nil, fmt.Errorf("Unknown replica store %s", target.storageName)
+		}
+		targets = append(targets, target)
+	}
+	return targets, nil
+}
+
+// targets returns the replica targets of the acquisition using the same lookup order as the JFS mapping:
+// sample, project, project owner and then the default policy
+func (r *replicator) targets(acq *models.Acquisition) []replicaTarget {
+	if r == nil {
+		return nil
+	}
+	for _, key := range []string{acq.SampleName, acq.ProjectName, acq.ProjectOwner, defaultReplicationPolicy} {
+		if targets, found := r.policies[key]; found && key != "" {
+			return targets
+		}
+	}
+	return nil
+}
+
+// replicate writes the synchronous replicas of the content and queues the asynchronous ones
+func (r *replicator) replicate(acq *models.Acquisition, path string, content []byte, params map[string]string, fObj *models.FileObject) error {
+	var errs []string
+	for _, target := range r.targets(acq) {
+		job := &replicaJob{
+			acq:    acq,
+			path:   path,
+			params: params,
+			target: target,
+			replica: &models.FileReplica{
+				FileObjectID:         fObj.FileObjectID,
+				DerivedFromReplicaID: fObj.FileFSID,
+				StorageName:          target.storageName,
+				JfsPath:              path,
+				VerificationStatus:   models.ReplicaPendingStatus,
+			},
+		}
+		if target.mode == syncReplication {
+			if err := r.writeReplica(job, content); err != nil {
+				errs = append(errs, err.Error())
+			}
+			continue
+		}
+		if err := r.catalog.saveReplica(job.replica); err != nil {
+			logger.Errorf("Error saving the pending replica of %s in %s: %v", path, target.storageName, err)
+		}
+		select {
+		case r.asyncJobs <- job:
+		default:
+			logger.Errorf("Replication queue is full - %s was not copied to %s", path, target.storageName)
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("Error replicating %s: %s", path, strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+func (r *replicator) runAsyncReplication() {
+	for job := range r.asyncJobs {
+		if err := r.writeReplica(job, nil); err != nil {
+			logger.Errorf("Asynchronous replication failed: %v", err)
+		}
+	}
+}
+
+// writeReplica stores and verifies the replica and records its status. If no content is given
+// the content is read from the primary store.
+func (r *replicator) writeReplica(job *replicaJob, content []byte) (err error) {
+	defer func() {
+		job.replica.FileExists = err == nil
+		job.replica.VerificationStatus = models.ReplicaVerifiedStatus
+		if err != nil {
+			job.replica.VerificationStatus = models.ReplicaFailedStatus
+		}
+		if saveErr := r.catalog.saveReplica(job.replica); saveErr != nil {
+			logger.Errorf("Error saving the replica of %s in %s: %v", job.path, job.target.storageName, saveErr)
+			if err == nil {
+				err = saveErr
+			}
+		}
+	}()
+	if content == nil {
+		if content, err = r.primary.Get(job.acq, job.path); err != nil {
+			return fmt.Errorf("Error reading %s from the primary store: %v", job.path, err)
+		}
+	}
+	res, err := job.target.store.Put(job.acq, job.path, content, job.params)
+	if err != nil {
+		return fmt.Errorf("Error writing %s to %s: %v", job.path, job.target.storageName, err)
+	}
+	if key, ok := res["scalityKey"].(string); ok {
+		job.replica.JfsKey = key
+	}
+	if locationURL, ok := res["locationUrl"].(string); ok {
+		job.replica.LocationURL = locationURL
+	}
+	if err = job.target.store.Verify(job.acq, job.path, job.params); err != nil {
+		return fmt.Errorf("Error verifying %s in %s: %v", job.path, job.target.storageName, err)
+	}
+	logger.Debugf("Replicated %s to %s", job.path, job.target.storageName)
+	return nil
+}
+
+// store returns the replica store with the given name
+func (r *replicator) store(storageName string) ContentStore {
+	if r == nil {
+		return nil
+	}
+	return r.stores[storageName]
+}
+
+// retrieve reads the content from the first replica that has it
+func (r *replicator) retrieve(acq *models.Acquisition, path string) ([]byte, error) {
+	if r == nil || len(r.stores) == 0 {
+		return nil, fmt.Errorf("No replica stores configured")
+	}
+	replicas, err := r.catalog.retrieveReplicas(path)
+	if err != nil {
+		return nil, err
+	}
+	for _, replica := range replicas {
+		store := r.stores[replica.StorageName]
+		if store == nil || !replica.FileExists {
+			continue
+		}
+		content, err := store.Get(acq, path)
+		if err == nil {
+			logger.Infof("Retrieved %s from replica %s", path, replica.StorageName)
+			return content, nil
+		}
+		logger.Errorf("Error retrieving %s from replica %s: %v", path, replica.StorageName, err)
+	}
+	return nil, fmt.Errorf("No readable replica found for %s", path)
+}
@@ -0,0 +1,145 @@
+package service
+
+import (
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"imagecatcher/checksum"
+	"imagecatcher/config"
+	"imagecatcher/models"
+)
+
+// memReplicaCatalog keeps the replicas in memory
+type memReplicaCatalog struct {
+	sync.Mutex
+	replicas []*models.FileReplica
+}
+
+func (c *memReplicaCatalog) saveReplica(r *models.FileReplica) error {
+	c.Lock()
+	defer c.Unlock()
+	saved := *r
+	if r.ReplicaID == 0 {
+		r.ReplicaID = int64(len(c.replicas) + 1)
+		saved.ReplicaID = r.ReplicaID
+		c.replicas = append(c.replicas, &saved)
+	} else {
+		c.replicas[r.ReplicaID-1] = &saved
+	}
+	return nil
+}
+
+func (c *memReplicaCatalog) retrieveReplicas(path string) ([]*models.FileReplica, error) {
+	c.Lock()
+	defer c.Unlock()
+	var res []*models.FileReplica
+	for _, r := range c.replicas {
+		if r.JfsPath == path {
+			copy := *r
+			res = append(res, &copy)
+		}
+	}
+	return res, nil
+}
+
+func (c *memReplicaCatalog) get(storageName string) *models.FileReplica {
+	c.Lock()
+	defer c.Unlock()
+	for _, r := range c.replicas {
+		if r.StorageName == storageName {
+			copy := *r
+			return &copy
+		}
+	}
+	return nil
+}
+
+func TestReplicateContent(t *testing.T) {
+	rootDir, err := ioutil.TempDir("", "replicas")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(rootDir)
+	testConfig := config.Config{
+		"STORAGE_BACKEND":   "local",
+		"LOCAL_STORAGE_DIR": rootDir + "/primary",
+		"REPLICA_STORES": map[string]interface{}{
+			"backup":  map[string]interface{}{"STORAGE_BACKEND": "local", "LOCAL_STORAGE_DIR": rootDir + "/backup"},
+			"archive": map[string]interface{}{"STORAGE_BACKEND": "local", "LOCAL_STORAGE_DIR": rootDir + "/archive"},
+		},
+		"REPLICATION_POLICIES": map[string]interface{}{
+			"replicated": "backup:sync, archive:async",
+		},
+	}
+	catalog := &memReplicaCatalog{}
+	primary, err := newContentStore(testConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := newReplicator(testConfig, catalog, primary)
+	if err != nil {
+		t.Fatalf("Error creating the replicator: %v", err)
+	}
+	if targets := r.targets(&models.Acquisition{ProjectName: "other"}); len(targets) != 0 {
+		t.Errorf("Expected no replicas for an acquisition without a policy but got %v", targets)
+	}
+
+	acq := &models.Acquisition{ProjectName: "replicated"}
+	content := []byte("replicated tile content")
+	sum, _ := checksum.Sum(checksum.MD5, content)
+	params := map[string]string{"checksum": hex.EncodeToString(sum), "checksumAlgorithm": checksum.MD5.String()}
+	path := acqFilePath(20, "tile.tif")
+	if _, err = primary.Put(acq, path, content, params); err != nil {
+		t.Fatal(err)
+	}
+	if err = r.replicate(acq, path, content, params, &models.FileObject{FileObjectID: 1, FileFSID: 1}); err != nil {
+		t.Fatalf("Unexpected replication error: %v", err)
+	}
+	backup := catalog.get("backup")
+	if backup == nil || !backup.FileExists || backup.VerificationStatus != models.ReplicaVerifiedStatus ||
+		backup.DerivedFromReplicaID != 1 || backup.LocationURL == "" {
+		t.Errorf("Unexpected synchronous replica %+v", backup)
+	}
+	var archive *models.FileReplica
+	for i := 0; i < 100; i++ {
+		if archive = catalog.get("archive"); archive != nil && archive.VerificationStatus != models.ReplicaPendingStatus {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if archive == nil || !archive.FileExists || archive.VerificationStatus != models.ReplicaVerifiedStatus {
+		t.Errorf("Unexpected asynchronous replica %+v", archive)
+	}
+
+	if err = primary.Delete(acq, path); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = primary.Get(acq, path); err == nil {
+		t.Fatal("Expected the primary copy to be deleted")
+	}
+	if replicaContent, err := r.retrieve(acq, path); err != nil || string(replicaContent) != string(content) {
+		t.Errorf("Expected the content to be read from a replica but got %q: %v", replicaContent, err)
+	}
+	s := &imageCatcherServiceImpl{contentStore: primary, replicator: r}
+	mosaic := &models.TemImageMosaic{Acquisition: *acq}
+	if _, err = s.RetrieveAcquisitionFile(mosaic, path); err != nil {
+		t.Errorf("Expected the service to fall back to the replicas: %v", err)
+	}
+	// the verification must not be satisfied by a replica when the primary copy is lost
+	storedFile := &models.FileObject{JfsPath: path, Checksum: sum, ChecksumAlgorithm: checksum.MD5.String()}
+	if status, message := verifyStoredFile(s, mosaic, storedFile); status != fileMissing {
+		t.Errorf("Expected the lost primary copy to be reported as missing but got %s: %s", status, message)
+	}
+
+	missingPath := acqFilePath(20, "missing.tif")
+	if err = r.replicate(acq, missingPath, nil, params, &models.FileObject{FileObjectID: 2, FileFSID: 2}); err == nil {
+		t.Error("Expected the synchronous replication to fail when the content is not in the primary store")
+	}
+	if _, err = newReplicator(config.Config{"REPLICATION_POLICIES": map[string]interface{}{"p": "unknown"}}, catalog, primary); err == nil {
+		t.Error("Expected an error for a policy that references an unknown store")
+	}
+}
@@ -0,0 +1,315 @@
+package service
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"imagecatcher/checksum"
+	"imagecatcher/config"
+	"imagecatcher/logger"
+	"imagecatcher/models"
+)
+
+const (
+	s3ChecksumMetadata          = "X-Amz-Meta-Checksum"
+	s3ChecksumAlgorithmMetadata = "X-Amz-Meta-Checksum-Algorithm"
+	s3SigningAlgorithm          = "AWS4-HMAC-SHA256"
+	s3TimeFormat                = "20060102T150405Z"
+)
+
+// s3ContentStore stores the content as objects in an S3 compatible bucket (AWS S3, MinIO).
+// The object key is the content store path without the leading slash, i.e. acquisitions/<acqID>/<file name>,
+// and the checksum is kept in the object metadata.
+type s3ContentStore struct {
+	endpoint   string
+	bucket     string
+	signer     s3Signer
+	httpClient *http.Client
+}
+
+// s3Signer signs requests with AWS signature version 4
+type s3Signer struct {
+	accessKey string
+	secretKey string
+	region    string
+	service   string
+}
+
+func newS3ContentStore(config config.Config) (*s3ContentStore, error) {
+	endpoint := strings.TrimRight(config.GetStringProperty("S3_ENDPOINT", ""), "/")
+	bucket := config.GetStringProperty("S3_BUCKET", "")
+	if endpoint == "" || bucket == "" {
+		return nil, fmt.Errorf("S3_ENDPOINT and S3_BUCKET must be set for the s3 storage backend")
+	}
+	timeoutValue := config.GetStringProperty("S3_REQUEST_TIMEOUT", "60s")
+	timeout, err := time.ParseDuration(timeoutValue)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid S3_REQUEST_TIMEOUT %s: %v", timeoutValue, err)
+	}
+	return &s3ContentStore{
+		endpoint: endpoint,
+		bucket:   bucket,
+		signer: s3Signer{
+			accessKey: config.GetStringProperty("S3_ACCESS_KEY", ""),
+			secretKey: config.GetStringProperty("S3_SECRET_KEY", ""),
+			region:    config.GetStringProperty("S3_REGION", "us-east-1"),
+			service:   "s3",
+		},
+		httpClient: &http.Client{Timeout: timeout},
+	}, nil
+}
+
+// objectKey maps the store path to the object key
+func (s *s3ContentStore) objectKey(path string) string {
+	return strings.TrimLeft(path, "/")
+}
+
+// objectURL returns the path style URL of the object
+func (s *s3ContentStore) objectURL(key string) string {
+	return s.endpoint + s3EscapePath("/"+s.bucket+"/"+key)
+}
+
+func (s *s3ContentStore) do(method, key string, body []byte, header http.Header) (*http.Response, error) {
+	req, err := http.NewRequest(method, s.objectURL(key), bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("Error creating the %s request for %s: %v", method, key, err)
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	payloadHash := sha256.Sum256(body)
+	req.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(payloadHash[:]))
+	s.signer.sign(req, hex.EncodeToString(payloadHash[:]), time.Now())
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("Error sending the %s request for %s: %v", method, key, err)
+	}
+	return resp, nil
+}
+
+// s3ResponseError reads the error returned by the object store
+func s3ResponseError(method, key string, resp *http.Response) error {
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	return fmt.Errorf("Error response to %s %s: %s %s", method, key, resp.Status, strings.TrimSpace(string(body)))
+}
+
+func (s *s3ContentStore) Put(acq *models.Acquisition, path string, content []byte, params map[string]string) (map[string]interface{}, error) {
+	key := s.objectKey(path)
+	md5Sum := md5.Sum(content)
+	header := http.Header{}
+	header.Set("Content-Type", "application/octet-stream")
+	// the object store rejects the upload if the content was corrupted on the way
+	header.Set("Content-Md5", base64.StdEncoding.EncodeToString(md5Sum[:]))
+	if params["checksum"] != "" {
+		alg, err := checksum.Lookup(params["checksumAlgorithm"])
+		if err != nil {
+			return nil, err
+		}
+		header.Set(s3ChecksumMetadata, params["checksum"])
+		header.Set(s3ChecksumAlgorithmMetadata, alg.String())
+	}
+	resp, err := s.do("PUT", key, content, header)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, s3ResponseError("PUT", key, resp)
+	}
+	res := map[string]interface{}{
+		"scalityKey":  key,
+		"locationUrl": s.objectURL(key),
+	}
+	if params["checksum"] != "" {
+		res["checksum"] = params["checksum"]
+		res["checksumAlgorithm"] = header.Get(s3ChecksumAlgorithmMetadata)
+	}
+	logger.Debugf("Stored %s (%d bytes) in bucket %s", key, len(content), s.bucket)
+	return res, nil
+}
+
+func (s *s3ContentStore) Get(acq *models.Acquisition, path string) ([]byte, error) {
+	key := s.objectKey(path)
+	resp, err := s.do("GET", key, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, &contentNotFoundError{path: key, err: fmt.Errorf("%s", resp.Status)}
+	} else if resp.StatusCode != http.StatusOK {
+		return nil, s3ResponseError("GET", key, resp)
+	}
+	content, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("Error retrieving content for %s: %v", key, err)
+	}
+	return content, nil
+}
+
+// Verify compares the checksum from the parameters with the checksum from the object metadata. For MD5 checksums
+// the object's ETag is also checked since for single part uploads it is the MD5 of the stored content.
+// Without a checksum parameter it only checks that the object exists.
+func (s *s3ContentStore) Verify(acq *models.Acquisition, path string, params map[string]string) error {
+	key := s.objectKey(path)
+	resp, err := s.do("HEAD", key, nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return &contentNotFoundError{path: key, err: fmt.Errorf("%s", resp.Status)}
+	} else if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Error verifying %s: %s", key, resp.Status)
+	}
+	if params["checksum"] == "" {
+		return nil
+	}
+	alg, err := checksum.Lookup(params["checksumAlgorithm"])
+	if err != nil {
+		return err
+	}
+	expected := strings.ToLower(params["checksum"])
+	if storedAlg := resp.Header.Get(s3ChecksumAlgorithmMetadata); storedAlg == alg.String() {
+		if stored := strings.ToLower(resp.Header.Get(s3ChecksumMetadata)); stored != expected {
+			return fmt.Errorf("The %s checksum %s recorded for %s does not match the checksum %s", alg, stored, key, expected)
+		}
+	} else if alg != checksum.MD5 {
+		return fmt.Errorf("No %s checksum recorded for %s", alg, key)
+	}
+	etag := strings.ToLower(strings.Trim(resp.Header.Get("Etag"), `"`))
+	if alg == checksum.MD5 && !strings.Contains(etag, "-") && etag != expected {
+		return fmt.Errorf("The ETag %s of %s does not match the MD5 checksum %s", etag, key, expected)
+	}
+	return nil
+}
+
+func (s *s3ContentStore) Delete(acq *models.Acquisition, path string) error {
+	key := s.objectKey(path)
+	resp, err := s.do("DELETE", key, nil, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		return s3ResponseError("DELETE", key, resp)
+	}
+	return nil
+}
+
+// Ping writes and verifies a small object in the bucket
+func (s *s3ContentStore) Ping() error {
+	pingPath := acqFilePath(0, jfsPingFileType)
+	pingContent := []byte("S3 ping")
+	pingChecksum := md5.Sum(pingContent)
+	params := map[string]string{
+		"checksum":          hex.EncodeToString(pingChecksum[:]),
+		"checksumAlgorithm": checksum.MD5.String(),
+	}
+	if _, err := s.Put(nil, pingPath, pingContent, params); err != nil {
+		return err
+	}
+	return s.Verify(nil, pingPath, params)
+}
+
+// sign adds the X-Amz-Date and the Authorization headers to the request. The signed headers are
+// the host, Content-Md5, Content-Type and all X-Amz-* headers.
+func (signer s3Signer) sign(req *http.Request, payloadHash string, t time.Time) {
+	t = t.UTC()
+	amzDate := t.Format(s3TimeFormat)
+	scope := strings.Join([]string{t.Format("20060102"), signer.region, signer.service, "aws4_request"}, "/")
+	req.Header.Set("X-Amz-Date", amzDate)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		lname := strings.ToLower(name)
+		if lname == "content-md5" || lname == "content-type" || strings.HasPrefix(lname, "x-amz-") {
+			headers[lname] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	signedHeaderNames := make([]string, 0, len(headers))
+	for name := range headers {
+		signedHeaderNames = append(signedHeaderNames, name)
+	}
+	sort.Strings(signedHeaderNames)
+	var canonicalHeaders bytes.Buffer
+	for _, name := range signedHeaderNames {
+		fmt.Fprintf(&canonicalHeaders, "%s:%s\n", name, headers[name])
+	}
+	signedHeaders := strings.Join(signedHeaderNames, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		s3EscapePath(req.URL.Path),
+		s3CanonicalQuery(req),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	canonicalRequestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{
+		s3SigningAlgorithm,
+		amzDate,
+		scope,
+		hex.EncodeToString(canonicalRequestHash[:]),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+signer.secretKey), t.Format("20060102"))
+	key = hmacSHA256(key, signer.region)
+	key = hmacSHA256(key, signer.service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s3SigningAlgorithm, signer.accessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// s3CanonicalQuery returns the sorted and escaped query string
+func s3CanonicalQuery(req *http.Request) string {
+	query := req.URL.Query()
+	params := make([]string, 0, len(query))
+	for name, values := range query {
+		for _, v := range values {
+			params = append(params, s3Escape(name, true)+"="+s3Escape(v, true))
+		}
+	}
+	sort.Strings(params)
+	return strings.Join(params, "&")
+}
+
+func s3EscapePath(path string) string {
+	return s3Escape(path, false)
+}
+
+// s3Escape URI encodes every byte except the unreserved characters and, unless encodeSlash is set, the slash
+func s3Escape(s string, encodeSlash bool) string {
+	var escaped bytes.Buffer
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9', c == '-', c == '_', c == '.', c == '~':
+			escaped.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			escaped.WriteByte(c)
+		default:
+			fmt.Fprintf(&escaped, "%%%02X", c)
+		}
+	}
+	return escaped.String()
+}
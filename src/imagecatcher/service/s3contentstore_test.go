@@ -0,0 +1,144 @@
+package service
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"imagecatcher/checksum"
+	"imagecatcher/config"
+)
+
+type fakeS3Object struct {
+	content []byte
+	header  http.Header
+}
+
+// fakeS3Server is a minimal in-memory stand-in for a MinIO server that supports path style object requests
+type fakeS3Server struct {
+	sync.Mutex
+	objects map[string]*fakeS3Object
+}
+
+func (fs *fakeS3Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	fs.Lock()
+	defer fs.Unlock()
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=testkey/") {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	switch r.Method {
+	case "PUT":
+		content, _ := ioutil.ReadAll(r.Body)
+		contentMD5 := md5.Sum(content)
+		if r.Header.Get("Content-Md5") != base64.StdEncoding.EncodeToString(contentMD5[:]) {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, "BadDigest")
+			return
+		}
+		header := http.Header{}
+		for name, values := range r.Header {
+			if strings.HasPrefix(name, "X-Amz-Meta-") {
+				header[name] = values
+			}
+		}
+		header.Set("Etag", fmt.Sprintf(`"%x"`, contentMD5))
+		fs.objects[r.URL.Path] = &fakeS3Object{content: content, header: header}
+		w.Header().Set("Etag", header.Get("Etag"))
+	case "GET", "HEAD":
+		obj := fs.objects[r.URL.Path]
+		if obj == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		for name, values := range obj.header {
+			w.Header()[name] = values
+		}
+		w.Write(obj.content)
+	case "DELETE":
+		delete(fs.objects, r.URL.Path)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func TestS3SignerVector(t *testing.T) {
+	// get-vanilla from the AWS signature version 4 test suite
+	signer := s3Signer{
+		accessKey: "AKIDEXAMPLE",
+		secretKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY",
+		region:    "us-east-1",
+		service:   "service",
+	}
+	req, _ := http.NewRequest("GET", "https://example.amazonaws.com/", nil)
+	emptyPayloadHash := "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	signer.sign(req, emptyPayloadHash, time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC))
+	expected := "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, " +
+		"SignedHeaders=host;x-amz-date, Signature=5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31"
+	if auth := req.Header.Get("Authorization"); auth != expected {
+		t.Errorf("Expected authorization %s but got %s", expected, auth)
+	}
+}
+
+func TestS3ContentStore(t *testing.T) {
+	fakeServer := &fakeS3Server{objects: map[string]*fakeS3Object{}}
+	server := httptest.NewServer(fakeServer)
+	defer server.Close()
+	store, err := newContentStore(config.Config{
+		"STORAGE_BACKEND": "s3",
+		"S3_ENDPOINT":     server.URL,
+		"S3_BUCKET":       "tiles",
+		"S3_ACCESS_KEY":   "testkey",
+		"S3_SECRET_KEY":   "testsecret",
+	})
+	if err != nil {
+		t.Fatalf("Error creating the S3 content store: %v", err)
+	}
+	if err = store.Ping(); err != nil {
+		t.Errorf("Unexpected ping error: %v", err)
+	}
+
+	content := []byte("s3 tile content")
+	for _, alg := range []checksum.Algorithm{checksum.MD5, checksum.SHA256} {
+		sum, _ := checksum.Sum(alg, content)
+		params := map[string]string{"checksum": hex.EncodeToString(sum), "checksumAlgorithm": alg.String()}
+		path := acqFilePath(10, "col0001/col0001_row0002_cam0.tif")
+		res, err := store.Put(nil, path, content, params)
+		if err != nil {
+			t.Fatalf("Error storing the content with %s: %v", alg, err)
+		}
+		expectedKey := "acquisitions/10/col0001/col0001_row0002_cam0.tif"
+		if res["scalityKey"] != expectedKey || res["locationUrl"] != server.URL+"/tiles/"+expectedKey {
+			t.Errorf("Unexpected store result %v", res)
+		}
+		if storedContent, err := store.Get(nil, path); err != nil || string(storedContent) != string(content) {
+			t.Errorf("Unexpected stored content %q: %v", storedContent, err)
+		}
+		if err = store.Verify(nil, path, params); err != nil {
+			t.Errorf("Unexpected %s verify error: %v", alg, err)
+		}
+
+		corrupted := fakeServer.objects["/tiles/"+expectedKey]
+		corrupted.header.Set(s3ChecksumMetadata, strings.Repeat("0", len(params["checksum"])))
+		if err = store.Verify(nil, path, params); err == nil {
+			t.Errorf("Expected the verification of the object with a different %s checksum to fail", alg)
+		}
+
+		if err = store.Delete(nil, path); err != nil {
+			t.Fatalf("Error deleting the content: %v", err)
+		}
+		if err = store.Verify(nil, path, params); err == nil {
+			t.Error("Expected the verification of a deleted object to fail")
+		}
+		if _, err = store.Get(nil, path); !isContentNotFound(err) {
+			t.Errorf("Expected a deleted object to be reported as not found but got %v", err)
+		}
+	}
+}
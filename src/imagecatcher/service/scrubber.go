@@ -0,0 +1,137 @@
+package service
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"imagecatcher/config"
+	"imagecatcher/logger"
+	"imagecatcher/models"
+)
+
+// ReplicaScrubber walks all stored tile and ancillary file replicas at a limited rate, re-verifies
+// their checksums against their stores and sends a notification for the missing or corrupted replicas
+type ReplicaScrubber struct {
+	verifier        ReplicaVerifier
+	messageNotifier MessageNotifier
+	// rate is the maximum number of replicas verified per second
+	rate         float64
+	batchSize    int
+	passInterval time.Duration
+	errorDelay   time.Duration
+	stop         chan struct{}
+	stopOnce     sync.Once
+	done         chan struct{}
+}
+
+// scrubPassStats counts the results of a scrubbing pass
+type scrubPassStats struct {
+	started                                 time.Time
+	verified, missing, corrupted, unchecked int
+}
+
+// NewReplicaScrubber creates a replica scrubber configured with SCRUB_RATE, SCRUB_BATCH_SIZE and SCRUB_PASS_INTERVAL
+func NewReplicaScrubber(v ReplicaVerifier, messageNotifier MessageNotifier, config config.Config) *ReplicaScrubber {
+	passIntervalValue := config.GetStringProperty("SCRUB_PASS_INTERVAL", "24h")
+	passInterval, err := time.ParseDuration(passIntervalValue)
+	if err != nil {
+		logger.Errorf("Invalid SCRUB_PASS_INTERVAL value %s - will default to 24h: %v", passIntervalValue, err)
+		passInterval = 24 * time.Hour
+	}
+	return &ReplicaScrubber{
+		verifier:        v,
+		messageNotifier: messageNotifier,
+		rate:            config.GetFloat64Property("SCRUB_RATE", 5),
+		batchSize:       config.GetIntProperty("SCRUB_BATCH_SIZE", 20),
+		passInterval:    passInterval,
+		errorDelay:      time.Minute,
+		stop:            make(chan struct{}),
+		done:            make(chan struct{}),
+	}
+}
+
+// Run scrubs the replicas in repeated passes until the scrubber is stopped.
+// Scrubbing is disabled if the rate is not positive.
+func (s *ReplicaScrubber) Run() {
+	defer close(s.done)
+	if s.rate <= 0 || s.batchSize <= 0 {
+		logger.Infof("Replica scrubbing is disabled")
+		return
+	}
+	var lastReplicaID int64
+	pass := &scrubPassStats{started: time.Now()}
+	for {
+		batchStart := time.Now()
+		nextReplicaID, n, err := s.scrubBatch(lastReplicaID, pass)
+		var pause time.Duration
+		switch {
+		case err != nil:
+			logger.Errorf("Error scrubbing the replicas after %d: %v", lastReplicaID, err)
+			pause = s.errorDelay
+		case n == 0:
+			logger.Infof("Replica scrubbing pass started at %v completed: %d verified, %d missing, %d corrupted, %d not checked",
+				pass.started, pass.verified, pass.missing, pass.corrupted, pass.unchecked)
+			pause = s.passInterval
+		default:
+			pause = time.Duration(float64(n)/s.rate*float64(time.Second)) - time.Since(batchStart)
+		}
+		select {
+		case <-s.stop:
+			return
+		case <-time.After(pause):
+		}
+		if err == nil && n == 0 {
+			lastReplicaID = 0
+			pass = &scrubPassStats{started: time.Now()}
+		} else {
+			lastReplicaID = nextReplicaID
+		}
+	}
+}
+
+// scrubBatch verifies the batch of replicas after the given replica and notifies about the replicas that
+// are missing or corrupted. It returns the id of the last verified replica and the number of replicas verified.
+func (s *ReplicaScrubber) scrubBatch(afterReplicaID int64, pass *scrubPassStats) (int64, int, error) {
+	results, err := s.verifier.ScrubReplicas(afterReplicaID, s.batchSize)
+	if len(results) == 0 {
+		return afterReplicaID, 0, err
+	}
+	var problems []string
+	for _, r := range results {
+		switch r.Status {
+		case models.ReplicaVerifiedStatus:
+			pass.verified++
+		case models.ReplicaMissingStatus, models.ReplicaCorruptedStatus:
+			if r.Status == models.ReplicaMissingStatus {
+				pass.missing++
+			} else {
+				pass.corrupted++
+			}
+			storageName := r.Replica.StorageName
+			if storageName == "" {
+				storageName = "primary store"
+			}
+			problems = append(problems, fmt.Sprintf("Acquisition %d: %s is %s in %s: %v",
+				r.Replica.Acquisition.AcqUID, r.Replica.JfsPath, r.Status, storageName, r.Err))
+		default:
+			pass.unchecked++
+			logger.Errorf("Replica %d of %s could not be verified: %v", r.Replica.ReplicaID, r.Replica.JfsPath, r.Err)
+		}
+	}
+	if len(problems) > 0 {
+		logger.Errorf("Replica scrubbing found %d problems: %v", len(problems), problems)
+		s.messageNotifier.SendMessage(fmt.Sprintf("Replica scrubbing found %d missing or corrupted files:\n%s",
+			len(problems), strings.Join(problems, "\n")), false)
+	}
+	return results[len(results)-1].Replica.ReplicaID, len(results), err
+}
+
+// Stop stops the scrubber and waits for the current batch to complete
+func (s *ReplicaScrubber) Stop() {
+	s.stopOnce.Do(func() {
+		close(s.stop)
+	})
+	<-s.done
+}
@@ -0,0 +1,141 @@
+package service
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"imagecatcher/checksum"
+	"imagecatcher/config"
+	"imagecatcher/models"
+)
+
+func TestVerifyReplica(t *testing.T) {
+	rootDir, err := ioutil.TempDir("", "scrub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(rootDir)
+	primary, err := newLocalContentStore(rootDir + "/primary")
+	if err != nil {
+		t.Fatal(err)
+	}
+	backup, err := newLocalContentStore(rootDir + "/backup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &imageCatcherServiceImpl{
+		contentStore: primary,
+		replicator:   &replicator{stores: map[string]ContentStore{"backup": backup}},
+	}
+	content := []byte("scrubbed content")
+	sum, _ := checksum.Sum(checksum.SHA256, content)
+	params := map[string]string{"checksum": fmt.Sprintf("%x", sum), "checksumAlgorithm": checksum.SHA256.String()}
+	path := acqFilePath(30, "tile.tif")
+	for _, store := range []ContentStore{primary, backup} {
+		if _, err = store.Put(nil, path, content, params); err != nil {
+			t.Fatal(err)
+		}
+	}
+	replica := func(storageName string) *models.StoredReplica {
+		r := &models.StoredReplica{Checksum: sum, ChecksumAlgorithm: checksum.SHA256.String()}
+		r.StorageName = storageName
+		r.JfsPath = path
+		return r
+	}
+
+	if result := s.verifyReplica(replica("")); result.Status != models.ReplicaVerifiedStatus || result.Err != nil {
+		t.Errorf("Expected the primary replica to be verified but got %s: %v", result.Status, result.Err)
+	}
+	if err = ioutil.WriteFile(backup.fullPath(path), []byte("corrupted"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if result := s.verifyReplica(replica("backup")); result.Status != models.ReplicaCorruptedStatus || result.Err == nil {
+		t.Errorf("Expected the backup replica to be corrupted but got %s: %v", result.Status, result.Err)
+	}
+	if err = primary.Delete(nil, path); err != nil {
+		t.Fatal(err)
+	}
+	if result := s.verifyReplica(replica("")); result.Status != models.ReplicaMissingStatus {
+		t.Errorf("Expected the primary replica to be missing but got %s: %v", result.Status, result.Err)
+	}
+	if result := s.verifyReplica(replica("unknown")); result.Status != "" || result.Err == nil {
+		t.Errorf("Expected a replica in an unknown store not to be verified but got %s: %v", result.Status, result.Err)
+	}
+	s.replicator.stores["unavailable"] = &unavailableContentStore{backup}
+	if result := s.verifyReplica(replica("unavailable")); result.Status != "" || result.Err == nil {
+		t.Errorf("Expected a replica in an unavailable store not to be verified but got %s: %v", result.Status, result.Err)
+	}
+}
+
+// unavailableContentStore simulates a store that cannot be reached
+type unavailableContentStore struct {
+	ContentStore
+}
+
+func (s *unavailableContentStore) Verify(acq *models.Acquisition, path string, params map[string]string) error {
+	return fmt.Errorf("Error verifying %s: connection refused", path)
+}
+
+type fakeReplicaVerifier struct {
+	ImageCatcherService
+	results []*ReplicaScrubResult
+}
+
+func (v *fakeReplicaVerifier) ScrubReplicas(afterReplicaID int64, limit int) ([]*ReplicaScrubResult, error) {
+	var res []*ReplicaScrubResult
+	for _, r := range v.results {
+		if r.Replica.ReplicaID > afterReplicaID && len(res) < limit {
+			res = append(res, r)
+		}
+	}
+	return res, nil
+}
+
+func TestScrubBatch(t *testing.T) {
+	storedReplica := func(replicaID int64, storageName string) *models.StoredReplica {
+		r := &models.StoredReplica{Acquisition: models.Acquisition{AcqUID: 40}}
+		r.ReplicaID = replicaID
+		r.StorageName = storageName
+		r.JfsPath = acqFilePath(40, fmt.Sprintf("tile%d.tif", replicaID))
+		return r
+	}
+	verifier := &fakeReplicaVerifier{
+		results: []*ReplicaScrubResult{
+			{Replica: storedReplica(1, ""), Status: models.ReplicaVerifiedStatus},
+			{Replica: storedReplica(2, "backup"), Status: models.ReplicaCorruptedStatus, Err: fmt.Errorf("checksum mismatch")},
+			{Replica: storedReplica(3, ""), Status: models.ReplicaMissingStatus, Err: fmt.Errorf("not found")},
+			{Replica: storedReplica(4, "unknown"), Err: fmt.Errorf("unknown store")},
+		},
+	}
+	notifier := createFakeErrorNotifier()
+	scrubber := NewReplicaScrubber(verifier, notifier, config.Config{"SCRUB_BATCH_SIZE": 3})
+	pass := &scrubPassStats{}
+
+	next, n, err := scrubber.scrubBatch(0, pass)
+	if err != nil || next != 3 || n != 3 {
+		t.Fatalf("Expected 3 replicas to be scrubbed up to replica 3 but got %d up to %d: %v", n, next, err)
+	}
+	if pass.verified != 1 || pass.corrupted != 1 || pass.missing != 1 {
+		t.Errorf("Unexpected pass stats %+v", pass)
+	}
+	if notifier.messageStorage.len() != 1 {
+		t.Fatalf("Expected one notification but got %d", notifier.messageStorage.len())
+	}
+	message := notifier.messageStorage.getLast().(string)
+	if !strings.Contains(message, "tile2.tif is corrupted in backup") || !strings.Contains(message, "tile3.tif is missing in primary store") {
+		t.Errorf("Unexpected notification %s", message)
+	}
+
+	if next, n, err = scrubber.scrubBatch(next, pass); err != nil || next != 4 || n != 1 || pass.unchecked != 1 {
+		t.Errorf("Expected the last replica to be left unchecked but got %d up to %d: %v", n, next, err)
+	}
+	if notifier.messageStorage.len() != 1 {
+		t.Errorf("Expected no notification for a replica that could not be checked")
+	}
+	if _, n, _ = scrubber.scrubBatch(next, pass); n != 0 {
+		t.Errorf("Expected the pass to be complete but %d replicas were scrubbed", n)
+	}
+}
@@ -1,6 +1,7 @@
 package service
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"regexp"
@@ -8,6 +9,7 @@ import (
 	"strings"
 	"time"
 
+	"imagecatcher/checksum"
 	"imagecatcher/config"
 	"imagecatcher/diagnostic"
 	"imagecatcher/logger"
@@ -17,6 +19,7 @@ import (
 // ServerHandler interface for dealing with TCP request
 type ServerHandler interface {
 	Serve() error
+	Shutdown(ctx context.Context) error
 }
 
 // Initializer objects that could be initilized using a configuration
@@ -30,18 +33,27 @@ type AcqDataWriter interface {
 	CreateAncillaryFile(acqMosaic *models.TemImageMosaic, f *FileParams) (*models.FileObject, error)
 	CreateROIs(acqMosaic *models.TemImageMosaic, roiFiles *ROIFiles) error
 	EndAcquisition(acqID uint64) error
+	ChangeAcquisitionState(acqID uint64, newState string) (*models.Acquisition, error)
 	StoreTile(acqMosaic *models.TemImageMosaic, tileParams *TileParams) (*models.TemImage, error)
 	StoreAcquisitionFile(acqMosaic *models.TemImageMosaic, f *FileParams, fObj *models.FileObject) error
 	UpdateTile(tileImage *models.TemImage) error
+	// StoreTileMipmap stores a downsampled level of the tile as a file object derived from the tile
+	StoreTileMipmap(tileImage *models.TemImage, level int, f *FileParams) (*models.FileObject, error)
 }
 
 // AcqDataReader handles the retrieval of acquisition entities
 type AcqDataReader interface {
 	GetAcquisitions(acqFilter *models.AcquisitionFilter) ([]*models.Acquisition, error)
 	GetMosaic(acqID uint64) (*models.TemImageMosaic, error)
+	GetCameraConfiguration(acqMosaic *models.TemImageMosaic, camera int) (*models.TemCameraConfiguration, error)
 	GetTile(tileID int64) (*models.TemImageROI, error)
 	GetTiles(tileFilter *models.TileFilter) ([]*models.TemImageROI, error)
+	GetAncillaryFiles(acqID uint64) ([]*models.FileObject, error)
+	GetAcquisitionCompleteness(acqID uint64) (*CompletenessReport, error)
+	GetTileTimings(filter *models.TimingFilter) ([]*models.TileTiming, error)
 	RetrieveAcquisitionFile(acqMosaic *models.TemImageMosaic, path string) ([]byte, error)
+	// RetrievePrimaryAcquisitionFile retrieves the file only from the primary content store, without falling back to the replicas
+	RetrievePrimaryAcquisitionFile(acqMosaic *models.TemImageMosaic, path string) ([]byte, error)
 	VerifyAcquisitionFile(acqMosaic *models.TemImageMosaic, f *FileParams, fObj *models.FileObject) error
 }
 
@@ -50,11 +62,34 @@ type ProjectDataReader interface {
 	GetProjects(filter *models.ProjectFilter) ([]*models.Project, error)
 }
 
+// ReplicaVerifier re-verifies the stored replicas of the acquisition files
+type ReplicaVerifier interface {
+	// ScrubReplicas verifies up to limit stored replicas that come after the given replica and records the results
+	ScrubReplicas(afterReplicaID int64, limit int) ([]*ReplicaScrubResult, error)
+	GetReplicaScrubStatus(acqID uint64) (*ReplicaScrubStatus, error)
+}
+
+// AcqVerifier runs bulk verification jobs for the stored acquisition files
+type AcqVerifier interface {
+	StartVerification(acqFilter *models.AcquisitionFilter) (*VerificationJob, error)
+	GetVerification(jobID string) *VerificationJob
+}
+
+// StoredImageChecker cross-checks the images the microscope lists as saved with the persisted tiles
+type StoredImageChecker interface {
+	// ReconcileStoredImages reconciles the stored image lists of the acquisition and records the discrepancies found
+	ReconcileStoredImages(acqID uint64) (*StoredImageReconciliation, error)
+	GetStoredImageDiscrepancies(acqID uint64) ([]*models.StoredImageDiscrepancy, error)
+}
+
 // ImageCatcherService processes acquistion data
 type ImageCatcherService interface {
 	AcqDataWriter
 	AcqDataReader
 	ProjectDataReader
+	ReplicaVerifier
+	AcqVerifier
+	StoredImageChecker
 	diagnostic.Pingable
 }
 
@@ -62,6 +97,7 @@ type ImageCatcherService interface {
 type FileParams struct {
 	Name              string
 	Content, Checksum []byte
+	ChecksumAlgorithm checksum.Algorithm
 	ContentLen        int
 }
 
@@ -73,6 +109,7 @@ func (f *FileParams) reset() {
 	f.Name = ""
 	f.Content = nil
 	f.Checksum = nil
+	f.ChecksumAlgorithm = checksum.DefaultAlgorithm
 	f.ContentLen = 0
 }
 
@@ -88,6 +125,20 @@ type ROIFiles struct {
 	RoiSpec  FileParams
 }
 
+// ReplicaScrubResult result of verifying a stored replica. The status is empty if the replica could not be verified.
+type ReplicaScrubResult struct {
+	Replica *models.StoredReplica
+	Status  string
+	Err     error
+}
+
+// ReplicaScrubStatus verification status of the replicas of an acquisition's files
+type ReplicaScrubStatus struct {
+	AcqUID   uint64
+	Summary  []*models.ReplicaStatusSummary
+	Problems []*models.FileReplica
+}
+
 // ExecutionContext used for capturing the state during the processing of a single request.
 // For now it only captures when the processing starts.
 type ExecutionContext struct {
@@ -1,13 +1,14 @@
 package service
 
 import (
+	"bytes"
 	"encoding/hex"
 	"fmt"
 	"github.com/JaneliaSciComp/janelia-file-services/JFSGolang/jfs"
-	"github.com/hashicorp/golang-lru"
 	"strings"
 	"time"
 
+	"imagecatcher/checksum"
 	"imagecatcher/config"
 	"imagecatcher/dao"
 	"imagecatcher/logger"
@@ -31,11 +32,13 @@ const (
 )
 
 type imageCatcherServiceImpl struct {
-	config          config.Config
-	jfsFactory      jfs.Factory
-	dbHandler       dao.DbHandler
-	jfsServiceCache *lru.Cache
-	jfsMapping      map[string]string
+	config        config.Config
+	dbHandler     dao.DbHandler
+	contentStore  ContentStore
+	replicator    *replicator
+	verifications *verificationJobs
+	// metricThresholds are the accepted tile metric ranges
+	metricThresholds []models.MetricRange
 }
 
 // NewService creates an instance of an image catcher service
@@ -46,69 +49,24 @@ func NewService(dbHandler dao.DbHandler, config config.Config) (ImageCatcherServ
 }
 
 func (s *imageCatcherServiceImpl) Initialize(dbHandler dao.DbHandler, config config.Config) error {
+	var err error
 	s.config = config
-
-	// Initialize JFS Factory
-	jfsUser := config.GetStringProperty("JFS_MONGO_USER", "")
-	jfsPassword := config.GetStringProperty("JFS_MONGO_PASSWORD", "")
-	scalityRingsMapping := config.GetStringMapProperty("SCALITY_RINGS_MAPPING")
-	jfsDbUrls := config.GetStringArrayProperty("JFS_MONGO_URL")
-	logger.Debugf("Connect to JFS database(s) %v", jfsDbUrls)
-	jfsFactory, err := jfs.GetFactoryInstance(
-		jfsUser,
-		jfsPassword,
-		jfsDbUrls,
-		scalityRingsMapping)
-	if err != nil {
-		return fmt.Errorf("Error initializing JFS Factory: %v", err)
-	}
-	if err = s.initializeJFS(jfsFactory); err != nil {
+	if s.contentStore, err = newContentStore(config); err != nil {
 		return err
 	}
 	s.dbHandler = dbHandler
-
-	return err
-}
-
-func (s *imageCatcherServiceImpl) initializeJFS(f jfs.Factory) error {
-	var err error
-	s.jfsFactory = f
-	s.jfsMapping = s.config.GetStringMapProperty("JFS_MAPPING")
-	if s.jfsServiceCache, err = lru.New(s.config.GetIntProperty("JFS_SERVICE_CACHE_LEN", 20)); err != nil {
-		return fmt.Errorf("Error initializing JFS service cache")
+	if s.replicator, err = newReplicator(config, dbReplicaCatalog{dbHandler}, s.contentStore); err != nil {
+		return err
 	}
+	s.verifications = newVerificationJobs(s, config)
+	s.metricThresholds = metricThresholds(config)
 	return nil
 }
 
-func (s *imageCatcherServiceImpl) getAcqFileService(acq *models.Acquisition) (jfs.FileService, error) {
-	jfsCollectionName := s.jfsMapping[acq.SampleName]
-	if jfsCollectionName == "" {
-		jfsCollectionName = s.jfsMapping[acq.ProjectName]
-	}
-	if jfsCollectionName == "" {
-		jfsCollectionName = s.jfsMapping[acq.ProjectOwner]
-	}
-	if jfsCollectionName == "" {
-		jfsCollectionName = acq.ProjectOwner
-	}
-	return s.getFileService(jfsCollectionName)
-}
-
-func (s *imageCatcherServiceImpl) getFileService(jfsCollectionName string) (fileService jfs.FileService, err error) {
-	cachedFileService, found := s.jfsServiceCache.Get(jfsCollectionName)
-	if found {
-		return cachedFileService.(jfs.FileService), nil
-	}
-	logger.Debugf("Open fileservice %s", jfsCollectionName)
-	fileService = s.jfsFactory.GetFileService(jfsCollectionName)
-	if fileService == nil {
-		return nil, fmt.Errorf("No JFS service found for %s ", jfsCollectionName)
-	}
-	if err = fileService.Open(); err != nil {
-		return fileService, fmt.Errorf("Error opening JFS service for %s: %v", jfsCollectionName, err)
-	}
-	s.jfsServiceCache.Add(jfsCollectionName, fileService)
-	return fileService, nil
+func (s *imageCatcherServiceImpl) initializeJFS(f jfs.Factory) error {
+	var err error
+	s.contentStore, err = newJFSContentStore(f, s.config)
+	return err
 }
 
 // CreateAcquisition creates an acquisition from an acquisition log file.
@@ -163,7 +121,7 @@ func (s *imageCatcherServiceImpl) CreateROIs(acqMosaic *models.TemImageMosaic, r
 }
 
 // CreateAncillaryFile creates an ancillary file for the specified mosaic. If the ancillary file is a ROI INI spec or a ROI CSV file
-// it also creates the corresponding regions of interest.
+// it also creates the corresponding regions of interest and if it is a timing file it records the timings of the acquisition steps.
 func (s *imageCatcherServiceImpl) CreateAncillaryFile(acqMosaic *models.TemImageMosaic, f *FileParams) (*models.FileObject, error) {
 	fileType := extractAncillaryFileType(f.Name)
 	fObj, err := s.persistAncillaryFile(acqMosaic, fileType, f)
@@ -185,11 +143,58 @@ func (s *imageCatcherServiceImpl) CreateAncillaryFile(acqMosaic *models.TemImage
 			err = s.createROITiles(acqMosaic, roiTiles)
 		}
 		return fObj, err
+	case pulseFileType, controllerElapsedFileType, controllerTimingFileType, daqTimingFileType:
+		return fObj, s.createTimings(acqMosaic, fileType, f.Content)
+	case statisticsFileType:
+		return fObj, s.createTileMetrics(acqMosaic, storedImageListCamera(f.Name), f.Content)
 	default:
 		return fObj, err
 	}
 }
 
+// createTimings records the steps and the values from a timing file; the values from a previous version of the file are replaced.
+// The tile positions of the steps are only replaced if the file has them.
+func (s *imageCatcherServiceImpl) createTimings(acqMosaic *models.TemImageMosaic, fileType string, content []byte) error {
+	source := strings.TrimSuffix(fileType, ".csv")
+	steps, values, err := parseTimingFile(content, source)
+	if err != nil {
+		return err
+	}
+	session, err := s.dbHandler.OpenSession(false)
+	if err != nil {
+		return err
+	}
+	if len(steps) > 0 {
+		err = dao.ReplaceTimingSteps(acqMosaic, steps, session)
+	}
+	if err == nil {
+		err = dao.ReplaceTimingValues(acqMosaic, source, values, session)
+	}
+	session.Close(err)
+	if err == nil {
+		logger.Infof("Recorded %d steps and %d values from %s for %v", len(steps), len(values), source, acqMosaic)
+	}
+	return err
+}
+
+// createTileMetrics records the tile metrics from a statistics file; the metrics from a previous version of the file are replaced.
+func (s *imageCatcherServiceImpl) createTileMetrics(acqMosaic *models.TemImageMosaic, camera int, content []byte) error {
+	metrics, err := parseTileStatistics(content, camera)
+	if err != nil {
+		return err
+	}
+	session, err := s.dbHandler.OpenSession(false)
+	if err != nil {
+		return err
+	}
+	err = dao.ReplaceTileMetrics(acqMosaic, camera, metrics, session)
+	session.Close(err)
+	if err == nil {
+		logger.Infof("Recorded %d tile metrics for %v", len(metrics), acqMosaic)
+	}
+	return err
+}
+
 func extractAncillaryFileType(fname string) string {
 	r := strings.NewReplacer(
 		"_cam0.csv", ".csv",
@@ -233,6 +238,9 @@ func (s *imageCatcherServiceImpl) persistAncillaryFile(acqMosaic *models.TemImag
 	if err = s.updateFileObj(fileObject); err != nil {
 		return fileObject, fmt.Errorf("Error updating JFS parameters for %v", fileObject.Path)
 	}
+	if err = s.replicateContent(acqMosaic, f, fileObject); err != nil {
+		return fileObject, err
+	}
 	return fileObject, nil
 }
 
@@ -324,21 +332,76 @@ func (s *imageCatcherServiceImpl) retrieveROIsBySection(imageMosaic *models.TemI
 	return roiSectionMap, err
 }
 
-// EndAcquisition - only updates the acquistion completed date.
+// EndAcquisition - marks the acquisition as completed. Ending an acquisition that is already completed
+// only logs the request.
 func (s *imageCatcherServiceImpl) EndAcquisition(acqID uint64) error {
+	_, err := s.ChangeAcquisitionState(acqID, models.AcqCompletedState)
+	if stateErr, ok := err.(*AcqStateError); ok && stateErr.CurrentState == models.AcqCompletedState {
+		logger.Infof("Acquisition %d is already completed", acqID)
+		return nil
+	}
+	return err
+}
+
+// ChangeAcquisitionState moves the acquisition to the new lifecycle state if the transition from its current state is allowed
+func (s *imageCatcherServiceImpl) ChangeAcquisitionState(acqID uint64, newState string) (*models.Acquisition, error) {
+	if !models.IsValidAcqState(newState) {
+		return nil, &CaptureError{
+			Code: ErrCodeInvalidRequest,
+			Err:  fmt.Errorf("Invalid acquisition state %s", newState),
+		}
+	}
 	session, err := s.dbHandler.OpenSession(false)
 	if err != nil {
-		return err
+		return nil, err
 	}
-
-	err = dao.EndAcquisition(acqID, session)
+	acq, err := s.updateAcquisitionState(acqID, newState, session)
 	session.Close(err)
+	return acq, err
+}
 
-	return err
+func (s *imageCatcherServiceImpl) updateAcquisitionState(acqID uint64, newState string, session dao.DbSession) (*models.Acquisition, error) {
+	acq, err := dao.RetrieveAcquisition(acqID, session)
+	if err != nil {
+		return nil, err
+	}
+	if acq == nil {
+		return nil, &CaptureError{
+			Code: ErrCodeUnknownAcquisition,
+			Err:  fmt.Errorf("No acquisition found for %d", acqID),
+		}
+	}
+	if !acq.CanChangeStateTo(newState) {
+		return acq, &AcqStateError{AcqUID: acqID, CurrentState: acq.AcqState, NewState: newState}
+	}
+	nUpdates, err := dao.UpdateAcquisitionState(acqID, acq.AcqState, newState, session)
+	if err != nil {
+		return acq, fmt.Errorf("Error changing the state of acquisition %d to %s: %v", acqID, newState, err)
+	}
+	if nUpdates == 0 {
+		// the state was changed by a concurrent request
+		return acq, &AcqStateError{AcqUID: acqID, CurrentState: acq.AcqState, NewState: newState}
+	}
+	logger.Infof("Acquisition %d changed from %s to %s", acqID, acq.AcqState, newState)
+	return dao.RetrieveAcquisition(acqID, session)
 }
 
 // StoreTile - persists a tile metadata for the given mosaic.
 func (s *imageCatcherServiceImpl) StoreTile(acqMosaic *models.TemImageMosaic, tileParams *TileParams) (*models.TemImage, error) {
+	switch acqMosaic.AcqState {
+	case models.AcqArchivedState:
+		return nil, &CaptureError{
+			Code: ErrCodeInvalidRequest,
+			Err:  fmt.Errorf("Acquisition %d is archived and it cannot receive tiles", acqMosaic.AcqUID),
+		}
+	case models.AcqAbortedState, models.AcqFailedState:
+		return nil, &CaptureError{
+			Code: ErrCodeAcquisitionStopped,
+			Err:  fmt.Errorf("Acquisition %d is %s and it must be reopened before it can receive tiles", acqMosaic.AcqUID, acqMosaic.AcqState),
+		}
+	case models.AcqCreatedState:
+		s.startAcquiring(acqMosaic)
+	}
 	tileImage, err := s.persistTileInfo(acqMosaic, tileParams)
 	if err != nil {
 		logger.Errorf("Error while persisting tile %v for %v: %v", tileParams, acqMosaic, err)
@@ -348,6 +411,23 @@ func (s *imageCatcherServiceImpl) StoreTile(acqMosaic *models.TemImageMosaic, ti
 	return tileImage, nil
 }
 
+// startAcquiring moves a newly created acquisition to the acquiring state when its first tile is received
+func (s *imageCatcherServiceImpl) startAcquiring(acqMosaic *models.TemImageMosaic) {
+	session, err := s.dbHandler.OpenSession(false)
+	if err != nil {
+		logger.Errorf("Error opening a session for updating the state of %d: %v", acqMosaic.AcqUID, err)
+		return
+	}
+	// concurrent tiles may attempt the same update but only the first one changes the state
+	_, err = dao.UpdateAcquisitionState(acqMosaic.AcqUID, models.AcqCreatedState, models.AcqAcquiringState, session)
+	session.Close(err)
+	if err != nil {
+		logger.Errorf("Error changing the state of acquisition %d to %s: %v", acqMosaic.AcqUID, models.AcqAcquiringState, err)
+		return
+	}
+	acqMosaic.AcqState = models.AcqAcquiringState
+}
+
 func (s *imageCatcherServiceImpl) persistTileInfo(acqMosaic *models.TemImageMosaic, tileParams *TileParams) (*models.TemImage, error) {
 	cameraConfiguration, err := s.retrieveCameraConfigurationByTemcaIDAndCamera(acqMosaic.Temca.TemcaID, tileParams.Camera)
 	if err != nil {
@@ -421,6 +501,26 @@ func (s *imageCatcherServiceImpl) UpdateTile(tileImage *models.TemImage) error {
 	return nil
 }
 
+// StoreTileMipmap stores the content of a tile mipmap level and records it as a file object derived from the tile
+func (s *imageCatcherServiceImpl) StoreTileMipmap(tileImage *models.TemImage, level int, f *FileParams) (*models.FileObject, error) {
+	jfsObj, err := s.storeContent(&tileImage.ImageMosaic, f)
+	if err != nil {
+		logger.Errorf("Error storing the mipmap level %d of %v: %v", level, tileImage, err)
+		return nil, err
+	}
+	mipmap := &models.FileObject{}
+	if err = mipmap.UpdateJFSAndPathParams(f.Name, jfsObj); err != nil {
+		return nil, err
+	}
+	session, err := s.dbHandler.OpenSession(false)
+	if err != nil {
+		return nil, err
+	}
+	err = dao.SaveTileMipmap(tileImage.TileFile.FileObjectID, level, mipmap, session)
+	session.Close(err)
+	return mipmap, err
+}
+
 // GetMosaic retrieves the acquisition's mosaic entity. If no mosaic is found the error result is set.
 func (s *imageCatcherServiceImpl) GetMosaic(acqID uint64) (*models.TemImageMosaic, error) {
 	session, _ := s.dbHandler.OpenSession(true)
@@ -430,11 +530,19 @@ func (s *imageCatcherServiceImpl) GetMosaic(acqID uint64) (*models.TemImageMosai
 		return nil, err
 	}
 	if imageMosaic == nil {
-		return nil, fmt.Errorf("No mosaic image found for acquisition id %d", acqID)
+		return nil, &CaptureError{
+			Code: ErrCodeUnknownAcquisition,
+			Err:  fmt.Errorf("No mosaic image found for acquisition id %d", acqID),
+		}
 	}
 	return imageMosaic, nil
 }
 
+// GetCameraConfiguration returns the configuration of the camera of the acquisition's TEMCA
+func (s *imageCatcherServiceImpl) GetCameraConfiguration(acqMosaic *models.TemImageMosaic, camera int) (*models.TemCameraConfiguration, error) {
+	return s.retrieveCameraConfigurationByTemcaIDAndCamera(acqMosaic.Temca.TemcaID, camera)
+}
+
 func (s *imageCatcherServiceImpl) retrieveCameraConfigurationByTemcaIDAndCamera(temcaID int64, camera int) (*models.TemCameraConfiguration, error) {
 	session, _ := s.dbHandler.OpenSession(true)
 	cameraConfigurations, err := dao.RetrieveCameraConfigurationsByTemcaID(temcaID, session)
@@ -463,7 +571,22 @@ func (s *imageCatcherServiceImpl) updateFileContent(acqMosaic *models.TemImageMo
 	if err = fObj.UpdateJFSAndPathParams(f.Name, jfsObj); err != nil {
 		return err
 	}
-	return s.updateFileObj(fObj)
+	if err = s.updateFileObj(fObj); err != nil {
+		return err
+	}
+	return s.replicateContent(acqMosaic, f, fObj)
+}
+
+// replicateContent copies the stored content to the replica stores of the acquisition's replication policy
+func (s *imageCatcherServiceImpl) replicateContent(acqMosaic *models.TemImageMosaic, f *FileParams, fObj *models.FileObject) error {
+	if len(s.replicator.targets(&acqMosaic.Acquisition)) == 0 {
+		return nil
+	}
+	data, err := s.createAcqStorageContext(acqMosaic, f)
+	if err != nil {
+		return err
+	}
+	return s.replicator.replicate(&acqMosaic.Acquisition, acqFilePath(acqMosaic.AcqUID, f.Name), f.Content, data, fObj)
 }
 
 func (s *imageCatcherServiceImpl) updateFileObj(f *models.FileObject) error {
@@ -482,32 +605,33 @@ func (s *imageCatcherServiceImpl) storeContent(acqMosaic *models.TemImageMosaic,
 			err = fmt.Errorf("Unexpcted error while storing file %v for %v", f, acqMosaic)
 		}
 	}()
-	fileService, err := s.getAcqFileService(&acqMosaic.Acquisition)
+	filename := f.Name
+	body := f.Content
+	data, err := s.createAcqStorageContext(acqMosaic, f)
 	if err != nil {
 		return res, err
 	}
-	filename := f.Name
-	body := f.Content
-	data := s.createAcqStorageContext(acqMosaic, f)
-	jfsFilePath := s.getJfsFilePath(acqMosaic.AcqUID, filename)
+	filePath := acqFilePath(acqMosaic.AcqUID, filename)
 
-	if res, err = fileService.Put(jfsFilePath, body, data); err != nil {
+	if res, err = s.contentStore.Put(&acqMosaic.Acquisition, filePath, body, data); err != nil {
 		return res, err
 	}
-	res["jfsPath"] = jfsFilePath
-	var locationURL string
-	if res["locationUrl"] != nil {
-		locationURL = strings.Replace(res["locationUrl"].(string),
-			"localhost",
-			s.config.GetStringProperty("SCALITY_HOST", "localhost"),
-			1)
-		res["locationUrl"] = locationURL
+	res["jfsPath"] = filePath
+	switch {
+	case res["checksum"] == nil && len(f.Checksum) > 0:
+		res["checksum"] = data["checksum"]
+		res["checksumAlgorithm"] = data["checksumAlgorithm"]
+	case res["checksum"] != nil && res["checksumAlgorithm"] == nil:
+		// a checksum computed by the store itself (JFS) is reported with the default algorithm
+		res["checksumAlgorithm"] = checksum.DefaultAlgorithm.String()
 	}
 
 	return res, err
 }
 
-func (s *imageCatcherServiceImpl) createAcqStorageContext(acq *models.TemImageMosaic, f *FileParams) map[string]string {
+// createAcqStorageContext creates the storage parameters for the given file. If the client did not send a checksum
+// the checksum is computed here so that the stored content can always be verified.
+func (s *imageCatcherServiceImpl) createAcqStorageContext(acq *models.TemImageMosaic, f *FileParams) (map[string]string, error) {
 	storageContext := map[string]string{}
 	storageContext["sample"] = acq.SampleName
 	if project := acq.ProjectName; project != "" {
@@ -519,14 +643,24 @@ func (s *imageCatcherServiceImpl) createAcqStorageContext(acq *models.TemImageMo
 	if tileStack := acq.StackName; tileStack != "" {
 		storageContext["stack"] = tileStack
 	}
+	if len(f.Checksum) == 0 && len(f.Content) > 0 {
+		var err error
+		if f.Checksum, err = checksum.Sum(f.ChecksumAlgorithm, f.Content); err != nil {
+			return storageContext, err
+		}
+	} else if !f.ChecksumAlgorithm.Supported() {
+		return storageContext, fmt.Errorf("Unsupported checksum algorithm %s for %s", f.ChecksumAlgorithm, f.Name)
+	}
 	if len(f.Checksum) > 0 {
 		storageContext["checksum"] = hex.EncodeToString(f.Checksum)
+		storageContext["checksumAlgorithm"] = f.ChecksumAlgorithm.String()
 	}
 
-	return storageContext
+	return storageContext, nil
 }
 
-func (s *imageCatcherServiceImpl) getJfsFilePath(acqID uint64, filename string) string {
+// acqFilePath returns the content store path of an acquisition file
+func acqFilePath(acqID uint64, filename string) string {
 	return fmt.Sprintf("/acquisitions/%d/%s", acqID, filename)
 }
 
@@ -537,14 +671,126 @@ func (s *imageCatcherServiceImpl) VerifyAcquisitionFile(acqMosaic *models.TemIma
 			err = fmt.Errorf("Unexpcted error while verifying file %v for %v", f, acqMosaic)
 		}
 	}()
-	fileService, err := s.getAcqFileService(&acqMosaic.Acquisition)
+	data, err := s.createAcqStorageContext(acqMosaic, f)
 	if err != nil {
 		return err
 	}
-	data := s.createAcqStorageContext(acqMosaic, f)
+	if len(fObj.Checksum) > 0 && fObj.ChecksumAlgorithm == data["checksumAlgorithm"] && !bytes.Equal(fObj.Checksum, f.Checksum) {
+		return fmt.Errorf("The stored %s checksum %x of %s does not match the checksum %x of the content",
+			fObj.ChecksumAlgorithm, fObj.Checksum, f.Name, f.Checksum)
+	}
 	data["scalityKey"] = fObj.JfsKey
 	logger.Debugf("Verify content: %d:%s (%d) - %v", acqMosaic.AcqUID, f.Name, f.ContentLen, data)
-	return fileService.Verify(s.getJfsFilePath(acqMosaic.AcqUID, f.Name), data)
+	return s.contentStore.Verify(&acqMosaic.Acquisition, acqFilePath(acqMosaic.AcqUID, f.Name), data)
+}
+
+// ScrubReplicas verifies the next batch of stored replicas against their stores and records the results
+func (s *imageCatcherServiceImpl) ScrubReplicas(afterReplicaID int64, limit int) ([]*ReplicaScrubResult, error) {
+	session, err := s.dbHandler.OpenSession(true)
+	if err != nil {
+		return nil, err
+	}
+	replicas, err := dao.RetrieveReplicasToScrub(afterReplicaID, limit, session)
+	session.Close(err)
+	if err != nil {
+		return nil, err
+	}
+	results := make([]*ReplicaScrubResult, 0, len(replicas))
+	for _, replica := range replicas {
+		result := s.verifyReplica(replica)
+		results = append(results, result)
+		if result.Status == "" {
+			continue
+		}
+		if session, err = s.dbHandler.OpenSession(false); err != nil {
+			return results, err
+		}
+		err = dao.UpdateReplicaVerification(replica.ReplicaID, result.Status != models.ReplicaMissingStatus, result.Status, session)
+		session.Close(err)
+		if err != nil {
+			return results, err
+		}
+	}
+	return results, nil
+}
+
+// verifyReplica checks the replica's checksum in its store. If the checksum does not match it checks
+// whether the replica exists at all to tell a missing replica from a corrupted one. A replica whose store
+// fails for any other reason is left unchecked.
+func (s *imageCatcherServiceImpl) verifyReplica(replica *models.StoredReplica) *ReplicaScrubResult {
+	result := &ReplicaScrubResult{Replica: replica}
+	store := s.contentStore
+	if replica.StorageName != "" {
+		store = s.replicator.store(replica.StorageName)
+	}
+	if store == nil {
+		result.Err = fmt.Errorf("Unknown store %s for replica %d", replica.StorageName, replica.ReplicaID)
+		return result
+	}
+	data := map[string]string{
+		"sample":     replica.Acquisition.SampleName,
+		"scalityKey": replica.JfsKey,
+	}
+	if project := replica.Acquisition.ProjectName; project != "" {
+		data["project"] = project
+	}
+	if owner := replica.Acquisition.ProjectOwner; owner != "" {
+		data["owner"] = owner
+	}
+	if tileStack := replica.Acquisition.StackName; tileStack != "" {
+		data["stack"] = tileStack
+	}
+	if len(replica.Checksum) > 0 {
+		alg, err := checksum.Lookup(replica.ChecksumAlgorithm)
+		if err != nil {
+			result.Err = err
+			return result
+		}
+		data["checksum"] = hex.EncodeToString(replica.Checksum)
+		data["checksumAlgorithm"] = alg.String()
+	}
+	if result.Err = store.Verify(&replica.Acquisition, replica.JfsPath, data); result.Err == nil {
+		result.Status = models.ReplicaVerifiedStatus
+		return result
+	}
+	if isContentNotFound(result.Err) {
+		result.Status = models.ReplicaMissingStatus
+		return result
+	}
+	if data["checksum"] == "" {
+		// the store could not be checked so the replica stays unchecked
+		return result
+	}
+	delete(data, "checksum")
+	delete(data, "checksumAlgorithm")
+	switch err := store.Verify(&replica.Acquisition, replica.JfsPath, data); {
+	case err == nil:
+		result.Status = models.ReplicaCorruptedStatus
+	case isContentNotFound(err):
+		result.Status = models.ReplicaMissingStatus
+	default:
+		// the checksum error may have been caused by the store as well so the replica stays unchecked
+		result.Err = err
+	}
+	return result
+}
+
+// GetReplicaScrubStatus returns the verification status of the acquisition's replicas together with
+// the replicas that were found missing or corrupted
+func (s *imageCatcherServiceImpl) GetReplicaScrubStatus(acqID uint64) (*ReplicaScrubStatus, error) {
+	session, err := s.dbHandler.OpenSession(true)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		session.Close(err)
+	}()
+	status := &ReplicaScrubStatus{AcqUID: acqID}
+	if status.Summary, err = dao.RetrieveReplicaStatusSummary(acqID, session); err != nil {
+		return nil, err
+	}
+	status.Problems, err = dao.RetrieveAcqReplicasByStatus(acqID, []string{models.ReplicaMissingStatus, models.ReplicaCorruptedStatus}, session)
+	return status, err
 }
 
 func (s *imageCatcherServiceImpl) GetTile(tileID int64) (*models.TemImageROI, error) {
@@ -563,6 +809,9 @@ func (s *imageCatcherServiceImpl) GetAcquisitions(acqFilter *models.AcquisitionF
 }
 
 func (s *imageCatcherServiceImpl) GetTiles(tileFilter *models.TileFilter) ([]*models.TemImageROI, error) {
+	if tileFilter.WithinMetricThresholds {
+		tileFilter.MetricRanges = s.metricThresholds
+	}
 	session, _ := s.dbHandler.OpenSession(true)
 	temImages, err := dao.RetrieveTemImages(tileFilter, session)
 	session.Close(err)
@@ -570,20 +819,129 @@ func (s *imageCatcherServiceImpl) GetTiles(tileFilter *models.TileFilter) ([]*mo
 	return temImages, err
 }
 
+func (s *imageCatcherServiceImpl) GetAncillaryFiles(acqID uint64) ([]*models.FileObject, error) {
+	session, _ := s.dbHandler.OpenSession(true)
+	ancillaryFiles, err := dao.RetrieveAncillaryFiles(acqID, session)
+	session.Close(err)
+	return ancillaryFiles, err
+}
+
+// GetAcquisitionCompleteness reports the expected tiles of the acquisition that were not received or were received without content
+func (s *imageCatcherServiceImpl) GetAcquisitionCompleteness(acqID uint64) (*CompletenessReport, error) {
+	acqMosaic, err := s.GetMosaic(acqID)
+	if err != nil {
+		return nil, err
+	}
+	session, _ := s.dbHandler.OpenSession(true)
+	tiles, err := dao.RetrieveTileCoverage(acqID, session)
+	session.Close(err)
+	if err != nil {
+		return nil, err
+	}
+	return buildCompletenessReport(acqMosaic, tiles), nil
+}
+
+// ReconcileStoredImages cross-checks the images listed in the stored image lists of the acquisition with the persisted tiles
+// and replaces the previously recorded discrepancies with the ones found
+func (s *imageCatcherServiceImpl) ReconcileStoredImages(acqID uint64) (*StoredImageReconciliation, error) {
+	acqMosaic, err := s.GetMosaic(acqID)
+	if err != nil {
+		return nil, err
+	}
+	ancillaryFiles, err := s.GetAncillaryFiles(acqID)
+	if err != nil {
+		return nil, err
+	}
+	res := &StoredImageReconciliation{AcqUID: acqID}
+	var listed []models.StoredImage
+	listedCameras := make(map[int]bool)
+	for _, f := range ancillaryFiles {
+		if extractAncillaryFileType(f.Path) != storedImageListFileType {
+			continue
+		}
+		content, err := s.RetrieveAcquisitionFile(acqMosaic, f.JfsPath)
+		if err != nil {
+			return nil, fmt.Errorf("Error retrieving the stored image list %s of acquisition %d: %v", f.Path, acqID, err)
+		}
+		camera := storedImageListCamera(f.Path)
+		images, err := parseStoredImageList(content, camera)
+		if err != nil {
+			return nil, fmt.Errorf("Error reading %s of acquisition %d: %v", f.Path, acqID, err)
+		}
+		listedCameras[camera] = true
+		listed = append(listed, images...)
+		res.Lists++
+	}
+	if res.Lists == 0 {
+		return res, nil
+	}
+	session, err := s.dbHandler.OpenSession(false)
+	if err != nil {
+		return nil, err
+	}
+	tiles, err := dao.RetrieveAcqTileFiles(acqID, session)
+	if err == nil {
+		res.Listed, res.Persisted, res.Discrepancies = reconcileStoredImages(listed, listedCameras, tiles)
+		err = dao.ReplaceStoredImageDiscrepancies(acqMosaic, res.Discrepancies, session)
+	}
+	session.Close(err)
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// GetStoredImageDiscrepancies retrieves the discrepancies found by the last reconciliation of the acquisition's stored image lists
+func (s *imageCatcherServiceImpl) GetStoredImageDiscrepancies(acqID uint64) ([]*models.StoredImageDiscrepancy, error) {
+	session, _ := s.dbHandler.OpenSession(true)
+	discrepancies, err := dao.RetrieveStoredImageDiscrepancies(acqID, session)
+	session.Close(err)
+	return discrepancies, err
+}
+
+// GetTileTimings retrieves the timings recorded for the acquisition tiles selected by the filter
+func (s *imageCatcherServiceImpl) GetTileTimings(filter *models.TimingFilter) ([]*models.TileTiming, error) {
+	session, _ := s.dbHandler.OpenSession(true)
+	tileTimings, err := dao.RetrieveTileTimings(filter, session)
+	session.Close(err)
+	return tileTimings, err
+}
+
+// StartVerification starts a background job that verifies the stored files of the selected acquisitions
+func (s *imageCatcherServiceImpl) StartVerification(acqFilter *models.AcquisitionFilter) (*VerificationJob, error) {
+	return s.verifications.start(acqFilter)
+}
+
+// GetVerification returns the verification job with the given id or nil if the job is not known
+func (s *imageCatcherServiceImpl) GetVerification(jobID string) *VerificationJob {
+	return s.verifications.get(jobID)
+}
+
 func (s *imageCatcherServiceImpl) RetrieveAcquisitionFile(acqMosaic *models.TemImageMosaic, path string) (jfsContent []byte, err error) {
 	defer func() {
 		if r := recover(); r != nil {
 			err = fmt.Errorf("Unexpcted error while retrieving file for %v", acqMosaic)
 		}
 	}()
-	fileService, err := s.getAcqFileService(&acqMosaic.Acquisition)
-	if err != nil {
-		return jfsContent, err
+	if jfsContent, err = s.RetrievePrimaryAcquisitionFile(acqMosaic, path); err == nil {
+		return jfsContent, nil
 	}
-	if jfsContent, err = fileService.Get(path); err != nil {
-		return jfsContent, fmt.Errorf("Error retrieving content from JFS for %s: %v", path, err)
+	// fall back to the other replicas if the primary copy cannot be read
+	replicaContent, replicaErr := s.replicator.retrieve(&acqMosaic.Acquisition, path)
+	if replicaErr != nil {
+		logger.Infof("No replica available for %s: %v", path, replicaErr)
+		return jfsContent, err
 	}
-	return jfsContent, nil
+	return replicaContent, nil
+}
+
+func (s *imageCatcherServiceImpl) RetrievePrimaryAcquisitionFile(acqMosaic *models.TemImageMosaic, path string) (jfsContent []byte, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("Unexpcted error while retrieving file for %v", acqMosaic)
+		}
+	}()
+	return s.contentStore.Get(&acqMosaic.Acquisition, path)
 }
 
 func (s *imageCatcherServiceImpl) GetProjects(filter *models.ProjectFilter) ([]*models.Project, error) {
@@ -597,49 +955,25 @@ func (s *imageCatcherServiceImpl) Ping() error {
 	if err := s.dbHandler.Ping(); err != nil {
 		return err
 	}
-	if err := s.pingJfs(); err != nil {
+	if err := s.pingContentStore(); err != nil {
 		return err
 	}
 	return nil
 }
 
-func (s *imageCatcherServiceImpl) pingJfs() error {
-	data := map[string]string{}
-	jfsPingContent := []byte("JFS Ping")
-	okchan := make(chan struct{})
-	errschan := make(chan error)
+func (s *imageCatcherServiceImpl) pingContentStore() error {
+	errschan := make(chan error, 1)
 	go func() {
-		fileService, err := s.getFileService(s.jfsMapping["PING"])
-		if err != nil {
-			logger.Errorf("Error opening a file service for ping: %v", err)
-			errschan <- err
-			return
-		}
-		_, werr := fileService.Put(s.getJfsFilePath(0, jfsPingFileType), jfsPingContent, data)
-		// if there was a write error the collection may be an immutable collection so we still want
-		// to attempt a read to see if this succeeds
-		if werr != nil {
-			logger.Errorf("Error sending the ping message: %v", werr)
-		}
-		rerr := fileService.Verify(s.getJfsFilePath(0, jfsPingFileType), data)
-		if rerr != nil {
-			logger.Errorf("Error verifying the ping message: %v", werr)
-			errschan <- rerr
-		} else {
-			var ok struct{}
-			okchan <- ok
-		}
-		return
+		errschan <- s.contentStore.Ping()
 	}()
 	select {
 	case err := <-errschan:
-		logger.Errorf("Error sending data to JFS: %v", err)
+		if err != nil {
+			logger.Errorf("Error sending data to the content store: %v", err)
+		}
 		return err
-	case <-okchan:
-		break
 	case <-time.After(1.5 * 1e9):
-		logger.Errorf("JFS/Scality write timeout")
-		return fmt.Errorf("JFS/Scality write timeout")
+		logger.Errorf("Content store write timeout")
+		return fmt.Errorf("Content store write timeout")
 	}
-	return nil
 }
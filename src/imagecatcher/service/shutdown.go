@@ -0,0 +1,166 @@
+package service
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"imagecatcher/logger"
+)
+
+// queueDrainPollInterval is how often the queues are checked while waiting for them to drain
+const queueDrainPollInterval = 100 * time.Millisecond
+
+// Processing stages of the unprocessed jobs
+const (
+	unprocessedTileStage    = "tile"
+	unprocessedContentStage = "content"
+)
+
+// unprocessedJob records a tile that was accepted but not completely processed when the service stopped.
+// The tile content is always available in the temporary file.
+type unprocessedJob struct {
+	Stage             string `json:"stage"`
+	AcqID             uint64 `json:"acqId"`
+	TileName          string `json:"tileName"`
+	TileID            int64  `json:"tileId,omitempty"`
+	TmpTileFile       string `json:"tmpTileFile"`
+	Checksum          string `json:"checksum,omitempty"`
+	ChecksumAlgorithm string `json:"checksumAlgorithm"`
+}
+
+// Shutdown waits until the queued tile and content jobs are processed or until the context is done and then
+// it stops the dispatchers. The jobs still left in the queues are recorded in TMP_DATA_DIR so that they can be recovered.
+func (th *TileRequestHandler) Shutdown(ctx context.Context) error {
+	logger.Infof("Draining the processing queues: %d tile jobs, %d content jobs",
+		len(th.tileProcessingJobQueue), len(th.contentProcessingJobQueue))
+	if th.tileProcessingDispatcher != nil {
+		waitForQueueToDrain(ctx, func() int { return len(th.tileProcessingJobQueue) })
+		waitForDispatcher(ctx, "tile processing", th.tileProcessingDispatcher.stop())
+	}
+	if th.contentProcessingDispatcher != nil {
+		waitForQueueToDrain(ctx, func() int { return len(th.contentProcessingJobQueue) })
+		waitForDispatcher(ctx, "content processing", th.contentProcessingDispatcher.stop())
+	}
+	unprocessed := th.collectUnprocessedJobs()
+	if th.spool != nil {
+		if err := th.spool.close(); err != nil {
+			logger.Errorf("Error closing the content spool: %v", err)
+		}
+	}
+	if len(unprocessed) == 0 {
+		logger.Infof("All queued tiles were processed")
+		return nil
+	}
+	recordFile, err := writeUnprocessedJobs(th.tmpDataDir, unprocessed)
+	if err != nil {
+		return err
+	}
+	logger.Errorf("%d tiles were left unprocessed - see %s", len(unprocessed), recordFile)
+	return nil
+}
+
+func waitForQueueToDrain(ctx context.Context, queueLen func() int) {
+	ticker := time.NewTicker(queueDrainPollInterval)
+	defer ticker.Stop()
+	for queueLen() > 0 {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func waitForDispatcher(ctx context.Context, name string, stopped <-chan struct{}) {
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		logger.Errorf("Timeout waiting for the %s workers to finish their current jobs", name)
+	}
+}
+
+// collectUnprocessedJobs empties the job queues once the dispatchers were stopped
+func (th *TileRequestHandler) collectUnprocessedJobs() []unprocessedJob {
+	return append(th.collectUnprocessedTileJobs(), th.collectUnprocessedContentJobs()...)
+}
+
+// collectUnprocessedTileJobs reads the tile queue without blocking because a dispatcher that
+// did not stop before the deadline may still take the last job
+func (th *TileRequestHandler) collectUnprocessedTileJobs() (unprocessed []unprocessedJob) {
+	for {
+		select {
+		case job := <-th.tileProcessingJobQueue:
+			unprocessed = append(unprocessed, th.unprocessedTileJob(job))
+		default:
+			return unprocessed
+		}
+	}
+}
+
+// collectUnprocessedContentJobs reads the content queue without blocking for the same reason
+func (th *TileRequestHandler) collectUnprocessedContentJobs() (unprocessed []unprocessedJob) {
+	for {
+		select {
+		case job := <-th.contentProcessingJobQueue:
+			unprocessed = append(unprocessed, unprocessedContentJob(job))
+		default:
+			return unprocessed
+		}
+	}
+}
+
+func (th *TileRequestHandler) unprocessedTileJob(job *tileProcessingJob) unprocessedJob {
+	defer job.clear()
+	fParams := &job.tileParams.FileParams
+	tmpTileFile := job.tmpTileFile
+	if tmpTileFile == "" {
+		// the content of a queued tile job is only in memory so save it before the service stops
+		var err error
+		if tmpTileFile, err = createTmpDataFile(th.tmpDataDir, job.acqID, fParams, job.execCtx); err != nil {
+			logger.Errorf("Error saving the content of the unprocessed tile %d:%s: %v", job.acqID, fParams.Name, err)
+		}
+	}
+	return unprocessedJob{
+		Stage:             unprocessedTileStage,
+		AcqID:             job.acqID,
+		TileName:          fParams.Name,
+		TmpTileFile:       tmpTileFile,
+		Checksum:          hex.EncodeToString(fParams.Checksum),
+		ChecksumAlgorithm: fParams.ChecksumAlgorithm.String(),
+	}
+}
+
+func unprocessedContentJob(job *contentProcessingJob) unprocessedJob {
+	defer job.clear()
+	rec := unprocessedJob{
+		Stage:             unprocessedContentStage,
+		AcqID:             job.acqID,
+		TileName:          job.fileParams.Name,
+		TmpTileFile:       job.tmpTileFile,
+		Checksum:          hex.EncodeToString(job.fileParams.Checksum),
+		ChecksumAlgorithm: job.fileParams.ChecksumAlgorithm.String(),
+	}
+	if job.tileImage != nil {
+		rec.TileID = job.tileImage.ImageID
+	}
+	return rec
+}
+
+// writeUnprocessedJobs writes the unprocessed jobs to a new JSON file in the data dir and returns the name of the file
+func writeUnprocessedJobs(dataDir string, unprocessed []unprocessedJob) (string, error) {
+	content, err := json.MarshalIndent(unprocessed, "", "  ")
+	if err != nil {
+		return "", fmt.Errorf("Error encoding the unprocessed jobs: %v", err)
+	}
+	recordFile := filepath.Join(dataDir, fmt.Sprintf("unprocessed-%s.json", time.Now().Format("20060102150405")))
+	if err = ioutil.WriteFile(recordFile, content, os.ModePerm); err != nil {
+		return "", fmt.Errorf("Error writing the unprocessed jobs to %s: %v", recordFile, err)
+	}
+	return recordFile, nil
+}
@@ -0,0 +1,107 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"imagecatcher/checksum"
+	"imagecatcher/models"
+)
+
+func TestContentDispatcherStopWaitsForCurrentJobs(t *testing.T) {
+	jobQueue := make(chan *contentProcessingJob, 2)
+	d := newContentDispatcher(jobQueue, 1)
+	d.run()
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	blockingProcessor := contentProcessorFunc(func(job *contentProcessingJob) contentProcessingResult {
+		close(started)
+		<-release
+		return contentProcessingResult{}
+	})
+	jobQueue <- &contentProcessingJob{processor: blockingProcessor, fileParams: &FileParams{}}
+	<-started
+	pendingJob := &contentProcessingJob{processor: blockingProcessor, fileParams: &FileParams{}}
+	jobQueue <- pendingJob
+
+	stopped := d.stop()
+	select {
+	case <-stopped:
+		t.Fatal("Expected the dispatcher to wait for the job in progress")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("Timeout waiting for the dispatcher to stop")
+	}
+	if len(jobQueue) != 1 || <-jobQueue != pendingJob {
+		t.Error("Expected the job that was not dispatched to be left in the queue")
+	}
+}
+
+func TestShutdownRecordsUnprocessedJobs(t *testing.T) {
+	tmpDataDir, err := ioutil.TempDir("", "shutdown")
+	if err != nil {
+		t.Fatalf("Error creating the temporary data dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDataDir)
+
+	th := &TileRequestHandler{
+		tmpDataDir:                tmpDataDir,
+		tileProcessingJobQueue:    make(chan *tileProcessingJob, 1),
+		contentProcessingJobQueue: make(chan *contentProcessingJob, 1),
+	}
+	tileJob := &tileProcessingJob{acqID: 1}
+	tileJob.tileParams.Name = "tile1.tif"
+	tileJob.tileParams.Content = []byte("tile1 content")
+	tileJob.tileParams.ChecksumAlgorithm = checksum.SHA1
+	th.tileProcessingJobQueue <- tileJob
+	th.contentProcessingJobQueue <- &contentProcessingJob{
+		acqID:       1,
+		fileParams:  &FileParams{Name: "tile2.tif", Checksum: []byte{0xab, 0xcd}},
+		tileImage:   &models.TemImage{ImageID: 2},
+		tmpTileFile: filepath.Join(tmpDataDir, "1", "tile2.tif"),
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err = th.Shutdown(ctx); err != nil {
+		t.Fatalf("Unexpected shutdown error: %v", err)
+	}
+
+	recordFiles, err := filepath.Glob(filepath.Join(tmpDataDir, "unprocessed-*.json"))
+	if err != nil || len(recordFiles) != 1 {
+		t.Fatalf("Expected exactly one unprocessed jobs record but found %v (%v)", recordFiles, err)
+	}
+	content, err := ioutil.ReadFile(recordFiles[0])
+	if err != nil {
+		t.Fatalf("Error reading %s: %v", recordFiles[0], err)
+	}
+	var unprocessed []unprocessedJob
+	if err = json.Unmarshal(content, &unprocessed); err != nil {
+		t.Fatalf("Error decoding %s: %v", recordFiles[0], err)
+	}
+	expected := []unprocessedJob{
+		{Stage: "tile", AcqID: 1, TileName: "tile1.tif", TmpTileFile: filepath.Join(tmpDataDir, "1", "tile1.tif"), ChecksumAlgorithm: "SHA1"},
+		{Stage: "content", AcqID: 1, TileName: "tile2.tif", TileID: 2, TmpTileFile: filepath.Join(tmpDataDir, "1", "tile2.tif"), Checksum: "abcd", ChecksumAlgorithm: "MD5"},
+	}
+	if len(unprocessed) != len(expected) {
+		t.Fatalf("Expected %d unprocessed jobs but got %v", len(expected), unprocessed)
+	}
+	for i := range expected {
+		if unprocessed[i] != expected[i] {
+			t.Errorf("Expected unprocessed job %d to be %v but got %v", i, expected[i], unprocessed[i])
+		}
+	}
+	if tileContent, err := ioutil.ReadFile(expected[0].TmpTileFile); err != nil || string(tileContent) != "tile1 content" {
+		t.Errorf("Expected the queued tile content to be saved in %s: %q, %v", expected[0].TmpTileFile, tileContent, err)
+	}
+}
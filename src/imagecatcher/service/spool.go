@@ -0,0 +1,378 @@
+package service
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"imagecatcher/checksum"
+	"imagecatcher/logger"
+)
+
+// spoolManifestName is the name of the spool manifest file in TMP_DATA_DIR
+const spoolManifestName = "content-spool.manifest"
+
+// spoolCompactionThreshold is the number of completed entries after which the manifest is rewritten
+const spoolCompactionThreshold = 10000
+
+// Spool manifest operations
+const (
+	spoolAddOp  = "add"
+	spoolDoneOp = "done"
+)
+
+// spoolEntry is a manifest record of a tile whose content was spooled to TMP_DATA_DIR
+// but not yet written to the content store
+type spoolEntry struct {
+	Op                string `json:"op"`
+	TileID            int64  `json:"tileId"`
+	AcqID             uint64 `json:"acqId,omitempty"`
+	Name              string `json:"name,omitempty"`
+	TmpTileFile       string `json:"tmpTileFile,omitempty"`
+	Checksum          string `json:"checksum,omitempty"`
+	ChecksumAlgorithm string `json:"checksumAlgorithm,omitempty"`
+}
+
+// contentSpool is an append only journal of the pending content jobs. Every spooled tile is added
+// to the manifest before its content is stored and it is marked as done once the content is in the content store,
+// so the tiles that are still pending after a restart can be recovered from their temporary files.
+type contentSpool struct {
+	lock         sync.Mutex
+	manifestName string
+	manifest     *os.File
+	syncWrites   bool
+	pending      map[int64]spoolEntry
+	completed    int
+}
+
+// openContentSpool replays the manifest from the data dir, if there is one, and then it compacts it
+// so that it only contains the pending entries.
+func openContentSpool(dataDir string, syncWrites bool) (*contentSpool, error) {
+	if err := os.MkdirAll(dataDir, os.ModePerm); err != nil {
+		return nil, fmt.Errorf("Error creating the spool directory %s: %v", dataDir, err)
+	}
+	s := &contentSpool{
+		manifestName: filepath.Join(dataDir, spoolManifestName),
+		syncWrites:   syncWrites,
+		pending:      make(map[int64]spoolEntry),
+	}
+	if err := s.replay(); err != nil {
+		return nil, err
+	}
+	if err := s.compact(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *contentSpool) replay() error {
+	content, err := ioutil.ReadFile(s.manifestName)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("Error reading the spool manifest %s: %v", s.manifestName, err)
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		var entry spoolEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			// most likely a partially written record
+			logger.Errorf("Invalid spool manifest record %s:%d: %v", s.manifestName, lineNo, err)
+			continue
+		}
+		switch entry.Op {
+		case spoolAddOp:
+			s.pending[entry.TileID] = entry
+		case spoolDoneOp:
+			delete(s.pending, entry.TileID)
+		}
+	}
+	return scanner.Err()
+}
+
+// compact rewrites the manifest with only the pending entries and reopens it for appending
+func (s *contentSpool) compact() error {
+	tmpManifestName := s.manifestName + ".tmp"
+	tmpManifest, err := os.OpenFile(tmpManifestName, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("Error creating the spool manifest %s: %v", tmpManifestName, err)
+	}
+	w := bufio.NewWriter(tmpManifest)
+	for _, entry := range s.pendingEntriesLocked() {
+		if err = writeSpoolEntry(w, entry); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = tmpManifest.Sync()
+	}
+	tmpManifest.Close()
+	if err != nil {
+		return fmt.Errorf("Error writing the spool manifest %s: %v", tmpManifestName, err)
+	}
+	if s.manifest != nil {
+		s.manifest.Close()
+		s.manifest = nil
+	}
+	if err = os.Rename(tmpManifestName, s.manifestName); err != nil {
+		return fmt.Errorf("Error replacing the spool manifest %s: %v", s.manifestName, err)
+	}
+	if s.manifest, err = os.OpenFile(s.manifestName, os.O_APPEND|os.O_WRONLY, 0644); err != nil {
+		return fmt.Errorf("Error opening the spool manifest %s: %v", s.manifestName, err)
+	}
+	s.completed = 0
+	return nil
+}
+
+// add records a spooled tile in the manifest
+func (s *contentSpool) add(entry spoolEntry) error {
+	entry.Op = spoolAddOp
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if err := s.append(entry); err != nil {
+		return err
+	}
+	s.pending[entry.TileID] = entry
+	return nil
+}
+
+// complete marks the tile's content as stored
+func (s *contentSpool) complete(tileID int64) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if _, found := s.pending[tileID]; !found {
+		return nil
+	}
+	if err := s.append(spoolEntry{Op: spoolDoneOp, TileID: tileID}); err != nil {
+		return err
+	}
+	delete(s.pending, tileID)
+	s.completed++
+	if s.completed >= spoolCompactionThreshold && s.completed > 2*len(s.pending) {
+		return s.compact()
+	}
+	return nil
+}
+
+// close closes the manifest; the pending entries are kept for the next start
+func (s *contentSpool) close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.manifest.Close()
+}
+
+func (s *contentSpool) append(entry spoolEntry) error {
+	var line bytes.Buffer
+	if err := writeSpoolEntry(&line, entry); err != nil {
+		return err
+	}
+	// write the record at once so that a crash can only leave the last record incomplete
+	if _, err := s.manifest.Write(line.Bytes()); err != nil {
+		return fmt.Errorf("Error writing %s record for tile %d to the spool manifest: %v", entry.Op, entry.TileID, err)
+	}
+	if s.syncWrites {
+		if err := s.manifest.Sync(); err != nil {
+			return fmt.Errorf("Error syncing the spool manifest: %v", err)
+		}
+	}
+	return nil
+}
+
+func writeSpoolEntry(w io.Writer, entry spoolEntry) error {
+	record, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("Error encoding the spool record for tile %d: %v", entry.TileID, err)
+	}
+	record = append(record, '\n')
+	_, err = w.Write(record)
+	return err
+}
+
+// pendingEntries returns the entries of the tiles that are not in the content store yet ordered by tile ID
+func (s *contentSpool) pendingEntries() []spoolEntry {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.pendingEntriesLocked()
+}
+
+func (s *contentSpool) pendingEntriesLocked() []spoolEntry {
+	entries := make([]spoolEntry, 0, len(s.pending))
+	for _, entry := range s.pending {
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].TileID < entries[j].TileID })
+	return entries
+}
+
+// spoolContentJob records the content job in the spool manifest. If the client did not send a checksum
+// it computes it now so that the spooled content can be verified when it is recovered.
+func (th *TileRequestHandler) spoolContentJob(job *contentProcessingJob) {
+	if th.spool == nil || job.tmpTileFile == "" || job.tileImage == nil {
+		return
+	}
+	f := job.fileParams
+	if len(f.Checksum) == 0 {
+		var sum []byte
+		var err error
+		if f.isEmpty() {
+			sum, err = fileChecksum(f.ChecksumAlgorithm, job.tmpTileFile)
+		} else {
+			sum, err = checksum.Sum(f.ChecksumAlgorithm, f.Content)
+		}
+		if err != nil {
+			logger.Errorf("Error computing the checksum of the spooled tile %d:%s: %v", job.acqID, f.Name, err)
+			return
+		}
+		f.Checksum = sum
+	}
+	err := th.spool.add(spoolEntry{
+		TileID:            job.tileImage.ImageID,
+		AcqID:             job.acqID,
+		Name:              f.Name,
+		TmpTileFile:       job.tmpTileFile,
+		Checksum:          hex.EncodeToString(f.Checksum),
+		ChecksumAlgorithm: f.ChecksumAlgorithm.String(),
+	})
+	if err != nil {
+		logger.Errorf("Error spooling tile %d:%s: %v", job.acqID, f.Name, err)
+	}
+}
+
+func completeSpooledContent(spool *contentSpool) contentProcessDecorator {
+	return func(p contentProcessor) contentProcessor {
+		return contentProcessorFunc(func(job *contentProcessingJob) contentProcessingResult {
+			res := p.process(job)
+			if spool != nil && res.err == nil && job.tileImage != nil {
+				if err := spool.complete(job.tileImage.ImageID); err != nil {
+					logger.Errorf("Error marking the spooled tile %d:%s as stored: %v", job.acqID, job.fileParams.Name, err)
+				}
+			}
+			return res
+		})
+	}
+}
+
+// RecoverSpooledContent re-enqueues the content storage for the spooled tiles whose replica does not have
+// a JFS key yet. It is meant to be called once, when the service starts.
+func (th *TileRequestHandler) RecoverSpooledContent() {
+	if th.spool == nil {
+		return
+	}
+	entries := th.spool.pendingEntries()
+	if len(entries) == 0 {
+		return
+	}
+	logger.Infof("Recovering %d spooled tiles from %s", len(entries), th.tmpDataDir)
+	var recovered int
+	for _, entry := range entries {
+		if th.deadLetters != nil {
+			// the dead lettered tiles are only retried on demand
+			if dl, err := th.deadLetters.get(entry.AcqID, entry.TileID); err != nil || dl != nil {
+				continue
+			}
+		}
+		job, err := th.prepareSpooledContentJob(entry)
+		if err != nil {
+			// keep the entry so that the recovery is retried on the next start
+			logger.Errorf("Error recovering spooled tile %d:%s (%d): %v", entry.AcqID, entry.Name, entry.TileID, err)
+			continue
+		}
+		if job == nil {
+			// there's nothing to recover for this entry
+			if err = th.spool.complete(entry.TileID); err != nil {
+				logger.Errorf("Error removing spooled tile %d:%s (%d): %v", entry.AcqID, entry.Name, entry.TileID, err)
+			}
+			continue
+		}
+		th.resubmitContentJob(job)
+		recovered++
+	}
+	logger.Infof("Re-enqueued the content storage of %d spooled tiles", recovered)
+}
+
+// prepareSpooledContentJob creates the content job for a spooled tile. It returns a nil job
+// if the tile was already stored or if the spooled content is no longer usable.
+func (th *TileRequestHandler) prepareSpooledContentJob(entry spoolEntry) (*contentProcessingJob, error) {
+	tile, err := th.imageCatcher.GetTile(entry.TileID)
+	if err != nil {
+		return nil, err
+	}
+	if tile == nil {
+		logger.Errorf("Spooled tile %d:%s (%d) not found", entry.AcqID, entry.Name, entry.TileID)
+		return nil, nil
+	}
+	if tile.TileFile.JfsKey != "" {
+		logger.Infof("Spooled tile %d:%s (%d) is already stored as %s", entry.AcqID, entry.Name, entry.TileID, tile.TileFile.JfsKey)
+		removeSpooledFile(entry.TmpTileFile)
+		return nil, nil
+	}
+	alg, err := checksum.Lookup(entry.ChecksumAlgorithm)
+	if err != nil {
+		return nil, err
+	}
+	sum, err := fileChecksum(alg, entry.TmpTileFile)
+	if os.IsNotExist(err) {
+		logger.Errorf("Spooled content %s of tile %d:%s (%d) not found", entry.TmpTileFile, entry.AcqID, entry.Name, entry.TileID)
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if hex.EncodeToString(sum) != entry.Checksum {
+		logger.Errorf("The %s checksum %x of the spooled content %s does not match the recorded checksum %s",
+			alg, sum, entry.TmpTileFile, entry.Checksum)
+		return nil, nil
+	}
+	acqMosaic, err := th.imageCatcher.GetMosaic(entry.AcqID)
+	if err != nil {
+		return nil, err
+	}
+	tile.ImageMosaic = *acqMosaic
+	job := &contentProcessingJob{
+		acqID: entry.AcqID,
+		// the content is loaded from the spooled file when it is stored
+		fileParams: &FileParams{
+			Name:              entry.Name,
+			Checksum:          sum,
+			ChecksumAlgorithm: alg,
+		},
+		tileImage:   &tile.TemImage,
+		tmpTileFile: entry.TmpTileFile,
+	}
+	job.execCtx.StartTime = time.Now()
+	return job, nil
+}
+
+// fileChecksum computes the checksum of the file without loading the whole file in memory
+func fileChecksum(alg checksum.Algorithm, name string) ([]byte, error) {
+	h, err := checksum.New(alg)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if _, err = io.Copy(h, f); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+func removeSpooledFile(name string) {
+	if err := os.Remove(name); err != nil && !os.IsNotExist(err) {
+		logger.Errorf("Error deleting spooled file %s: %v", name, err)
+	}
+}
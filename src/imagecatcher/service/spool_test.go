@@ -0,0 +1,133 @@
+package service
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"imagecatcher/checksum"
+	"imagecatcher/models"
+)
+
+type spoolTestService struct {
+	fakeImageCatcherService
+	jfsKeys map[int64]string
+}
+
+func (s spoolTestService) GetTile(tileID int64) (*models.TemImageROI, error) {
+	tile := &models.TemImageROI{}
+	tile.ImageID = tileID
+	tile.TileFile.JfsKey = s.jfsKeys[tileID]
+	return tile, nil
+}
+
+func createSpoolTestDir(t *testing.T) string {
+	dataDir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatalf("Error creating the spool dir: %v", err)
+	}
+	return dataDir
+}
+
+func TestContentSpoolReplay(t *testing.T) {
+	dataDir := createSpoolTestDir(t)
+	defer os.RemoveAll(dataDir)
+
+	spool, err := openContentSpool(dataDir, false)
+	if err != nil {
+		t.Fatalf("Error opening the spool: %v", err)
+	}
+	for tileID := int64(1); tileID <= 3; tileID++ {
+		if err = spool.add(spoolEntry{TileID: tileID, AcqID: 10}); err != nil {
+			t.Fatalf("Error adding tile %d to the spool: %v", tileID, err)
+		}
+	}
+	if err = spool.complete(2); err != nil {
+		t.Fatalf("Error completing tile 2: %v", err)
+	}
+	spool.close()
+
+	spool, err = openContentSpool(dataDir, false)
+	if err != nil {
+		t.Fatalf("Error reopening the spool: %v", err)
+	}
+	defer spool.close()
+	pending := spool.pendingEntries()
+	if len(pending) != 2 || pending[0].TileID != 1 || pending[1].TileID != 3 {
+		t.Errorf("Expected tiles 1 and 3 to be pending but got %v", pending)
+	}
+	manifest, err := ioutil.ReadFile(filepath.Join(dataDir, spoolManifestName))
+	if err != nil {
+		t.Fatalf("Error reading the spool manifest: %v", err)
+	}
+	if records := strings.Count(string(manifest), "\n"); records != 2 {
+		t.Errorf("Expected the compacted manifest to have 2 records but it has %d", records)
+	}
+}
+
+func TestRecoverSpooledContent(t *testing.T) {
+	dataDir := createSpoolTestDir(t)
+	defer os.RemoveAll(dataDir)
+
+	testService := &spoolTestService{
+		fakeImageCatcherService: fakeImageCatcherService{
+			tileData:    createLocalStorage(),
+			tileContent: createLocalStorage(),
+		},
+		jfsKeys: map[int64]string{2: "stored"},
+	}
+	spool, err := openContentSpool(dataDir, false)
+	if err != nil {
+		t.Fatalf("Error opening the spool: %v", err)
+	}
+	th := &TileRequestHandler{
+		imageCatcher:             testService,
+		messageNotifier:          createFakeErrorNotifier(),
+		tmpDataDir:               dataDir,
+		contentProcessingWorkers: 1,
+		contentProcessor:         &contentProcessorImpl{service: testService},
+		spool:                    spool,
+	}
+	defer spool.close()
+
+	testContent := []byte("spooled tile content")
+	testChecksum, _ := checksum.Sum(checksum.SHA256, testContent)
+	for tileID := int64(1); tileID <= 3; tileID++ {
+		name := filepath.Join("col0001", fmt.Sprintf("tile%d.tif", tileID))
+		tmpTileFile, err := createTmpDataFile(dataDir, 1, &FileParams{Name: name, Content: testContent}, ExecutionContext{})
+		if err != nil {
+			t.Fatalf("Error creating the spooled file for tile %d: %v", tileID, err)
+		}
+		spool.add(spoolEntry{
+			TileID:            tileID,
+			AcqID:             1,
+			Name:              name,
+			TmpTileFile:       tmpTileFile,
+			Checksum:          hex.EncodeToString(testChecksum),
+			ChecksumAlgorithm: checksum.SHA256.String(),
+		})
+	}
+	// tile 3 content is lost
+	os.Remove(spool.pendingEntries()[2].TmpTileFile)
+
+	th.RecoverSpooledContent()
+
+	if pending := spool.pendingEntries(); len(pending) != 0 {
+		t.Errorf("Expected no pending spool entries after the recovery but got %v", pending)
+	}
+	if testService.tileContent.len() != 1 {
+		t.Fatalf("Expected only tile 1 to be stored but %d tiles were stored", testService.tileContent.len())
+	}
+	storedContent := testService.tileContent.getLast().(FileParams)
+	if !bytes.Equal(storedContent.Content, testContent) || storedContent.ChecksumAlgorithm != checksum.SHA256 {
+		t.Errorf("Unexpected stored content %s (%s)", storedContent.Content, storedContent.ChecksumAlgorithm)
+	}
+	if tmpFiles, _ := filepath.Glob(filepath.Join(dataDir, "1", "col0001", "*")); len(tmpFiles) != 0 {
+		t.Errorf("Expected the spooled files to be removed but found %v", tmpFiles)
+	}
+}
@@ -0,0 +1,105 @@
+package service
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"imagecatcher/config"
+	"imagecatcher/logger"
+	"imagecatcher/models"
+)
+
+// statisticsMetricName returns the metric name of a statistics column; the histogram columns
+// are named as the tem_camera_images columns they populate
+func statisticsMetricName(column string) string {
+	switch strings.ToLower(strings.Replace(column, " ", "", -1)) {
+	case strings.ToLower(models.U8HistOffsetMetric):
+		return models.U8HistOffsetMetric
+	case strings.ToLower(models.U8HistScaleMetric):
+		return models.U8HistScaleMetric
+	default:
+		return column
+	}
+}
+
+// parseTileStatistics parses the per tile image statistics. Every numeric column other than the tile columns is a metric;
+// values that are not finite numbers are skipped. The camera defaults to the camera of the statistics file.
+func parseTileStatistics(content []byte, defaultCamera int) ([]models.TileMetric, error) {
+	tiles, err := readTileCSV(content)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing the statistics file: %v", err)
+	}
+	if tiles.header == nil && len(tiles.records) > 0 {
+		return nil, fmt.Errorf("Error parsing the statistics file: the file has no header")
+	}
+	metricColumns := tiles.otherColumns()
+	metricIndexes := make([]int, 0, len(metricColumns))
+	for i := range metricColumns {
+		metricIndexes = append(metricIndexes, i)
+	}
+	sort.Ints(metricIndexes)
+	var metrics []models.TileMetric
+	for _, r := range tiles.records {
+		if tiles.isEmpty(r) {
+			continue
+		}
+		tileParams, ok := tiles.tileParams(r, defaultCamera)
+		if !ok {
+			continue
+		}
+		for _, i := range metricIndexes {
+			metricValue := tiles.field(r, i)
+			if metricValue == "" {
+				continue
+			}
+			value, err := strconv.ParseFloat(metricValue, 64)
+			if err != nil || math.IsNaN(value) || math.IsInf(value, 0) {
+				continue
+			}
+			metrics = append(metrics, models.TileMetric{
+				Col:    tileParams.Col,
+				Row:    tileParams.Row,
+				Camera: tileParams.Camera,
+				Frame:  tileParams.Frame,
+				Metric: statisticsMetricName(metricColumns[i]),
+				Value:  value,
+			})
+		}
+	}
+	return metrics, nil
+}
+
+// metricThresholds reads the accepted metric ranges from TILE_METRIC_THRESHOLDS, which maps a metric name
+// to its "min" and "max" bounds; either bound may be missing
+func metricThresholds(config config.Config) []models.MetricRange {
+	var ranges []models.MetricRange
+	for metric, thresholds := range config.GetConfigMapProperty("TILE_METRIC_THRESHOLDS") {
+		r := models.MetricRange{Metric: metric}
+		r.Min = metricThreshold(metric, thresholds, "min")
+		r.Max = metricThreshold(metric, thresholds, "max")
+		if r.Min == nil && r.Max == nil {
+			logger.Errorf("Invalid TILE_METRIC_THRESHOLDS value for %s: %v - neither min nor max is set", metric, thresholds)
+			continue
+		}
+		ranges = append(ranges, r)
+	}
+	sort.Slice(ranges, func(i, j int) bool {
+		return ranges[i].Metric < ranges[j].Metric
+	})
+	return ranges
+}
+
+func metricThreshold(metric string, thresholds config.Config, bound string) *float64 {
+	if thresholds[bound] == nil {
+		return nil
+	}
+	value := thresholds.GetFloat64Property(bound, math.NaN())
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		logger.Errorf("Invalid TILE_METRIC_THRESHOLDS %s value for %s: %v - the bound will be ignored", bound, metric, thresholds[bound])
+		return nil
+	}
+	return &value
+}
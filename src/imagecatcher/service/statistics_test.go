@@ -0,0 +1,70 @@
+package service
+
+import (
+	"reflect"
+	"testing"
+
+	"imagecatcher/config"
+	"imagecatcher/models"
+)
+
+func TestParseTileStatistics(t *testing.T) {
+	content := "Col, Row, Mean, U8 Hist Offset, u8HistScale, Comment\n" +
+		"1, 2, 120.5, 10, 0.5, ok\n" +
+		"3, x, 100, 11, 0.4,\n" +
+		"\n" +
+		"4, 5, NaN, 12, , bad\n"
+	metrics, err := parseTileStatistics([]byte(content), 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedMetrics := []models.TileMetric{
+		{Col: 1, Row: 2, Camera: 2, Frame: -1, Metric: "Mean", Value: 120.5},
+		{Col: 1, Row: 2, Camera: 2, Frame: -1, Metric: models.U8HistOffsetMetric, Value: 10},
+		{Col: 1, Row: 2, Camera: 2, Frame: -1, Metric: models.U8HistScaleMetric, Value: 0.5},
+		{Col: 4, Row: 5, Camera: 2, Frame: -1, Metric: models.U8HistOffsetMetric, Value: 12},
+	}
+	if !reflect.DeepEqual(metrics, expectedMetrics) {
+		t.Errorf("Expected metrics %v but got %v", expectedMetrics, metrics)
+	}
+}
+
+func TestParseTileStatisticsByImageName(t *testing.T) {
+	content := "Image, Camera, Frame, Mean\n" +
+		"col0007_row0008_cam1.tif, 1, , 99\n" +
+		"Dump_cam3_frame2_col0001_row0002.tif, , 2, 98\n"
+	metrics, err := parseTileStatistics([]byte(content), -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedMetrics := []models.TileMetric{
+		{Col: 7, Row: 8, Camera: 1, Frame: -1, Metric: "Mean", Value: 99},
+		{Col: 1, Row: 2, Camera: 3, Frame: 2, Metric: "Mean", Value: 98},
+	}
+	if !reflect.DeepEqual(metrics, expectedMetrics) {
+		t.Errorf("Expected metrics %v but got %v", expectedMetrics, metrics)
+	}
+	if _, err = parseTileStatistics([]byte("Mean, Std\n1, 2\n"), -1); err == nil {
+		t.Error("Expected an error for a statistics file without tile columns")
+	}
+}
+
+func TestMetricThresholds(t *testing.T) {
+	cfg := config.Config{
+		"TILE_METRIC_THRESHOLDS": map[string]interface{}{
+			"Mean":    map[string]interface{}{"min": 10.0, "max": 200.0},
+			"Std":     map[string]interface{}{"max": 50},
+			"Invalid": map[string]interface{}{"min": "low"},
+		},
+	}
+	ranges := metricThresholds(cfg)
+	if len(ranges) != 2 {
+		t.Fatalf("Expected 2 metric ranges but got %v", ranges)
+	}
+	if ranges[0].Metric != "Mean" || *ranges[0].Min != 10 || *ranges[0].Max != 200 {
+		t.Errorf("Unexpected Mean range %+v", ranges[0])
+	}
+	if ranges[1].Metric != "Std" || ranges[1].Min != nil || *ranges[1].Max != 50 {
+		t.Errorf("Unexpected Std range %+v", ranges[1])
+	}
+}
@@ -0,0 +1,246 @@
+package service
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"imagecatcher/config"
+	"imagecatcher/logger"
+	"imagecatcher/models"
+)
+
+// maxNotifiedDiscrepancies is the maximum number of discrepancies listed in a notification
+const maxNotifiedDiscrepancies = 50
+
+var storedImageListCameraRegexp = regexp.MustCompile("_cam(\\d+)\\.csv$")
+
+// StoredImageReconciliation is the result of reconciling the stored image lists of an acquisition with its persisted tiles
+type StoredImageReconciliation struct {
+	AcqUID        uint64
+	Lists         int
+	Listed        int
+	Persisted     int
+	Discrepancies []*models.StoredImageDiscrepancy
+}
+
+// Summary describes the discrepancies found
+func (r *StoredImageReconciliation) Summary() string {
+	var notPersisted, notListed int
+	for _, d := range r.Discrepancies {
+		switch d.Discrepancy {
+		case models.StoredImageNotListed:
+			notListed++
+		default:
+			notPersisted++
+		}
+	}
+	lines := []string{
+		fmt.Sprintf("Acq %d: %d of the %d images listed as stored in %d lists do not match the persisted tiles and %d of the %d persisted tiles were not listed",
+			r.AcqUID, notPersisted, r.Listed, r.Lists, notListed, r.Persisted),
+	}
+	for i, d := range r.Discrepancies {
+		if i == maxNotifiedDiscrepancies {
+			lines = append(lines, fmt.Sprintf("... and %d more", len(r.Discrepancies)-i))
+			break
+		}
+		lines = append(lines, d.String())
+	}
+	return strings.Join(lines, "\n")
+}
+
+// storedImageListCamera returns the camera from the stored image list file name or -1 if the list is not for a single camera
+func storedImageListCamera(fname string) int {
+	matches := storedImageListCameraRegexp.FindStringSubmatch(fname)
+	if matches == nil {
+		return -1
+	}
+	camera, err := strconv.Atoi(matches[1])
+	if err != nil {
+		return -1
+	}
+	return camera
+}
+
+// parseStoredImageList parses the CSV list of the images saved by the microscope. The images are identified as in any tile CSV file
+// and the optional checksum or md5 column holds the hex checksum of the image. The camera defaults to the camera of the list.
+func parseStoredImageList(content []byte, defaultCamera int) ([]models.StoredImage, error) {
+	tiles, err := readTileCSV(content)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing the stored image list: %v", err)
+	}
+	checksumColumn := -1
+	for i, h := range tiles.otherColumns() {
+		switch strings.ToLower(h) {
+		case "checksum", "md5":
+			checksumColumn = i
+		}
+	}
+	var images []models.StoredImage
+	for _, r := range tiles.records {
+		if tiles.isEmpty(r) {
+			continue
+		}
+		tileParams, ok := tiles.tileParams(r, defaultCamera)
+		if !ok {
+			continue
+		}
+		img := models.StoredImage{
+			Col:    tileParams.Col,
+			Row:    tileParams.Row,
+			Camera: tileParams.Camera,
+			Frame:  tileParams.Frame,
+			Name:   tileParams.Name,
+		}
+		if checksumValue := tiles.field(r, checksumColumn); checksumValue != "" {
+			if img.Checksum, err = hex.DecodeString(checksumValue); err != nil {
+				logger.Errorf("WARNING: Invalid checksum: %s in %v", checksumValue, r)
+				img.Checksum = nil
+			}
+		}
+		images = append(images, img)
+	}
+	return images, nil
+}
+
+type storedImageKey struct {
+	col, row, camera, frame int
+}
+
+func storedTileCamera(t *models.TemImage) int {
+	if t.Configuration == nil {
+		return -1
+	}
+	return t.Configuration.Camera
+}
+
+// reconcileStoredImages compares the listed images with the persisted tiles of the same camera. A listed image without
+// a camera is only matched to a tile if no other camera persisted a tile at the same position.
+// The persisted tiles that were not listed are only reported for the cameras that have a list; camera -1 means that
+// a list covers all cameras. It returns the number of listed images, the number of persisted tiles checked and the discrepancies found.
+func reconcileStoredImages(listed []models.StoredImage, listedCameras map[int]bool, tiles []*models.TemImage) (int, int, []*models.StoredImageDiscrepancy) {
+	now := time.Now()
+	tilesByKey := make(map[storedImageKey]*models.TemImage)
+	// the tiles of all cameras at a position, used to match the listed images without a camera
+	tilesByPosition := make(map[storedImageKey][]*models.TemImage)
+	for _, t := range tiles {
+		tilesByKey[storedImageKey{t.Col, t.Row, storedTileCamera(t), t.Frame}] = t
+		position := storedImageKey{t.Col, t.Row, -1, t.Frame}
+		tilesByPosition[position] = append(tilesByPosition[position], t)
+	}
+	discrepancies := []*models.StoredImageDiscrepancy{}
+	listedKeys := make(map[storedImageKey]bool)
+	listedTiles := make(map[*models.TemImage]bool)
+	for _, img := range listed {
+		key := storedImageKey{img.Col, img.Row, img.Camera, img.Frame}
+		if listedKeys[key] {
+			continue
+		}
+		listedKeys[key] = true
+		d := &models.StoredImageDiscrepancy{
+			Col:    img.Col,
+			Row:    img.Row,
+			Camera: img.Camera,
+			Frame:  img.Frame,
+			Name:   img.Name,
+			Found:  now,
+		}
+		tile := tilesByKey[key]
+		if tile == nil && img.Camera < 0 && len(tilesByPosition[key]) == 1 {
+			tile = tilesByPosition[key][0]
+		}
+		if tile != nil {
+			listedTiles[tile] = true
+		}
+		switch {
+		case tile == nil:
+			d.Discrepancy = models.StoredImageNotPersisted
+		case tile.TileFile.JfsPath == "":
+			d.ImageID = tile.ImageID
+			d.Discrepancy = models.StoredImageNoContent
+			d.Details = "the tile was received but its content was not stored"
+		case len(img.Checksum) > 0 && len(img.Checksum) == len(tile.TileFile.Checksum) && !bytes.Equal(img.Checksum, tile.TileFile.Checksum):
+			d.ImageID = tile.ImageID
+			d.Discrepancy = models.StoredImageChecksumMismatch
+			d.Details = fmt.Sprintf("listed checksum %x does not match the persisted checksum %x", img.Checksum, tile.TileFile.Checksum)
+		default:
+			continue
+		}
+		discrepancies = append(discrepancies, d)
+	}
+	var persisted int
+	for _, t := range tiles {
+		camera := storedTileCamera(t)
+		if t.TileFile.JfsPath == "" || !listedCameras[-1] && !listedCameras[camera] {
+			continue
+		}
+		persisted++
+		if listedTiles[t] {
+			continue
+		}
+		discrepancies = append(discrepancies, &models.StoredImageDiscrepancy{
+			ImageID:     t.ImageID,
+			Col:         t.Col,
+			Row:         t.Row,
+			Camera:      camera,
+			Frame:       t.Frame,
+			Name:        t.TileFile.Path,
+			Discrepancy: models.StoredImageNotListed,
+			Found:       now,
+		})
+	}
+	return len(listedKeys), persisted, discrepancies
+}
+
+// StoredImageReconciler reconciles the stored image lists of the acquisitions and sends a notification
+// whenever the images listed by the microscope do not match the persisted tiles
+type StoredImageReconciler struct {
+	checker         StoredImageChecker
+	messageNotifier MessageNotifier
+	// delay gives the tiles still queued when an acquisition ends the time to be persisted
+	delay time.Duration
+}
+
+// NewStoredImageReconciler creates a stored image reconciler that waits STORED_IMAGE_RECONCILE_DELAY before reconciling an acquisition
+func NewStoredImageReconciler(checker StoredImageChecker, messageNotifier MessageNotifier, config config.Config) *StoredImageReconciler {
+	delayValue := config.GetStringProperty("STORED_IMAGE_RECONCILE_DELAY", "2m")
+	delay, err := time.ParseDuration(delayValue)
+	if err != nil {
+		logger.Errorf("Invalid STORED_IMAGE_RECONCILE_DELAY value %s - will default to 2m: %v", delayValue, err)
+		delay = 2 * time.Minute
+	}
+	return &StoredImageReconciler{
+		checker:         checker,
+		messageNotifier: messageNotifier,
+		delay:           delay,
+	}
+}
+
+// Schedule reconciles the acquisition in the background after the configured delay
+func (r *StoredImageReconciler) Schedule(acqID uint64) {
+	time.AfterFunc(r.delay, func() {
+		r.Reconcile(acqID)
+	})
+}
+
+// Reconcile reconciles the stored image lists of the acquisition and notifies about the discrepancies found
+func (r *StoredImageReconciler) Reconcile(acqID uint64) (*StoredImageReconciliation, error) {
+	res, err := r.checker.ReconcileStoredImages(acqID)
+	if err != nil {
+		logger.Errorf("Error reconciling the stored image lists of acquisition %d: %v", acqID, err)
+		return nil, err
+	}
+	if len(res.Discrepancies) == 0 {
+		logger.Infof("Reconciled %d images listed as stored in %d lists with the persisted tiles of acquisition %d",
+			res.Listed, res.Lists, acqID)
+		return res, nil
+	}
+	summary := res.Summary()
+	logger.Error(summary)
+	r.messageNotifier.SendMessage(summary, false)
+	return res, nil
+}
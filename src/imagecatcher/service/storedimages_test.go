@@ -0,0 +1,187 @@
+package service
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"imagecatcher/config"
+	"imagecatcher/models"
+)
+
+func TestParseStoredImageList(t *testing.T) {
+	type testdata struct {
+		content        string
+		defaultCamera  int
+		expectedImages []models.StoredImage
+	}
+	var tests = []testdata{
+		{
+			"Col, Row, Frame, MD5\n1, 2, -1, 0a0b\n3, x, -1,\n4, 5, 7, zz\n",
+			2,
+			[]models.StoredImage{
+				{Col: 1, Row: 2, Camera: 2, Frame: -1, Checksum: []byte{10, 11}},
+				{Col: 4, Row: 5, Camera: 2, Frame: 7},
+			},
+		},
+		{
+			"File name,Checksum\nC:\\data\\col0001_row0002_cam3.tif,ff\nDump_cam1_frame000004_col0005_row0006.tif,\nstatistics.csv,\n",
+			-1,
+			[]models.StoredImage{
+				{Col: 1, Row: 2, Camera: 3, Frame: -1, Name: "C:\\data\\col0001_row0002_cam3.tif", Checksum: []byte{255}},
+				{Col: 5, Row: 6, Camera: 1, Frame: 4, Name: "Dump_cam1_frame000004_col0005_row0006.tif"},
+			},
+		},
+		{
+			"col0007_row0008_cam0.tif\n\ncol0009_row0010_cam0.tif\n",
+			0,
+			[]models.StoredImage{
+				{Col: 7, Row: 8, Camera: 0, Frame: -1, Name: "col0007_row0008_cam0.tif"},
+				{Col: 9, Row: 10, Camera: 0, Frame: -1, Name: "col0009_row0010_cam0.tif"},
+			},
+		},
+	}
+	for _, td := range tests {
+		images, err := parseStoredImageList([]byte(td.content), td.defaultCamera)
+		if err != nil {
+			t.Errorf("Unexpected error parsing %q: %v", td.content, err)
+			continue
+		}
+		if !reflect.DeepEqual(images, td.expectedImages) {
+			t.Errorf("Expected %v but got %v for %q", td.expectedImages, images, td.content)
+		}
+	}
+	if _, err := parseStoredImageList([]byte("a,b\n1,2\n"), 0); err == nil {
+		t.Error("Expected an error for a list without tile coordinates or image names")
+	}
+	if camera := storedImageListCamera("150407200041_40x168_stored_image_list_cam2.csv"); camera != 2 {
+		t.Errorf("Expected camera 2 but got %d", camera)
+	}
+	if camera := storedImageListCamera("150407200041_40x168_stored_image_list.csv"); camera != -1 {
+		t.Errorf("Expected no camera but got %d", camera)
+	}
+}
+
+func TestReconcileStoredImages(t *testing.T) {
+	tile := func(tileID int64, col, row, camera int, jfsPath string, checksum []byte) *models.TemImage {
+		return &models.TemImage{
+			ImageID:       tileID,
+			Col:           col,
+			Row:           row,
+			Frame:         -1,
+			Configuration: &models.TemCameraConfiguration{Camera: camera},
+			TileFile:      models.FileObject{Path: jfsPath, JfsPath: jfsPath, Checksum: checksum},
+		}
+	}
+	tiles := []*models.TemImage{
+		tile(1, 0, 0, 0, "/a/t1", []byte{1}),
+		tile(2, 0, 1, 0, "/a/t2", []byte{2}),
+		tile(3, 1, 0, 0, "", nil),
+		tile(4, 1, 1, 0, "/a/t4", []byte{4}),
+		// the camera 1 tiles are not checked since there is no list for camera 1
+		tile(5, 2, 0, 1, "/a/t5", []byte{5}),
+	}
+	listed := []models.StoredImage{
+		{Col: 0, Row: 0, Camera: 0, Frame: -1, Checksum: []byte{1}},
+		{Col: 0, Row: 0, Camera: 0, Frame: -1},
+		{Col: 0, Row: 1, Camera: 0, Frame: -1, Checksum: []byte{9}},
+		{Col: 1, Row: 0, Camera: 0, Frame: -1},
+		{Col: 3, Row: 3, Camera: 0, Frame: -1, Name: "col0003_row0003_cam0.tif"},
+	}
+	nListed, nPersisted, discrepancies := reconcileStoredImages(listed, map[int]bool{0: true}, tiles)
+	if nListed != 4 || nPersisted != 3 {
+		t.Errorf("Expected 4 listed and 3 persisted images but got %d and %d", nListed, nPersisted)
+	}
+	expected := []struct {
+		imageID     int64
+		col, row    int
+		discrepancy string
+	}{
+		{2, 0, 1, models.StoredImageChecksumMismatch},
+		{3, 1, 0, models.StoredImageNoContent},
+		{0, 3, 3, models.StoredImageNotPersisted},
+		{4, 1, 1, models.StoredImageNotListed},
+	}
+	if len(discrepancies) != len(expected) {
+		t.Fatalf("Expected %d discrepancies but got %v", len(expected), discrepancies)
+	}
+	for i, e := range expected {
+		d := discrepancies[i]
+		if d.ImageID != e.imageID || d.Col != e.col || d.Row != e.row || d.Discrepancy != e.discrepancy {
+			t.Errorf("Expected discrepancy %d to be %+v but got %v", i, e, d)
+		}
+	}
+}
+
+func TestReconcileStoredImagesOfTwoCameras(t *testing.T) {
+	tile := func(tileID int64, camera int, checksum []byte) *models.TemImage {
+		return &models.TemImage{
+			ImageID:       tileID,
+			Col:           1,
+			Row:           2,
+			Frame:         -1,
+			Configuration: &models.TemCameraConfiguration{Camera: camera},
+			TileFile:      models.FileObject{Path: "t", JfsPath: "t", Checksum: checksum},
+		}
+	}
+	// both cameras acquire the same position
+	tiles := []*models.TemImage{
+		tile(1, 0, []byte{1}),
+		tile(2, 1, []byte{2}),
+		tile(3, 0, []byte{3}),
+	}
+	tiles[2].Col = 5
+	listed := []models.StoredImage{
+		{Col: 1, Row: 2, Camera: 0, Frame: -1, Checksum: []byte{1}},
+		{Col: 1, Row: 2, Camera: 1, Frame: -1, Checksum: []byte{2}},
+		{Col: 5, Row: 2, Camera: 1, Frame: -1, Checksum: []byte{3}},
+	}
+	nListed, nPersisted, discrepancies := reconcileStoredImages(listed, map[int]bool{0: true, 1: true}, tiles)
+	if nListed != 3 || nPersisted != 3 {
+		t.Errorf("Expected 3 listed and 3 persisted images but got %d and %d", nListed, nPersisted)
+	}
+	// the camera 0 tile at 5,2 does not satisfy the camera 1 entry
+	if len(discrepancies) != 2 ||
+		discrepancies[0].Camera != 1 || discrepancies[0].Col != 5 || discrepancies[0].Discrepancy != models.StoredImageNotPersisted ||
+		discrepancies[1].ImageID != 3 || discrepancies[1].Discrepancy != models.StoredImageNotListed {
+		t.Errorf("Unexpected discrepancies %v", discrepancies)
+	}
+}
+
+type fakeStoredImageChecker struct {
+	ImageCatcherService
+	res *StoredImageReconciliation
+}
+
+func (c *fakeStoredImageChecker) ReconcileStoredImages(acqID uint64) (*StoredImageReconciliation, error) {
+	return c.res, nil
+}
+
+func TestStoredImageReconcilerNotifications(t *testing.T) {
+	checker := &fakeStoredImageChecker{
+		res: &StoredImageReconciliation{AcqUID: 60, Lists: 1, Listed: 2, Persisted: 2},
+	}
+	notifier := createFakeErrorNotifier()
+	reconciler := NewStoredImageReconciler(checker, notifier, config.Config{})
+	if _, err := reconciler.Reconcile(60); err != nil {
+		t.Fatal(err)
+	}
+	if notifier.messageStorage.len() != 0 {
+		t.Errorf("Expected no notification when the stored images match")
+	}
+	checker.res.Discrepancies = []*models.StoredImageDiscrepancy{
+		{Col: 1, Row: 2, Camera: 0, Frame: -1, Discrepancy: models.StoredImageNotPersisted},
+		{Col: 3, Row: 4, Camera: 0, Frame: -1, Discrepancy: models.StoredImageNotListed},
+	}
+	if _, err := reconciler.Reconcile(60); err != nil {
+		t.Fatal(err)
+	}
+	if notifier.messageStorage.len() != 1 {
+		t.Fatalf("Expected one notification but got %d", notifier.messageStorage.len())
+	}
+	message := notifier.messageStorage.getLast().(string)
+	if !strings.Contains(message, "Acq 60: 1 of the 2 images listed as stored in 1 lists do not match the persisted tiles and 1 of the 2 persisted tiles were not listed") ||
+		!strings.Contains(message, "col 3, row 4, cam 0, frame -1: not_listed") {
+		t.Errorf("Unexpected notification %s", message)
+	}
+}
@@ -1,27 +1,71 @@
 package service
 
 import (
-	"bytes"
+	"bufio"
+	"context"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"math"
 	"net"
+	"sync"
 	"time"
 
 	"imagecatcher/logger"
 	"imagecatcher/models"
 	"imagecatcher/protocol"
-	"imagecatcher/utils"
 )
 
+// maxStreamedRequestHeaderSize limits the header of the streamed requests, which only holds the tile metadata
+const maxStreamedRequestHeaderSize = 64 * 1024
+
+// requestIDPrefixSize is how much of a rejected request is read for finding its request ID
+const requestIDPrefixSize = 1024
+
+// defaultMaxTileSize is the default limit of the streamed tile images
+const defaultMaxTileSize int64 = 256 * 1024 * 1024
+
 // tcpServerHandler handles request coming over a TCP/IP socket
 type tcpServerHandler struct {
-	l   net.Listener
-	trh *TileRequestHandler
+	l                   net.Listener
+	trh                 *TileRequestHandler
+	maxInFlightRequests uint16
+	// maxTileSize limits the size of the streamed images; 0 means there is no limit
+	maxTileSize int64
+	// connsLock guards the open connections and the shutdown flag
+	connsLock    sync.Mutex
+	conns        map[net.Conn]struct{}
+	activeConns  sync.WaitGroup
+	shuttingDown bool
+}
+
+// tcpConnSession holds the protocol parameters negotiated for a connection
+type tcpConnSession struct {
+	version      uint16
+	capabilities protocol.Capability
+	// inFlightRequests limits the number of pipelined requests processed concurrently
+	inFlightRequests chan struct{}
+	pendingRequests  sync.WaitGroup
+	// writeLock serializes the responses of the pipelined requests
+	writeLock sync.Mutex
+	// desynchronized is set when the rest of a request could not be read so no other request can be read from the connection
+	desynchronized bool
 }
 
 // NewTCPServerHandler creates an instance of a request Handler
 func NewTCPServerHandler(l net.Listener, trh *TileRequestHandler) ServerHandler {
-	h := &tcpServerHandler{l, trh}
+	maxInFlightRequests := trh.config.GetIntProperty("TCP_MAX_INFLIGHT_REQUESTS", 8)
+	if maxInFlightRequests < 1 || maxInFlightRequests > math.MaxUint16 {
+		logger.Errorf("Invalid TCP_MAX_INFLIGHT_REQUESTS value %d - will default to 1", maxInFlightRequests)
+		maxInFlightRequests = 1
+	}
+	h := &tcpServerHandler{
+		l:                   l,
+		trh:                 trh,
+		maxInFlightRequests: uint16(maxInFlightRequests),
+		maxTileSize:         trh.config.GetInt64Property("MAX_TILE_SIZE", defaultMaxTileSize),
+		conns:               make(map[net.Conn]struct{}),
+	}
 	return h
 }
 
@@ -31,20 +75,87 @@ func (h *tcpServerHandler) Serve() (err error) {
 		var e error
 		var conn net.Conn
 		if conn, e = h.l.Accept(); e != nil {
+			if h.isShuttingDown() {
+				return nil
+			}
 			logger.Errorf("tcp: Accept error: %v", e)
 			continue
 		}
+		if !h.trackConn(conn) {
+			h.closeConn(conn)
+			return nil
+		}
 		go h.handle(conn)
 	}
 }
 
+// Shutdown implementation of a ServerHandler method. It closes the listener, it stops reading new requests
+// from the open connections and it waits until the requests already read are answered or until the context is done.
+func (h *tcpServerHandler) Shutdown(ctx context.Context) error {
+	h.connsLock.Lock()
+	h.shuttingDown = true
+	for conn := range h.conns {
+		// unblock the connections waiting for the next request
+		if err := conn.SetReadDeadline(time.Now()); err != nil {
+			logger.Errorf("Error interrupting the connection with %v: %v", conn.RemoteAddr(), err)
+		}
+	}
+	h.connsLock.Unlock()
+
+	err := h.l.Close()
+	done := make(chan struct{})
+	go func() {
+		h.activeConns.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (h *tcpServerHandler) isShuttingDown() bool {
+	h.connsLock.Lock()
+	defer h.connsLock.Unlock()
+	return h.shuttingDown
+}
+
+func (h *tcpServerHandler) trackConn(conn net.Conn) bool {
+	h.connsLock.Lock()
+	defer h.connsLock.Unlock()
+	if h.shuttingDown {
+		return false
+	}
+	h.conns[conn] = struct{}{}
+	h.activeConns.Add(1)
+	return true
+}
+
+func (h *tcpServerHandler) untrackConn(conn net.Conn) {
+	h.connsLock.Lock()
+	delete(h.conns, conn)
+	h.connsLock.Unlock()
+	h.activeConns.Done()
+}
+
 func (h *tcpServerHandler) handle(conn net.Conn) {
+	defer h.untrackConn(conn)
+	reader := bufio.NewReader(conn)
+	session, err := h.openSession(reader, conn)
+	if err != nil {
+		if err != io.EOF {
+			logger.Errorf("Error opening the protocol session with %v: %v", conn.RemoteAddr(), err)
+		}
+		h.closeConn(conn)
+		return
+	}
 	for {
-		var err error
-		if err = h.handleCaptureImageRequest(conn, conn); err == io.EOF {
-			if closeErr := conn.Close(); closeErr != nil {
-				logger.Errorf("Unexpected error while closing the connection: %v", closeErr)
-			}
+		if err = h.handleCaptureImageRequest(session, reader, conn); err == io.EOF || err != nil && (h.isShuttingDown() || session.desynchronized) {
+			// wait for the pipelined requests to be answered before closing the connection
+			session.pendingRequests.Wait()
+			h.closeConn(conn)
 			break
 		}
 		if err != nil {
@@ -53,32 +164,92 @@ func (h *tcpServerHandler) handle(conn net.Conn) {
 	}
 }
 
-func (h *tcpServerHandler) handleCaptureImageRequest(reader io.Reader, writer io.Writer) (err error) {
+func (h *tcpServerHandler) closeConn(conn net.Conn) {
+	if closeErr := conn.Close(); closeErr != nil {
+		logger.Errorf("Unexpected error while closing the connection: %v", closeErr)
+	}
+}
+
+// openSession checks whether the client starts the connection with a handshake. Clients that don't
+// send the handshake are legacy clients and for them the first 4 bytes are the length of the first tile request.
+func (h *tcpServerHandler) openSession(reader *bufio.Reader, writer io.Writer) (*tcpConnSession, error) {
+	prefix, err := reader.Peek(4)
+	if err != nil {
+		return nil, err
+	}
+	if !protocol.IsHandshake(prefix) {
+		return &tcpConnSession{version: protocol.LegacyProtocolVersion}, nil
+	}
+	clientHandshake, err := protocol.ReadHandshake(reader)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading the client handshake: %v", err)
+	}
+	serverHandshake := protocol.NegotiateHandshake(clientHandshake, &protocol.Handshake{
+		Version:             protocol.CurrentProtocolVersion,
+		MaxInFlightRequests: h.maxInFlightRequests,
+		Capabilities:        protocol.SupportedCapabilities,
+	})
+	if err = protocol.WriteHandshake(writer, serverHandshake); err != nil {
+		return nil, fmt.Errorf("Error writing the server handshake: %v", err)
+	}
+	logger.Debugf("Negotiated protocol version %d with capabilities %x and %d in-flight requests (client requested version %d with capabilities %x and %d in-flight requests)",
+		serverHandshake.Version, serverHandshake.Capabilities, serverHandshake.MaxInFlightRequests,
+		clientHandshake.Version, clientHandshake.Capabilities, clientHandshake.MaxInFlightRequests)
+	return &tcpConnSession{
+		version:          serverHandshake.Version,
+		capabilities:     serverHandshake.Capabilities,
+		inFlightRequests: make(chan struct{}, serverHandshake.MaxInFlightRequests),
+	}, nil
+}
+
+func (h *tcpServerHandler) handleCaptureImageRequest(session *tcpConnSession, reader io.Reader, writer io.Writer) (err error) {
 	tileJob := &tileProcessingJob{}
 	tileJob.execCtx.StartTime = time.Now()
-	defer tileJob.clear()
 
-	if _, err = h.readTileRequest(tileJob, reader); err != nil {
-		if err != io.EOF && err != io.ErrUnexpectedEOF {
+	if _, err = h.readTileRequest(session, tileJob, reader); err != nil {
+		// a read interrupted by the shutdown is not a request that needs an answer
+		if err != io.EOF && err != io.ErrUnexpectedEOF && !h.isShuttingDown() {
 			logger.Errorf("Read request error encountered: %v", err)
-			h.writeTileResponse(writer, tileJob, 0, err)
+			h.writeTileResponse(session, writer, tileJob, 0, err)
 		}
+		tileJob.clear()
 		return err
 	}
 	logger.Debugf("End request parsing for %d:%s (%d) %v",
 		tileJob.acqID, tileJob.tileParams.Name, tileJob.tileParams.ContentLen, time.Since(tileJob.execCtx.StartTime))
 
+	if !session.capabilities.Has(protocol.CapPipelining) {
+		return h.processTileRequest(session, writer, tileJob)
+	}
+	// stop reading new requests from the connection while the number of in-flight requests is at the negotiated limit
+	session.inFlightRequests <- struct{}{}
+	session.pendingRequests.Add(1)
+	go func() {
+		defer func() {
+			<-session.inFlightRequests
+			session.pendingRequests.Done()
+		}()
+		if perr := h.processTileRequest(session, writer, tileJob); perr != nil {
+			logger.Errorf("Error processing request %d for %d:%s: %v", tileJob.requestID, tileJob.acqID, tileJob.tileParams.Name, perr)
+		}
+	}()
+	return nil
+}
+
+func (h *tcpServerHandler) processTileRequest(session *tcpConnSession, writer io.Writer, tileJob *tileProcessingJob) (err error) {
+	defer tileJob.clear()
+
 	var tileID int64
 	var tileInfo *models.TemImage
 	tileInfo, err = h.trh.startTileProcessingJob(tileJob)
 	if tileInfo != nil {
 		tileID = tileInfo.ImageID
 	}
-	h.writeTileResponse(writer, tileJob, tileID, err)
+	h.writeTileResponse(session, writer, tileJob, tileID, err)
 	return
 }
 
-func (h *tcpServerHandler) readTileRequest(tileJob *tileProcessingJob, reader io.Reader) (n int64, err error) {
+func (h *tcpServerHandler) readTileRequest(session *tcpConnSession, tileJob *tileProcessingJob, reader io.Reader) (n int64, err error) {
 	var requestBufferLength uint32
 	if requestBufferLength, err = protocol.ReadUint32(reader); err != nil {
 		if err == io.EOF {
@@ -88,45 +259,183 @@ func (h *tcpServerHandler) readTileRequest(tileJob *tileProcessingJob, reader io
 		logger.Errorf("Error reading the total buffer length from the connection %v", err)
 		return
 	}
-	// allocate a little bit more than the request buffer length to avoid reallocations
-	requestBufferPtr, requestBufferBytes := utils.Alloc(requestBufferLength + bytes.MinRead + 1)
-	requestBuffer := bytes.NewBuffer(requestBufferBytes[0:0])
-	tileJob.memPtr = requestBufferPtr
-
-	n, err = requestBuffer.ReadFrom(io.LimitReader(reader, int64(requestBufferLength)))
+	if session.capabilities.Has(protocol.CapStreamedContent) {
+		return h.readStreamedTileRequest(session, tileJob, reader, requestBufferLength)
+	}
+	if tileJob.buffer, err = h.trh.acquireTileBuffer(int(requestBufferLength)); err != nil {
+		logger.Errorf("Error acquiring the buffer for a %d bytes request: %v", requestBufferLength, err)
+		return h.skipTileRequest(tileJob, reader, requestBufferLength, err)
+	}
+	requestBufferBytes := tileJob.buffer.Bytes()
 
-	if err != nil {
-		if err == io.EOF {
-			logger.Errorf("Unexpected EOF")
-			return
+	var nread int
+	nread, err = io.ReadFull(reader, requestBufferBytes)
+	n = int64(nread)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return n, &CaptureError{
+			Code: ErrCodeInvalidRequest,
+			Err:  fmt.Errorf("Expected to read %d bytes but instead it only read %d. This may result into a 'Unmarshalling error'!", requestBufferLength, n),
 		}
+	} else if err != nil {
 		return
 	}
-	if uint32(n) < requestBufferLength {
-		return n, fmt.Errorf("Expected to read %d bytes but instead it only read %d. This may result into a 'Unmarshalling error'!", requestBufferLength, n)
-	}
 	logger.Debugf("End reading buffer (%d) %v", requestBufferLength, time.Since(tileJob.execCtx.StartTime))
 
-	tileJob.acqID,
-		tileJob.tileParams.Camera,
-		tileJob.tileParams.Frame,
-		tileJob.tileParams.Col,
-		tileJob.tileParams.Row,
-		tileJob.tileParams.ContentLen,
-		tileJob.tileParams.Content,
-		tileJob.tileParams.Checksum,
-		err = protocol.UnmarshalTileRequest(requestBufferBytes)
+	var req *protocol.CaptureImageRequest
+	req, err = protocol.UnmarshalTileRequest(requestBufferBytes)
+	err = newCaptureError(ErrCodeInvalidRequest, err)
+	if req != nil {
+		if verr := setTileJobParams(session, tileJob, req); err == nil {
+			err = verr
+		}
+		tileJob.tileParams.ContentLen = len(req.Image)
+		tileJob.tileParams.Content = req.Image
+	}
 
 	tileJob.tileParams.UpdateTileName()
 	return
 }
 
-func (h *tcpServerHandler) writeTileResponse(writer io.Writer, tileJob *tileProcessingJob, tileID int64, perr error) (werr error) {
+// skipTileRequest reads the request ID from the beginning of a request that is rejected without being read, so that
+// a pipelining client can match the rejection, and then it skips the rest of the request so that the next requests
+// can still be read from the connection
+func (h *tcpServerHandler) skipTileRequest(tileJob *tileProcessingJob, reader io.Reader, requestBufferLength uint32, rejectErr error) (n int64, err error) {
+	prefixLength := requestBufferLength
+	if prefixLength > requestIDPrefixSize {
+		prefixLength = requestIDPrefixSize
+	}
+	prefix := make([]byte, prefixLength)
+	var nread int
+	nread, err = io.ReadFull(reader, prefix)
+	n = int64(nread)
+	if err != nil {
+		return
+	}
+	if tileJob.requestID, err = protocol.PeekTileRequestID(prefix); err != nil {
+		logger.Errorf("Error reading the ID of the rejected request: %v", err)
+	}
+	var nskipped int64
+	nskipped, err = io.CopyN(ioutil.Discard, reader, int64(requestBufferLength)-n)
+	n += nskipped
+	if err != nil {
+		return
+	}
+	return n, rejectErr
+}
+
+// readStreamedTileRequest reads the request header and then it writes the image straight to the temporary tile file
+// so that the image is never held in memory. The header is small so it is not taken from the tile buffers but
+// headers larger than maxStreamedRequestHeaderSize and images larger than MAX_TILE_SIZE are rejected without reading them.
+func (h *tcpServerHandler) readStreamedTileRequest(session *tcpConnSession, tileJob *tileProcessingJob, reader io.Reader, headerLength uint32) (n int64, err error) {
+	if headerLength > maxStreamedRequestHeaderSize {
+		// the header cannot be read so the next request cannot be found in the connection
+		session.desynchronized = true
+		return 0, &CaptureError{
+			Code: ErrCodeInvalidRequest,
+			Err:  fmt.Errorf("Request header of %d bytes exceeds the maximum of %d bytes", headerLength, maxStreamedRequestHeaderSize),
+		}
+	}
+	headerBuffer := make([]byte, headerLength)
+	var nread int
+	nread, err = io.ReadFull(reader, headerBuffer)
+	n = int64(nread)
+	if err != nil {
+		return
+	}
+	var req *protocol.CaptureImageRequest
+	if req, err = protocol.UnmarshalTileRequestHeader(headerBuffer); err != nil {
+		// the image size is unknown so the next request cannot be found in the connection
+		session.desynchronized = true
+		return n, newCaptureError(ErrCodeInvalidRequest, err)
+	}
+	err = setTileJobParams(session, tileJob, req)
+	tileJob.tileParams.ContentLen = int(req.ImageSize)
+	tileJob.tileParams.UpdateTileName()
+	maxTileSize := uint64(math.MaxInt64)
+	if h.maxTileSize > 0 {
+		maxTileSize = uint64(h.maxTileSize)
+	}
+	if req.ImageSize > maxTileSize {
+		// the image is too large to be even skipped
+		session.desynchronized = true
+		return n, &CaptureError{
+			Code: ErrCodeInvalidRequest,
+			Err:  fmt.Errorf("Tile %s of %d bytes exceeds the maximum tile size of %d bytes", tileJob.tileParams.Name, req.ImageSize, maxTileSize),
+		}
+	}
+	if err != nil {
+		// skip the image so that the next requests can still be read from the connection
+		nskipped, derr := io.CopyN(ioutil.Discard, reader, int64(req.ImageSize))
+		if derr != nil {
+			session.desynchronized = true
+			return n + nskipped, derr
+		}
+		return n + nskipped, err
+	}
+	var nimage int64
+	tileJob.tmpTileFile, nimage, err = streamTmpDataFile(h.trh.tmpDataDir, tileJob.acqID, &tileJob.tileParams.FileParams, reader, req)
+	if nimage < int64(req.ImageSize) {
+		session.desynchronized = true
+	}
+	logger.Debugf("End streaming tile content %d:%s (%d) %v", tileJob.acqID, tileJob.tileParams.Name, nimage, time.Since(tileJob.execCtx.StartTime))
+	return n + nimage, err
+}
+
+// setTileJobParams sets the tile parameters from the request and it checks the request version
+func setTileJobParams(session *tcpConnSession, tileJob *tileProcessingJob, req *protocol.CaptureImageRequest) error {
+	tileJob.requestID = req.RequestID
+	tileJob.acqID = req.AcqID
+	tileJob.tileParams.Camera = int(req.Camera)
+	tileJob.tileParams.Frame = int(req.Frame)
+	tileJob.tileParams.Col = int(req.Col)
+	tileJob.tileParams.Row = int(req.Row)
+	tileJob.tileParams.Checksum = req.Checksum
+	tileJob.tileParams.ChecksumAlgorithm = req.ChecksumAlgorithm
+	if session.capabilities.Has(protocol.CapVersionedMessages) && req.Version != session.version {
+		return &CaptureError{
+			Code: ErrCodeUnsupportedVersion,
+			Err:  fmt.Errorf("Request version %d does not match the negotiated protocol version %d", req.Version, session.version),
+		}
+	}
+	return nil
+}
+
+// streamTmpDataFile writes the streamed image to the temporary tile file. The image is always read from the connection
+// but the file is removed if the image could not be written or if its checksum does not match.
+func streamTmpDataFile(dataDir string, acqID uint64, f *FileParams, reader io.Reader, req *protocol.CaptureImageRequest) (string, int64, error) {
+	startTime := time.Now()
+	fullFilename, file, ferr := openTmpDataFile(dataDir, acqID, f)
+	var dst io.Writer = ioutil.Discard
+	if ferr == nil {
+		dst = file
+	}
+	n, err := protocol.ReadTileContent(reader, req, dst)
+	if ferr == nil {
+		if cerr := file.Close(); cerr != nil && err == nil {
+			err = fmt.Errorf("Error writing temporary file %s to disc: %v", fullFilename, cerr)
+		}
+	} else if err == nil {
+		err = ferr
+	}
+	if err != nil {
+		if ferr == nil {
+			removeSpooledFile(fullFilename)
+		}
+		return "", n, err
+	}
+	logger.Debugf("Streamed temporary tile file %s (%d): %v", fullFilename, n, time.Since(startTime))
+	return fullFilename, n, nil
+}
+
+func (h *tcpServerHandler) writeTileResponse(session *tcpConnSession, writer io.Writer, tileJob *tileProcessingJob, tileID int64, perr error) (werr error) {
 	var status int16
+	var errorMessage string
 	var systemStatus QueueStatus
 	systemStatus, tileQueueStatus, contentQueueStatus := h.trh.getProcessingQueuesStatus()
+	hints := h.trh.computeBackpressureHints(perr)
 	if perr != nil {
 		status = 1
+		errorMessage = perr.Error()
 		systemStatus = Red // automatically make system RED in case of an error
 	} else {
 		status = 0
@@ -138,8 +447,17 @@ func (h *tcpServerHandler) writeTileResponse(writer io.Writer, tileJob *tileProc
 		SystemStatus:       int16(systemStatus),
 		TileQueueStatus:    int16(tileQueueStatus),
 		ContentQueueStatus: int16(contentQueueStatus),
+		Version:            session.version,
+		RequestID:          tileJob.requestID,
+		ErrorCode:          int16(captureErrorCode(perr)),
+		ErrorMessage:       errorMessage,
+		RetryAfterMs:       durationToMillis(hints.retryAfter),
+		RecommendedRateMs:  durationToMillis(hints.recommendedRate),
 	})
 
+	session.writeLock.Lock()
+	defer session.writeLock.Unlock()
+
 	if werr = protocol.WriteUint32(writer, uint32(len(responseBuf))); werr != nil {
 		logger.Errorf("Error writing the total response buffer length for %d:%s (%d bytes): %v",
 			tileJob.acqID, tileJob.tileParams.Name, tileJob.tileParams.ContentLen, werr)
@@ -5,11 +5,16 @@ import (
 	"crypto/md5"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
+	"os"
+	"sync"
 	"testing"
 
+	"imagecatcher/checksum"
 	"imagecatcher/config"
 	"imagecatcher/protocol"
+	"imagecatcher/utils"
 )
 
 func newLocalTCPListener() net.Listener {
@@ -65,15 +70,287 @@ func TestTcpCaptureImageRequest(t *testing.T) {
 	}
 }
 
-func tcpSendTile(serverURL string, acqID uint64, camera, col, row int, image []byte) (*protocol.CaptureImageResponse, error) {
-	tcpconn, err := net.Dial("tcp", serverURL)
+func TestTcpCaptureImageRequestWithHandshake(t *testing.T) {
+	testConfig := config.Config{
+		"TILE_PROCESSING_WORKERS":    1,
+		"TILE_PROCESSING_QUEUE_SIZE": 1,
+		"CONTENT_STORE_WORKERS":      1,
+		"CONTENT_STORE_QUEUE_SIZE":   1,
+	}
+	fakeService, tcpHandler, tcpListener := setupTCP(testConfig)
+	go startListening(tcpHandler)
+
+	tcpconn, err := net.Dial("tcp", tcpListener.Addr().String())
 	if err != nil {
-		return nil, fmt.Errorf("Error opening the tcp connection to %s: %v", serverURL, err)
+		t.Fatal(err)
+	}
+	defer tcpconn.Close()
+	hs, err := protocol.ClientHandshake(tcpconn, &protocol.Handshake{
+		Version:      protocol.CurrentProtocolVersion,
+		Capabilities: protocol.CapVersionedMessages,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hs.Version != protocol.CurrentProtocolVersion {
+		t.Errorf("Expected negotiated version to be %d but it was %d", protocol.CurrentProtocolVersion, hs.Version)
+	}
+	testBytes := createTestBuffer(testBufferLength)
+	req := createTestTileRequest(testAcqID, testTileCamera, testTileCol, testTileRow, testBytes)
+	req.Version = hs.Version
+	res, err := tcpSendTileRequest(tcpconn, tcpListener.Addr().String(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Status != 0 {
+		t.Error("Expected status to be OK")
+	}
+	if res.Version != hs.Version {
+		t.Errorf("Expected response version to be %d but it was %d", hs.Version, res.Version)
+	}
+	lastTileContent := fakeService.tileContent.getLast().(FileParams)
+	if !bytes.Equal(lastTileContent.Content, testBytes) {
+		t.Error("Expected tile content to be test content")
+	}
+}
+
+func TestTcpPipelinedCaptureImageRequests(t *testing.T) {
+	fakeService, tcpHandler, tcpListener := setupTCP(defaultTestingConfig)
+	go startListening(tcpHandler)
+
+	tcpconn, err := net.Dial("tcp", tcpListener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
 	}
 	defer tcpconn.Close()
+	hs, err := protocol.ClientHandshake(tcpconn, &protocol.Handshake{
+		Version:             protocol.CurrentProtocolVersion,
+		MaxInFlightRequests: 4,
+		Capabilities:        protocol.SupportedCapabilities,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !hs.Capabilities.Has(protocol.CapPipelining) {
+		t.Fatalf("Expected pipelining to be negotiated but the capabilities were %x", hs.Capabilities)
+	}
+	if hs.MaxInFlightRequests != 4 {
+		t.Errorf("Expected 4 in-flight requests but got %d", hs.MaxInFlightRequests)
+	}
+	sender := protocol.NewPipelinedTileSender(tcpconn, hs)
+	var lock sync.Mutex
+	responses := make(map[uint64]*protocol.CaptureImageResponse)
+	nTiles := 10
+	for i := 0; i < nTiles; i++ {
+		req := createTestTileRequest(testAcqID, testTileCamera, i, testTileRow, createTestBuffer(1024))
+		err := sender.Send(req, func(req *protocol.CaptureImageRequest, resp *protocol.CaptureImageResponse, err error) {
+			if err != nil {
+				t.Errorf("Unexpected error for request %d: %v", req.RequestID, err)
+				return
+			}
+			if resp.RequestID != req.RequestID {
+				t.Errorf("Response ID %d does not match the request ID %d", resp.RequestID, req.RequestID)
+			}
+			lock.Lock()
+			responses[resp.RequestID] = resp
+			lock.Unlock()
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	sender.Wait()
+	if len(responses) != nTiles {
+		t.Errorf("Expected %d responses but got %d", nTiles, len(responses))
+	}
+	for id, resp := range responses {
+		if resp.Status != 0 {
+			t.Errorf("Expected status to be OK for request %d", id)
+		}
+	}
+	if fakeService.tileData.len() != nTiles {
+		t.Errorf("Expected %d tiles to be stored but found %d", nTiles, fakeService.tileData.len())
+	}
+}
+
+func TestTcpCaptureImageRequestWithInvalidChecksum(t *testing.T) {
+	fakeService, tcpHandler, tcpListener := setupTCP(defaultTestingConfig)
+	go startListening(tcpHandler)
+
+	tcpconn, err := net.Dial("tcp", tcpListener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tcpconn.Close()
+	req := createTestTileRequest(testAcqID, testTileCamera, testTileCol, testTileRow, createTestBuffer(testBufferLength))
+	req.Checksum[0] ^= 0xff
+	res, err := tcpSendTileRequest(tcpconn, tcpListener.Addr().String(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Status == 0 {
+		t.Error("Expected the request to fail")
+	}
+	if ErrorCode(res.ErrorCode) != ErrCodeChecksumMismatch {
+		t.Errorf("Expected error code %s but got %s", ErrCodeChecksumMismatch, ErrorCode(res.ErrorCode))
+	}
+	if res.ErrorMessage == "" {
+		t.Error("Expected an error message")
+	}
+	if fakeService.tileData.len() != 0 {
+		t.Errorf("Did not expect any tile to be stored but found %d", fakeService.tileData.len())
+	}
+}
+
+func TestTcpCaptureImageRequestWithChecksumAlgorithms(t *testing.T) {
+	fakeService, tcpHandler, tcpListener := setupTCP(defaultTestingConfig)
+	go startListening(tcpHandler)
+
+	for _, alg := range []checksum.Algorithm{checksum.SHA1, checksum.SHA256, checksum.CRC32C, checksum.XXHash64} {
+		testBytes := createTestBuffer(testBufferLength)
+		req := createTestTileRequest(testAcqID, testTileCamera, testTileCol, testTileRow, testBytes)
+		req.ChecksumAlgorithm = alg
+		req.Checksum, _ = checksum.Sum(alg, testBytes)
+		tcpconn, err := net.Dial("tcp", tcpListener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := tcpSendTileRequest(tcpconn, tcpListener.Addr().String(), req)
+		tcpconn.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.Status != 0 {
+			t.Errorf("Expected status to be OK for %s but got %s: %s", alg, ErrorCode(res.ErrorCode), res.ErrorMessage)
+		}
+		lastTileContent := fakeService.tileContent.getLast().(FileParams)
+		if lastTileContent.ChecksumAlgorithm != alg {
+			t.Errorf("Expected the tile checksum algorithm to be %s but it was %s", alg, lastTileContent.ChecksumAlgorithm)
+		}
+	}
+}
+
+func TestReadStreamedTileRequest(t *testing.T) {
+	dataDir, err := ioutil.TempDir("", "streamed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataDir)
+	h := &tcpServerHandler{trh: &TileRequestHandler{tmpDataDir: dataDir}}
+	session := &tcpConnSession{
+		version:      protocol.CurrentProtocolVersion,
+		capabilities: protocol.SupportedCapabilities,
+	}
+
+	image := createTestBuffer(4096)
+	var requests bytes.Buffer
+	for col := 1; col <= 2; col++ {
+		req := createTestTileRequest(testAcqID, testTileCamera, col, testTileRow, image)
+		req.Version = protocol.CurrentProtocolVersion
+		if col == 1 {
+			req.Checksum = []byte("invalid checksum")
+		}
+		if err = protocol.WriteStreamedTileRequest(&requests, req); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	invalidJob := &tileProcessingJob{}
+	if _, err = h.readTileRequest(session, invalidJob, &requests); captureErrorCode(err) != ErrCodeChecksumMismatch {
+		t.Errorf("Expected a checksum mismatch but got %v", err)
+	}
+	if invalidJob.tmpTileFile != "" || session.desynchronized {
+		t.Errorf("Expected the invalid tile to be skipped without leaving a temporary file (%s)", invalidJob.tmpTileFile)
+	}
+
+	tileJob := &tileProcessingJob{}
+	if _, err = h.readTileRequest(session, tileJob, &requests); err != nil {
+		t.Fatalf("Unexpected error reading the streamed request: %v", err)
+	}
+	if tileJob.tileParams.Col != 2 || tileJob.tileParams.ContentLen != len(image) || len(tileJob.tileParams.Content) != 0 {
+		t.Errorf("Unexpected tile params %+v", tileJob.tileParams)
+	}
+	content, err := ioutil.ReadFile(tileJob.tmpTileFile)
+	if err != nil {
+		t.Fatalf("Error reading the streamed tile file: %v", err)
+	}
+	if !bytes.Equal(content, image) {
+		t.Error("The streamed tile file does not match the image")
+	}
+}
+
+func TestRejectedTileRequestKeepsRequestID(t *testing.T) {
+	// the pool is too small for any request so every request is rejected without being read
+	h := &tcpServerHandler{trh: &TileRequestHandler{tileBuffers: utils.NewBufferPool(16)}}
+	session := &tcpConnSession{
+		version:      protocol.CurrentProtocolVersion,
+		capabilities: protocol.CapVersionedMessages | protocol.CapPipelining,
+	}
+
+	var requests bytes.Buffer
+	for requestID := uint64(1); requestID <= 2; requestID++ {
+		req := createTestTileRequest(testAcqID, testTileCamera, testTileCol, int(requestID), createTestBuffer(4096))
+		req.Version = protocol.CurrentProtocolVersion
+		req.RequestID = requestID
+		requestBuffer := protocol.MarshalTileRequest(req)
+		protocol.WriteUint32(&requests, uint32(len(requestBuffer)))
+		requests.Write(requestBuffer)
+	}
+	for requestID := uint64(1); requestID <= 2; requestID++ {
+		tileJob := &tileProcessingJob{}
+		if _, err := h.readTileRequest(session, tileJob, &requests); captureErrorCode(err) != ErrCodeQueueTimeout {
+			t.Errorf("Expected request %d to be rejected with a queue timeout but got %v", requestID, err)
+		}
+		if tileJob.requestID != requestID {
+			t.Errorf("Expected the rejection to carry the request ID %d but got %d", requestID, tileJob.requestID)
+		}
+	}
+	if requests.Len() != 0 {
+		t.Errorf("Expected the rejected requests to be skipped but %d bytes are left", requests.Len())
+	}
+}
 
+func TestReadOversizedStreamedTileRequest(t *testing.T) {
+	dataDir, err := ioutil.TempDir("", "streamed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataDir)
+	h := &tcpServerHandler{trh: &TileRequestHandler{tmpDataDir: dataDir}, maxTileSize: 1024}
+	session := &tcpConnSession{
+		version:      protocol.CurrentProtocolVersion,
+		capabilities: protocol.SupportedCapabilities,
+	}
+
+	var requests bytes.Buffer
+	req := createTestTileRequest(testAcqID, testTileCamera, testTileCol, testTileRow, createTestBuffer(4096))
+	req.Version = protocol.CurrentProtocolVersion
+	req.RequestID = 7
+	if err = protocol.WriteStreamedTileRequest(&requests, req); err != nil {
+		t.Fatal(err)
+	}
+	tileJob := &tileProcessingJob{}
+	if _, err = h.readTileRequest(session, tileJob, &requests); captureErrorCode(err) != ErrCodeInvalidRequest {
+		t.Errorf("Expected an invalid request error for an oversized tile but got %v", err)
+	}
+	if tileJob.requestID != 7 || tileJob.tmpTileFile != "" || !session.desynchronized {
+		t.Errorf("Expected the oversized tile %d to be rejected without reading it (%s)", tileJob.requestID, tileJob.tmpTileFile)
+	}
+
+	session.desynchronized = false
+	requests.Reset()
+	protocol.WriteUint32(&requests, maxStreamedRequestHeaderSize+1)
+	if _, err = h.readTileRequest(session, &tileProcessingJob{}, &requests); captureErrorCode(err) != ErrCodeInvalidRequest {
+		t.Errorf("Expected an invalid request error for an oversized header but got %v", err)
+	}
+	if !session.desynchronized {
+		t.Error("Expected the connection to be closed after an oversized header")
+	}
+}
+
+func createTestTileRequest(acqID uint64, camera, col, row int, image []byte) *protocol.CaptureImageRequest {
 	checksum := md5.Sum(image)
-	req := &protocol.CaptureImageRequest{
+	return &protocol.CaptureImageRequest{
 		AcqID:    acqID,
 		Camera:   int32(camera),
 		Frame:    -1,
@@ -82,6 +359,19 @@ func tcpSendTile(serverURL string, acqID uint64, camera, col, row int, image []b
 		Image:    image,
 		Checksum: checksum[0:],
 	}
+}
+
+func tcpSendTile(serverURL string, acqID uint64, camera, col, row int, image []byte) (*protocol.CaptureImageResponse, error) {
+	tcpconn, err := net.Dial("tcp", serverURL)
+	if err != nil {
+		return nil, fmt.Errorf("Error opening the tcp connection to %s: %v", serverURL, err)
+	}
+	defer tcpconn.Close()
+
+	return tcpSendTileRequest(tcpconn, serverURL, createTestTileRequest(acqID, camera, col, row, image))
+}
+
+func tcpSendTileRequest(tcpconn net.Conn, serverURL string, req *protocol.CaptureImageRequest) (*protocol.CaptureImageResponse, error) {
 	tileReqBuf := protocol.MarshalTileRequest(req)
 	if err := protocol.WriteUint32(tcpconn, uint32(len(tileReqBuf))); err != nil {
 		return nil, fmt.Errorf("Error writing the total buffer length for %d:%d:%d:%d to %s: %v",
@@ -53,6 +53,12 @@ func (s *localStorage) add(item interface{}) {
 	s.content.PushBack(item)
 }
 
+func (s *localStorage) len() int {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.content.Len()
+}
+
 func (s *localStorage) getLast() interface{} {
 	s.lock.RLock()
 	defer s.lock.RUnlock()
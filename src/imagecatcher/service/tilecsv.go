@@ -0,0 +1,137 @@
+package service
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"imagecatcher/logger"
+)
+
+// tileCSV is a CSV file with one tile per record. The tile is identified either by the col and row columns,
+// optionally with the camera and frame columns, or by the image file name column. A file without a header
+// must have the image file name in every record.
+type tileCSV struct {
+	header  []string
+	records [][]string
+	// the indexes of the tile columns are -1 if the column is missing
+	col, row, camera, frame, name int
+}
+
+func readTileCSV(content []byte) (*tileCSV, error) {
+	csvReader := csv.NewReader(bytes.NewReader(content))
+	csvReader.TrimLeadingSpace = true
+	csvReader.FieldsPerRecord = -1
+	csvRecords, err := csvReader.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	c := &tileCSV{col: -1, row: -1, camera: -1, frame: -1, name: -1}
+	if len(csvRecords) == 0 || findTileFileName(csvRecords[0]) != "" {
+		c.records = csvRecords
+		return c, nil
+	}
+	c.header = csvRecords[0]
+	c.records = csvRecords[1:]
+	for i, h := range c.header {
+		switch strings.ToLower(strings.TrimSpace(h)) {
+		case "col", "column":
+			c.col = i
+		case "row":
+			c.row = i
+		case "cam", "camera":
+			c.camera = i
+		case "frame":
+			c.frame = i
+		case "file", "filename", "file name", "image", "image name", "name", "path":
+			c.name = i
+		}
+	}
+	if (c.col < 0 || c.row < 0) && c.name < 0 {
+		return nil, fmt.Errorf("no tile coordinates or image name found in the header %v", c.header)
+	}
+	return c, nil
+}
+
+// otherColumns returns the names of the header columns that do not identify the tile indexed by their position
+func (c *tileCSV) otherColumns() map[int]string {
+	columns := make(map[int]string)
+	for i, h := range c.header {
+		if i != c.col && i != c.row && i != c.camera && i != c.frame && i != c.name && strings.TrimSpace(h) != "" {
+			columns[i] = strings.TrimSpace(h)
+		}
+	}
+	return columns
+}
+
+func (c *tileCSV) field(r []string, i int) string {
+	if i < 0 || i >= len(r) {
+		return ""
+	}
+	return strings.TrimSpace(r[i])
+}
+
+// isEmpty checks if the record is an empty line
+func (c *tileCSV) isEmpty(r []string) bool {
+	return len(r) == 1 && strings.TrimSpace(r[0]) == ""
+}
+
+// tileParams returns the tile of the record; the camera defaults to the given camera.
+// Records with an invalid tile are logged and the returned flag is false.
+func (c *tileCSV) tileParams(r []string, defaultCamera int) (*TileParams, bool) {
+	tileParams := &TileParams{Camera: defaultCamera, Frame: -1}
+	var err error
+	if c.header == nil {
+		tileParams.Name = findTileFileName(r)
+	} else {
+		tileParams.Name = c.field(r, c.name)
+	}
+	colValue := c.field(r, c.col)
+	rowValue := c.field(r, c.row)
+	if colValue == "" || rowValue == "" {
+		name := tileParams.Name
+		if !isTileFileName(name) || tileParams.ExtractTileParamsFromURL(name) != nil {
+			logger.Errorf("WARNING: Invalid image name: %s in %v", name, r)
+			return nil, false
+		}
+		// keep the name as it was listed
+		tileParams.Name = name
+		return tileParams, true
+	}
+	if tileParams.Col, err = strconv.Atoi(colValue); err != nil {
+		logger.Errorf("WARNING: Invalid column number: %s in %v", colValue, r)
+		return nil, false
+	}
+	if tileParams.Row, err = strconv.Atoi(rowValue); err != nil {
+		logger.Errorf("WARNING: Invalid row number: %s in %v", rowValue, r)
+		return nil, false
+	}
+	if cameraValue := c.field(r, c.camera); cameraValue != "" {
+		if tileParams.Camera, err = strconv.Atoi(cameraValue); err != nil {
+			logger.Errorf("WARNING: Invalid camera: %s in %v", cameraValue, r)
+			return nil, false
+		}
+	}
+	if frameValue := c.field(r, c.frame); frameValue != "" {
+		if tileParams.Frame, err = strconv.Atoi(frameValue); err != nil {
+			logger.Errorf("WARNING: Invalid frame: %s in %v", frameValue, r)
+			return nil, false
+		}
+	}
+	return tileParams, true
+}
+
+func isTileFileName(name string) bool {
+	return tileFileNameRegexp.MatchString(name) || dumpFileNameRegexp.MatchString(name)
+}
+
+func findTileFileName(record []string) string {
+	for _, f := range record {
+		if isTileFileName(f) {
+			return strings.TrimSpace(f)
+		}
+	}
+	return ""
+}
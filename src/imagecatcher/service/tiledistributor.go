@@ -56,13 +56,14 @@ type TileDistributor interface {
 }
 
 type tileDistributorImpl struct {
-	dbh dao.DbHandler
-	cfg config.Config
+	dbh              dao.DbHandler
+	cfg              config.Config
+	metricThresholds []models.MetricRange
 }
 
 // NewTileDistributor - instantiante a tile distributor
 func NewTileDistributor(dbHandler dao.DbHandler, config config.Config) TileDistributor {
-	return &tileDistributorImpl{dbh: dbHandler, cfg: config}
+	return &tileDistributorImpl{dbh: dbHandler, cfg: config, metricThresholds: metricThresholds(config)}
 }
 
 // ServeNextAvailableTiles picks next available tiles by acquisition ID, section number and state
@@ -74,6 +75,9 @@ func (td *tileDistributorImpl) ServeNextAvailableTiles(tileFilter *models.TileFi
 	if tileFilter.State == "" {
 		return notilespec, InvalidTileRequest, fmt.Errorf("The current tile state must be specified")
 	}
+	if tileFilter.WithinMetricThresholds {
+		tileFilter.MetricRanges = td.metricThresholds
+	}
 	session, err := td.dbh.OpenSession(false)
 	if err != nil {
 		return notilespec, NoTileReady, fmt.Errorf("Error opening a database session: %v", err)
@@ -87,6 +91,9 @@ func (td *tileDistributorImpl) ServeNextAvailableTiles(tileFilter *models.TileFi
 	if tilespecs, err = dao.UpdateTilesStatus(tileFilter, newTileState, session); err != nil {
 		return notilespec, NoTileReady, err
 	}
+	if err = dao.RetrieveTileMipmaps(tilespecs, session); err != nil {
+		return notilespec, NoTileReady, err
+	}
 	session.Close(nil)
 	session = nil
 	if len(tilespecs) > 0 {
@@ -119,7 +126,7 @@ func (td *tileDistributorImpl) ServeNextAvailableTiles(tileFilter *models.TileFi
 		session.Close(err)
 	}()
 
-	var acqCompleted bool
+	var acqFinished bool
 	var acq *models.Acquisition
 	if tileFilter.AcqUID > 0 {
 		acquisitionFilter := &models.AcquisitionFilter{
@@ -132,18 +139,18 @@ func (td *tileDistributorImpl) ServeNextAvailableTiles(tileFilter *models.TileFi
 		}
 		if len(acqs) > 0 {
 			acq = acqs[0]
-			acqCompleted = acq.IsCompleted()
+			acqFinished = acq.IsFinished()
 		}
 	}
-	if !acqCompleted {
-		// if acquisition is not completed yet return no tile ready in section or no tile ready
+	if !acqFinished {
+		// if acquisition is still created or acquiring return no tile ready in section or no tile ready
 		// depending on whether a particular section is requested or not
 		if tileFilter.NominalSection > 0 {
 			return nil, NoTileReadyInSection, err
 		}
 		return nil, NoTileReady, err
 	}
-	// if acquisition is completed count how many tiles are in the new state
+	// if acquisition is completed, aborted, failed or archived no more tiles will be added so count how many tiles are in the new state
 	// if the number of tiles in the new state equals the total then return nothing to serve for acquisition or section
 	// if it doesn't than simply return no tile ready
 	newTileStateFilter := *tileFilter
@@ -0,0 +1,221 @@
+package service
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"imagecatcher/logger"
+	"imagecatcher/models"
+	"imagecatcher/utils"
+)
+
+// Image formats of the tile content endpoints
+const (
+	tiffImageFormat = "tiff"
+	pngImageFormat  = "png"
+	jpegImageFormat = "jpeg"
+)
+
+var imageFormatContentTypes = map[string]string{
+	tiffImageFormat: "image/tiff",
+	pngImageFormat:  "image/png",
+	jpegImageFormat: "image/jpeg",
+}
+
+// defaultJPEGQuality is the quality of the tile images converted to JPEG
+const defaultJPEGQuality = 90
+
+// tileImageOptions describe how the tile content is converted before it is returned
+type tileImageOptions struct {
+	format string
+	// scaleTo8Bit maps the pixel values to 8 bit using the histogram scaling of the tile
+	scaleTo8Bit bool
+	// downsample is the factor the image size is reduced by
+	downsample int
+	// crop is the returned rectangle of the full resolution tile; nil returns the entire tile
+	crop *image.Rectangle
+}
+
+// converted returns true if the stored tile content cannot be returned as is
+func (o *tileImageOptions) converted() bool {
+	return o.format != tiffImageFormat || o.scaleTo8Bit || o.downsample > 1 || o.crop != nil
+}
+
+// parseTileImageOptions reads the tile conversion from the format, scale-8bit, downsample and crop query parameters.
+// If the format is not set it is selected from the Accept header.
+func parseTileImageOptions(r *http.Request) (*tileImageOptions, error) {
+	var err error
+	options := &tileImageOptions{}
+	if options.format, err = tileImageFormat(r.URL.Query().Get("format"), r.Header.Get("Accept")); err != nil {
+		return nil, err
+	}
+	if options.scaleTo8Bit, err = getQueryParamAsBool(r, "scale-8bit", false); err != nil {
+		return nil, err
+	}
+	if options.downsample, err = parseParamValueAsInt("downsample", r.URL.Query().Get("downsample"), 1); err != nil {
+		return nil, err
+	}
+	if options.downsample < 1 {
+		return nil, fmt.Errorf("Invalid downsample factor %d - the factor must be at least 1", options.downsample)
+	}
+	if cropParam := r.URL.Query().Get("crop"); cropParam != "" {
+		if options.crop, err = parseCropRectangle(cropParam); err != nil {
+			return nil, err
+		}
+	}
+	return options, nil
+}
+
+// tileImageFormat returns the requested format or, if no format is requested, the format most preferred by the Accept header.
+// TIFF is returned if the Accept header is not set or if it does not accept any of the supported formats.
+func tileImageFormat(formatParam, accept string) (string, error) {
+	if formatParam != "" {
+		switch format := strings.ToLower(formatParam); format {
+		case "tif", tiffImageFormat:
+			return tiffImageFormat, nil
+		case "jpg", jpegImageFormat:
+			return jpegImageFormat, nil
+		case pngImageFormat:
+			return pngImageFormat, nil
+		default:
+			return "", fmt.Errorf("Unsupported image format %s - the supported formats are tiff, png and jpeg", formatParam)
+		}
+	}
+	format := tiffImageFormat
+	var formatQuality float64
+	for _, mediaRange := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(mediaRange))
+		if err != nil {
+			continue
+		}
+		quality := 1.0
+		if q, found := params["q"]; found {
+			if quality, err = strconv.ParseFloat(q, 64); err != nil {
+				continue
+			}
+		}
+		if quality <= formatQuality {
+			continue
+		}
+		switch mediaType {
+		case "image/tiff", "image/*", "*/*":
+			format, formatQuality = tiffImageFormat, quality
+		case "image/png":
+			format, formatQuality = pngImageFormat, quality
+		case "image/jpeg":
+			format, formatQuality = jpegImageFormat, quality
+		}
+	}
+	return format, nil
+}
+
+// parseCropRectangle parses a crop rectangle given as x,y,width,height
+func parseCropRectangle(cropParam string) (*image.Rectangle, error) {
+	values := strings.Split(cropParam, ",")
+	if len(values) != 4 {
+		return nil, fmt.Errorf("Invalid crop parameter %s - expected x,y,width,height", cropParam)
+	}
+	var coords [4]int
+	for i, v := range values {
+		var err error
+		if coords[i], err = strconv.Atoi(strings.TrimSpace(v)); err != nil {
+			return nil, fmt.Errorf("Invalid crop parameter %s: %v", cropParam, err)
+		}
+	}
+	if coords[0] < 0 || coords[1] < 0 || coords[2] <= 0 || coords[3] <= 0 {
+		return nil, fmt.Errorf("Invalid crop parameter %s - the origin must not be negative and the size must be positive", cropParam)
+	}
+	crop := image.Rect(coords[0], coords[1], coords[0]+coords[2], coords[1]+coords[3])
+	return &crop, nil
+}
+
+// convertTileImage decodes the tile content, crops, downsamples and scales it to 8 bit as requested and then it encodes it
+// in the requested format. The tile's histogram scaling is used if it is known, otherwise it is computed from the converted image.
+// JPEG images are always 8 bit so 16 bit tiles converted to JPEG are scaled even if scaling was not requested.
+func convertTileImage(content []byte, tileImage *models.TemImage, options *tileImageOptions) ([]byte, error) {
+	img, err := utils.DecodeTIFF(content)
+	if err != nil {
+		return nil, fmt.Errorf("Error decoding tile %v: %v", tileImage, err)
+	}
+	if options.crop != nil {
+		cropped := options.crop.Intersect(img.Bounds())
+		if cropped.Empty() {
+			return nil, fmt.Errorf("The crop rectangle %v is outside of tile %v with the bounds %v", *options.crop, tileImage, img.Bounds())
+		}
+		img = img.(interface {
+			SubImage(r image.Rectangle) image.Image
+		}).SubImage(cropped)
+	}
+	if options.downsample > 1 {
+		img = utils.DownsampleBy(img, options.downsample)
+	}
+	if _, is16Bit := img.(*image.Gray16); options.scaleTo8Bit || (is16Bit && options.format == jpegImageFormat) {
+		var offset, scale float64
+		if tileImage.U8HistOffset != nil && tileImage.U8HistScale != nil && *tileImage.U8HistScale > 0 {
+			offset, scale = *tileImage.U8HistOffset, *tileImage.U8HistScale
+		} else {
+			offset, scale = utils.HistogramScaling(img, 0.5, 99.5)
+		}
+		img = utils.ScaleTo8Bit(img, offset, scale)
+	}
+	var buf bytes.Buffer
+	switch options.format {
+	case pngImageFormat:
+		err = png.Encode(&buf, img)
+	case jpegImageFormat:
+		err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: defaultJPEGQuality})
+	default:
+		_, err = buf.Write(utils.EncodeTIFF(img))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Error encoding tile %v as %s: %v", tileImage, options.format, err)
+	}
+	return buf.Bytes(), nil
+}
+
+// tileRepresentation identifies the representation of the tile content returned for the options; it is empty for the stored content.
+// The representation of the images scaled to 8 bit includes the histogram scaling of the tile because that may change.
+func tileRepresentation(tileImage *models.TemImage, options *tileImageOptions) string {
+	if !options.converted() {
+		return ""
+	}
+	representation := options.format
+	if (options.scaleTo8Bit || options.format == jpegImageFormat) && tileImage.U8HistOffset != nil && tileImage.U8HistScale != nil {
+		representation += fmt.Sprintf(".u8_%g_%g", *tileImage.U8HistOffset, *tileImage.U8HistScale)
+	} else if options.scaleTo8Bit {
+		representation += ".u8"
+	}
+	if options.downsample > 1 {
+		representation += fmt.Sprintf(".d%d", options.downsample)
+	}
+	if options.crop != nil {
+		representation += fmt.Sprintf(".c%d_%d_%d_%d", options.crop.Min.X, options.crop.Min.Y, options.crop.Dx(), options.crop.Dy())
+	}
+	return representation
+}
+
+// checkTileContentNotModified writes 304 (Not Modified) and returns true if the client already has the requested tile representation
+func checkTileContentNotModified(w http.ResponseWriter, r *http.Request, tileImage *models.TemImage, options *tileImageOptions) bool {
+	w.Header().Set("Vary", "Accept")
+	return checkNotModified(w, r, storedContentETag(&tileImage.TileFile, tileRepresentation(tileImage, options)))
+}
+
+// writeTileContent writes the tile content converted as requested by the options
+func writeTileContent(w http.ResponseWriter, r *http.Request, tileImage *models.TemImage, content []byte, options *tileImageOptions) {
+	if options.converted() {
+		var err error
+		if content, err = convertTileImage(content, tileImage, options); err != nil {
+			logger.Error(err)
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+	}
+	serveStoredContent(w, r, imageFormatContentTypes[options.format], tileImage.AcquiredTimestamp, content)
+}
@@ -0,0 +1,100 @@
+package service
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"imagecatcher/models"
+	"imagecatcher/utils"
+)
+
+func TestTileImageFormat(t *testing.T) {
+	testData := []struct {
+		formatParam, accept string
+		expectedFormat      string
+	}{
+		{"", "", tiffImageFormat},
+		{"PNG", "image/jpeg", pngImageFormat},
+		{"jpg", "", jpegImageFormat},
+		{"", "image/png", pngImageFormat},
+		{"", "image/tiff;q=0.5, image/jpeg;q=0.8, image/png;q=0.2", jpegImageFormat},
+		{"", "image/png, image/*;q=0.8", pngImageFormat},
+		{"", "text/html, */*;q=0.1", tiffImageFormat},
+		{"", "image/png;q=0, image/jpeg", jpegImageFormat},
+	}
+	for _, td := range testData {
+		format, err := tileImageFormat(td.formatParam, td.accept)
+		if err != nil {
+			t.Errorf("Unexpected error for format %q and accept %q: %v", td.formatParam, td.accept, err)
+		} else if format != td.expectedFormat {
+			t.Errorf("Expected %s for format %q and accept %q but got %s", td.expectedFormat, td.formatParam, td.accept, format)
+		}
+	}
+	if _, err := tileImageFormat("gif", ""); err == nil {
+		t.Error("Expected an error for an unsupported format")
+	}
+}
+
+func TestParseTileImageOptions(t *testing.T) {
+	r := httptest.NewRequest("GET", "/service/v1/tile/1/content?format=png&scale-8bit=true&downsample=4&crop=10,20,100,50", nil)
+	options, err := parseTileImageOptions(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if options.format != pngImageFormat || !options.scaleTo8Bit || options.downsample != 4 || *options.crop != image.Rect(10, 20, 110, 70) {
+		t.Errorf("Unexpected options %+v", options)
+	}
+	for _, query := range []string{"downsample=0", "downsample=x", "crop=1,2,3", "crop=1,2,0,4", "scale-8bit=maybe", "format=bmp"} {
+		if _, err = parseTileImageOptions(httptest.NewRequest("GET", "/service/v1/tile/1/content?"+query, nil)); err == nil {
+			t.Errorf("Expected an error for %s", query)
+		}
+	}
+}
+
+func TestWriteTileContent(t *testing.T) {
+	tile := image.NewGray16(image.Rect(0, 0, 8, 8))
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			tile.SetGray16(x, y, color.Gray16{Y: uint16(1000 + 10*x)})
+		}
+	}
+	content := utils.EncodeTIFF(tile)
+	offset, scale := 1000.0, 2.0
+	tileImage := &models.TemImage{ImageID: 1, U8HistOffset: &offset, U8HistScale: &scale}
+
+	w := httptest.NewRecorder()
+	writeTileContent(w, httptest.NewRequest("GET", "/service/v1/tile/1/content", nil), tileImage, content, &tileImageOptions{format: tiffImageFormat, downsample: 1})
+	if w.Header().Get("Content-Type") != "image/tiff" || !bytes.Equal(w.Body.Bytes(), content) {
+		t.Errorf("Expected the raw tile content but got %s with %d bytes", w.Header().Get("Content-Type"), w.Body.Len())
+	}
+
+	crop := image.Rect(2, 0, 6, 8)
+	w = httptest.NewRecorder()
+	writeTileContent(w, httptest.NewRequest("GET", "/service/v1/tile/1/content", nil), tileImage, content, &tileImageOptions{format: pngImageFormat, scaleTo8Bit: true, downsample: 2, crop: &crop})
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "image/png" {
+		t.Fatalf("Expected a PNG image but got %d %s: %s", w.Code, w.Header().Get("Content-Type"), w.Body.String())
+	}
+	img, err := png.Decode(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img.Bounds() != image.Rect(0, 0, 2, 4) {
+		t.Fatalf("Expected a 2x4 image but got %v", img.Bounds())
+	}
+	// the downsampled columns average the values 1020, 1030 and 1040, 1050 that are scaled as (v - 1000) * 2
+	if v0, v1 := color.GrayModel.Convert(img.At(0, 0)).(color.Gray).Y, color.GrayModel.Convert(img.At(1, 0)).(color.Gray).Y; v0 != 50 || v1 != 90 {
+		t.Errorf("Expected the pixel values 50 and 90 but got %d and %d", v0, v1)
+	}
+
+	outside := image.Rect(10, 10, 20, 20)
+	w = httptest.NewRecorder()
+	writeTileContent(w, httptest.NewRequest("GET", "/service/v1/tile/1/content", nil), tileImage, content, &tileImageOptions{format: tiffImageFormat, downsample: 1, crop: &outside})
+	if w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("Expected status %d for a crop outside of the tile but got %d", http.StatusUnprocessableEntity, w.Code)
+	}
+}
@@ -1,15 +1,17 @@
 package service
 
 import (
+	"bytes"
 	"fmt"
-	"io/ioutil"
+	"io"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
-	"unsafe"
 
 	"imagecatcher/logger"
 	"imagecatcher/models"
+	"imagecatcher/utils"
 )
 
 type tileProcessor interface {
@@ -17,17 +19,38 @@ type tileProcessor interface {
 }
 
 type tileProcessingJob struct {
+	requestID   uint64
 	acqID       uint64
 	acqMosaic   *models.TemImageMosaic
 	tileParams  TileParams
 	processor   tileProcessor
 	execCtx     ExecutionContext
-	memPtr      unsafe.Pointer
+	buffer      *utils.Buffer
 	tmpTileFile string
 }
 
+// clear releases the request buffer unless it was handed off to the content job
 func (tpj *tileProcessingJob) clear() {
-	tpj.memPtr = nil
+	tpj.buffer.Release()
+	tpj.buffer = nil
+}
+
+// contentReader returns a reader of the tile content and its size. If the content is only in the temporary tile file
+// the file is read on demand, so that the parts that are not needed are not loaded in memory; the reader must be closed.
+func (tpj *tileProcessingJob) contentReader() (io.ReaderAt, int64, func() error, error) {
+	if !tpj.tileParams.isEmpty() || tpj.tmpTileFile == "" {
+		return bytes.NewReader(tpj.tileParams.Content), int64(len(tpj.tileParams.Content)), func() error { return nil }, nil
+	}
+	tmpFile, err := os.Open(tpj.tmpTileFile)
+	if err != nil {
+		return nil, 0, nil, fmt.Errorf("Error opening the temporary tile file %s: %v", tpj.tmpTileFile, err)
+	}
+	fi, err := tmpFile.Stat()
+	if err != nil {
+		tmpFile.Close()
+		return nil, 0, nil, fmt.Errorf("Error reading the size of the temporary tile file %s: %v", tpj.tmpTileFile, err)
+	}
+	return tmpFile, fi.Size(), tmpFile.Close, nil
 }
 
 type tileProcessingResult struct {
@@ -43,6 +66,7 @@ type tileProcessingDispatcher struct {
 	maxWorkers int
 	jobQueue   chan *tileProcessingJob
 	quit       chan struct{}
+	stopped    chan struct{}
 }
 
 // tileProcessingWorker subscribes to a pool of workers by putting its own
@@ -61,6 +85,7 @@ func newTileProcessingDispatcher(jobQueue chan *tileProcessingJob, maxWorkers in
 		maxWorkers: maxWorkers,
 		workerPool: workerPool,
 		quit:       make(chan struct{}),
+		stopped:    make(chan struct{}),
 	}
 }
 
@@ -73,34 +98,45 @@ func (d *tileProcessingDispatcher) run() {
 	go d.dispatch()
 }
 
-// stop the dispatcher
-func (d *tileProcessingDispatcher) stop() {
-	go func() {
-		var quit struct{}
-		d.quit <- quit
-	}()
+// stop the dispatcher - the returned channel is closed once all workers finished their current jobs.
+// The jobs that were not dispatched yet are left in the job queue.
+func (d *tileProcessingDispatcher) stop() <-chan struct{} {
+	close(d.quit)
+	return d.stopped
 }
 
 // dispatch is the method that looks up an available worker and
 // then it transfers the job to that workers queue
 func (d *tileProcessingDispatcher) dispatch() {
+	defer close(d.stopped)
 	for {
 		select {
 		case workerJobQueue := <-d.workerPool:
-			job := <-d.jobQueue
-			execTime := time.Since(job.execCtx.StartTime)
-			logger.Debugf("Dispatching tile %d %s (%d): %v",
-				job.acqID, job.tileParams.Name, job.tileParams.ContentLen, execTime)
-			workerJobQueue <- job
-		case <-d.quit:
-			for workerJobQueue := range d.workerPool {
-				close(workerJobQueue)
+			select {
+			case job := <-d.jobQueue:
+				execTime := time.Since(job.execCtx.StartTime)
+				logger.Debugf("Dispatching tile %d %s (%d): %v",
+					job.acqID, job.tileParams.Name, job.tileParams.ContentLen, execTime)
+				workerJobQueue <- job
+			case <-d.quit:
+				d.workerPool <- workerJobQueue
+				d.stopWorkers()
+				return
 			}
+		case <-d.quit:
+			d.stopWorkers()
 			return
 		}
 	}
 }
 
+// stopWorkers waits for every worker to become available and then closes its queue
+func (d *tileProcessingDispatcher) stopWorkers() {
+	for i := 0; i < d.maxWorkers; i++ {
+		close(<-d.workerPool)
+	}
+}
+
 // newTileProcessingWorker creates a worker and gives it a pool to "subscribe"
 func newTileProcessingWorker(workerPool chan chan *tileProcessingJob) *tileProcessingWorker {
 	return &tileProcessingWorker{
@@ -187,6 +223,10 @@ func saveTileContent(dataDir string) tileProcessDecorator {
 		return tileProcessorFunc(func(job *tileProcessingJob) tileProcessingResult {
 			var err error
 			fParams := &job.tileParams.FileParams
+			if job.tmpTileFile != "" {
+				// the content was streamed to the temporary file while the request was read
+				return p.process(job)
+			}
 			if job.tmpTileFile, err = createTmpDataFile(dataDir, job.acqID, fParams, job.execCtx); err != nil {
 				return tileProcessingResult{nil, fmt.Errorf("Error creating the temporary file for %d:%s - %v", job.acqID, fParams.Name, err)}
 			}
@@ -195,17 +235,91 @@ func saveTileContent(dataDir string) tileProcessDecorator {
 	}
 }
 
+// tileValidation holds the checks of the tile images against the camera configuration
+type tileValidation struct {
+	// reject the tiles that fail the validation; otherwise they are only flagged in the log
+	reject bool
+	// bitsPerSample is the expected bit depth of the tiles; 0 if not checked
+	bitsPerSample int
+}
+
+// check returns an error describing all mismatches between the tile image and the camera configuration.
+// The image size is not checked if the camera configuration does not have it.
+func (v *tileValidation) check(info *utils.TIFFInfo, cameraConfig *models.TemCameraConfiguration) error {
+	var mismatches []string
+	if cameraConfig != nil && cameraConfig.Width > 0 && cameraConfig.Height > 0 &&
+		(info.Width != cameraConfig.Width || info.Height != cameraConfig.Height) {
+		mismatches = append(mismatches, fmt.Sprintf("the image size %dx%d does not match the camera %d size %dx%d",
+			info.Width, info.Height, cameraConfig.Camera, cameraConfig.Width, cameraConfig.Height))
+	}
+	if v.bitsPerSample > 0 && info.BitsPerSample != v.bitsPerSample {
+		mismatches = append(mismatches, fmt.Sprintf("the image has %d bits per sample instead of %d", info.BitsPerSample, v.bitsPerSample))
+	}
+	if info.SamplesPerPixel != 1 {
+		mismatches = append(mismatches, fmt.Sprintf("the image has %d samples per pixel instead of 1", info.SamplesPerPixel))
+	}
+	if info.Pages != 1 {
+		mismatches = append(mismatches, fmt.Sprintf("the image has %d pages instead of 1", info.Pages))
+	}
+	if len(mismatches) > 0 {
+		return fmt.Errorf("%s", strings.Join(mismatches, ", "))
+	}
+	return nil
+}
+
+// validateTileImage checks the tile image before the tile metadata or the temporary tile file are persisted.
+// Invalid tiles are either rejected with ErrCodeInvalidTileImage, in which case nothing is stored and a streamed
+// temporary file is removed, or only flagged in the log. The image size is not checked if the camera configuration cannot be found.
+func validateTileImage(validation *tileValidation, cameraConfiguration func(job *tileProcessingJob) (*models.TemCameraConfiguration, error)) tileProcessDecorator {
+	return func(p tileProcessor) tileProcessor {
+		if validation == nil {
+			return p
+		}
+		return tileProcessorFunc(func(job *tileProcessingJob) tileProcessingResult {
+			src, size, closeContent, err := job.contentReader()
+			if err != nil {
+				return tileProcessingResult{nil, err}
+			}
+			// only the header and the image directories are read
+			info, err := utils.ReadTIFFInfoAt(src, size)
+			closeContent()
+			if err == nil {
+				cameraConfig, cameraErr := cameraConfiguration(job)
+				if cameraErr != nil {
+					logger.Errorf("Error retrieving the camera configuration for validating %d:%s: %v", job.acqID, job.tileParams.Name, cameraErr)
+				}
+				err = validation.check(info, cameraConfig)
+			}
+			if err == nil {
+				return p.process(job)
+			}
+			if !validation.reject {
+				logger.Errorf("WARNING: %s %d:%s: %v", ErrCodeInvalidTileImage, job.acqID, job.tileParams.Name, err)
+				return p.process(job)
+			}
+			if job.tmpTileFile != "" {
+				removeSpooledFile(job.tmpTileFile)
+				job.tmpTileFile = ""
+			}
+			return tileProcessingResult{nil, &CaptureError{
+				Code: ErrCodeInvalidTileImage,
+				Err:  fmt.Errorf("Invalid tile image %d:%s: %v", job.acqID, job.tileParams.Name, err),
+			}}
+		})
+	}
+}
+
 func createTmpDataFile(dataDir string, acqID uint64, f *FileParams, execCtx ExecutionContext) (string, error) {
 	startTime := time.Now()
 
-	fullFilename := filepath.Join(dataDir, fmt.Sprintf("%d", acqID), f.Name)
-
-	parentDir := filepath.Dir(fullFilename)
-	err := os.MkdirAll(parentDir, os.ModePerm)
+	fullFilename, file, err := openTmpDataFile(dataDir, acqID, f)
 	if err != nil {
-		return "", fmt.Errorf("Error creating directory %s for writing temporary file to disc: %v", parentDir, err)
+		return fullFilename, err
+	}
+	_, err = file.Write(f.Content)
+	if cerr := file.Close(); err == nil {
+		err = cerr
 	}
-	err = ioutil.WriteFile(fullFilename, f.Content, os.ModePerm)
 	if err != nil {
 		return fullFilename, fmt.Errorf("Error writing temporary file %s to disc: %v", fullFilename, err)
 	}
@@ -214,6 +328,22 @@ func createTmpDataFile(dataDir string, acqID uint64, f *FileParams, execCtx Exec
 	return fullFilename, err
 }
 
+// openTmpDataFile creates the temporary file for the tile content
+func openTmpDataFile(dataDir string, acqID uint64, f *FileParams) (string, *os.File, error) {
+	fullFilename := filepath.Join(dataDir, fmt.Sprintf("%d", acqID), f.Name)
+
+	parentDir := filepath.Dir(fullFilename)
+	err := os.MkdirAll(parentDir, os.ModePerm)
+	if err != nil {
+		return "", nil, fmt.Errorf("Error creating directory %s for writing temporary file to disc: %v", parentDir, err)
+	}
+	file, err := os.OpenFile(fullFilename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, os.ModePerm)
+	if err != nil {
+		return fullFilename, nil, fmt.Errorf("Error creating temporary file %s: %v", fullFilename, err)
+	}
+	return fullFilename, file, nil
+}
+
 func decorateTileProcessor(p tileProcessor, decorators ...tileProcessDecorator) tileProcessor {
 	decorated := p
 	for _, decorate := range decorators {
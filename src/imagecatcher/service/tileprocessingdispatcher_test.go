@@ -0,0 +1,75 @@
+package service
+
+import (
+	"image"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"imagecatcher/models"
+	"imagecatcher/utils"
+)
+
+func TestValidateTileImage(t *testing.T) {
+	cameraConfig := &models.TemCameraConfiguration{Camera: 1, Width: 8, Height: 4}
+	cameraConfiguration := func(job *tileProcessingJob) (*models.TemCameraConfiguration, error) {
+		return cameraConfig, nil
+	}
+	var storedTiles int
+	storeTile := tileProcessorFunc(func(job *tileProcessingJob) tileProcessingResult {
+		storedTiles++
+		return tileProcessingResult{&models.TemImage{ImageID: 1, Configuration: cameraConfig}, nil}
+	})
+	rejectInvalid := decorateTileProcessor(storeTile, validateTileImage(&tileValidation{reject: true, bitsPerSample: 16}, cameraConfiguration))
+	flagInvalid := decorateTileProcessor(storeTile, validateTileImage(&tileValidation{bitsPerSample: 16}, cameraConfiguration))
+
+	testData := []struct {
+		name    string
+		content []byte
+		valid   bool
+	}{
+		{"valid", utils.EncodeTIFF(image.NewGray16(image.Rect(0, 0, 8, 4))), true},
+		{"wrong size", utils.EncodeTIFF(image.NewGray16(image.Rect(0, 0, 4, 8))), false},
+		{"wrong bit depth", utils.EncodeTIFF(image.NewGray(image.Rect(0, 0, 8, 4))), false},
+		{"not a tiff", []byte("not a tiff"), false},
+	}
+	for _, td := range testData {
+		job := &tileProcessingJob{acqID: 1, tileParams: TileParams{FileParams: FileParams{Name: "col0001_row0001_cam1.tif", Content: td.content}}}
+		storedTiles = 0
+		res := rejectInvalid.process(job)
+		if td.valid && (res.err != nil || storedTiles != 1) {
+			t.Errorf("Expected the %s tile to be accepted but got %v", td.name, res.err)
+		} else if !td.valid && (captureErrorCode(res.err) != ErrCodeInvalidTileImage || storedTiles != 0) {
+			t.Errorf("Expected the %s tile to be rejected with %s without storing it but got %v", td.name, ErrCodeInvalidTileImage, res.err)
+		}
+		if res = flagInvalid.process(job); res.err != nil || res.tileImage == nil {
+			t.Errorf("Expected the %s tile to be only flagged but got %v", td.name, res.err)
+		}
+	}
+
+	// the size is not checked if the camera configuration does not have it
+	cameraConfig.Width, cameraConfig.Height = 0, 0
+	job := &tileProcessingJob{acqID: 1, tileParams: TileParams{FileParams: FileParams{Name: "col0001_row0002_cam1.tif", Content: testData[1].content}}}
+	if res := rejectInvalid.process(job); res.err != nil {
+		t.Errorf("Expected the tile to be accepted without a camera size but got %v", res.err)
+	}
+	if p := decorateTileProcessor(storeTile, validateTileImage(nil, cameraConfiguration)); p.process(job).err != nil {
+		t.Error("Expected no validation if the tile validation is off")
+	}
+
+	// the temporary file of a rejected streamed tile is removed
+	tmpTileFile, err := ioutil.TempFile("", "col0001_row0003_cam1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpTileFile.Write(testData[2].content)
+	tmpTileFile.Close()
+	defer os.Remove(tmpTileFile.Name())
+	job = &tileProcessingJob{acqID: 1, tmpTileFile: tmpTileFile.Name(), tileParams: TileParams{FileParams: FileParams{Name: "col0001_row0003_cam1.tif"}}}
+	if res := rejectInvalid.process(job); captureErrorCode(res.err) != ErrCodeInvalidTileImage {
+		t.Errorf("Expected the streamed tile to be rejected with %s but got %v", ErrCodeInvalidTileImage, res.err)
+	}
+	if _, err = os.Stat(tmpTileFile.Name()); !os.IsNotExist(err) || job.tmpTileFile != "" {
+		t.Errorf("Expected the temporary file %s of the rejected tile to be removed: %v", tmpTileFile.Name(), err)
+	}
+}
@@ -1,12 +1,14 @@
 package service
 
 import (
+	"errors"
 	"fmt"
 	"time"
 
 	"imagecatcher/config"
 	"imagecatcher/logger"
 	"imagecatcher/models"
+	"imagecatcher/utils"
 )
 
 // QueueStatus type for queue status
@@ -37,6 +39,9 @@ func (qs QueueStatus) String() string {
 
 const defaultRetries int = 3
 
+// defaultMaxInFlightTileBytes is the default limit of the memory used by the tile requests being processed
+const defaultMaxInFlightTileBytes int64 = 1 << 30
+
 // TileRequestHandler request handler
 type TileRequestHandler struct {
 	imageCatcher                ImageCatcherService
@@ -52,8 +57,22 @@ type TileRequestHandler struct {
 	contentProcessedResBuffer   chan contentProcessingResult
 	contentProcessingErrors     chan string
 	waitTimeout                 time.Duration
+	storageRetryAfter           time.Duration
+	backpressure                backpressureMonitor
+	spool                       *contentSpool
+	deadLetters                 *deadLetterStore
+	contentRetries              int
+	contentRetryBackoff         retryBackoff
+	tileBuffers                 *utils.BufferPool
+	tileBufferWaitTimeout       time.Duration
 	tileProcessor               tileProcessor
 	contentProcessor            contentProcessor
+	// tileHistogram is nil if the tile histograms are not computed
+	tileHistogram *histogramPercentiles
+	// tileValidation is nil if the tile images are not validated
+	tileValidation *tileValidation
+	// mipmapper is nil if the tile mipmaps are not generated
+	mipmapper *tileMipmapper
 }
 
 // NewTileRequestHandler create a new instance of a TileRequestHandler
@@ -68,6 +87,7 @@ func NewTileRequestHandler(s ImageCatcherService, messageNotifier MessageNotifie
 		contentProcessor: cp,
 	}
 	th.initialize()
+	cp.acquireBuffer = th.acquireTileBuffer
 	return th
 }
 
@@ -82,6 +102,35 @@ func (th *TileRequestHandler) initialize() {
 		logger.Errorf("Invalid timeout value %s - will default to 1s: %v", timeout, err)
 		th.waitTimeout = time.Duration(1 * time.Second) // default to 1s
 	}
+	storageRetryAfter := th.config.GetStringProperty("STORAGE_RETRY_AFTER", "5s")
+	if th.storageRetryAfter, err = time.ParseDuration(storageRetryAfter); err != nil {
+		logger.Errorf("Invalid storage retry after value %s - will default to 5s: %v", storageRetryAfter, err)
+		th.storageRetryAfter = time.Duration(5 * time.Second) // default to 5s
+	}
+	th.contentRetries = th.config.GetIntProperty("CONTENT_STORE_RETRIES", defaultRetries)
+	th.contentRetryBackoff = retryBackoff{
+		initial: th.getDurationProperty("CONTENT_STORE_RETRY_BACKOFF", "100ms"),
+		max:     th.getDurationProperty("CONTENT_STORE_MAX_RETRY_BACKOFF", "5s"),
+	}
+	th.tileBuffers = utils.NewBufferPool(th.config.GetInt64Property("MAX_INFLIGHT_TILE_BYTES", defaultMaxInFlightTileBytes))
+	th.tileBufferWaitTimeout = th.getDurationProperty("TILE_BUFFER_WAIT_TIMEOUT", "1s")
+	if th.config.GetBoolProperty("COMPUTE_TILE_HISTOGRAM", true) {
+		th.tileHistogram = &histogramPercentiles{
+			low:  th.config.GetFloat64Property("TILE_HISTOGRAM_LOW_PERCENTILE", 0.5),
+			high: th.config.GetFloat64Property("TILE_HISTOGRAM_HIGH_PERCENTILE", 99.5),
+		}
+	}
+	th.mipmapper = newTileMipmapper(th.imageCatcher, th.config)
+	switch tileValidationMode := th.config.GetStringProperty("TILE_VALIDATION", "off"); tileValidationMode {
+	case "off":
+	case "flag", "reject":
+		th.tileValidation = &tileValidation{
+			reject:        tileValidationMode == "reject",
+			bitsPerSample: th.config.GetIntProperty("TILE_VALIDATION_BITS_PER_SAMPLE", 16),
+		}
+	default:
+		logger.Errorf("Invalid TILE_VALIDATION value %s - the tile images will not be validated", tileValidationMode)
+	}
 	if th.tileProcessingWorkers > 1 {
 		th.tileProcessingJobQueue = make(chan *tileProcessingJob, tileProcessingJobQueueSize)
 		th.tileProcessingDispatcher = newTileProcessingDispatcher(th.tileProcessingJobQueue, th.tileProcessingWorkers)
@@ -104,6 +153,30 @@ func (th *TileRequestHandler) initialize() {
 		th.contentProcessingDispatcher.run()
 	}
 	th.contentProcessingErrors = make(chan string, contentProcessingJobQueueSize)
+	if th.spool, err = openContentSpool(th.tmpDataDir, th.config.GetBoolProperty("SPOOL_SYNC", true)); err != nil {
+		logger.Errorf("Error opening the content spool - the spooled tiles will not be recovered after a restart: %v", err)
+	}
+	th.deadLetters = newDeadLetterStore(th.tmpDataDir)
+}
+
+func (th *TileRequestHandler) getDurationProperty(name, defaultValue string) time.Duration {
+	value := th.config.GetStringProperty(name, defaultValue)
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		logger.Errorf("Invalid %s value %s - will default to %s: %v", name, value, defaultValue, err)
+		d, _ = time.ParseDuration(defaultValue)
+	}
+	return d
+}
+
+// acquireTileBuffer returns a buffer for the tile request content. If the in-flight tile bytes stay above
+// MAX_INFLIGHT_TILE_BYTES for longer than TILE_BUFFER_WAIT_TIMEOUT the request is rejected so that the client backs off.
+func (th *TileRequestHandler) acquireTileBuffer(size int) (*utils.Buffer, error) {
+	buffer, err := th.tileBuffers.Acquire(size, th.tileBufferWaitTimeout)
+	if err != nil {
+		return nil, &CaptureError{Code: ErrCodeQueueTimeout, Err: err}
+	}
+	return buffer, nil
 }
 
 func (th *TileRequestHandler) getProcessingQueuesStatus() (systemStatus, contentQueueStatus, tileQueueStatus QueueStatus) {
@@ -129,7 +202,7 @@ func (th *TileRequestHandler) SendMessage(message string, force bool) {
 func (th *TileRequestHandler) checkForContentErrors() error {
 	select {
 	case errmessage := <-th.contentProcessingErrors:
-		return fmt.Errorf(errmessage)
+		return &CaptureError{Code: ErrCodeContentStore, Err: errors.New(errmessage)}
 	default:
 		return nil
 	}
@@ -142,6 +215,7 @@ func (th *TileRequestHandler) startTileProcessingJob(job *tileProcessingJob) (*m
 	resultChan := make(chan tileProcessingResult, 1)
 	job.processor = decorateTileProcessor(th.tileProcessor,
 		saveTileContent(th.tmpDataDir),
+		validateTileImage(th.tileValidation, th.tileCameraConfiguration),
 		concurrentTileProcessing(resultChan),
 		errMonitoredTileProcessing(th.messageNotifier),
 		loggedTileProcessing(startTime),
@@ -154,24 +228,49 @@ func (th *TileRequestHandler) startTileProcessingJob(job *tileProcessingJob) (*m
 		job.processor.process(job)
 	}
 	tileResult := <-resultChan
+	th.backpressure.recordTileLatency(time.Since(startTime))
 	if resultErr = tileResult.err; resultErr != nil {
 		// if tile processing failed don't go further
 		return tileResult.tileImage, resultErr
 	}
-	th.startStoreFileContent(&contentProcessingJob{
+	// the content job gets its own copy of the file parameters because the content workers update them
+	// while the tile job may still be logged by the tile worker
+	fileParams := job.tileParams.FileParams
+	contentJob := &contentProcessingJob{
 		tmpTileFile: job.tmpTileFile,
 		acqID:       job.acqID,
-		fileParams:  &job.tileParams.FileParams,
+		fileParams:  &fileParams,
 		tileImage:   tileResult.tileImage,
 		execCtx:     job.execCtx,
-		memPtr:      job.memPtr,
-	})
+		buffer:      job.buffer,
+	}
+	// the content job owns the request buffer from now on
+	job.buffer = nil
+	th.spoolContentJob(contentJob)
+	contentStoreErr := th.startStoreFileContent(contentJob)
+	// always drain the pending content errors but report the error of the current job first since it is better classified
 	if contentProcessingErr := th.checkForContentErrors(); contentProcessingErr != nil {
 		resultErr = contentProcessingErr
 	}
+	if contentStoreErr != nil {
+		resultErr = newCaptureError(ErrCodeContentStore, contentStoreErr)
+	}
 	return tileResult.tileImage, resultErr
 }
 
+// tileCameraConfiguration looks up the camera configuration of a tile that is not persisted yet.
+// The mosaic is kept in the job so that it is not retrieved again when the tile is stored.
+func (th *TileRequestHandler) tileCameraConfiguration(job *tileProcessingJob) (*models.TemCameraConfiguration, error) {
+	if job.acqMosaic == nil {
+		acqMosaic, err := th.imageCatcher.GetMosaic(job.acqID)
+		if err != nil {
+			return nil, err
+		}
+		job.acqMosaic = acqMosaic
+	}
+	return th.imageCatcher.GetCameraConfiguration(job.acqMosaic, job.tileParams.Camera)
+}
+
 func (th *TileRequestHandler) enqueueTileProcessingJob(job *tileProcessingJob) error {
 	// we do that in a select so that we know when the channel becomes blocked
 	select {
@@ -191,7 +290,10 @@ func (th *TileRequestHandler) enqueueTileProcessingJob(job *tileProcessingJob) e
 		return nil
 	case <-time.After(th.waitTimeout):
 		// a timeout occurred - break the circuit
-		return fmt.Errorf("Timeout waiting to enqueue the tile job for: %d:%s", job.acqID, job.tileParams.Name)
+		return &CaptureError{
+			Code: ErrCodeQueueTimeout,
+			Err:  fmt.Errorf("Timeout waiting to enqueue the tile job for: %d:%s", job.acqID, job.tileParams.Name),
+		}
 	}
 }
 
@@ -214,40 +316,64 @@ type tileProcessorImpl struct {
 }
 
 func (p *tileProcessorImpl) process(job *tileProcessingJob) tileProcessingResult {
-	acqMosaic, err := p.service.GetMosaic(job.acqID)
-	if err != nil {
-		return tileProcessingResult{nil, err}
+	if job.acqMosaic == nil {
+		// the mosaic may have been retrieved already for validating the tile
+		acqMosaic, err := p.service.GetMosaic(job.acqID)
+		if err != nil {
+			return tileProcessingResult{nil, newCaptureError(ErrCodeMetadataStore, err)}
+		}
+		job.acqMosaic = acqMosaic
 	}
-	job.acqMosaic = acqMosaic
 	tileImage, err := p.service.StoreTile(job.acqMosaic, &job.tileParams)
-	return tileProcessingResult{tileImage, err}
+	return tileProcessingResult{tileImage, newCaptureError(ErrCodeMetadataStore, err)}
 }
 
 func (th *TileRequestHandler) startStoreFileContent(job *contentProcessingJob) error {
 	var err error
-	startTime := time.Now()
-	job.processor = decorateContentProcessor(th.contentProcessor,
+	job.processor = th.newContentProcessor(time.Now())
+	if th.contentProcessingWorkers > 1 {
+		if err = th.enqueueContentProcessingJob(job); err != nil {
+			th.SendMessage(err.Error(), false)
+			job.clear()
+		}
+		return err
+	}
+	// the content processing is synchronous
+	result := job.processor.process(job)
+	return result.err
+}
+
+// resubmitContentJob processes a content job that does not come from a client request,
+// so unlike startStoreFileContent it waits as long as needed for room in the queue
+func (th *TileRequestHandler) resubmitContentJob(job *contentProcessingJob) {
+	job.resubmitted = true
+	job.processor = th.newContentProcessor(time.Now())
+	if th.contentProcessingWorkers > 1 {
+		th.contentProcessingJobQueue <- job
+		return
+	}
+	job.processor.process(job)
+}
+
+func (th *TileRequestHandler) newContentProcessor(startTime time.Time) contentProcessor {
+	return decorateContentProcessor(th.contentProcessor,
+		computeTileHistogram(th.tileHistogram, th.acquireTileBuffer),
 		updateTileMetadata(func(ti *models.TemImage) error {
 			ti.SetAcquiredTimestamp(time.Now()) // update the acquired timestamp
 			return th.imageCatcher.UpdateTile(ti)
 		}),
 		verifyContentProcessing(th.imageCatcher.VerifyAcquisitionFile),
-		retryContentProcessing(defaultRetries),
+		retryContentProcessing(th.contentRetries, th.contentRetryBackoff),
+		generateTileMipmaps(th.mipmapper),
+		deadLetterContentProcessing(th.deadLetters),
+		monitoredContentProcessing(&th.backpressure),
 		concurrentContentProcessing(th.contentProcessedResBuffer),
 		errMonitoredContentProcessing(th, th.messageNotifier),
 		loggedContentProcessing(startTime),
+		completeSpooledContent(th.spool),
 		removeTemporaryTileFile(),
 		clearContentProcessing(),
 	)
-	if th.contentProcessingWorkers > 1 {
-		if err = th.enqueueContentProcessingJob(job); err != nil {
-			th.SendMessage(err.Error(), false)
-		}
-		return err
-	}
-	// the content processing is synchronous
-	result := job.processor.process(job)
-	return result.err
 }
 
 func (th *TileRequestHandler) enqueueContentProcessingJob(job *contentProcessingJob) error {
@@ -270,16 +396,25 @@ func (th *TileRequestHandler) enqueueContentProcessingJob(job *contentProcessing
 		return nil
 	case <-time.After(th.waitTimeout):
 		// a timeout occurred - break the circuit
-		return fmt.Errorf("Timeout waiting to enqueue the content processing job for: %d:%s", job.acqID, job.fileParams.Name)
+		return &CaptureError{
+			Code: ErrCodeQueueTimeout,
+			Err:  fmt.Errorf("Timeout waiting to enqueue the content processing job for: %d:%s", job.acqID, job.fileParams.Name),
+		}
 	}
 }
 
 type contentProcessorImpl struct {
 	service ImageCatcherService
+	// acquireBuffer provides the buffers for the content of the spooled tiles
+	acquireBuffer func(size int) (*utils.Buffer, error)
 }
 
 func (p *contentProcessorImpl) process(job *contentProcessingJob) contentProcessingResult {
 	fObj := job.getTileFile()
+	// the content of a streamed tile is only in the temporary file
+	if err := job.loadSpooledContent(p.acquireBuffer); err != nil {
+		return contentProcessingResult{fObj, err}
+	}
 	err := p.service.StoreAcquisitionFile(job.getTileMosaic(), job.fileParams, fObj)
 	return contentProcessingResult{fObj, err}
 }
@@ -0,0 +1,142 @@
+package service
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"imagecatcher/logger"
+	"imagecatcher/models"
+)
+
+// maxTimingTextValue is the maximum length of a recorded value that is not a number
+const maxTimingTextValue = 255
+
+// timingCameraColumnRegexp matches the per camera columns of a timing file, e.g. "Cam 0 Col" or "Cam 2 Exposure"
+var timingCameraColumnRegexp = regexp.MustCompile("(?i)^cam\\s*(\\d+)\\s+(.+)$")
+
+type timingColumn struct {
+	index   int
+	camera  int
+	measure string
+}
+
+// parseTimingFile parses a CSV timing file in which every record is an acquisition step. The tile acquired by each camera
+// at a step comes from the "Cam N Col" and "Cam N Row" columns, the other "Cam N ..." columns are values for camera N
+// and all remaining columns are values for all cameras. The step is the value of the "Step" column or the record index,
+// and the frame is the value of the "Frame" column or -1 for stable tiles.
+func parseTimingFile(content []byte, source string) ([]models.TimingStep, []models.TimingValue, error) {
+	csvReader := csv.NewReader(bytes.NewReader(content))
+	csvReader.LazyQuotes = true
+	csvReader.TrimLeadingSpace = true
+	csvReader.FieldsPerRecord = -1
+	csvRecords, err := csvReader.ReadAll()
+	if err != nil {
+		return nil, nil, fmt.Errorf("Error parsing the %s file: %v", source, err)
+	}
+	if len(csvRecords) == 0 {
+		return nil, nil, nil
+	}
+	stepIndex, frameIndex := -1, -1
+	colIndexes := make(map[int]int)
+	rowIndexes := make(map[int]int)
+	var cameras []int
+	var valueColumns []timingColumn
+	for i, h := range csvRecords[0] {
+		h = strings.TrimSpace(h)
+		if h == "" {
+			continue
+		}
+		if matches := timingCameraColumnRegexp.FindStringSubmatch(h); matches != nil {
+			camera, _ := strconv.Atoi(matches[1])
+			switch strings.ToLower(matches[2]) {
+			case "col":
+				if _, found := rowIndexes[camera]; !found {
+					cameras = append(cameras, camera)
+				}
+				colIndexes[camera] = i
+			case "row":
+				if _, found := colIndexes[camera]; !found {
+					cameras = append(cameras, camera)
+				}
+				rowIndexes[camera] = i
+			default:
+				valueColumns = append(valueColumns, timingColumn{i, camera, matches[2]})
+			}
+			continue
+		}
+		switch strings.ToLower(h) {
+		case "step":
+			stepIndex = i
+		case "frame":
+			frameIndex = i
+		default:
+			valueColumns = append(valueColumns, timingColumn{i, -1, h})
+		}
+	}
+	field := func(r []string, i int) string {
+		if i < 0 || i >= len(r) {
+			return ""
+		}
+		return strings.TrimSpace(r[i])
+	}
+	var steps []models.TimingStep
+	var values []models.TimingValue
+	for ri, r := range csvRecords[1:] {
+		if len(r) == 1 && strings.TrimSpace(r[0]) == "" {
+			continue
+		}
+		step := ri
+		if stepValue := field(r, stepIndex); stepValue != "" {
+			if step, err = strconv.Atoi(stepValue); err != nil {
+				return nil, nil, fmt.Errorf("Error parsing the %s file: invalid step %s in %v", source, stepValue, r)
+			}
+		}
+		frame := -1
+		if frameValue := field(r, frameIndex); frameValue != "" {
+			if frame, err = strconv.Atoi(frameValue); err != nil {
+				return nil, nil, fmt.Errorf("Error parsing the %s file: invalid frame %s in %v", source, frameValue, r)
+			}
+		}
+		for _, camera := range cameras {
+			colIndex, hasCol := colIndexes[camera]
+			rowIndex, hasRow := rowIndexes[camera]
+			if !hasCol || !hasRow {
+				continue
+			}
+			colValue := field(r, colIndex)
+			rowValue := field(r, rowIndex)
+			if colValue == "" || rowValue == "" {
+				// the camera did not acquire a tile at this step
+				continue
+			}
+			col, colErr := strconv.Atoi(colValue)
+			row, rowErr := strconv.Atoi(rowValue)
+			if colErr != nil || rowErr != nil {
+				logger.Errorf("WARNING: Invalid camera %d tile position %s, %s in %v", camera, colValue, rowValue, r)
+				continue
+			}
+			steps = append(steps, models.TimingStep{Step: step, Camera: camera, Col: col, Row: row, Frame: frame})
+		}
+		for _, c := range valueColumns {
+			fieldValue := field(r, c.index)
+			if fieldValue == "" {
+				continue
+			}
+			v := models.TimingValue{Source: source, Measure: c.measure, Step: step, Camera: c.camera}
+			if f, err := strconv.ParseFloat(fieldValue, 64); err == nil && !math.IsNaN(f) && !math.IsInf(f, 0) {
+				v.Value = &f
+			} else if len(fieldValue) > maxTimingTextValue {
+				v.TextValue = fieldValue[:maxTimingTextValue]
+			} else {
+				v.TextValue = fieldValue
+			}
+			values = append(values, v)
+		}
+	}
+	return steps, values, nil
+}
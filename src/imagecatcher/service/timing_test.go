@@ -0,0 +1,70 @@
+package service
+
+import (
+	"reflect"
+	"testing"
+
+	"imagecatcher/models"
+)
+
+func TestParseTimingFile(t *testing.T) {
+	content := "Time, Cam 0 Col, Cam 0 Row, Cam 1 Col, Cam 1 Row, Cam 1 Exposure, Stage move\n" +
+		"10:15:32.123, 1, 2, 3, 4, 12.5, 220\n" +
+		"10:15:33.001, 5, 6, , , , NaN\n" +
+		"10:15:34.456, x, 8, 9, 10, 13,\n"
+	steps, values, err := parseTimingFile([]byte(content), "DAQ timing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedSteps := []models.TimingStep{
+		{Step: 0, Camera: 0, Col: 1, Row: 2, Frame: -1},
+		{Step: 0, Camera: 1, Col: 3, Row: 4, Frame: -1},
+		{Step: 1, Camera: 0, Col: 5, Row: 6, Frame: -1},
+		{Step: 2, Camera: 1, Col: 9, Row: 10, Frame: -1},
+	}
+	if !reflect.DeepEqual(steps, expectedSteps) {
+		t.Errorf("Expected steps %v but got %v", expectedSteps, steps)
+	}
+	type expectedValue struct {
+		step, camera int
+		measure      string
+		value        float64
+		textValue    string
+	}
+	expectedValues := []expectedValue{
+		{0, -1, "Time", 0, "10:15:32.123"},
+		{0, 1, "Exposure", 12.5, ""},
+		{0, -1, "Stage move", 220, ""},
+		{1, -1, "Time", 0, "10:15:33.001"},
+		{1, -1, "Stage move", 0, "NaN"},
+		{2, -1, "Time", 0, "10:15:34.456"},
+		{2, 1, "Exposure", 13, ""},
+	}
+	if len(values) != len(expectedValues) {
+		t.Fatalf("Expected %d values but got %d", len(expectedValues), len(values))
+	}
+	for i, e := range expectedValues {
+		v := values[i]
+		if v.Source != "DAQ timing" || v.Step != e.step || v.Camera != e.camera || v.Measure != e.measure || v.TextValue != e.textValue ||
+			e.textValue == "" && (v.Value == nil || *v.Value != e.value) || e.textValue != "" && v.Value != nil {
+			t.Errorf("Expected value %d to be %+v but got %+v", i, e, v)
+		}
+	}
+}
+
+func TestParseTimingFileWithSteps(t *testing.T) {
+	content := "Step,Frame,Elapsed\n7,3,1.5\n8,,2\n"
+	steps, values, err := parseTimingFile([]byte(content), "Controller elapsed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(steps) != 0 {
+		t.Errorf("Expected no tile positions but got %v", steps)
+	}
+	if len(values) != 2 || values[0].Step != 7 || *values[0].Value != 1.5 || values[1].Step != 8 || *values[1].Value != 2 {
+		t.Errorf("Unexpected values %+v", values)
+	}
+	if _, _, err = parseTimingFile([]byte("Step,Elapsed\nfirst,1\n"), "Controller elapsed"); err == nil {
+		t.Error("Expected an error for an invalid step")
+	}
+}
@@ -0,0 +1,364 @@
+package service
+
+import (
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/satori/go.uuid"
+
+	"imagecatcher/checksum"
+	"imagecatcher/config"
+	"imagecatcher/logger"
+	"imagecatcher/models"
+)
+
+// Verification job states
+const (
+	verificationRunning   = "running"
+	verificationCompleted = "completed"
+	verificationFailed    = "failed"
+)
+
+// Verification results of a stored file
+const (
+	fileVerified   = "verified"
+	fileMissing    = "missing"
+	fileMismatched = "mismatched"
+	fileNoJfsPath  = "no_jfs_path"
+	fileNoChecksum = "no_checksum"
+	fileUnverified = "unverified"
+)
+
+const (
+	verificationPageSize = 1000
+	// maxFinishedVerifications is the number of finished jobs kept for reporting
+	maxFinishedVerifications = 50
+)
+
+// ErrTooManyVerifications is returned when the maximum number of verification jobs are already running
+var ErrTooManyVerifications = errors.New("Too many verification jobs running")
+
+// VerificationProgress verification job progress
+type VerificationProgress struct {
+	JobID        string     `json:"job_id"`
+	Status       string     `json:"status"`
+	Started      time.Time  `json:"started"`
+	Finished     *time.Time `json:"finished,omitempty"`
+	Error        string     `json:"error,omitempty"`
+	Acquisitions int        `json:"n_acquisitions"`
+	Files        int        `json:"n_files"`
+	Verified     int        `json:"n_verified"`
+	Missing      int        `json:"n_missing"`
+	Mismatched   int        `json:"n_mismatched"`
+	NoJfsPath    int        `json:"n_no_jfs_path"`
+	NoChecksum   int        `json:"n_no_checksum"`
+	Unverified   int        `json:"n_unverified"`
+}
+
+// VerificationProblem a stored file that could not be verified
+type VerificationProblem struct {
+	AcqUID  uint64 `json:"acq_id"`
+	Type    string `json:"type"`
+	TileID  int64  `json:"tile_id,omitempty"`
+	Col     int    `json:"col"`
+	Row     int    `json:"row"`
+	Camera  int    `json:"camera"`
+	Frame   int    `json:"frame"`
+	Path    string `json:"path"`
+	Status  string `json:"status"`
+	Message string `json:"message,omitempty"`
+}
+
+// VerificationJob verifies all tiles and ancillary files of the acquisitions selected by a filter
+type VerificationJob struct {
+	Filter   models.AcquisitionFilter
+	lock     sync.RWMutex
+	progress VerificationProgress
+	problems []*VerificationProblem
+}
+
+// Progress returns a snapshot of the job progress
+func (j *VerificationJob) Progress() VerificationProgress {
+	j.lock.RLock()
+	defer j.lock.RUnlock()
+	return j.progress
+}
+
+// Problems returns the files found so far that are missing, mismatched or not verifiable
+func (j *VerificationJob) Problems() []*VerificationProblem {
+	j.lock.RLock()
+	defer j.lock.RUnlock()
+	return append([]*VerificationProblem{}, j.problems...)
+}
+
+// WriteCSVReport writes the problems found by the job as CSV
+func (j *VerificationJob) WriteCSVReport(w io.Writer) error {
+	csvWriter := csv.NewWriter(w)
+	csvWriter.Write([]string{"acq_id", "type", "tile_id", "col", "row", "camera", "frame", "path", "status", "message"})
+	for _, p := range j.Problems() {
+		record := []string{strconv.FormatUint(p.AcqUID, 10), p.Type, "", "", "", "", "", p.Path, p.Status, p.Message}
+		if p.TileID > 0 {
+			record[2] = strconv.FormatInt(p.TileID, 10)
+			record[3] = strconv.Itoa(p.Col)
+			record[4] = strconv.Itoa(p.Row)
+			record[5] = strconv.Itoa(p.Camera)
+			record[6] = strconv.Itoa(p.Frame)
+		}
+		csvWriter.Write(record)
+	}
+	csvWriter.Flush()
+	return csvWriter.Error()
+}
+
+func (j *VerificationJob) record(problem *VerificationProblem) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	j.progress.Files++
+	switch problem.Status {
+	case fileVerified:
+		j.progress.Verified++
+		return
+	case fileMissing:
+		j.progress.Missing++
+	case fileMismatched:
+		j.progress.Mismatched++
+	case fileNoJfsPath:
+		j.progress.NoJfsPath++
+	case fileNoChecksum:
+		j.progress.NoChecksum++
+	case fileUnverified:
+		j.progress.Unverified++
+	}
+	j.problems = append(j.problems, problem)
+}
+
+func (j *VerificationJob) finish(err error) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	now := time.Now()
+	j.progress.Finished = &now
+	j.progress.Status = verificationCompleted
+	if err != nil {
+		j.progress.Status = verificationFailed
+		j.progress.Error = err.Error()
+	}
+}
+
+// verificationItem is a stored file to be verified
+type verificationItem struct {
+	mosaic  *models.TemImageMosaic
+	file    *models.FileObject
+	problem *VerificationProblem
+}
+
+// verificationJobs runs the verification jobs; every job verifies the files with a fixed number of workers
+type verificationJobs struct {
+	reader  AcqDataReader
+	workers int
+	maxJobs int
+	lock    sync.Mutex
+	jobs    map[string]*VerificationJob
+	// finished keeps the ids of the finished jobs in the order they finished
+	finished []string
+	running  int
+}
+
+func newVerificationJobs(reader AcqDataReader, config config.Config) *verificationJobs {
+	return &verificationJobs{
+		reader:  reader,
+		workers: config.GetIntProperty("VERIFICATION_WORKERS", 4),
+		maxJobs: config.GetIntProperty("MAX_VERIFICATION_JOBS", 2),
+		jobs:    map[string]*VerificationJob{},
+	}
+}
+
+// start starts a job that verifies the acquisitions selected by the filter
+func (vj *verificationJobs) start(filter *models.AcquisitionFilter) (*VerificationJob, error) {
+	vj.lock.Lock()
+	defer vj.lock.Unlock()
+	if vj.running >= vj.maxJobs {
+		return nil, ErrTooManyVerifications
+	}
+	job := &VerificationJob{
+		Filter: *filter,
+		progress: VerificationProgress{
+			JobID:   uuid.NewV1().String(),
+			Status:  verificationRunning,
+			Started: time.Now(),
+		},
+	}
+	vj.jobs[job.progress.JobID] = job
+	vj.running++
+	go vj.run(job)
+	return job, nil
+}
+
+func (vj *verificationJobs) get(jobID string) *VerificationJob {
+	vj.lock.Lock()
+	defer vj.lock.Unlock()
+	return vj.jobs[jobID]
+}
+
+func (vj *verificationJobs) run(job *VerificationJob) {
+	items := make(chan *verificationItem, vj.workers)
+	var wg sync.WaitGroup
+	for w := 0; w < vj.workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for item := range items {
+				item.problem.Status, item.problem.Message = verifyStoredFile(vj.reader, item.mosaic, item.file)
+				job.record(item.problem)
+			}
+		}()
+	}
+	err := vj.listFiles(job, items)
+	close(items)
+	wg.Wait()
+	if err != nil {
+		logger.Errorf("Verification job %s failed: %v", job.progress.JobID, err)
+	}
+	vj.lock.Lock()
+	vj.running--
+	vj.finished = append(vj.finished, job.progress.JobID)
+	if len(vj.finished) > maxFinishedVerifications {
+		delete(vj.jobs, vj.finished[0])
+		vj.finished = vj.finished[1:]
+	}
+	vj.lock.Unlock()
+	job.finish(err)
+	logger.Infof("Verification job %s finished: %+v", job.progress.JobID, job.Progress())
+}
+
+// listFiles sends all tiles and ancillary files of the selected acquisitions to the workers
+func (vj *verificationJobs) listFiles(job *VerificationJob, items chan<- *verificationItem) error {
+	acqFilter := job.Filter
+	acqFilter.Pagination = models.Page{NRecords: verificationPageSize}
+	for {
+		acquisitions, err := vj.reader.GetAcquisitions(&acqFilter)
+		if err != nil {
+			return fmt.Errorf("Error retrieving the acquisitions to verify: %v", err)
+		}
+		for _, acq := range acquisitions {
+			job.lock.Lock()
+			job.progress.Acquisitions++
+			job.lock.Unlock()
+			if err = vj.listAcqFiles(acq.AcqUID, items); err != nil {
+				return err
+			}
+		}
+		if len(acquisitions) < verificationPageSize {
+			return nil
+		}
+		acqFilter.Pagination.StartRecordIndex += int64(len(acquisitions))
+	}
+}
+
+func (vj *verificationJobs) listAcqFiles(acqID uint64, items chan<- *verificationItem) error {
+	tileFilter := models.TileFilter{
+		FrameType:           models.All,
+		IncludeNotPersisted: true,
+		Pagination:          models.Page{NRecords: verificationPageSize},
+	}
+	tileFilter.AcqUID = acqID
+	tileFilter.Col = -1
+	tileFilter.Row = -1
+	tileFilter.CameraConfig.Camera = -1
+	// a tile that belongs to more than one ROI is listed once for each ROI
+	verifiedTiles := map[int64]bool{}
+	for {
+		tiles, err := vj.reader.GetTiles(&tileFilter)
+		if err != nil {
+			return fmt.Errorf("Error retrieving the tiles of acquisition %d: %v", acqID, err)
+		}
+		for _, tile := range tiles {
+			if verifiedTiles[tile.ImageID] {
+				continue
+			}
+			verifiedTiles[tile.ImageID] = true
+			camera := -1
+			if tile.Configuration != nil {
+				camera = tile.Configuration.Camera
+			}
+			tileFile := tile.TileFile
+			items <- &verificationItem{
+				mosaic: &tile.ImageMosaic,
+				file:   &tileFile,
+				problem: &VerificationProblem{
+					AcqUID: acqID,
+					Type:   "tile",
+					TileID: tile.ImageID,
+					Col:    tile.Col,
+					Row:    tile.Row,
+					Camera: camera,
+					Frame:  tile.Frame,
+					Path:   tileFile.JfsPath,
+				},
+			}
+		}
+		if len(tiles) < verificationPageSize {
+			break
+		}
+		tileFilter.Pagination.StartRecordIndex += int64(len(tiles))
+	}
+	ancillaryFiles, err := vj.reader.GetAncillaryFiles(acqID)
+	if err != nil {
+		return fmt.Errorf("Error retrieving the ancillary files of acquisition %d: %v", acqID, err)
+	}
+	if len(ancillaryFiles) == 0 {
+		return nil
+	}
+	mosaic, err := vj.reader.GetMosaic(acqID)
+	if err != nil {
+		return fmt.Errorf("Error retrieving the mosaic of acquisition %d: %v", acqID, err)
+	}
+	for _, f := range ancillaryFiles {
+		path := f.JfsPath
+		if path == "" {
+			path = f.Path
+		}
+		items <- &verificationItem{
+			mosaic:  mosaic,
+			file:    f,
+			problem: &VerificationProblem{AcqUID: acqID, Type: "ancillary", Path: path},
+		}
+	}
+	return nil
+}
+
+// verifyStoredFile retrieves the stored content of the file from the primary store and compares its checksum with
+// the recorded checksum. The replicas are not read so that a lost primary copy is not reported as verified.
+// Only content that the store reports as not found is missing; any other store error leaves the file unverified.
+func verifyStoredFile(reader AcqDataReader, mosaic *models.TemImageMosaic, f *models.FileObject) (string, string) {
+	if f.JfsPath == "" {
+		return fileNoJfsPath, "JFSPath not set"
+	}
+	content, err := reader.RetrievePrimaryAcquisitionFile(mosaic, f.JfsPath)
+	if isContentNotFound(err) {
+		return fileMissing, fmt.Sprintf("Error while retrieving content for %s: %v", f.JfsPath, err)
+	} else if err != nil {
+		return fileUnverified, fmt.Sprintf("Error while retrieving content for %s: %v", f.JfsPath, err)
+	}
+	if len(f.Checksum) == 0 {
+		return fileNoChecksum, "No checksum recorded"
+	}
+	alg, err := checksum.Lookup(f.ChecksumAlgorithm)
+	if err != nil {
+		return fileNoChecksum, err.Error()
+	}
+	calculatedChecksum, err := checksum.Sum(alg, content)
+	if err != nil {
+		return fileNoChecksum, err.Error()
+	}
+	if !bytes.Equal(calculatedChecksum, f.Checksum) {
+		return fileMismatched, fmt.Sprintf("%s checksum stored %x does not match the calculated checksum %x",
+			alg, f.Checksum, calculatedChecksum)
+	}
+	return fileVerified, ""
+}
@@ -0,0 +1,140 @@
+package service
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"imagecatcher/checksum"
+	"imagecatcher/config"
+	"imagecatcher/models"
+)
+
+type fakeVerifiedAcqReader struct {
+	ImageCatcherService
+	acquisitions   []*models.Acquisition
+	tiles          map[uint64][]*models.TemImageROI
+	ancillaryFiles map[uint64][]*models.FileObject
+	content        map[string][]byte
+	storeErrors    map[string]error
+}
+
+func (r *fakeVerifiedAcqReader) GetAcquisitions(acqFilter *models.AcquisitionFilter) ([]*models.Acquisition, error) {
+	var res []*models.Acquisition
+	for _, acq := range r.acquisitions {
+		if acqFilter.ProjectName == "" || acqFilter.ProjectName == acq.ProjectName {
+			res = append(res, acq)
+		}
+	}
+	return res, nil
+}
+
+func (r *fakeVerifiedAcqReader) GetMosaic(acqID uint64) (*models.TemImageMosaic, error) {
+	mosaic := &models.TemImageMosaic{}
+	mosaic.AcqUID = acqID
+	return mosaic, nil
+}
+
+func (r *fakeVerifiedAcqReader) GetTiles(tileFilter *models.TileFilter) ([]*models.TemImageROI, error) {
+	tiles := r.tiles[tileFilter.AcqUID]
+	if tileFilter.Pagination.StartRecordIndex >= int64(len(tiles)) {
+		return nil, nil
+	}
+	return tiles[tileFilter.Pagination.StartRecordIndex:], nil
+}
+
+func (r *fakeVerifiedAcqReader) GetAncillaryFiles(acqID uint64) ([]*models.FileObject, error) {
+	return r.ancillaryFiles[acqID], nil
+}
+
+func (r *fakeVerifiedAcqReader) RetrievePrimaryAcquisitionFile(acqMosaic *models.TemImageMosaic, path string) ([]byte, error) {
+	if content, found := r.content[path]; found {
+		return content, nil
+	}
+	if err, found := r.storeErrors[path]; found {
+		return nil, err
+	}
+	return nil, &contentNotFoundError{path: path, err: fmt.Errorf("no such file")}
+}
+
+func TestVerificationJob(t *testing.T) {
+	storedFile := func(path string, content []byte) models.FileObject {
+		sum, _ := checksum.Sum(checksum.MD5, content)
+		return models.FileObject{JfsPath: path, Checksum: sum, ChecksumAlgorithm: checksum.MD5.String()}
+	}
+	tile := func(tileID int64, col int, f models.FileObject) *models.TemImageROI {
+		t := &models.TemImageROI{}
+		t.ImageID = tileID
+		t.Col = col
+		t.TileFile = f
+		t.Configuration = &models.TemCameraConfiguration{Camera: 1}
+		return t
+	}
+	reader := &fakeVerifiedAcqReader{
+		acquisitions: []*models.Acquisition{
+			{AcqUID: 1, ProjectName: "p1"},
+			{AcqUID: 2, ProjectName: "p2"},
+		},
+		content: map[string][]byte{
+			"/1/verified.tif": []byte("verified"),
+			"/1/mismatch.tif": []byte("changed"),
+			"/1/log.txt":      []byte("log"),
+			"/2/other.tif":    []byte("other"),
+		},
+		storeErrors: map[string]error{
+			"/1/unreachable.tif": fmt.Errorf("connection refused"),
+		},
+	}
+	verified := tile(1, 1, storedFile("/1/verified.tif", []byte("verified")))
+	reader.tiles = map[uint64][]*models.TemImageROI{
+		1: {
+			verified,
+			verified, // the same tile in a different ROI is only verified once
+			tile(2, 2, storedFile("/1/mismatch.tif", []byte("original"))),
+			tile(3, 3, storedFile("/1/missing.tif", []byte("missing"))),
+			tile(4, 4, models.FileObject{}),
+			tile(6, 5, storedFile("/1/unreachable.tif", []byte("unreachable"))),
+		},
+		2: {tile(5, 1, storedFile("/2/other.tif", []byte("other")))},
+	}
+	reader.ancillaryFiles = map[uint64][]*models.FileObject{
+		1: {{Path: "log.txt", JfsPath: "/1/log.txt"}},
+	}
+	jobs := newVerificationJobs(reader, config.Config{"VERIFICATION_WORKERS": 2, "MAX_VERIFICATION_JOBS": 1})
+
+	job, err := jobs.start(&models.AcquisitionFilter{Acquisition: models.Acquisition{ProjectName: "p1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if jobs.get(job.Progress().JobID) != job {
+		t.Errorf("Expected the job to be retrievable by its id")
+	}
+	for i := 0; job.Progress().Status == verificationRunning && i < 100; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	progress := job.Progress()
+	if progress.Status != verificationCompleted || progress.Finished == nil {
+		t.Fatalf("Expected the job to be completed but got %+v", progress)
+	}
+	if progress.Acquisitions != 1 || progress.Files != 6 || progress.Verified != 1 || progress.Mismatched != 1 ||
+		progress.Missing != 1 || progress.NoJfsPath != 1 || progress.NoChecksum != 1 || progress.Unverified != 1 {
+		t.Errorf("Unexpected verification progress %+v", progress)
+	}
+	if problems := job.Problems(); len(problems) != 5 {
+		t.Errorf("Expected 5 problems but got %d", len(problems))
+	}
+	var report bytes.Buffer
+	if err = job.WriteCSVReport(&report); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(report.String(), "1,tile,2,2,0,1,0,/1/mismatch.tif,mismatched,") ||
+		!strings.Contains(report.String(), "1,ancillary,,,,,,/1/log.txt,no_checksum,No checksum recorded") ||
+		!strings.Contains(report.String(), "1,tile,6,5,0,1,0,/1/unreachable.tif,unverified,") {
+		t.Errorf("Unexpected CSV report %s", report.String())
+	}
+	if _, err = jobs.start(&models.AcquisitionFilter{}); err != nil {
+		t.Errorf("Expected a new job to be started after the previous job completed: %v", err)
+	}
+}
@@ -0,0 +1,192 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// minBufferClassShift is the log2 of the smallest pooled buffer size (64KB)
+	minBufferClassShift = 16
+	// maxBufferClassShift is the log2 of the largest pooled buffer size (64MB);
+	// larger buffers are allocated on demand and they are not pooled
+	maxBufferClassShift = 26
+)
+
+// ErrBufferPoolExhausted is returned when a buffer could not be acquired without exceeding the pool capacity
+var ErrBufferPoolExhausted = errors.New("Buffer pool capacity exceeded")
+
+// BufferPool hands out byte buffers from pools of power of two size classes and it
+// limits the total size of the buffers in use to the pool capacity
+type BufferPool struct {
+	maxBytes int64
+	classes  [maxBufferClassShift - minBufferClassShift + 1]sync.Pool
+
+	lock sync.Mutex
+	// released is closed and replaced every time a buffer is released to wake up the waiting requests
+	released chan struct{}
+	stats    BufferPoolStats
+}
+
+// BufferPoolStats buffer pool usage statistics
+type BufferPoolStats struct {
+	MaxBytes       int64  `json:"max_bytes"`
+	InUseBytes     int64  `json:"in_use_bytes"`
+	PeakInUseBytes int64  `json:"peak_in_use_bytes"`
+	InUseBuffers   int64  `json:"in_use_buffers"`
+	Acquired       uint64 `json:"acquired"`
+	Released       uint64 `json:"released"`
+	Allocated      uint64 `json:"allocated"`
+	Waits          uint64 `json:"waits"`
+	Rejected       uint64 `json:"rejected"`
+}
+
+// Buffer is a byte buffer acquired from a BufferPool. It must be released exactly once
+// and its content must not be used after it was released.
+type Buffer struct {
+	pool     *BufferPool
+	buf      []byte
+	class    int
+	released int32
+}
+
+// NewBufferPool creates a buffer pool that allows at most maxBytes in use;
+// a pool with maxBytes <= 0 is not bounded
+func NewBufferPool(maxBytes int64) *BufferPool {
+	return &BufferPool{
+		maxBytes: maxBytes,
+		released: make(chan struct{}),
+		stats:    BufferPoolStats{MaxBytes: maxBytes},
+	}
+}
+
+// bufferClass returns the index of the smallest size class that fits size or -1 if size is larger than all classes
+func bufferClass(size int) int {
+	for c := 0; c <= maxBufferClassShift-minBufferClassShift; c++ {
+		if size <= 1<<uint(c+minBufferClassShift) {
+			return c
+		}
+	}
+	return -1
+}
+
+// Acquire returns a buffer of the requested size. If the buffer does not fit in the remaining capacity
+// it waits up to timeout for other buffers to be released and then it fails with ErrBufferPoolExhausted.
+// A request larger than the pool capacity fails right away.
+func (p *BufferPool) Acquire(size int, timeout time.Duration) (*Buffer, error) {
+	if size < 0 {
+		return nil, fmt.Errorf("Invalid buffer size %d", size)
+	}
+	if err := p.reserve(int64(size), timeout); err != nil {
+		return nil, err
+	}
+	b := &Buffer{pool: p, class: bufferClass(size)}
+	if b.class < 0 {
+		b.buf = make([]byte, size)
+		p.countAllocation()
+		return b, nil
+	}
+	if pooled, ok := p.classes[b.class].Get().(*[]byte); ok {
+		b.buf = (*pooled)[:size]
+	} else {
+		b.buf = make([]byte, size, 1<<uint(b.class+minBufferClassShift))
+		p.countAllocation()
+	}
+	return b, nil
+}
+
+func (p *BufferPool) reserve(size int64, timeout time.Duration) error {
+	var deadline <-chan time.Time
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.maxBytes > 0 && size > p.maxBytes {
+		p.stats.Rejected++
+		return fmt.Errorf("%v: %d bytes requested but the capacity is %d bytes", ErrBufferPoolExhausted, size, p.maxBytes)
+	}
+	for p.maxBytes > 0 && p.stats.InUseBytes+size > p.maxBytes {
+		if deadline == nil {
+			if timeout <= 0 {
+				p.stats.Rejected++
+				return fmt.Errorf("%v: %d bytes requested and %d of %d bytes in use", ErrBufferPoolExhausted, size, p.stats.InUseBytes, p.maxBytes)
+			}
+			p.stats.Waits++
+			timer := time.NewTimer(timeout)
+			defer timer.Stop()
+			deadline = timer.C
+		}
+		released := p.released
+		p.lock.Unlock()
+		select {
+		case <-released:
+			p.lock.Lock()
+		case <-deadline:
+			p.lock.Lock()
+			if p.stats.InUseBytes+size <= p.maxBytes {
+				break
+			}
+			p.stats.Rejected++
+			return fmt.Errorf("%v: timeout waiting for %d bytes after %v with %d of %d bytes in use",
+				ErrBufferPoolExhausted, size, timeout, p.stats.InUseBytes, p.maxBytes)
+		}
+	}
+	p.stats.InUseBytes += size
+	p.stats.InUseBuffers++
+	p.stats.Acquired++
+	if p.stats.InUseBytes > p.stats.PeakInUseBytes {
+		p.stats.PeakInUseBytes = p.stats.InUseBytes
+	}
+	return nil
+}
+
+func (p *BufferPool) countAllocation() {
+	p.lock.Lock()
+	p.stats.Allocated++
+	p.lock.Unlock()
+}
+
+func (p *BufferPool) release(b *Buffer) {
+	size := int64(len(b.buf))
+	if b.class >= 0 {
+		pooled := b.buf[:0]
+		p.classes[b.class].Put(&pooled)
+	}
+	p.lock.Lock()
+	p.stats.InUseBytes -= size
+	p.stats.InUseBuffers--
+	p.stats.Released++
+	close(p.released)
+	p.released = make(chan struct{})
+	p.lock.Unlock()
+}
+
+// Stats returns a snapshot of the pool statistics
+func (p *BufferPool) Stats() BufferPoolStats {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.stats
+}
+
+// Bytes returns the buffer's content
+func (b *Buffer) Bytes() []byte {
+	if b == nil {
+		return nil
+	}
+	return b.buf
+}
+
+// Len returns the buffer size
+func (b *Buffer) Len() int {
+	return len(b.Bytes())
+}
+
+// Release returns the buffer to its pool; releasing a nil or an already released buffer is a no-op
+func (b *Buffer) Release() {
+	if b == nil || !atomic.CompareAndSwapInt32(&b.released, 0, 1) {
+		return
+	}
+	b.pool.release(b)
+	b.buf = nil
+}
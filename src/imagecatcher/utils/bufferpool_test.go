@@ -0,0 +1,80 @@
+package utils
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBufferClass(t *testing.T) {
+	var tests = []struct {
+		size          int
+		expectedClass int
+	}{
+		{0, 0},
+		{1 << 16, 0},
+		{1<<16 + 1, 1},
+		{5 * 1024 * 1024, 7},
+		{1 << 26, 10},
+		{1<<26 + 1, -1},
+	}
+	for _, td := range tests {
+		if c := bufferClass(td.size); c != td.expectedClass {
+			t.Errorf("Expected class %d for size %d but got %d", td.expectedClass, td.size, c)
+		}
+	}
+}
+
+func TestBufferPoolAcquireAndRelease(t *testing.T) {
+	p := NewBufferPool(3 << 20)
+	b1, err := p.Acquire(1<<20, 0)
+	if err != nil {
+		t.Fatalf("Unexpected error acquiring the first buffer: %v", err)
+	}
+	if b1.Len() != 1<<20 {
+		t.Errorf("Expected a %d bytes buffer but got %d bytes", 1<<20, b1.Len())
+	}
+	b2, err := p.Acquire(2<<20, 0)
+	if err != nil {
+		t.Fatalf("Unexpected error acquiring the second buffer: %v", err)
+	}
+	if _, err = p.Acquire(1, 0); err == nil {
+		t.Error("Expected the pool to reject a request that exceeds its capacity")
+	}
+	if _, err = p.Acquire(4<<20, time.Second); err == nil {
+		t.Error("Expected the pool to reject a request larger than its capacity")
+	}
+	b1.Release()
+	b1.Release()
+	stats := p.Stats()
+	if stats.InUseBytes != 2<<20 || stats.InUseBuffers != 1 || stats.PeakInUseBytes != 3<<20 ||
+		stats.Acquired != 2 || stats.Released != 1 || stats.Rejected != 2 {
+		t.Errorf("Unexpected pool stats %+v", stats)
+	}
+	b2.Release()
+	if stats = p.Stats(); stats.InUseBytes != 0 || stats.InUseBuffers != 0 {
+		t.Errorf("Expected no buffer in use after releasing all buffers but got %+v", stats)
+	}
+}
+
+func TestBufferPoolWaitsForRelease(t *testing.T) {
+	p := NewBufferPool(1 << 20)
+	b1, err := p.Acquire(1<<20, 0)
+	if err != nil {
+		t.Fatalf("Unexpected error acquiring the first buffer: %v", err)
+	}
+	if _, err = p.Acquire(1<<10, 10*time.Millisecond); err == nil {
+		t.Error("Expected a timeout waiting for the buffer")
+	}
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		b1.Release()
+	}()
+	b2, err := p.Acquire(1<<10, time.Second)
+	if err != nil {
+		t.Fatalf("Expected the buffer to be acquired once the first buffer was released: %v", err)
+	}
+	b2.Release()
+	if stats := p.Stats(); stats.Waits != 2 || stats.Rejected != 1 {
+		t.Errorf("Unexpected pool stats %+v", stats)
+	}
+}
@@ -0,0 +1,96 @@
+package utils
+
+import (
+	"image"
+	"image/color"
+)
+
+// HistogramScaling computes the offset and the scale that map the pixel values between the low and the high percentiles
+// of the image histogram to the 0-255 range, i.e. u8 = (v - offset) * scale. The percentiles are between 0 and 100.
+func HistogramScaling(img image.Image, lowPercentile, highPercentile float64) (offset, scale float64) {
+	histogram := imageHistogram(img)
+	var total int64
+	for _, c := range histogram {
+		total += c
+	}
+	low := histogramPercentile(histogram, total, lowPercentile)
+	high := histogramPercentile(histogram, total, highPercentile)
+	valueRange := float64(high - low)
+	if valueRange < 1 {
+		valueRange = 1
+	}
+	return float64(low), 255 / valueRange
+}
+
+// ScaleTo8Bit maps the pixel values of the image to 8 bit as (v - offset) * scale clamped to the 0-255 range
+func ScaleTo8Bit(img image.Image, offset, scale float64) *image.Gray {
+	bounds := img.Bounds()
+	scaled := image.NewGray(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	gray16, is16Bit := img.(*image.Gray16)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			var v float64
+			if is16Bit {
+				v = float64(gray16.Gray16At(x, y).Y)
+			} else {
+				v = float64(color.GrayModel.Convert(img.At(x, y)).(color.Gray).Y)
+			}
+			u8 := (v - offset) * scale
+			if u8 < 0 {
+				u8 = 0
+			} else if u8 > 255 {
+				u8 = 255
+			}
+			scaled.SetGray(x-bounds.Min.X, y-bounds.Min.Y, color.Gray{Y: uint8(u8 + 0.5)})
+		}
+	}
+	return scaled
+}
+
+// imageHistogram counts the pixel values; the histogram has 65536 bins for 16 bit images and 256 bins for all other images
+func imageHistogram(img image.Image) []int64 {
+	bounds := img.Bounds()
+	switch i := img.(type) {
+	case *image.Gray16:
+		histogram := make([]int64, 1<<16)
+		for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+			row := i.Pix[i.PixOffset(bounds.Min.X, y):i.PixOffset(bounds.Max.X, y)]
+			for x := 0; x < len(row); x += 2 {
+				histogram[int(row[x])<<8|int(row[x+1])]++
+			}
+		}
+		return histogram
+	case *image.Gray:
+		histogram := make([]int64, 1<<8)
+		for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+			for _, v := range i.Pix[i.PixOffset(bounds.Min.X, y):i.PixOffset(bounds.Max.X, y)] {
+				histogram[v]++
+			}
+		}
+		return histogram
+	default:
+		histogram := make([]int64, 1<<8)
+		for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+			for x := bounds.Min.X; x < bounds.Max.X; x++ {
+				histogram[color.GrayModel.Convert(img.At(x, y)).(color.Gray).Y]++
+			}
+		}
+		return histogram
+	}
+}
+
+// histogramPercentile returns the lowest value for which the cumulative count reaches the percentile of all counts
+func histogramPercentile(histogram []int64, total int64, percentile float64) int {
+	if total == 0 {
+		return 0
+	}
+	threshold := percentile / 100 * float64(total)
+	var cumulative int64
+	for v, c := range histogram {
+		cumulative += c
+		if c > 0 && float64(cumulative) >= threshold {
+			return v
+		}
+	}
+	return len(histogram) - 1
+}
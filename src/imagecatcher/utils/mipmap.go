@@ -0,0 +1,54 @@
+package utils
+
+import (
+	"image"
+	"image/color"
+)
+
+// Downsample halves the image size by averaging every 2x2 block of pixels
+func Downsample(img image.Image) image.Image {
+	return DownsampleBy(img, 2)
+}
+
+// DownsampleBy reduces the image size by the given factor by averaging every factor x factor block of pixels; the blocks
+// on the right and bottom edges of an image whose size is not a multiple of the factor average only the pixels they have.
+// 16 bit images stay 16 bit and all other images are converted to 8 bit grayscale.
+func DownsampleBy(img image.Image, factor int) image.Image {
+	if factor < 1 {
+		factor = 1
+	}
+	bounds := img.Bounds()
+	width, height := (bounds.Dx()+factor-1)/factor, (bounds.Dy()+factor-1)/factor
+	gray16, is16Bit := img.(*image.Gray16)
+	var downsampled16 *image.Gray16
+	var downsampled *image.Gray
+	if is16Bit {
+		downsampled16 = image.NewGray16(image.Rect(0, 0, width, height))
+	} else {
+		downsampled = image.NewGray(image.Rect(0, 0, width, height))
+	}
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			var sum, n uint64
+			for sy := bounds.Min.Y + factor*y; sy < bounds.Min.Y+factor*(y+1) && sy < bounds.Max.Y; sy++ {
+				for sx := bounds.Min.X + factor*x; sx < bounds.Min.X+factor*(x+1) && sx < bounds.Max.X; sx++ {
+					if is16Bit {
+						sum += uint64(gray16.Gray16At(sx, sy).Y)
+					} else {
+						sum += uint64(color.GrayModel.Convert(img.At(sx, sy)).(color.Gray).Y)
+					}
+					n++
+				}
+			}
+			if is16Bit {
+				downsampled16.SetGray16(x, y, color.Gray16{Y: uint16((sum + n/2) / n)})
+			} else {
+				downsampled.SetGray(x, y, color.Gray{Y: uint8((sum + n/2) / n)})
+			}
+		}
+	}
+	if is16Bit {
+		return downsampled16
+	}
+	return downsampled
+}
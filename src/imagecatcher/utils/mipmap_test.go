@@ -0,0 +1,45 @@
+package utils
+
+import (
+	"image"
+	"testing"
+)
+
+func TestDownsample(t *testing.T) {
+	// 5x3 image with the values 1000, 1010, ..., 1140
+	img := Downsample(createTestGray16Image(5, 3))
+	downsampled, ok := img.(*image.Gray16)
+	if !ok || downsampled.Bounds() != image.Rect(0, 0, 3, 2) {
+		t.Fatalf("Expected a 3x2 16 bit image but got %T %v", img, img.Bounds())
+	}
+	expectedValues := []uint16{
+		1030, 1050, 1065, // e.g. (1000 + 1010 + 1050 + 1060) / 4 and (1040 + 1090) / 2
+		1105, 1125, 1140,
+	}
+	for i, v := range expectedValues {
+		if actual := downsampled.Gray16At(i%3, i/3).Y; actual != v {
+			t.Errorf("Expected %d at %d,%d but got %d", v, i%3, i/3, actual)
+		}
+	}
+	gray := image.NewGray(image.Rect(0, 0, 2, 2))
+	copy(gray.Pix, []uint8{10, 20, 30, 41})
+	if downsampled, ok := Downsample(gray).(*image.Gray); !ok || len(downsampled.Pix) != 1 || downsampled.Pix[0] != 25 {
+		t.Errorf("Expected a single 8 bit pixel with the value 25 but got %v", downsampled)
+	}
+}
+
+func TestDownsampleBy(t *testing.T) {
+	// 5x3 image with the values 1000, 1010, ..., 1140
+	img := DownsampleBy(createTestGray16Image(5, 3), 3)
+	downsampled, ok := img.(*image.Gray16)
+	if !ok || downsampled.Bounds() != image.Rect(0, 0, 2, 1) {
+		t.Fatalf("Expected a 2x1 16 bit image but got %T %v", img, img.Bounds())
+	}
+	// (1000 + 1010 + 1020 + 1050 + 1060 + 1070 + 1100 + 1110 + 1120) / 9 and (1030 + 1040 + 1080 + 1090 + 1130 + 1140) / 6
+	if downsampled.Gray16At(0, 0).Y != 1060 || downsampled.Gray16At(1, 0).Y != 1085 {
+		t.Errorf("Unexpected downsampled values %v", downsampled.Pix)
+	}
+	if img = DownsampleBy(createTestGray16Image(5, 3), 1); img.Bounds() != image.Rect(0, 0, 5, 3) {
+		t.Errorf("Expected the image size to be unchanged by a factor of 1 but got %v", img.Bounds())
+	}
+}
@@ -0,0 +1,360 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/draw"
+	"io"
+)
+
+// TIFF tags used for decoding the tile images
+const (
+	tiffImageWidth                = 256
+	tiffImageLength               = 257
+	tiffBitsPerSample             = 258
+	tiffCompression               = 259
+	tiffPhotometricInterpretation = 262
+	tiffStripOffsets              = 273
+	tiffSamplesPerPixel           = 277
+	tiffRowsPerStrip              = 278
+	tiffStripByteCounts           = 279
+)
+
+const (
+	tiffTypeByte  = 1
+	tiffTypeShort = 3
+	tiffTypeLong  = 4
+)
+
+const (
+	tiffPhotometricWhiteIsZero = 0
+	tiffPhotometricBlackIsZero = 1
+	tiffNoCompression          = 1
+)
+
+type tiffReader struct {
+	src           io.ReaderAt
+	size          int64
+	byteOrder     binary.ByteOrder
+	tags          map[uint16][]uint32
+	nextIFDOffset int64
+}
+
+// DecodeTIFF decodes an uncompressed grayscale TIFF image stored in strips, which is how the cameras save the tiles.
+// 8 bit images are decoded as image.Gray and 16 bit images as image.Gray16.
+func DecodeTIFF(content []byte) (image.Image, error) {
+	r, err := readTIFFHeader(bytes.NewReader(content), int64(len(content)))
+	if err != nil {
+		return nil, err
+	}
+	width := r.tagValue(tiffImageWidth, 0)
+	height := r.tagValue(tiffImageLength, 0)
+	if width == 0 || height == 0 {
+		return nil, fmt.Errorf("Invalid TIFF image size %dx%d", width, height)
+	}
+	if samples := r.tagValue(tiffSamplesPerPixel, 1); samples != 1 {
+		return nil, fmt.Errorf("Unsupported TIFF image with %d samples per pixel", samples)
+	}
+	if compression := r.tagValue(tiffCompression, tiffNoCompression); compression != tiffNoCompression {
+		return nil, fmt.Errorf("Unsupported TIFF compression %d", compression)
+	}
+	photometric := r.tagValue(tiffPhotometricInterpretation, tiffPhotometricBlackIsZero)
+	if photometric != tiffPhotometricWhiteIsZero && photometric != tiffPhotometricBlackIsZero {
+		return nil, fmt.Errorf("Unsupported TIFF photometric interpretation %d", photometric)
+	}
+	bitsPerSample := r.tagValue(tiffBitsPerSample, 1)
+	if bitsPerSample != 8 && bitsPerSample != 16 {
+		return nil, fmt.Errorf("Unsupported TIFF image with %d bits per sample", bitsPerSample)
+	}
+	bytesPerPixel := int(bitsPerSample / 8)
+	// the size comes from the image directory so check it against the content before allocating anything
+	if uint64(width)*uint64(height) > uint64(len(content)/bytesPerPixel) {
+		return nil, fmt.Errorf("Invalid TIFF image size %dx%d: the content has only %d bytes", width, height, len(content))
+	}
+	pix, err := r.readStrips(int(width) * int(height) * bytesPerPixel)
+	if err != nil {
+		return nil, err
+	}
+	rect := image.Rect(0, 0, int(width), int(height))
+	if bytesPerPixel == 1 {
+		img := &image.Gray{Pix: pix, Stride: int(width), Rect: rect}
+		if photometric == tiffPhotometricWhiteIsZero {
+			for i, v := range img.Pix {
+				img.Pix[i] = 0xff - v
+			}
+		}
+		return img, nil
+	}
+	img := image.NewGray16(rect)
+	for i := 0; i < len(pix); i += 2 {
+		// image.Gray16 stores the pixels in big endian order
+		v := r.byteOrder.Uint16(pix[i:])
+		if photometric == tiffPhotometricWhiteIsZero {
+			v = 0xffff - v
+		}
+		img.Pix[i] = uint8(v >> 8)
+		img.Pix[i+1] = uint8(v)
+	}
+	return img, nil
+}
+
+// TIFFInfo describes a TIFF image as read from its image directories
+type TIFFInfo struct {
+	Width, Height   int
+	BitsPerSample   int
+	SamplesPerPixel int
+	Compression     int
+	// Pages is the number of image directories
+	Pages int
+}
+
+// maxTIFFPages limits the number of image directories read when the pages are counted
+const maxTIFFPages = 1024
+
+// ReadTIFFInfo reads the description of the first page of the TIFF image and counts its pages without decoding the pixels
+func ReadTIFFInfo(content []byte) (*TIFFInfo, error) {
+	return ReadTIFFInfoAt(bytes.NewReader(content), int64(len(content)))
+}
+
+// ReadTIFFInfoAt is ReadTIFFInfo for an image of the given size that is not in memory; only the header
+// and the image directories are read
+func ReadTIFFInfoAt(src io.ReaderAt, size int64) (*TIFFInfo, error) {
+	r, err := readTIFFHeader(src, size)
+	if err != nil {
+		return nil, err
+	}
+	info := &TIFFInfo{
+		Width:           int(r.tagValue(tiffImageWidth, 0)),
+		Height:          int(r.tagValue(tiffImageLength, 0)),
+		BitsPerSample:   int(r.tagValue(tiffBitsPerSample, 1)),
+		SamplesPerPixel: int(r.tagValue(tiffSamplesPerPixel, 1)),
+		Compression:     int(r.tagValue(tiffCompression, tiffNoCompression)),
+		Pages:           1,
+	}
+	visited := map[int64]bool{}
+	for next := r.nextIFDOffset; next != 0; info.Pages++ {
+		if visited[next] || info.Pages >= maxTIFFPages {
+			return nil, fmt.Errorf("Invalid TIFF image directory chain: directory %d at %d", info.Pages+1, next)
+		}
+		visited[next] = true
+		if next, err = r.readIFD(next, nil); err != nil {
+			return nil, err
+		}
+	}
+	return info, nil
+}
+
+func readTIFFHeader(src io.ReaderAt, size int64) (*tiffReader, error) {
+	if size < 8 {
+		return nil, fmt.Errorf("Invalid TIFF header: the content has only %d bytes", size)
+	}
+	r := &tiffReader{src: src, size: size, tags: make(map[uint16][]uint32)}
+	content, err := r.readAt(0, 8)
+	if err != nil {
+		return nil, err
+	}
+	switch string(content[0:2]) {
+	case "II":
+		r.byteOrder = binary.LittleEndian
+	case "MM":
+		r.byteOrder = binary.BigEndian
+	default:
+		return nil, fmt.Errorf("Invalid TIFF byte order mark %q", content[0:2])
+	}
+	if magic := r.byteOrder.Uint16(content[2:4]); magic != 42 {
+		return nil, fmt.Errorf("Invalid TIFF magic number %d", magic)
+	}
+	if r.nextIFDOffset, err = r.readIFD(int64(r.byteOrder.Uint32(content[4:8])), r.tags); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// readIFD reads the tags of the image directory at the given offset, if tags is not nil, and returns the offset of the next directory
+func (r *tiffReader) readIFD(ifdOffset int64, tags map[uint16][]uint32) (int64, error) {
+	if ifdOffset < 8 || ifdOffset+2 > r.size {
+		return 0, fmt.Errorf("Invalid TIFF image directory offset %d for %d bytes", ifdOffset, r.size)
+	}
+	entriesCount, err := r.readAt(ifdOffset, 2)
+	if err != nil {
+		return 0, err
+	}
+	nEntries := int64(r.byteOrder.Uint16(entriesCount))
+	nextOffsetPos := ifdOffset + 2 + nEntries*12
+	if nextOffsetPos+4 > r.size {
+		return 0, fmt.Errorf("Truncated TIFF image directory with %d entries at %d", nEntries, ifdOffset)
+	}
+	// the directory entries followed by the offset of the next directory
+	content, err := r.readAt(ifdOffset+2, nEntries*12+4)
+	if err != nil {
+		return 0, err
+	}
+	for i := int64(0); tags != nil && i < nEntries; i++ {
+		entry := content[i*12:]
+		tag := r.byteOrder.Uint16(entry[0:2])
+		values, err := r.readTagValues(tag, r.byteOrder.Uint16(entry[2:4]), int64(r.byteOrder.Uint32(entry[4:8])), entry[8:12])
+		if err != nil {
+			return 0, err
+		}
+		if values != nil {
+			tags[tag] = values
+		}
+	}
+	return int64(r.byteOrder.Uint32(content[nEntries*12:])), nil
+}
+
+// readAt reads n bytes of the image at the given offset
+func (r *tiffReader) readAt(offset, n int64) ([]byte, error) {
+	data := make([]byte, n)
+	if read, err := r.src.ReadAt(data, offset); int64(read) < n {
+		return nil, fmt.Errorf("Error reading %d TIFF bytes at %d: %v", n, offset, err)
+	}
+	return data, nil
+}
+
+// readTagValues reads the values of the integer tags; the values of the other types are ignored
+func (r *tiffReader) readTagValues(tag, valueType uint16, count int64, valueOrOffset []byte) ([]uint32, error) {
+	var valueSize int64
+	switch valueType {
+	case tiffTypeByte:
+		valueSize = 1
+	case tiffTypeShort:
+		valueSize = 2
+	case tiffTypeLong:
+		valueSize = 4
+	default:
+		return nil, nil
+	}
+	data := valueOrOffset
+	if count*valueSize > 4 {
+		offset := int64(r.byteOrder.Uint32(valueOrOffset))
+		if offset+count*valueSize > r.size {
+			return nil, fmt.Errorf("Invalid TIFF tag %d with %d values at %d for %d bytes", tag, count, offset, r.size)
+		}
+		var err error
+		if data, err = r.readAt(offset, count*valueSize); err != nil {
+			return nil, err
+		}
+	}
+	values := make([]uint32, count)
+	for i := range values {
+		switch valueType {
+		case tiffTypeByte:
+			values[i] = uint32(data[i])
+		case tiffTypeShort:
+			values[i] = uint32(r.byteOrder.Uint16(data[2*i:]))
+		default:
+			values[i] = r.byteOrder.Uint32(data[4*i:])
+		}
+	}
+	return values, nil
+}
+
+func (r *tiffReader) tagValue(tag uint16, defaultValue uint32) uint32 {
+	values := r.tags[tag]
+	if len(values) == 0 {
+		return defaultValue
+	}
+	return values[0]
+}
+
+// readStrips concatenates the image strips
+func (r *tiffReader) readStrips(imageSize int) ([]byte, error) {
+	offsets := r.tags[tiffStripOffsets]
+	byteCounts := r.tags[tiffStripByteCounts]
+	if len(offsets) == 0 || len(offsets) != len(byteCounts) {
+		return nil, fmt.Errorf("Invalid TIFF strips: %d offsets and %d byte counts", len(offsets), len(byteCounts))
+	}
+	pix := make([]byte, 0, imageSize)
+	for i, offset := range offsets {
+		if len(pix) >= imageSize {
+			// the remaining strips are not needed and reading them could only grow the buffer past the image
+			break
+		}
+		end := int64(offset) + int64(byteCounts[i])
+		if end > r.size {
+			return nil, fmt.Errorf("Truncated TIFF strip %d: it ends at %d but the content has only %d bytes", i, end, r.size)
+		}
+		// the strip is read straight into the pixels and the bytes past the image are not read
+		n := int64(byteCounts[i])
+		if remaining := int64(imageSize - len(pix)); n > remaining {
+			n = remaining
+		}
+		start := len(pix)
+		pix = pix[:start+int(n)]
+		if read, err := r.src.ReadAt(pix[start:], int64(offset)); int64(read) < n {
+			return nil, fmt.Errorf("Error reading TIFF strip %d at %d: %v", i, offset, err)
+		}
+	}
+	if len(pix) < imageSize {
+		return nil, fmt.Errorf("Truncated TIFF image: expected %d bytes of pixel data but found %d", imageSize, len(pix))
+	}
+	return pix, nil
+}
+
+// EncodeTIFF encodes the image as an uncompressed little endian grayscale TIFF with a single strip.
+// image.Gray16 images are encoded with 16 bits per sample and all other images are converted to 8 bit grayscale.
+func EncodeTIFF(img image.Image) []byte {
+	var pix []byte
+	var bitsPerSample uint32
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if gray16, ok := img.(*image.Gray16); ok {
+		bitsPerSample = 16
+		pix = make([]byte, 0, 2*width*height)
+		for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+			for x := bounds.Min.X; x < bounds.Max.X; x++ {
+				v := gray16.Gray16At(x, y).Y
+				pix = append(pix, uint8(v), uint8(v>>8))
+			}
+		}
+	} else {
+		bitsPerSample = 8
+		gray := image.NewGray(image.Rect(0, 0, width, height))
+		draw.Draw(gray, gray.Bounds(), img, bounds.Min, draw.Src)
+		pix = gray.Pix
+	}
+	entries := []struct {
+		tag       uint16
+		valueType uint16
+		value     uint32
+	}{
+		{tiffImageWidth, tiffTypeLong, uint32(width)},
+		{tiffImageLength, tiffTypeLong, uint32(height)},
+		{tiffBitsPerSample, tiffTypeShort, bitsPerSample},
+		{tiffCompression, tiffTypeShort, tiffNoCompression},
+		{tiffPhotometricInterpretation, tiffTypeShort, tiffPhotometricBlackIsZero},
+		{tiffStripOffsets, tiffTypeLong, 0},
+		{tiffSamplesPerPixel, tiffTypeShort, 1},
+		{tiffRowsPerStrip, tiffTypeLong, uint32(height)},
+		{tiffStripByteCounts, tiffTypeLong, uint32(len(pix))},
+	}
+	ifdSize := 2 + 12*len(entries) + 4
+	stripOffset := uint32(8 + ifdSize)
+	var buf bytes.Buffer
+	buf.WriteString("II")
+	binary.Write(&buf, binary.LittleEndian, uint16(42))
+	binary.Write(&buf, binary.LittleEndian, uint32(8))
+	binary.Write(&buf, binary.LittleEndian, uint16(len(entries)))
+	for _, e := range entries {
+		value := e.value
+		if e.tag == tiffStripOffsets {
+			value = stripOffset
+		}
+		binary.Write(&buf, binary.LittleEndian, e.tag)
+		binary.Write(&buf, binary.LittleEndian, e.valueType)
+		binary.Write(&buf, binary.LittleEndian, uint32(1))
+		if e.valueType == tiffTypeShort {
+			binary.Write(&buf, binary.LittleEndian, uint16(value))
+			binary.Write(&buf, binary.LittleEndian, uint16(0))
+		} else {
+			binary.Write(&buf, binary.LittleEndian, value)
+		}
+	}
+	// no other image directory
+	binary.Write(&buf, binary.LittleEndian, uint32(0))
+	buf.Write(pix)
+	return buf.Bytes()
+}
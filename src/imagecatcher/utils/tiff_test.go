@@ -0,0 +1,163 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"testing"
+)
+
+func createTestGray16Image(width, height int) *image.Gray16 {
+	img := image.NewGray16(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.SetGray16(x, y, color.Gray16{Y: uint16(1000 + 10*(y*width+x))})
+		}
+	}
+	return img
+}
+
+func TestEncodeDecodeTIFF(t *testing.T) {
+	gray16 := createTestGray16Image(5, 3)
+	img, err := DecodeTIFF(EncodeTIFF(gray16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded16, ok := img.(*image.Gray16)
+	if !ok || decoded16.Bounds() != gray16.Bounds() {
+		t.Fatalf("Expected a 5x3 16 bit image but got %T %v", img, img.Bounds())
+	}
+	for i := range gray16.Pix {
+		if decoded16.Pix[i] != gray16.Pix[i] {
+			t.Fatalf("Pixel data differs at %d: expected %d but got %d", i, gray16.Pix[i], decoded16.Pix[i])
+		}
+	}
+
+	gray := image.NewGray(image.Rect(0, 0, 4, 2))
+	for i := range gray.Pix {
+		gray.Pix[i] = uint8(i * 30)
+	}
+	if img, err = DecodeTIFF(EncodeTIFF(gray)); err != nil {
+		t.Fatal(err)
+	}
+	if decoded, ok := img.(*image.Gray); !ok || string(decoded.Pix) != string(gray.Pix) {
+		t.Errorf("Expected the 8 bit image %v but got %v", gray, img)
+	}
+}
+
+func TestDecodeInvalidTIFF(t *testing.T) {
+	content := EncodeTIFF(createTestGray16Image(5, 3))
+	compressed := append([]byte{}, content...)
+	// the compression is the value of the fourth entry of the image directory
+	binary.LittleEndian.PutUint16(compressed[8+2+3*12+8:], 5)
+	oversized := append([]byte{}, content...)
+	// the width and the height are the values of the first two entries of the image directory
+	binary.LittleEndian.PutUint32(oversized[8+2+8:], 0xffffffff)
+	binary.LittleEndian.PutUint32(oversized[8+2+12+8:], 0xffffffff)
+	testData := []struct {
+		name    string
+		content []byte
+	}{
+		{"empty", nil},
+		{"bad byte order", append([]byte("XX"), content[2:]...)},
+		{"truncated directory", content[:20]},
+		{"truncated pixel data", content[:len(content)-1]},
+		{"compressed", compressed},
+		{"oversized", oversized},
+	}
+	for _, td := range testData {
+		if _, err := DecodeTIFF(td.content); err == nil {
+			t.Errorf("Expected an error decoding the %s TIFF", td.name)
+		}
+	}
+}
+
+func TestHistogramScaling(t *testing.T) {
+	// 100 pixels with the values 1000, 1010, ..., 1990
+	img := createTestGray16Image(10, 10)
+	offset, scale := HistogramScaling(img, 1, 99)
+	if offset != 1000 || scale != 255.0/980 {
+		t.Errorf("Expected offset 1000 and scale %f but got %f and %f", 255.0/980, offset, scale)
+	}
+	offset, scale = HistogramScaling(img, 0, 100)
+	if offset != 1000 || scale != 255.0/990 {
+		t.Errorf("Expected offset 1000 and scale %f but got %f and %f", 255.0/990, offset, scale)
+	}
+	uniform := image.NewGray(image.Rect(0, 0, 3, 3))
+	for i := range uniform.Pix {
+		uniform.Pix[i] = 7
+	}
+	if offset, scale = HistogramScaling(uniform, 0.5, 99.5); offset != 7 || scale != 255 {
+		t.Errorf("Expected offset 7 and scale 255 for a uniform image but got %f and %f", offset, scale)
+	}
+}
+
+func TestReadTIFFInfo(t *testing.T) {
+	content := EncodeTIFF(createTestGray16Image(5, 3))
+	info, err := ReadTIFFInfo(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedInfo := TIFFInfo{Width: 5, Height: 3, BitsPerSample: 16, SamplesPerPixel: 1, Compression: tiffNoCompression, Pages: 1}
+	if *info != expectedInfo {
+		t.Errorf("Expected %+v but got %+v", expectedInfo, *info)
+	}
+	// the offset of the next image directory follows the 9 entries of the first directory
+	nextIFDOffsetPos := 8 + 2 + 9*12
+	multiPage := append([]byte{}, content...)
+	binary.LittleEndian.PutUint32(multiPage[nextIFDOffsetPos:], uint32(len(multiPage)))
+	// an empty second image directory
+	multiPage = append(multiPage, 0, 0, 0, 0, 0, 0)
+	if info, err = ReadTIFFInfo(multiPage); err != nil {
+		t.Fatal(err)
+	}
+	if info.Pages != 2 {
+		t.Errorf("Expected 2 pages but got %d", info.Pages)
+	}
+	cyclic := append([]byte{}, content...)
+	binary.LittleEndian.PutUint32(cyclic[nextIFDOffsetPos:], 8)
+	if _, err = ReadTIFFInfo(cyclic); err == nil {
+		t.Error("Expected an error for a cyclic image directory chain")
+	}
+}
+
+// countingReaderAt counts the bytes read from the underlying reader
+type countingReaderAt struct {
+	r    *bytes.Reader
+	read int
+}
+
+func (c *countingReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	n, err := c.r.ReadAt(p, off)
+	c.read += n
+	return n, err
+}
+
+func TestReadTIFFInfoAt(t *testing.T) {
+	content := EncodeTIFF(createTestGray16Image(100, 100))
+	src := &countingReaderAt{r: bytes.NewReader(content)}
+	info, err := ReadTIFFInfoAt(src, int64(len(content)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Width != 100 || info.Height != 100 || info.Pages != 1 {
+		t.Errorf("Unexpected TIFF info %+v", info)
+	}
+	// only the header and the image directory are read
+	if headerSize := 8 + 2 + 9*12 + 4; src.read != headerSize {
+		t.Errorf("Expected %d bytes to be read but %d were read", headerSize, src.read)
+	}
+}
+
+func TestScaleTo8Bit(t *testing.T) {
+	// in the 5x3 test image the values of the last 4 columns of the last 2 rows are 1060, ..., 1090 and 1110, ..., 1140
+	scaled := ScaleTo8Bit(createTestGray16Image(5, 3).SubImage(image.Rect(1, 1, 5, 3)), 1060, 2.5)
+	if scaled.Bounds() != image.Rect(0, 0, 4, 2) {
+		t.Fatalf("Expected a 4x2 image but got %v", scaled.Bounds())
+	}
+	expectedValues := []uint8{0, 25, 50, 75, 125, 150, 175, 200}
+	if string(scaled.Pix) != string(expectedValues) {
+		t.Errorf("Expected the scaled values %v but got %v", expectedValues, scaled.Pix)
+	}
+}